@@ -32,6 +32,11 @@ type OdynLogger struct {
 
 var std = OdynLogger{}
 
+// Log to STDOUT until Init is called.
+func init() {
+    initFallback()
+}
+
 // If /var/log/canopy files cannot be opened, then fallback to just logging to STDOUT
 func initFallback() error {
     std.logger = log.New(os.Stdout, "", log.LstdFlags | log.Lshortfile)
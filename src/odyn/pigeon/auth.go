@@ -0,0 +1,226 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+// Authentication for the TCP transport.
+//
+// Two independent mechanisms are available, configured through
+// TCPTransportConfig:
+//
+//  - Mutual TLS.  Every server and client presents a certificate signed by
+//    the cluster CA, and connections from peers without one are refused.
+//    Use NewClusterTLSConfig to build a suitable tls.Config.
+//
+//  - Signed frames.  Every frame carries an HMAC-SHA256 of its header, msg
+//    key and payload, computed with a key shared by the whole cluster.
+//    Requests with a missing or bad signature are rejected and the
+//    connection is dropped.  Signatures also cover nonces exchanged when
+//    the connection opens and a count of the frames sent on it, so captured
+//    frames cannot be replayed (see wireSession).
+//
+// Rejected peers are logged with their address (and certificate subject,
+// when known).
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net"
+    "time"
+)
+
+const wireMACLen = sha256.Size
+
+const wireNonceLen = 16
+
+// Which end of a connection a wireSession is for
+const (
+    wireClientSide byte = 'C'
+    wireServerSide byte = 'S'
+)
+
+// Signs and checks the frames on one connection in a keyed cluster.  The
+// connection opens with each side sending FRAME_HELLO with a random nonce.
+// Every frame, including the hellos, is then signed together with the nonces
+// exchanged so far, which side sent it, and how many frames that side had
+// sent before it.  A frame captured from one connection fails verification
+// on any other, since the nonces differ, and one replayed on the same
+// connection arrives with the wrong count.
+type wireSession struct {
+    key []byte
+    side byte
+
+    // Client nonce followed by server nonce, once the hellos are exchanged
+    nonces []byte
+
+    // Number of frames signed and checked so far
+    sent uint64
+    received uint64
+}
+
+// How long a server waits for a client to complete the TLS handshake
+const wireHandshakeTimeout = 10 * time.Second
+
+// Build a mutual TLS configuration for a cluster member.  <caFile> is the PEM
+// certificate of the cluster CA, and <certFile>/<keyFile> are this member's
+// PEM certificate and private key, signed by that CA.
+func NewClusterTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+    caPEM, err := ioutil.ReadFile(caFile)
+    if err != nil {
+        return nil, err
+    }
+    caPool := x509.NewCertPool()
+    if !caPool.AppendCertsFromPEM(caPEM) {
+        return nil, fmt.Errorf("Pigeon: No CA certificates found in %s", caFile)
+    }
+
+    cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+    if err != nil {
+        return nil, err
+    }
+
+    return &tls.Config{
+        Certificates: []tls.Certificate{cert},
+        RootCAs: caPool,
+        ClientCAs: caPool,
+        ClientAuth: tls.RequireAndVerifyClientCert,
+        MinVersion: tls.VersionTLS12,
+    }, nil
+}
+
+// Compute the signature of an encoded frame (without its trailer).
+func frameMAC(key, encoded []byte) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write(encoded)
+    return mac.Sum(nil)
+}
+
+func newWireSession(key []byte, side byte) *wireSession {
+    return &wireSession{
+        key: key,
+        side: side,
+    }
+}
+
+// Signature for encoded frame <encoded>, sent by <side> after <count> other
+// frames.
+func (session *wireSession) mac(side byte, count uint64, encoded []byte) []byte {
+    var prefix [9]byte
+    prefix[0] = side
+    binary.BigEndian.PutUint64(prefix[1:], count)
+
+    mac := hmac.New(sha256.New, session.key)
+    mac.Write(prefix[:])
+    mac.Write(session.nonces)
+    mac.Write(encoded)
+    return mac.Sum(nil)
+}
+
+// Sign the next frame we send.  Caller must serialize writes.
+func (session *wireSession) sign(encoded []byte) []byte {
+    sum := session.mac(session.side, session.sent, encoded)
+    session.sent++
+    return sum
+}
+
+// Check the signature of the next frame we received.  Must be called for
+// every frame, in order.
+func (session *wireSession) verify(f *frame) bool {
+    peer := wireServerSide
+    if session.side == wireServerSide {
+        peer = wireClientSide
+    }
+    count := session.received
+    session.received++
+    return f.mac != nil && hmac.Equal(f.mac, session.mac(peer, count, f.signed))
+}
+
+func newNonce() ([]byte, error) {
+    nonce := make([]byte, wireNonceLen)
+    _, err := rand.Read(nonce)
+    if err != nil {
+        return nil, err
+    }
+    return nonce, nil
+}
+
+// Send our hello on <conn> and check the server's answer, read from
+// <reader>.  Gives up at <ctx>'s deadline, or after wireHandshakeTimeout.
+func clientHandshake(ctx context.Context, conn net.Conn, reader io.Reader, key []byte) (*wireSession, error) {
+    deadline, hasDeadline := ctx.Deadline()
+    if !hasDeadline {
+        deadline = time.Now().Add(wireHandshakeTimeout)
+    }
+    conn.SetDeadline(deadline)
+    defer conn.SetDeadline(time.Time{})
+
+    nonce, err := newNonce()
+    if err != nil {
+        return nil, err
+    }
+    session := newWireSession(key, wireClientSide)
+    err = writeFrame(conn, &frame{frameType: FRAME_HELLO, payload: nonce}, session)
+    if err != nil {
+        return nil, err
+    }
+
+    f, err := readFrame(reader)
+    if err != nil {
+        return nil, err
+    }
+    if f.frameType != FRAME_HELLO || len(f.payload) != wireNonceLen {
+        return nil, fmt.Errorf("Pigeon: Server did not answer hello")
+    }
+    session.nonces = append(nonce, f.payload...)
+    if !session.verify(f) {
+        return nil, fmt.Errorf("Pigeon: Server is not signing with the cluster key")
+    }
+    return session, nil
+}
+
+// Handle the client's hello <f>.  Returns our nonce, to send back in a hello.
+// <session> may be nil if the cluster has no key.
+func serverHello(session *wireSession, f *frame) ([]byte, error) {
+    if len(f.payload) != wireNonceLen {
+        return nil, fmt.Errorf("malformed hello")
+    }
+    nonce, err := newNonce()
+    if err != nil {
+        return nil, err
+    }
+    if session != nil {
+        session.nonces = append(append([]byte{}, f.payload...), nonce...)
+    }
+    return nonce, nil
+}
+
+// Describe the peer on <conn> for log messages.
+func peerName(conn net.Conn) string {
+    tlsConn, ok := conn.(*tls.Conn)
+    if ok {
+        certs := tlsConn.ConnectionState().PeerCertificates
+        if len(certs) > 0 {
+            return fmt.Sprintf("%s (%s)", conn.RemoteAddr(), certs[0].Subject.CommonName)
+        }
+    }
+    return conn.RemoteAddr().String()
+}
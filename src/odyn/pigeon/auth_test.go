@@ -0,0 +1,179 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "net"
+    "testing"
+    "time"
+)
+
+func keyedConfig(key string) TCPTransportConfig {
+    cfg := DefaultTCPTransportConfig
+    cfg.ClusterKey = []byte(key)
+    return cfg
+}
+
+func callEcho(t *testing.T, cfg TCPTransportConfig, hostname string) (*PigeonResponse, error) {
+    transport, err := NewTCPTransportWithConfig(cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+    defer cancel()
+    resp := &PigeonResponse{}
+    err = transport.Call(ctx, hostname, &PigeonRequest{
+        ReqJobKey: "echo",
+        ReqBody: map[string]interface{}{"n": 1},
+    }, resp)
+    return resp, err
+}
+
+func TestSignedCall(t *testing.T) {
+    hostname := startTCPServer(t, keyedConfig("secret"))
+    resp, err := callEcho(t, keyedConfig("secret"), hostname)
+    if err == nil {
+        err = resp.Err()
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+    if resp.RespBody["n"] == nil {
+        t.Errorf("Body is %v", resp.RespBody)
+    }
+}
+
+func TestCallWithWrongKey(t *testing.T) {
+    hostname := startTCPServer(t, keyedConfig("secret"))
+    for _, cfg := range []TCPTransportConfig{keyedConfig("other"), DefaultTCPTransportConfig} {
+        resp, err := callEcho(t, cfg, hostname)
+        if err == nil && resp.RespStatus == RESP_OK {
+            t.Errorf("Call with key %q succeeded", cfg.ClusterKey)
+        }
+    }
+}
+
+// Connection to <hostname> that has exchanged hellos with key <key>
+func dialSession(t *testing.T, hostname string, key []byte) (net.Conn, *bufio.Reader, *wireSession) {
+    conn, err := net.Dial("tcp", hostname)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        conn.Close()
+    })
+    reader := bufio.NewReader(conn)
+    session, err := clientHandshake(context.Background(), conn, reader, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    return conn, reader, session
+}
+
+// Read the response to a request, or nil if the connection was dropped.
+func readResponse(t *testing.T, reader *bufio.Reader, session *wireSession) *PigeonResponse {
+    f, err := readFrame(reader)
+    if err != nil {
+        return nil
+    }
+    if !session.verify(f) {
+        t.Fatal("Response is not signed")
+    }
+    resp := &PigeonResponse{}
+    err = lookupCodec(f.codecID).Unmarshal(f.payload, resp)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return resp
+}
+
+func TestReplayedFrameIsRejected(t *testing.T) {
+    key := []byte("secret")
+    hostname := startTCPServer(t, keyedConfig("secret"))
+    codec := lookupCodec(CODEC_GOB)
+    payload, err := codec.Marshal(&PigeonRequest{ReqJobKey: "echo"})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    conn, reader, session := dialSession(t, hostname, key)
+    var captured bytes.Buffer
+    err = writeFrame(&captured, &frame{
+        frameType: FRAME_REQUEST,
+        codecID: codec.ID(),
+        correlationID: 1,
+        msgKey: "echo",
+        payload: payload,
+    }, session)
+    if err != nil {
+        t.Fatal(err)
+    }
+    conn.Write(captured.Bytes())
+    resp := readResponse(t, reader, session)
+    if resp == nil || resp.RespStatus != RESP_OK {
+        t.Fatalf("Original request failed: %+v", resp)
+    }
+
+    // Again on the same connection
+    conn.Write(captured.Bytes())
+    resp = readResponse(t, reader, session)
+    if resp != nil && resp.RespStatus != RESP_REJECTED {
+        t.Errorf("Replay on the same connection was answered with %+v", resp)
+    }
+    _, err = readFrame(reader)
+    if err == nil {
+        t.Error("Connection stayed open after a replay")
+    }
+
+    // On a new connection
+    conn, reader, session = dialSession(t, hostname, key)
+    conn.Write(captured.Bytes())
+    resp = readResponse(t, reader, session)
+    if resp != nil && resp.RespStatus != RESP_REJECTED {
+        t.Errorf("Replay on a new connection was answered with %+v", resp)
+    }
+}
+
+func TestKeyedServerRequiresHello(t *testing.T) {
+    hostname := startTCPServer(t, keyedConfig("secret"))
+    conn, err := net.Dial("tcp", hostname)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+    // Signed with the key, but without the session
+    session := newWireSession([]byte("secret"), wireClientSide)
+    session.nonces = make([]byte, 2 * wireNonceLen)
+    err = writeFrame(conn, &frame{frameType: FRAME_PING}, session)
+    if err != nil {
+        t.Fatal(err)
+    }
+    reader := bufio.NewReader(conn)
+    for {
+        f, err := readFrame(reader)
+        if err != nil {
+            break
+        }
+        if f.frameType == FRAME_PONG {
+            t.Fatal("Server answered a ping without a hello")
+        }
+    }
+}
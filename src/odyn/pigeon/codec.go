@@ -0,0 +1,127 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "bytes"
+    "encoding/gob"
+    "encoding/json"
+    "net/url"
+    "sync"
+)
+
+// Codec serializes requests and responses for the TCP transport.  The codec
+// used for each message is recorded in its frame header, so a server can
+// answer clients that use different codecs, as long as every codec is
+// registered on both ends.
+type Codec interface {
+    // Unique identifier sent in frame headers.  0 is reserved.
+    ID() byte
+
+    // Human-readable name, such as "gob".
+    Name() string
+
+    Marshal(v interface{}) ([]byte, error)
+
+    Unmarshal(data []byte, v interface{}) error
+}
+
+const (
+    CODEC_GOB byte = 1
+    CODEC_JSON byte = 2
+    CODEC_MSGPACK byte = 3
+)
+
+var codecsMu sync.RWMutex
+var codecs = map[byte]Codec{}
+
+// Encodes with encoding/gob.  Payload values must be gob-registered types.
+type gobCodec struct {
+}
+
+// Encodes with encoding/json.  Numbers in payloads decode as float64.
+type jsonCodec struct {
+}
+
+func init() {
+    // Types commonly found in payloads
+    gob.Register(map[string]interface{}{})
+    gob.Register([]interface{}{})
+    gob.Register(map[string]string{})
+    gob.Register(map[string][]string{})
+    gob.Register(url.Values{})
+
+    RegisterCodec(GobCodec())
+    RegisterCodec(JSONCodec())
+}
+
+// Make <codec> available to the TCP transport.  Replaces any codec with the
+// same ID.
+func RegisterCodec(codec Codec) {
+    codecsMu.Lock()
+    defer codecsMu.Unlock()
+    codecs[codec.ID()] = codec
+}
+
+func lookupCodec(id byte) Codec {
+    codecsMu.RLock()
+    defer codecsMu.RUnlock()
+    return codecs[id]
+}
+
+func GobCodec() Codec {
+    return &gobCodec{}
+}
+
+func JSONCodec() Codec {
+    return &jsonCodec{}
+}
+
+func (codec *gobCodec) ID() byte {
+    return CODEC_GOB
+}
+
+func (codec *gobCodec) Name() string {
+    return "gob"
+}
+
+func (codec *gobCodec) Marshal(v interface{}) ([]byte, error) {
+    var buf bytes.Buffer
+    err := gob.NewEncoder(&buf).Encode(v)
+    if err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+func (codec *gobCodec) Unmarshal(data []byte, v interface{}) error {
+    return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (codec *jsonCodec) ID() byte {
+    return CODEC_JSON
+}
+
+func (codec *jsonCodec) Name() string {
+    return "json"
+}
+
+func (codec *jsonCodec) Marshal(v interface{}) ([]byte, error) {
+    return json.Marshal(v)
+}
+
+func (codec *jsonCodec) Unmarshal(data []byte, v interface{}) error {
+    return json.Unmarshal(data, v)
+}
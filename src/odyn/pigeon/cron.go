@@ -0,0 +1,183 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Parsed cron spec.  Supports the standard five fields:
+//
+//      minute hour day-of-month month day-of-week
+//
+// Each field is "*", a number, a range "a-b", a step "*/n" or "a-b/n", or a
+// comma-separated list of those.  Day-of-week is 0-6 (Sunday is 0 or 7).  As
+// in cron, if both day fields are restricted (neither starts with "*"), a day
+// matching either one matches; otherwise a day must match both.  Also
+// supported are "@yearly", "@monthly", "@weekly", "@daily", "@hourly" and
+// "@every <duration>".  Times are in the local time zone.
+type cronSchedule struct {
+    minute, hour, dom, month, dow uint64
+    domStar, dowStar bool
+
+    // Non-zero for "@every"
+    every time.Duration
+}
+
+var cronDescriptors = map[string]string{
+    "@yearly": "0 0 1 1 *",
+    "@annually": "0 0 1 1 *",
+    "@monthly": "0 0 1 * *",
+    "@weekly": "0 0 * * 0",
+    "@daily": "0 0 * * *",
+    "@midnight": "0 0 * * *",
+    "@hourly": "0 * * * *",
+}
+
+func parseCron(spec string) (*cronSchedule, error) {
+    spec = strings.TrimSpace(spec)
+    if strings.HasPrefix(spec, "@every ") {
+        every, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+        if err != nil {
+            return nil, fmt.Errorf("Pigeon: Bad cron spec %q: %s", spec, err.Error())
+        }
+        if every < time.Second {
+            return nil, fmt.Errorf("Pigeon: Bad cron spec %q: interval must be at least 1s", spec)
+        }
+        return &cronSchedule{every: every}, nil
+    }
+    if expanded, ok := cronDescriptors[spec]; ok {
+        spec = expanded
+    }
+
+    fields := strings.Fields(spec)
+    if len(fields) != 5 {
+        return nil, fmt.Errorf("Pigeon: Bad cron spec %q: expected 5 fields", spec)
+    }
+
+    sched := &cronSchedule{
+        domStar: strings.HasPrefix(fields[2], "*"),
+        dowStar: strings.HasPrefix(fields[4], "*"),
+    }
+    var err error
+    ranges := []struct {
+        bits *uint64
+        min, max int
+    }{
+        {&sched.minute, 0, 59},
+        {&sched.hour, 0, 23},
+        {&sched.dom, 1, 31},
+        {&sched.month, 1, 12},
+        {&sched.dow, 0, 7},
+    }
+    for i, r := range ranges {
+        *r.bits, err = parseCronField(fields[i], r.min, r.max)
+        if err != nil {
+            return nil, fmt.Errorf("Pigeon: Bad cron spec %q: %s", spec, err.Error())
+        }
+    }
+
+    // Sunday is 0 or 7
+    if sched.dow & (1 << 7) != 0 {
+        sched.dow |= 1
+    }
+    return sched, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+    var bits uint64
+    for _, part := range strings.Split(field, ",") {
+        step := 1
+        if i := strings.Index(part, "/"); i >= 0 {
+            n, err := strconv.Atoi(part[i+1:])
+            if err != nil || n <= 0 {
+                return 0, fmt.Errorf("bad step in %q", part)
+            }
+            step = n
+            part = part[:i]
+        }
+
+        lo, hi := min, max
+        if part != "*" {
+            bounds := strings.SplitN(part, "-", 2)
+            n, err := strconv.Atoi(bounds[0])
+            if err != nil {
+                return 0, fmt.Errorf("bad value %q", part)
+            }
+            lo, hi = n, n
+            if len(bounds) == 2 {
+                hi, err = strconv.Atoi(bounds[1])
+                if err != nil {
+                    return 0, fmt.Errorf("bad range %q", part)
+                }
+            } else if step > 1 {
+                // "a/n" means "a-max/n"
+                hi = max
+            }
+        }
+        if lo < min || hi > max || lo > hi {
+            return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+        }
+
+        for v := lo; v <= hi; v += step {
+            bits |= 1 << uint(v)
+        }
+    }
+    return bits, nil
+}
+
+// Get the first time after <after> that matches the schedule, or the zero
+// time if there is none within five years (for example, "0 0 30 2 *").
+func (sched *cronSchedule) next(after time.Time) time.Time {
+    if sched.every > 0 {
+        return after.Add(sched.every)
+    }
+
+    after = after.Local()
+    t := time.Date(after.Year(), after.Month(), after.Day(), after.Hour(), after.Minute(), 0, 0, time.Local).Add(time.Minute)
+    limit := t.AddDate(5, 0, 0)
+    for t.Before(limit) {
+        if sched.month & (1 << uint(t.Month())) == 0 {
+            t = time.Date(t.Year(), t.Month() + 1, 1, 0, 0, 0, 0, time.Local)
+            continue
+        }
+        if !sched.dayMatches(t) {
+            t = time.Date(t.Year(), t.Month(), t.Day() + 1, 0, 0, 0, 0, time.Local)
+            continue
+        }
+        if sched.hour & (1 << uint(t.Hour())) == 0 {
+            t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour() + 1, 0, 0, 0, time.Local)
+            continue
+        }
+        if sched.minute & (1 << uint(t.Minute())) == 0 {
+            t = t.Add(time.Minute)
+            continue
+        }
+        return t
+    }
+    return time.Time{}
+}
+
+func (sched *cronSchedule) dayMatches(t time.Time) bool {
+    domMatch := sched.dom & (1 << uint(t.Day())) != 0
+    dowMatch := sched.dow & (1 << uint(t.Weekday())) != 0
+    if sched.domStar || sched.dowStar {
+        return domMatch && dowMatch
+    }
+    return domMatch || dowMatch
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "testing"
+    "time"
+)
+
+func TestParseCronRejects(t *testing.T) {
+    for _, spec := range []string{
+        "",
+        "* * * *",
+        "* * * * * *",
+        "60 * * * *",
+        "* 24 * * *",
+        "* * 0 * *",
+        "* * * 13 *",
+        "* * * * 8",
+        "5-1 * * * *",
+        "*/0 * * * *",
+        "a * * * *",
+        "@every 10ms",
+        "@every soon",
+        "@fortnightly",
+    } {
+        _, err := parseCron(spec)
+        if err == nil {
+            t.Errorf("parseCron(%q) succeeded", spec)
+        }
+    }
+}
+
+func TestCronNext(t *testing.T) {
+    // A Monday
+    from := time.Date(2015, 8, 3, 20, 22, 8, 0, time.Local)
+    at := func(month time.Month, day, hour, minute int) time.Time {
+        return time.Date(2015, month, day, hour, minute, 0, 0, time.Local)
+    }
+
+    cases := []struct {
+        spec string
+        expected time.Time
+    }{
+        {"* * * * *", at(8, 3, 20, 23)},
+        {"0 3 * * *", at(8, 4, 3, 0)},
+        {"@daily", at(8, 4, 0, 0)},
+        {"@hourly", at(8, 3, 21, 0)},
+        {"*/15 * * * *", at(8, 3, 20, 30)},
+        {"5/20 * * * *", at(8, 3, 20, 25)},
+        {"0 9-17/4 * * *", at(8, 4, 9, 0)},
+        {"0,30 22 * * *", at(8, 3, 22, 0)},
+        {"0 0 1 * *", at(9, 1, 0, 0)},
+        {"@weekly", at(8, 9, 0, 0)},
+        {"0 0 * * 7", at(8, 9, 0, 0)},
+        {"0 0 * * 5", at(8, 7, 0, 0)},
+        {"0 0 1 1 *", time.Date(2016, 1, 1, 0, 0, 0, 0, time.Local)},
+
+        // Both day fields restricted: either matches
+        {"0 0 15 * 5", at(8, 7, 0, 0)},
+        {"0 0 5 * 0", at(8, 5, 0, 0)},
+
+        // A day field starting with "*" is not a restriction, so the other
+        // must match
+        {"0 0 */1 * 5", at(8, 7, 0, 0)},
+        {"0 0 15 * */1", at(8, 15, 0, 0)},
+        {"0 0 */2 * 5", at(8, 7, 0, 0)},
+
+        // Never
+        {"0 0 30 2 *", time.Time{}},
+    }
+    for _, c := range cases {
+        sched, err := parseCron(c.spec)
+        if err != nil {
+            t.Errorf("parseCron(%q): %s", c.spec, err)
+            continue
+        }
+        next := sched.next(from)
+        if !next.Equal(c.expected) {
+            t.Errorf("%q: next is %s, expected %s", c.spec, next, c.expected)
+        }
+    }
+}
+
+func TestCronEvery(t *testing.T) {
+    sched, err := parseCron("@every 90s")
+    if err != nil {
+        t.Fatal(err)
+    }
+    from := time.Date(2015, 8, 3, 20, 22, 8, 0, time.Local)
+    if !sched.next(from).Equal(from.Add(90 * time.Second)) {
+        t.Errorf("next is %s", sched.next(from))
+    }
+}
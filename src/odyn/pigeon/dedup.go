@@ -0,0 +1,498 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "odyn/log"
+    "odyn/storage"
+    "sort"
+    "sync"
+    "time"
+)
+
+// Remembers the responses to requests with idempotency keys (see
+// HEADER_IDEMPOTENCY_KEY), so that a retry gets the same response instead of
+// running the handler again.  With DedupConfig.Conn, responses are also saved
+// as documents:
+//
+//      /pigeon/dedup/responses/<id>
+//
+//          {
+//              "msgKey" : "<msgKey>",
+//              "key" : "<idempotency key>",
+//              "expires" : "2015-08-04T20:22:08.123456789Z",
+//              "body" : { ... },
+//              "headers" : { ... }
+//          }
+//
+//      /pigeon/dedup/servers/<hostname>
+//
+//          { "<id>" : "<expires>", ... }
+//
+// where <id> is a hash of the msg key and idempotency key.  Only successful
+// responses are saved: a request whose handler failed is handled again when
+// retried.
+//
+// Each document records its own expiry, and the second document lists the
+// documents a Server saved, since storage cannot list documents.  A Server
+// deletes the documents it saved when it forgets them, beyond MaxEntries or
+// once they expire, and deletes expired documents it finds when looking for
+// a response.  Documents saved before a restart are found through the list:
+// expired ones are deleted on startup, and the rest once they expire.
+// Responses are only loaded and saved while holding the claim on a key,
+// never store.mu, so slow storage delays retries of that key alone.
+type dedupStore struct {
+    cfg DedupConfig
+
+    // Hostname of the Server, which names its list of saved documents
+    owner string
+
+    // Protects the fields below
+    mu sync.Mutex
+    entries map[string]*dedupEntry
+
+    // IDs of <entries>, oldest first
+    order []string
+
+    // For each ID being handled, a channel closed once it is done
+    inflight map[string]chan struct{}
+
+    // Expiry of each document this Server saved, as listed in storage
+    saved map[string]time.Time
+
+    // IDs in <saved> from before a restart, soonest to expire first
+    previous []string
+
+    // True while a goroutine is writing the list, and if the list changed
+    // since that goroutine took its copy
+    listWriting bool
+    listDirty bool
+}
+
+// DedupConfig controls how long a Server remembers the responses to requests
+// with idempotency keys.
+type DedupConfig struct {
+    // How long a response is kept for retries.  Defaults to 24 hours.
+    Window time.Duration
+
+    // Maximum number of responses kept.  The oldest are forgotten first.
+    // Defaults to 10000.
+    MaxEntries int
+
+    // Where responses are saved, so they survive restarts.  Servers sharing
+    // a Conn share responses, so a retry that reaches another Server is
+    // answered too.  Defaults to the System's Storage.  Without either,
+    // responses are kept in memory only.
+    Conn storage.Connection
+}
+
+var DefaultDedupConfig = DedupConfig{
+    Window: 24 * time.Hour,
+    MaxEntries: 10000,
+}
+
+// A saved response.
+type dedupEntry struct {
+    msgKey string
+    key string
+    expires time.Time
+    body map[string]interface{}
+    headers map[string]string
+
+    // True if this Server saved the entry to storage
+    saved bool
+}
+
+// A request's hold on its idempotency key while it is handled.  Other
+// requests with the same key wait until it is released.
+type dedupClaim struct {
+    store *dedupStore
+    id string
+    msgKey string
+    key string
+    done chan struct{}
+    once sync.Once
+}
+
+// Create the store for Server <owner>.  Zero values in <cfg> are taken from
+// DefaultDedupConfig.  With cfg.Conn, deletes the expired documents the
+// Server saved before a restart.
+func newDedupStore(owner string, cfg DedupConfig) (*dedupStore, error) {
+    if cfg.Window < 0 {
+        return nil, fmt.Errorf("Pigeon: Invalid deduplication Window %s", cfg.Window)
+    }
+    if cfg.MaxEntries < 0 {
+        return nil, fmt.Errorf("Pigeon: Invalid deduplication MaxEntries %d", cfg.MaxEntries)
+    }
+    if cfg.Window == 0 {
+        cfg.Window = DefaultDedupConfig.Window
+    }
+    if cfg.MaxEntries == 0 {
+        cfg.MaxEntries = DefaultDedupConfig.MaxEntries
+    }
+    store := &dedupStore{
+        cfg: cfg,
+        owner: owner,
+        entries: map[string]*dedupEntry{},
+        inflight: map[string]chan struct{}{},
+        saved: map[string]time.Time{},
+    }
+    if cfg.Conn != nil {
+        store.loadList()
+    }
+    return store, nil
+}
+
+func dedupID(msgKey, key string) string {
+    sum := sha256.Sum256([]byte(msgKey + "\n" + key))
+    return hex.EncodeToString(sum[:])
+}
+
+func dedupResponsePath(id string) string {
+    return "/pigeon/dedup/responses/" + id
+}
+
+func dedupListPath(owner string) string {
+    return "/pigeon/dedup/servers/" + owner
+}
+
+// Get the saved response to <msgKey> with idempotency <key>, or claim the
+// key so that other requests with it wait for this one.  If another request
+// holds the key, waits for it to finish or <ctx> to be done.  Returns a nil
+// claim if a saved response was found.
+func (store *dedupStore) claim(ctx context.Context, msgKey, key string) (*dedupClaim, *dedupEntry, error) {
+    id := dedupID(msgKey, key)
+    for {
+        store.mu.Lock()
+        entry := store.lookupLocked(id, msgKey, key)
+        if entry != nil {
+            store.mu.Unlock()
+            return nil, entry, nil
+        }
+        done, busy := store.inflight[id]
+        if !busy {
+            claim := &dedupClaim{
+                store: store,
+                id: id,
+                msgKey: msgKey,
+                key: key,
+                done: make(chan struct{}),
+            }
+            store.inflight[id] = claim.done
+            store.mu.Unlock()
+
+            // Other requests with the key wait while we look in storage
+            if store.cfg.Conn != nil {
+                entry = store.load(id, msgKey, key)
+                if entry != nil {
+                    claim.release()
+                    return nil, entry, nil
+                }
+            }
+            return claim, nil, nil
+        }
+        store.mu.Unlock()
+
+        select {
+        case <-done:
+        case <-ctx.Done():
+            return nil, nil, ctx.Err()
+        }
+    }
+}
+
+// Find an unexpired response for <id> in memory.  Caller must hold store.mu.
+func (store *dedupStore) lookupLocked(id, msgKey, key string) *dedupEntry {
+    entry, ok := store.entries[id]
+    if !ok || !entry.matches(msgKey, key) {
+        return nil
+    }
+    return entry
+}
+
+// Find an unexpired response for <id> in storage, and keep it in memory.
+// Deletes the document if it has expired.
+func (store *dedupStore) load(id, msgKey, key string) *dedupEntry {
+    entry := store.loadEntry(id)
+    if entry == nil {
+        return nil
+    }
+    if !time.Now().Before(entry.expires) {
+        store.deleteSaved([]string{id})
+        store.saveList()
+        return nil
+    }
+    if !entry.matches(msgKey, key) {
+        return nil
+    }
+
+    // This Server may have saved it before a restart
+    store.mu.Lock()
+    _, entry.saved = store.saved[id]
+    store.mu.Unlock()
+    store.remember(id, entry)
+    return entry
+}
+
+func (entry *dedupEntry) matches(msgKey, key string) bool {
+    return time.Now().Before(entry.expires) && entry.msgKey == msgKey && entry.key == key
+}
+
+// Keep <entry> in memory, and delete the saved documents of the entries
+// that forgets.
+func (store *dedupStore) remember(id string, entry *dedupEntry) {
+    store.mu.Lock()
+    forgotten := store.rememberLocked(id, entry)
+    listed := false
+    if entry.saved {
+        expires, ok := store.saved[id]
+        listed = !ok || !expires.Equal(entry.expires)
+        store.saved[id] = entry.expires
+    }
+    store.mu.Unlock()
+    store.deleteSaved(forgotten)
+    if listed || len(forgotten) > 0 {
+        store.saveList()
+    }
+}
+
+// Keep <entry> in memory, forgetting expired entries and the oldest beyond
+// MaxEntries.  Returns the IDs of forgotten entries that this Server saved.
+// Caller must hold store.mu.
+func (store *dedupStore) rememberLocked(id string, entry *dedupEntry) []string {
+    _, exists := store.entries[id]
+    if exists {
+        for i, other := range store.order {
+            if other == id {
+                store.order = append(store.order[:i], store.order[i + 1:]...)
+                break
+            }
+        }
+    }
+    store.entries[id] = entry
+    store.order = append(store.order, id)
+
+    forgotten := []string{}
+    now := time.Now()
+    for len(store.order) > 0 {
+        oldest := store.order[0]
+        if len(store.order) <= store.cfg.MaxEntries && now.Before(store.entries[oldest].expires) {
+            break
+        }
+        if store.entries[oldest].saved {
+            forgotten = append(forgotten, oldest)
+        }
+        delete(store.entries, oldest)
+        store.order = store.order[1:]
+    }
+
+    // Documents saved before a restart are forgotten once they expire.
+    // Those loaded into <entries> since are forgotten from there instead.
+    for len(store.previous) > 0 {
+        oldest := store.previous[0]
+        expires, listed := store.saved[oldest]
+        _, loaded := store.entries[oldest]
+        if listed && !loaded {
+            if now.Before(expires) {
+                break
+            }
+            forgotten = append(forgotten, oldest)
+        }
+        store.previous = store.previous[1:]
+    }
+    return forgotten
+}
+
+// Save <resp> as the response for the claimed key, if it succeeded.
+func (claim *dedupClaim) save(resp *PigeonResponse) {
+    if resp.RespStatus != RESP_OK {
+        return
+    }
+
+    entry := &dedupEntry{
+        msgKey: claim.msgKey,
+        key: claim.key,
+        expires: time.Now().Add(claim.store.cfg.Window),
+        headers: map[string]string{},
+    }
+    if resp.RespBody != nil {
+        entry.body = map[string]interface{}{}
+        for name, value := range resp.RespBody {
+            entry.body[name] = value
+        }
+    }
+    for name, value := range resp.RespHeaders {
+        if name != HEADER_CORRELATION_ID {
+            entry.headers[name] = value
+        }
+    }
+
+    // Save before remembering, so the document cannot be deleted as
+    // forgotten before it is written
+    store := claim.store
+    if store.cfg.Conn != nil {
+        err := store.cfg.Conn.SaveDocument(dedupResponsePath(claim.id), map[string]interface{}{
+            "msgKey": entry.msgKey,
+            "key": entry.key,
+            "expires": entry.expires.UTC().Format(time.RFC3339Nano),
+            "body": entry.body,
+            "headers": entry.headers,
+        })
+        if err != nil {
+            log.Error("Pigeon: Cannot save response for idempotency key ", claim.key, ": ", err)
+        } else {
+            entry.saved = true
+        }
+    }
+    store.remember(claim.id, entry)
+}
+
+// Let other requests with the claimed key proceed.  Safe to call more than
+// once.
+func (claim *dedupClaim) release() {
+    claim.once.Do(func() {
+        store := claim.store
+        store.mu.Lock()
+        defer store.mu.Unlock()
+        delete(store.inflight, claim.id)
+        close(claim.done)
+    })
+}
+
+// Fill in <resp> with the saved response.
+func (entry *dedupEntry) replay(resp *PigeonResponse) {
+    resp.RespStatus = RESP_OK
+    resp.RespError = ""
+    resp.RespBody = nil
+    if entry.body != nil {
+        resp.RespBody = map[string]interface{}{}
+        for name, value := range entry.body {
+            resp.RespBody[name] = value
+        }
+    }
+    for name, value := range entry.headers {
+        resp.SetHeader(name, value)
+    }
+    resp.SetHeader(HEADER_REPLAYED, "true")
+}
+
+func (store *dedupStore) loadEntry(id string) *dedupEntry {
+    obj, err := store.cfg.Conn.LoadDocument(dedupResponsePath(id))
+    if err != nil {
+        return nil
+    }
+    doc, ok := obj.(map[string]interface{})
+    if !ok {
+        return nil
+    }
+
+    entry := &dedupEntry{
+        headers: map[string]string{},
+    }
+    entry.msgKey, _ = doc["msgKey"].(string)
+    entry.key, _ = doc["key"].(string)
+    expires, _ := doc["expires"].(string)
+    entry.expires, _ = time.Parse(time.RFC3339Nano, expires)
+    entry.body, _ = doc["body"].(map[string]interface{})
+    headers, _ := doc["headers"].(map[string]interface{})
+    for name, value := range headers {
+        entry.headers[name], _ = value.(string)
+    }
+    return entry
+}
+
+// Delete the saved responses with <ids>, and remove them from the list of
+// documents this Server saved.  The caller saves the list.
+func (store *dedupStore) deleteSaved(ids []string) {
+    store.mu.Lock()
+    for _, id := range ids {
+        delete(store.saved, id)
+    }
+    store.mu.Unlock()
+
+    for _, id := range ids {
+        err := store.cfg.Conn.DeleteDocument(dedupResponsePath(id))
+        if err != nil {
+            log.Warn("Pigeon: Cannot delete saved response ", id, ": ", err)
+        }
+    }
+}
+
+// Load the list of documents this Server saved before a restart, deleting
+// those that have expired.
+func (store *dedupStore) loadList() {
+    obj, err := store.cfg.Conn.LoadDocument(dedupListPath(store.owner))
+    if err != nil {
+        return
+    }
+    doc, _ := obj.(map[string]interface{})
+
+    expired := []string{}
+    now := time.Now()
+    for id, value := range doc {
+        text, _ := value.(string)
+        expires, err := time.Parse(time.RFC3339Nano, text)
+        if err != nil || !now.Before(expires) {
+            expired = append(expired, id)
+            continue
+        }
+        store.saved[id] = expires
+        store.previous = append(store.previous, id)
+    }
+    sort.Slice(store.previous, func(i, j int) bool {
+        return store.saved[store.previous[i]].Before(store.saved[store.previous[j]])
+    })
+
+    if len(expired) > 0 {
+        log.Info("Pigeon: Deleting ", len(expired), " expired saved responses of ", store.owner)
+        store.deleteSaved(expired)
+        store.saveList()
+    }
+}
+
+// Write the list of documents this Server saved.  If another goroutine is
+// already writing it, leaves that goroutine to write the changes too.
+func (store *dedupStore) saveList() {
+    if store.cfg.Conn == nil {
+        return
+    }
+    store.mu.Lock()
+    defer store.mu.Unlock()
+    store.listDirty = true
+    if store.listWriting {
+        return
+    }
+
+    store.listWriting = true
+    for store.listDirty {
+        store.listDirty = false
+        doc := make(map[string]interface{}, len(store.saved))
+        for id, expires := range store.saved {
+            doc[id] = expires.UTC().Format(time.RFC3339Nano)
+        }
+
+        store.mu.Unlock()
+        err := store.cfg.Conn.SaveDocument(dedupListPath(store.owner), doc)
+        store.mu.Lock()
+        if err != nil {
+            log.Error("Pigeon: Cannot save the list of saved responses of ", store.owner, ": ", err)
+        }
+    }
+    store.listWriting = false
+}
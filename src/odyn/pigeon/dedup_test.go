@@ -0,0 +1,349 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func newTestDedupStore(t *testing.T, owner string, cfg DedupConfig) *dedupStore {
+    store, err := newDedupStore(owner, cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return store
+}
+
+// Handle a request with idempotency <key> through <store>, answering with
+// <n> if the handler has to run.  Returns the response, and whether it was
+// replayed.
+func handleOnce(t *testing.T, store *dedupStore, key string, n int) (*PigeonResponse, bool) {
+    t.Helper()
+    claim, saved, err := store.claim(context.Background(), "work", key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp := &PigeonResponse{}
+    if saved != nil {
+        saved.replay(resp)
+        return resp, true
+    }
+    defer claim.release()
+    resp.SetBody(map[string]interface{}{"n": n})
+    claim.save(resp)
+    return resp, false
+}
+
+func (conn *memConn) has(path string) bool {
+    conn.mu.Lock()
+    defer conn.mu.Unlock()
+    _, ok := conn.docs[path]
+    return ok
+}
+
+func TestDedupReplay(t *testing.T) {
+    sys, server := newTestServer(t, "local")
+    var calls int32
+    newTestInbox(t, server, "work", func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        n := atomic.AddInt32(&calls, 1)
+        if req.Body()["fail"] == true {
+            resp.SetError(errors.New("failed"))
+            return
+        }
+        resp.SetBody(map[string]interface{}{"n": n})
+    })
+
+    outbox := sys.NewOutbox()
+    send := func(key string, body map[string]interface{}) Response {
+        ctx := WithIdempotencyKey(context.Background(), key)
+        respChan, err := outbox.LaunchContext(ctx, "work", body)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return waitResponse(t, respChan)
+    }
+
+    first := send("job-1", nil)
+    retry := send("job-1", nil)
+    if retry.Err() != nil || retry.Body()["n"] != first.Body()["n"] || retry.Header(HEADER_REPLAYED) != "true" {
+        t.Errorf("Retry got %v %v (%v), expected %v", retry.Body(), retry.Header(HEADER_REPLAYED), retry.Err(), first.Body())
+    }
+    if first.Header(HEADER_REPLAYED) != "" {
+        t.Error("First response marked as replayed")
+    }
+    other := send("job-2", nil)
+    if other.Header(HEADER_REPLAYED) != "" {
+        t.Error("Different key got a replayed response")
+    }
+
+    // Failures are not remembered
+    send("job-3", map[string]interface{}{"fail": true})
+    send("job-3", map[string]interface{}{"fail": true})
+    if n := atomic.LoadInt32(&calls); n != 4 {
+        t.Errorf("Handler called %d times, expected 4", n)
+    }
+}
+
+func TestDedupWindowExpiry(t *testing.T) {
+    conn := newMemConn()
+    store := newTestDedupStore(t, "local", DedupConfig{Window: 50 * time.Millisecond, Conn: conn})
+    path := dedupResponsePath(dedupID("work", "job-1"))
+
+    handleOnce(t, store, "job-1", 1)
+    if !conn.has(path) {
+        t.Fatal("Response was not saved")
+    }
+    _, replayed := handleOnce(t, store, "job-1", 2)
+    if !replayed {
+        t.Error("Retry inside the window was handled again")
+    }
+
+    time.Sleep(100 * time.Millisecond)
+    resp, replayed := handleOnce(t, store, "job-1", 3)
+    if replayed || resp.RespBody["n"] != 3 {
+        t.Errorf("Retry after the window got %v (replayed %v)", resp.RespBody, replayed)
+    }
+
+    // An expired document is deleted when found, by any Server
+    other := newTestDedupStore(t, "other", DedupConfig{Conn: conn})
+    time.Sleep(100 * time.Millisecond)
+    claim, saved, err := other.claim(context.Background(), "work", "job-1")
+    if err != nil || saved != nil {
+        t.Fatalf("Claim after expiry returned %v, %v", saved, err)
+    }
+    claim.release()
+    if conn.has(path) {
+        t.Error("Expired document was not deleted")
+    }
+}
+
+func TestDedupEviction(t *testing.T) {
+    conn := newMemConn()
+    store := newTestDedupStore(t, "local", DedupConfig{MaxEntries: 2, Conn: conn})
+    for i := 1; i <= 3; i++ {
+        handleOnce(t, store, fmt.Sprintf("job-%d", i), i)
+    }
+
+    if conn.has(dedupResponsePath(dedupID("work", "job-1"))) {
+        t.Error("Oldest document was not deleted")
+    }
+    for _, key := range []string{"job-2", "job-3"} {
+        if !conn.has(dedupResponsePath(dedupID("work", key))) {
+            t.Errorf("Document for %s was deleted", key)
+        }
+        _, replayed := handleOnce(t, store, key, 0)
+        if !replayed {
+            t.Errorf("%s was forgotten", key)
+        }
+    }
+    _, replayed := handleOnce(t, store, "job-1", 0)
+    if replayed {
+        t.Error("job-1 was remembered beyond MaxEntries")
+    }
+
+    // Without storage, only memory is bounded
+    store = newTestDedupStore(t, "local", DedupConfig{MaxEntries: 2})
+    for i := 1; i <= 3; i++ {
+        handleOnce(t, store, fmt.Sprintf("job-%d", i), i)
+    }
+    store.mu.Lock()
+    remembered := len(store.entries)
+    store.mu.Unlock()
+    if remembered != 2 {
+        t.Errorf("%d entries kept", remembered)
+    }
+}
+
+func TestDedupSharedStorage(t *testing.T) {
+    conn := newMemConn()
+    first := newTestDedupStore(t, "first", DedupConfig{Conn: conn})
+    second := newTestDedupStore(t, "second", DedupConfig{Conn: conn})
+
+    handleOnce(t, first, "job-1", 1)
+    resp, replayed := handleOnce(t, second, "job-1", 2)
+    if !replayed || resp.RespBody["n"] != float64(1) {
+        t.Errorf("Other server got %v (replayed %v)", resp.RespBody, replayed)
+    }
+}
+
+func TestDedupDefaultsToSystemStorage(t *testing.T) {
+    conn := newMemConn()
+    sys := NewPigeonSystem(SystemConfig{Storage: conn, DrainTimeout: time.Second})
+    defer sys.Close()
+    server, err := sys.StartServer("local")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer server.Stop()
+
+    pigeonServer := server.(*PigeonServer)
+    if pigeonServer.dedupStore().cfg.Conn != conn {
+        t.Error("New server does not save responses to the System's Storage")
+    }
+    server.SetDeduplication(DedupConfig{Window: time.Hour})
+    if pigeonServer.dedupStore().cfg.Conn != conn {
+        t.Error("SetDeduplication dropped the System's Storage")
+    }
+    other := newMemConn()
+    server.SetDeduplication(DedupConfig{Conn: other})
+    if pigeonServer.dedupStore().cfg.Conn != other {
+        t.Error("SetDeduplication ignored Conn")
+    }
+}
+
+// Only one of many concurrent requests with a key is handled, and the rest
+// get its response.
+func TestDedupConcurrentClaims(t *testing.T) {
+    store := newTestDedupStore(t, "local", DedupConfig{Conn: newMemConn()})
+    var handled int32
+    var wg sync.WaitGroup
+    for i := 0; i < 20; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            claim, saved, err := store.claim(context.Background(), "work", "job-1")
+            if err != nil {
+                t.Error(err)
+                return
+            }
+            if saved != nil {
+                return
+            }
+            defer claim.release()
+            atomic.AddInt32(&handled, 1)
+            time.Sleep(20 * time.Millisecond)
+            resp := &PigeonResponse{}
+            resp.SetBody(map[string]interface{}{"n": 1})
+            claim.save(resp)
+        }()
+    }
+    wg.Wait()
+    if handled != 1 {
+        t.Errorf("Handled %d times", handled)
+    }
+
+    // A waiter gives up with its context
+    claim, _, err := store.claim(context.Background(), "work", "job-2")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer claim.release()
+    ctx, cancel := context.WithTimeout(context.Background(), 20 * time.Millisecond)
+    defer cancel()
+    _, _, err = store.claim(ctx, "work", "job-2")
+    if err != context.DeadlineExceeded {
+        t.Errorf("Waiting claim returned %v", err)
+    }
+}
+
+// Storage that blocks loads of one document until released.
+type blockingConn struct {
+    *memConn
+    path string
+    release chan struct{}
+}
+
+func (conn *blockingConn) LoadDocument(path string) (interface{}, error) {
+    if path == conn.path {
+        <-conn.release
+    }
+    return conn.memConn.LoadDocument(path)
+}
+
+// Slow storage for one key does not hold up requests with other keys.
+func TestDedupStorageOutsideLock(t *testing.T) {
+    conn := &blockingConn{
+        memConn: newMemConn(),
+        path: dedupResponsePath(dedupID("work", "slow")),
+        release: make(chan struct{}),
+    }
+    store := newTestDedupStore(t, "local", DedupConfig{Conn: conn})
+
+    slow := make(chan struct{})
+    go func() {
+        defer close(slow)
+        handleOnce(t, store, "slow", 1)
+    }()
+    time.Sleep(20 * time.Millisecond)
+
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        handleOnce(t, store, "fast", 1)
+        handleOnce(t, store, "fast", 2)
+    }()
+    select {
+    case <-done:
+    case <-time.After(time.Second):
+        t.Error("Request with another key waited for slow storage")
+    }
+    close(conn.release)
+    <-slow
+}
+
+// Documents saved before a restart are deleted once they expire.
+func TestDedupRestartDeletesExpired(t *testing.T) {
+    conn := newMemConn()
+    listed := func() map[string]interface{} {
+        obj, err := conn.LoadDocument(dedupListPath("local"))
+        if err != nil {
+            t.Fatal(err)
+        }
+        return obj.(map[string]interface{})
+    }
+    path := func(key string) string {
+        return dedupResponsePath(dedupID("work", key))
+    }
+
+    before := newTestDedupStore(t, "local", DedupConfig{Window: 50 * time.Millisecond, Conn: conn})
+    handleOnce(t, before, "job-1", 1)
+    if _, ok := listed()[dedupID("work", "job-1")]; !ok {
+        t.Fatal("Saved response is not listed")
+    }
+
+    // Expired by the time the Server restarts
+    time.Sleep(100 * time.Millisecond)
+    before = newTestDedupStore(t, "local", DedupConfig{Window: 100 * time.Millisecond, Conn: conn})
+    if conn.has(path("job-1")) || len(listed()) != 0 {
+        t.Errorf("Expired response was not deleted on restart: %v", listed())
+    }
+
+    // Not yet expired when the Server restarts
+    handleOnce(t, before, "job-2", 2)
+    after := newTestDedupStore(t, "local", DedupConfig{Conn: conn})
+    if !conn.has(path("job-2")) {
+        t.Fatal("Unexpired response was deleted on restart")
+    }
+    time.Sleep(150 * time.Millisecond)
+    handleOnce(t, after, "job-3", 3)
+    if conn.has(path("job-2")) {
+        t.Error("Response from before the restart was not deleted once it expired")
+    }
+    if _, ok := listed()[dedupID("work", "job-3")]; !ok || len(listed()) != 1 {
+        t.Errorf("Listed %v", listed())
+    }
+
+    // Other Servers keep their own lists
+    newTestDedupStore(t, "other", DedupConfig{Conn: conn})
+    if !conn.has(path("job-3")) {
+        t.Error("Another Server deleted a response it did not save")
+    }
+}
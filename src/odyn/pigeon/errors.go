@@ -0,0 +1,96 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "fmt"
+    "strings"
+)
+
+// Error is reported by Response.Err() when a request was not handled.
+type Error struct {
+    Status ResponseStatus
+    MsgKey string
+    Hostname string
+    Message string
+
+    // What was wrong with the request, one problem each, such as
+    // "reading.celsius: expected number, got string".  Set for
+    // RESP_INVALID_PAYLOAD.
+    Details []string
+}
+
+var statusNames = map[ResponseStatus]string{
+    RESP_OK: "ok",
+    RESP_NOT_FOUND: "not found",
+    RESP_HANDLER_PANIC: "handler panic",
+    RESP_HANDLER_ERROR: "handler error",
+    RESP_TIMEOUT: "timeout",
+    RESP_CANCELLED: "cancelled",
+    RESP_TRANSPORT_FAILURE: "transport failure",
+    RESP_REJECTED: "rejected",
+    RESP_BUSY: "busy",
+    RESP_INVALID_PAYLOAD: "invalid payload",
+}
+
+// Create an error for a handler to pass to Response.SetError.
+func NewError(status ResponseStatus, format string, args ...interface{}) *Error {
+    return &Error{
+        Status: status,
+        Message: fmt.Sprintf(format, args...),
+    }
+}
+
+func (err *Error) Error() string {
+    msg := fmt.Sprintf("Pigeon: %s (%s) from %s: %s", err.MsgKey, err.Status, err.Hostname, err.Message)
+    if err.Hostname == "" {
+        // Not from a server, such as an EncodePayload error
+        msg = fmt.Sprintf("Pigeon: %s (%s): %s", err.MsgKey, err.Status, err.Message)
+    }
+    if len(err.Details) > 0 {
+        msg += " (" + strings.Join(err.Details, "; ") + ")"
+    }
+    return msg
+}
+
+// Returns true if <err> is a Pigeon error with status RESP_TIMEOUT.
+func IsTimeout(err error) bool {
+    pigeonErr, ok := err.(*Error)
+    return ok && pigeonErr.Status == RESP_TIMEOUT
+}
+
+// Returns true if <err> is a Pigeon error with status RESP_BUSY.
+func IsBusy(err error) bool {
+    pigeonErr, ok := err.(*Error)
+    return ok && pigeonErr.Status == RESP_BUSY
+}
+
+// Returns true if <err> is a Pigeon error with status RESP_INVALID_PAYLOAD.
+func IsInvalidPayload(err error) bool {
+    pigeonErr, ok := err.(*Error)
+    return ok && pigeonErr.Status == RESP_INVALID_PAYLOAD
+}
+
+func (status ResponseStatus) String() string {
+    name, ok := statusNames[status]
+    if !ok {
+        return fmt.Sprintf("status %d", int(status))
+    }
+    return name
+}
+
+func errNoSuchWorker(hostname string) error {
+    return fmt.Errorf("Pigeon: No server %s in registry", hostname)
+}
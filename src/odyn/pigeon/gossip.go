@@ -0,0 +1,1224 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+// Registry kept by gossip between peers, so that small clusters need no
+// database.
+//
+// Each process runs one gossip node, which owns the records of the Pigeon
+// servers registered through it.  Nodes find each other through seed
+// addresses and then follow SWIM (Das, Gupta and Motivala, 2002):
+//
+//  - Every ProbeInterval, a node pings the next member in a shuffled round
+//    robin.  If no ack arrives within ProbeTimeout, it asks IndirectChecks
+//    other members to ping the target on its behalf.  If still no ack
+//    arrives by the end of the interval, the target becomes "suspect".
+//
+//  - A suspect node that does not refute the suspicion within
+//    SuspicionTimeout is declared "dead".  A node refutes by gossiping that
+//    it is alive with a higher incarnation number.
+//
+//  - Changes to membership and to server records are piggybacked on pings
+//    and acks, and each is retransmitted a few times per member, so they
+//    spread through the cluster like an infection.  Every PushPullInterval a
+//    node also exchanges its full state with a random member, which repairs
+//    anything the piggybacking missed and lets partitioned nodes rejoin.
+//
+// Servers on suspect or dead nodes are reported as UNRESPONSIVE, and those on
+// nodes that left cleanly as STOPPED.  Incarnation and version numbers start
+// from the clock, so a restarted node's state supersedes what the cluster
+// remembers about its previous run.
+//
+// Messages are JSON over UDP, one per datagram.  Full state that does not fit
+// in one datagram is split into parts, and a sync only counts once every part
+// has arrived.  If GossipConfig.ClusterKey is set, each datagram ends with an
+// HMAC-SHA256 of the rest, and unsigned or mis-signed datagrams are dropped.
+//
+// Leases are granted by the live node with the lowest address and kept in its
+// memory, so they are only as safe as the cluster's view of membership.  See
+// AcquireLease.
+
+import (
+    "crypto/hmac"
+    "encoding/json"
+    "fmt"
+    "math"
+    "math/rand"
+    "net"
+    "odyn/log"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Largest gossip datagram sent or accepted.
+const MAX_GOSSIP_PACKET = 65000
+
+// Room left in each datagram for the message's own fields and signature, when
+// filling it with nodes and servers.
+const gossipMsgOverhead = 1024
+
+// Most updates piggybacked on each ping or ack.
+const MAX_GOSSIP_PIGGYBACK = 16
+
+// Each update is piggybacked GOSSIP_RETRANSMIT_MULT * log10(members + 1)
+// times, rounded up.
+const GOSSIP_RETRANSMIT_MULT = 4
+
+const (
+    gossipPing = "ping"
+    gossipPingReq = "ping-req"
+    gossipAck = "ack"
+    gossipSync = "sync"
+    gossipSyncReply = "sync-reply"
+)
+
+// GossipConfig controls a gossip Registry.
+type GossipConfig struct {
+    // UDP address to gossip on, such as "10.0.0.5:7946".  Other nodes reach
+    // this node at this address, so it must not be a wildcard.  Required.
+    BindAddr string
+
+    // Gossip addresses of nodes to join through.  May include BindAddr, so
+    // every node can be given the same list.
+    Seeds []string
+
+    // How often to probe a member.  Defaults to 1 second.
+    ProbeInterval time.Duration
+
+    // How long to wait for a direct ack before asking other members to
+    // probe.  Defaults to half the ProbeInterval.
+    ProbeTimeout time.Duration
+
+    // Number of members asked to probe a node that missed a direct ack.
+    // Defaults to 3.
+    IndirectChecks int
+
+    // How long a suspect node has to refute the suspicion before it is
+    // declared dead.  Defaults to 5 seconds.
+    SuspicionTimeout time.Duration
+
+    // How often to exchange full state with a random member.  Defaults to
+    // 10 seconds.
+    PushPullInterval time.Duration
+
+    // How long to remember dead nodes and their servers.  Defaults to 1
+    // minute.
+    DeadRetention time.Duration
+
+    // Key shared by every node.  If set, gossip is signed with it.
+    ClusterKey []byte
+}
+
+var DefaultGossipConfig = GossipConfig{
+    ProbeInterval: time.Second,
+    IndirectChecks: 3,
+    SuspicionTimeout: 5 * time.Second,
+    PushPullInterval: 10 * time.Second,
+    DeadRetention: time.Minute,
+}
+
+// GossipRegistry is a Registry kept by gossip between peers.  See gossip.go.
+type GossipRegistry interface {
+    Registry
+
+    // Get every gossip node this node knows of, including itself.
+    Members() []GossipMember
+
+    // Tell the other nodes that this one is leaving, and stop gossiping.
+    // Servers registered through this node are reported as STOPPED.
+    Leave() error
+}
+
+// GossipMember describes a gossip node.
+type GossipMember struct {
+    Addr string
+
+    // "alive", "suspect", "dead" or "left"
+    State string
+
+    Incarnation uint64
+}
+
+type nodeState int
+const (
+    // In order of precedence between updates with the same incarnation
+    nodeAlive nodeState = iota
+    nodeSuspect
+    nodeDead
+    nodeLeft
+)
+
+var nodeStateNames = map[nodeState]string{
+    nodeAlive: "alive",
+    nodeSuspect: "suspect",
+    nodeDead: "dead",
+    nodeLeft: "left",
+}
+
+// What the cluster knows about a gossip node.  Exported fields are gossiped.
+type gossipNode struct {
+    Addr string
+    Incarnation uint64
+    State nodeState
+
+    // When State last changed, and when we last heard from the node
+    stateSince time.Time
+    lastSeen time.Time
+}
+
+// A Pigeon server's record, owned by the node it registered through.
+// Replaced by records with a higher Version.
+type gossipServer struct {
+    Hostname string
+    Node string
+    Version uint64
+    Status StatusEnum
+    Load int
+    Listeners []string
+}
+
+type gossipMsg struct {
+    Type string
+    From string
+    Seq uint64
+
+    // For ping-req, the node to probe.  For acks, the node that answered.
+    Target string
+
+    // Piggybacked updates, or the full state for syncs
+    Nodes []gossipNode
+    Servers []gossipServer
+
+    // Syncs too large for one datagram are sent as Parts messages sharing a
+    // Seq, numbered from 0
+    Part int
+    Parts int
+}
+
+// Parts received of the latest sync from a node.
+type gossipSyncProgress struct {
+    seq uint64
+    parts map[int]bool
+}
+
+// Ping sent on behalf of another node's ping-req.
+type gossipRelay struct {
+    requester string
+    seq uint64
+    expires time.Time
+}
+
+type gossipRegistry struct {
+    cfg GossipConfig
+    conn *net.UDPConn
+    self string
+
+    mu sync.Mutex
+    nodes map[string]*gossipNode
+    servers map[string]*gossipServer
+
+    // Hostnames by msg key pattern
+    listeners *subjectTrie
+
+    // Last incarnation or version number handed out
+    version uint64
+
+    // Updates to piggyback, by key (see nodeUpdateKey), with the number of
+    // times each has been sent
+    updates map[string]int
+
+    // Servers reported by MarkUnresponsive, so each is reported once
+    reported map[string]bool
+
+    // Members we have exchanged full state with since they joined or last
+    // changed state, and the parts received of syncs still arriving
+    synced map[string]bool
+    syncing map[string]gossipSyncProgress
+
+    // Leases granted while this node is the leader, and since when it has
+    // been, or zero if it is not
+    leases map[string]lease
+    leaderSince time.Time
+
+    // Members left to probe this round
+    probeOrder []string
+
+    // Acks we are waiting for, by sequence number
+    seq uint64
+    acks map[uint64]chan struct{}
+    relays map[uint64]gossipRelay
+
+    stop chan struct{}
+    left bool
+}
+
+// Create a Registry kept by gossip, and join the cluster through
+// <cfg.Seeds>.  Zero values in <cfg> are taken from DefaultGossipConfig.
+func NewGossipRegistry(cfg GossipConfig) (GossipRegistry, error) {
+    if cfg.ProbeInterval <= 0 {
+        cfg.ProbeInterval = DefaultGossipConfig.ProbeInterval
+    }
+    if cfg.ProbeTimeout <= 0 || cfg.ProbeTimeout >= cfg.ProbeInterval {
+        cfg.ProbeTimeout = cfg.ProbeInterval / 2
+    }
+    if cfg.IndirectChecks <= 0 {
+        cfg.IndirectChecks = DefaultGossipConfig.IndirectChecks
+    }
+    if cfg.SuspicionTimeout <= 0 {
+        cfg.SuspicionTimeout = DefaultGossipConfig.SuspicionTimeout
+    }
+    if cfg.PushPullInterval <= 0 {
+        cfg.PushPullInterval = DefaultGossipConfig.PushPullInterval
+    }
+    if cfg.DeadRetention <= 0 {
+        cfg.DeadRetention = DefaultGossipConfig.DeadRetention
+    }
+
+    addr, err := net.ResolveUDPAddr("udp", cfg.BindAddr)
+    if err != nil {
+        return nil, fmt.Errorf("Pigeon: Invalid gossip address %q: %s", cfg.BindAddr, err.Error())
+    }
+    if addr.IP == nil || addr.IP.IsUnspecified() {
+        return nil, fmt.Errorf("Pigeon: Gossip address %q must name a host that other nodes can reach", cfg.BindAddr)
+    }
+    conn, err := net.ListenUDP("udp", addr)
+    if err != nil {
+        return nil, err
+    }
+
+    now := time.Now()
+    reg := &gossipRegistry{
+        cfg: cfg,
+        conn: conn,
+        self: cfg.BindAddr,
+        nodes: map[string]*gossipNode{},
+        servers: map[string]*gossipServer{},
+        listeners: newSubjectTrie(),
+        version: uint64(now.UnixNano()),
+        updates: map[string]int{},
+        reported: map[string]bool{},
+        synced: map[string]bool{},
+        syncing: map[string]gossipSyncProgress{},
+        leases: map[string]lease{},
+        acks: map[uint64]chan struct{}{},
+        relays: map[uint64]gossipRelay{},
+        stop: make(chan struct{}),
+    }
+    reg.nodes[reg.self] = &gossipNode{
+        Addr: reg.self,
+        Incarnation: reg.nextVersion(),
+        State: nodeAlive,
+        stateSince: now,
+        lastSeen: now,
+    }
+
+    go reg.receive()
+    go reg.run()
+
+    // Introduce ourselves
+    msgs := reg.syncMsgs(gossipSync)
+    for _, seed := range cfg.Seeds {
+        if seed != reg.self {
+            reg.sendAll(seed, msgs)
+        }
+    }
+    return reg, nil
+}
+
+func (state nodeState) String() string {
+    return nodeStateNames[state]
+}
+
+func nodeUpdateKey(addr string) string {
+    return "node:" + addr
+}
+
+func serverUpdateKey(hostname string) string {
+    return "server:" + hostname
+}
+
+// Caller must hold reg.mu.
+func (reg *gossipRegistry) nextVersion() uint64 {
+    reg.version++
+    return reg.version
+}
+
+// Queue an update to be piggybacked.  Caller must hold reg.mu.
+func (reg *gossipRegistry) enqueue(key string) {
+    reg.updates[key] = 0
+}
+
+//
+// Registry methods.  Servers can only be changed through the node that owns
+// them.
+//
+
+func (reg *gossipRegistry) RegisterWorker(hostname string) error {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    listeners := []string{}
+    current := reg.servers[hostname]
+    if current != nil && current.Node == reg.self {
+        listeners = current.Listeners
+    }
+    reg.putServer(&gossipServer{
+        Hostname: hostname,
+        Node: reg.self,
+        Version: reg.nextVersion(),
+        Status: RUNNING,
+        Listeners: listeners,
+    })
+    return nil
+}
+
+func (reg *gossipRegistry) Heartbeat(hostname string, load int) error {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    server, err := reg.ownedServer(hostname)
+    if err != nil {
+        return err
+    }
+    // Liveness comes from probing, so only changes need gossiping
+    if server.Load != load {
+        updated := *server
+        updated.Load = load
+        updated.Version = reg.nextVersion()
+        reg.putServer(&updated)
+    }
+    return nil
+}
+
+func (reg *gossipRegistry) SetWorkerStatus(hostname string, status StatusEnum) error {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    server, err := reg.ownedServer(hostname)
+    if err != nil {
+        return err
+    }
+    updated := *server
+    updated.Status = status
+    updated.Version = reg.nextVersion()
+    reg.putServer(&updated)
+    return nil
+}
+
+// Report servers whose nodes have failed since the last call.  Liveness
+// comes from probing, so <cutoff> is ignored.
+func (reg *gossipRegistry) MarkUnresponsive(cutoff time.Time) ([]string, error) {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    marked := []string{}
+    for hostname, server := range reg.servers {
+        if reg.statusOf(server) != UNRESPONSIVE {
+            delete(reg.reported, hostname)
+            continue
+        }
+        if !reg.reported[hostname] {
+            reg.reported[hostname] = true
+            marked = append(marked, hostname)
+        }
+    }
+    sort.Strings(marked)
+    return marked, nil
+}
+
+func (reg *gossipRegistry) GetWorker(hostname string) (ServerInfo, error) {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    server, ok := reg.servers[hostname]
+    if !ok {
+        return ServerInfo{Hostname: hostname, Status: DOES_NOT_EXIST}, nil
+    }
+    info := ServerInfo{
+        Hostname: hostname,
+        Status: reg.statusOf(server),
+        Load: server.Load,
+    }
+    node := reg.nodes[server.Node]
+    if server.Node == reg.self {
+        info.LastHeartbeat = time.Now()
+    } else if node != nil {
+        info.LastHeartbeat = node.lastSeen
+    }
+    return info, nil
+}
+
+func (reg *gossipRegistry) RegisterListener(hostname, msgKey string) error {
+    err := validatePattern(msgKey)
+    if err != nil {
+        return err
+    }
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    server, err := reg.ownedServer(hostname)
+    if err != nil {
+        return err
+    }
+    for _, pattern := range server.Listeners {
+        if pattern == msgKey {
+            return nil
+        }
+    }
+    updated := *server
+    updated.Listeners = append(append([]string{}, server.Listeners...), msgKey)
+    updated.Version = reg.nextVersion()
+    reg.putServer(&updated)
+    return nil
+}
+
+func (reg *gossipRegistry) UnregisterListener(hostname, msgKey string) error {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    server, err := reg.ownedServer(hostname)
+    if err != nil {
+        return err
+    }
+    remaining := []string{}
+    for _, pattern := range server.Listeners {
+        if pattern != msgKey {
+            remaining = append(remaining, pattern)
+        }
+    }
+    if len(remaining) == len(server.Listeners) {
+        return nil
+    }
+    updated := *server
+    updated.Listeners = remaining
+    updated.Version = reg.nextVersion()
+    reg.putServer(&updated)
+    return nil
+}
+
+func (reg *gossipRegistry) GetListeners(msgKey string) ([]string, error) {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    hosts := []string{}
+    for hostname := range reg.listeners.match(msgKey) {
+        server := reg.servers[hostname]
+        if server != nil && reg.statusOf(server) == RUNNING {
+            hosts = append(hosts, hostname)
+        }
+    }
+    sort.Strings(hosts)
+    return hosts, nil
+}
+
+// Leases are only granted by the live node with the lowest address, and are
+// kept in its memory.  So that two nodes don't both grant one, that node
+// refuses leases until it has exchanged full state with every member it
+// knows of, which tells it of any lower node they know of, and until <ttl>
+// after it became the leader, so that leases granted by the previous leader
+// have expired.  Nodes that cannot reach each other at all can still both
+// grant a lease, so holders must tolerate occasional overlap, as the
+// scheduler does.
+func (reg *gossipRegistry) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+    reg.mu.Lock()
+    now := time.Now()
+    reg.checkLeader(now)
+    if reg.leaderSince.IsZero() {
+        reg.mu.Unlock()
+        return false, nil
+    }
+
+    unsynced := []string{}
+    for _, addr := range reg.liveNodes("") {
+        if !reg.synced[addr] {
+            unsynced = append(unsynced, addr)
+        }
+    }
+    if len(unsynced) > 0 {
+        // Catch up now rather than waiting for push-pull
+        msgs := reg.syncMsgsLocked(gossipSync)
+        reg.mu.Unlock()
+        for _, addr := range unsynced {
+            reg.sendAll(addr, msgs)
+        }
+        return false, nil
+    }
+
+    defer reg.mu.Unlock()
+    if now.Sub(reg.leaderSince) < ttl {
+        return false, nil
+    }
+    current, ok := reg.leases[name]
+    if ok && current.holder != holder && current.expires.After(now) {
+        return false, nil
+    }
+    reg.leases[name] = lease{holder, now.Add(ttl)}
+    return true, nil
+}
+
+func (reg *gossipRegistry) Members() []GossipMember {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    members := []GossipMember{}
+    for _, node := range reg.nodes {
+        members = append(members, GossipMember{
+            Addr: node.Addr,
+            State: node.State.String(),
+            Incarnation: node.Incarnation,
+        })
+    }
+    sort.Slice(members, func(i, j int) bool {
+        return members[i].Addr < members[j].Addr
+    })
+    return members
+}
+
+func (reg *gossipRegistry) Leave() error {
+    reg.mu.Lock()
+    if reg.left {
+        reg.mu.Unlock()
+        return nil
+    }
+    reg.left = true
+    me := reg.nodes[reg.self]
+    me.Incarnation = reg.nextVersion()
+    me.State = nodeLeft
+    msgs := reg.syncMsgsLocked(gossipSyncReply)
+    peers := reg.liveNodes(reg.self)
+    reg.mu.Unlock()
+
+    // Tell everyone directly, since we won't be around to gossip it
+    for _, peer := range peers {
+        reg.sendAll(peer, msgs)
+    }
+    close(reg.stop)
+    return reg.conn.Close()
+}
+
+// Get server <hostname> if it belongs to this node.  Caller must hold
+// reg.mu.
+func (reg *gossipRegistry) ownedServer(hostname string) (*gossipServer, error) {
+    server, ok := reg.servers[hostname]
+    if !ok {
+        return nil, errNoSuchWorker(hostname)
+    }
+    if server.Node != reg.self {
+        return nil, fmt.Errorf("Pigeon: Server %s belongs to gossip node %s, not %s", hostname, server.Node, reg.self)
+    }
+    return server, nil
+}
+
+// Store <server> and queue it for gossip.  Caller must hold reg.mu.
+func (reg *gossipRegistry) putServer(server *gossipServer) {
+    current := reg.servers[server.Hostname]
+    if current != nil {
+        for _, pattern := range current.Listeners {
+            reg.listeners.remove(pattern, server.Hostname)
+        }
+    }
+    for _, pattern := range server.Listeners {
+        reg.listeners.insert(pattern, server.Hostname)
+    }
+    reg.servers[server.Hostname] = server
+    reg.enqueue(serverUpdateKey(server.Hostname))
+}
+
+// Forget server <hostname>.  Caller must hold reg.mu.
+func (reg *gossipRegistry) dropServer(hostname string) {
+    server := reg.servers[hostname]
+    for _, pattern := range server.Listeners {
+        reg.listeners.remove(pattern, hostname)
+    }
+    delete(reg.servers, hostname)
+    delete(reg.updates, serverUpdateKey(hostname))
+    delete(reg.reported, hostname)
+}
+
+// Status of <server>, taking its node's liveness into account.  Caller must
+// hold reg.mu.
+func (reg *gossipRegistry) statusOf(server *gossipServer) StatusEnum {
+    if server.Status != RUNNING {
+        return server.Status
+    }
+    node := reg.nodes[server.Node]
+    switch {
+    case node == nil:
+        return UNRESPONSIVE
+    case node.State == nodeAlive:
+        return RUNNING
+    case node.State == nodeLeft:
+        return STOPPED
+    }
+    return UNRESPONSIVE
+}
+
+// Live node with the lowest address.  Caller must hold reg.mu.
+func (reg *gossipRegistry) leader() string {
+    leader := ""
+    for addr, node := range reg.nodes {
+        if node.State == nodeAlive && (leader == "" || addr < leader) {
+            leader = addr
+        }
+    }
+    return leader
+}
+
+// Note whether this node is the leader, forgetting its leases if it no
+// longer is.  Caller must hold reg.mu.
+func (reg *gossipRegistry) checkLeader(now time.Time) {
+    if reg.leader() != reg.self {
+        if !reg.leaderSince.IsZero() {
+            reg.leaderSince = time.Time{}
+            reg.leases = map[string]lease{}
+        }
+    } else if reg.leaderSince.IsZero() {
+        reg.leaderSince = now
+    }
+}
+
+// Get the addresses of alive and suspect nodes other than <exclude> and
+// ourselves.  Caller must hold reg.mu.
+func (reg *gossipRegistry) liveNodes(exclude string) []string {
+    addrs := []string{}
+    for addr, node := range reg.nodes {
+        if addr != reg.self && addr != exclude && (node.State == nodeAlive || node.State == nodeSuspect) {
+            addrs = append(addrs, addr)
+        }
+    }
+    return addrs
+}
+
+//
+// Merging gossip
+//
+
+// Apply what another node says about node <update>.  Caller must hold
+// reg.mu.
+func (reg *gossipRegistry) mergeNode(update gossipNode) {
+    now := time.Now()
+
+    if update.Addr == reg.self {
+        // Refute rumours of our death
+        me := reg.nodes[reg.self]
+        if me.State == nodeAlive && update.State != nodeAlive && update.Incarnation >= me.Incarnation {
+            if update.Incarnation > reg.version {
+                reg.version = update.Incarnation
+            }
+            me.Incarnation = reg.nextVersion()
+            reg.enqueue(nodeUpdateKey(reg.self))
+            log.Warn("Pigeon: Gossip node ", reg.self, " refuting ", update.State)
+        }
+        return
+    }
+
+    node := reg.nodes[update.Addr]
+    if node == nil {
+        if update.State == nodeDead || update.State == nodeLeft {
+            // Don't resurrect nodes we have already forgotten
+            return
+        }
+        reg.nodes[update.Addr] = &gossipNode{
+            Addr: update.Addr,
+            Incarnation: update.Incarnation,
+            State: update.State,
+            stateSince: now,
+            lastSeen: now,
+        }
+        delete(reg.synced, update.Addr)
+        reg.enqueue(nodeUpdateKey(update.Addr))
+        log.Info("Pigeon: Gossip node ", update.Addr, " joined (", update.State, ")")
+        return
+    }
+
+    if update.Incarnation < node.Incarnation || (update.Incarnation == node.Incarnation && update.State <= node.State) {
+        return
+    }
+    if update.State != node.State {
+        node.stateSince = now
+        delete(reg.synced, update.Addr)
+        log.Info("Pigeon: Gossip node ", update.Addr, " is ", update.State)
+    }
+    node.Incarnation = update.Incarnation
+    node.State = update.State
+    reg.enqueue(nodeUpdateKey(update.Addr))
+}
+
+// Apply a server record from another node.  Caller must hold reg.mu.
+func (reg *gossipRegistry) mergeServer(update gossipServer) {
+    current := reg.servers[update.Hostname]
+    if current != nil && update.Version <= current.Version {
+        return
+    }
+    if current == nil {
+        node := reg.nodes[update.Node]
+        if node == nil || node.State == nodeDead || node.State == nodeLeft {
+            // Belongs to a node we have forgotten
+            return
+        }
+    }
+    reg.putServer(&update)
+}
+
+func (reg *gossipRegistry) merge(msg *gossipMsg) {
+    // Nodes first, so their servers are accepted
+    for _, node := range msg.Nodes {
+        reg.mergeNode(node)
+    }
+    for _, server := range msg.Servers {
+        reg.mergeServer(server)
+    }
+    reg.checkLeader(time.Now())
+}
+
+// Count a part of sync <msg>, and report whether every part has arrived.
+// Caller must hold reg.mu.
+func (reg *gossipRegistry) syncReceived(msg *gossipMsg) bool {
+    if msg.Parts > 1 {
+        progress, ok := reg.syncing[msg.From]
+        if !ok || progress.seq != msg.Seq {
+            progress = gossipSyncProgress{msg.Seq, map[int]bool{}}
+            reg.syncing[msg.From] = progress
+        }
+        progress.parts[msg.Part] = true
+        if len(progress.parts) < msg.Parts {
+            return false
+        }
+    }
+    delete(reg.syncing, msg.From)
+    reg.synced[msg.From] = true
+    return true
+}
+
+// Build messages carrying our full state.
+func (reg *gossipRegistry) syncMsgs(msgType string) []*gossipMsg {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    return reg.syncMsgsLocked(msgType)
+}
+
+// Nodes go before servers, so each part's servers can be accepted by
+// receivers that get the parts in order.  Caller must hold reg.mu.
+func (reg *gossipRegistry) syncMsgsLocked(msgType string) []*gossipMsg {
+    reg.seq++
+    msgs := []*gossipMsg{}
+    var msg *gossipMsg
+    size := 0
+    // Make room for an item of <n> bytes, starting a new part if needed
+    fit := func(n int) {
+        if msg == nil || size + n > MAX_GOSSIP_PACKET - gossipMsgOverhead {
+            msg = &gossipMsg{
+                Type: msgType,
+                From: reg.self,
+                Seq: reg.seq,
+            }
+            msgs = append(msgs, msg)
+            size = 0
+        }
+        size += n
+    }
+
+    fit(0)
+    for _, node := range reg.nodes {
+        fit(gossipSize(node))
+        msg.Nodes = append(msg.Nodes, *node)
+    }
+    for _, server := range reg.servers {
+        fit(gossipSize(server))
+        msg.Servers = append(msg.Servers, *server)
+    }
+    for i, part := range msgs {
+        part.Part = i
+        part.Parts = len(msgs)
+    }
+    return msgs
+}
+
+// Encoded size of <item> in a gossip message, with its separator.
+func gossipSize(item interface{}) int {
+    data, err := json.Marshal(item)
+    if err != nil {
+        return 0
+    }
+    return len(data) + 1
+}
+
+// Build a message with the least-sent updates piggybacked, always including
+// our own node.  Caller must hold reg.mu.
+func (reg *gossipRegistry) newMsgLocked(msgType string, seq uint64, target string) *gossipMsg {
+    msg := &gossipMsg{
+        Type: msgType,
+        From: reg.self,
+        Seq: seq,
+        Target: target,
+        Nodes: []gossipNode{*reg.nodes[reg.self]},
+    }
+    size := gossipSize(msg)
+
+    keys := make([]string, 0, len(reg.updates))
+    for key := range reg.updates {
+        keys = append(keys, key)
+    }
+    sort.Slice(keys, func(i, j int) bool {
+        return reg.updates[keys[i]] < reg.updates[keys[j]]
+    })
+
+    limit := GOSSIP_RETRANSMIT_MULT * int(math.Ceil(math.Log10(float64(len(reg.nodes) + 1))))
+    for i, key := range keys {
+        if i >= MAX_GOSSIP_PIGGYBACK {
+            break
+        }
+
+        var node *gossipNode
+        var server *gossipServer
+        if strings.HasPrefix(key, nodeUpdateKey("")) {
+            addr := strings.TrimPrefix(key, nodeUpdateKey(""))
+            if addr != reg.self {
+                node = reg.nodes[addr]
+            }
+        } else {
+            server = reg.servers[strings.TrimPrefix(key, serverUpdateKey(""))]
+        }
+        switch {
+        case node != nil:
+            size += gossipSize(node)
+        case server != nil:
+            size += gossipSize(server)
+        }
+        if size > MAX_GOSSIP_PACKET - gossipMsgOverhead {
+            // Leave the rest for the next message
+            break
+        }
+
+        reg.updates[key]++
+        if reg.updates[key] >= limit {
+            delete(reg.updates, key)
+        }
+        switch {
+        case node != nil:
+            msg.Nodes = append(msg.Nodes, *node)
+        case server != nil:
+            msg.Servers = append(msg.Servers, *server)
+        }
+    }
+    return msg
+}
+
+func (reg *gossipRegistry) newMsg(msgType string, seq uint64, target string) *gossipMsg {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    return reg.newMsgLocked(msgType, seq, target)
+}
+
+//
+// Network
+//
+
+func (reg *gossipRegistry) sendAll(addr string, msgs []*gossipMsg) {
+    for _, msg := range msgs {
+        reg.send(addr, msg)
+    }
+}
+
+func (reg *gossipRegistry) send(addr string, msg *gossipMsg) {
+    data, err := json.Marshal(msg)
+    if err != nil {
+        log.Error("Pigeon: Cannot encode gossip: ", err)
+        return
+    }
+    if reg.cfg.ClusterKey != nil {
+        data = append(data, frameMAC(reg.cfg.ClusterKey, data)...)
+    }
+    if len(data) > MAX_GOSSIP_PACKET + wireMACLen {
+        // Only a single server with an enormous record gets here
+        log.Error("Pigeon: Gossip ", msg.Type, " to ", addr, " is too large (", len(data), " bytes)")
+        return
+    }
+
+    udpAddr, err := net.ResolveUDPAddr("udp", addr)
+    if err != nil {
+        log.Warn("Pigeon: Cannot resolve gossip node ", addr, ": ", err)
+        return
+    }
+    _, err = reg.conn.WriteToUDP(data, udpAddr)
+    if err != nil {
+        log.Warn("Pigeon: Gossip to ", addr, " failed: ", err)
+    }
+}
+
+func (reg *gossipRegistry) receive() {
+    buf := make([]byte, MAX_GOSSIP_PACKET + wireMACLen)
+    for {
+        n, from, err := reg.conn.ReadFromUDP(buf)
+        if err != nil {
+            select {
+            case <-reg.stop:
+                return
+            default:
+            }
+            log.Error("Pigeon: Gossip receive failed on ", reg.self, ": ", err)
+            continue
+        }
+
+        data := buf[:n]
+        if reg.cfg.ClusterKey != nil {
+            if len(data) < wireMACLen || !hmac.Equal(data[len(data) - wireMACLen:], frameMAC(reg.cfg.ClusterKey, data[:len(data) - wireMACLen])) {
+                log.Warn("Pigeon: Dropping unsigned or mis-signed gossip from ", from)
+                continue
+            }
+            data = data[:len(data) - wireMACLen]
+        }
+
+        msg := &gossipMsg{}
+        err = json.Unmarshal(data, msg)
+        if err != nil {
+            log.Warn("Pigeon: Dropping bad gossip from ", from, ": ", err)
+            continue
+        }
+        reg.handle(msg)
+    }
+}
+
+func (reg *gossipRegistry) handle(msg *gossipMsg) {
+    reg.mu.Lock()
+    reg.merge(msg)
+    now := time.Now()
+    sender := reg.nodes[msg.From]
+    if sender != nil {
+        sender.lastSeen = now
+    }
+
+    switch msg.Type {
+    case gossipPing:
+        reply := reg.newMsgLocked(gossipAck, msg.Seq, reg.self)
+        reg.mu.Unlock()
+        reg.send(msg.From, reply)
+
+    case gossipPingReq:
+        reg.seq++
+        reg.relays[reg.seq] = gossipRelay{
+            requester: msg.From,
+            seq: msg.Seq,
+            expires: now.Add(reg.cfg.ProbeInterval),
+        }
+        ping := reg.newMsgLocked(gossipPing, reg.seq, msg.Target)
+        reg.mu.Unlock()
+        reg.send(msg.Target, ping)
+
+    case gossipAck:
+        target := reg.nodes[msg.Target]
+        if target != nil {
+            target.lastSeen = now
+        }
+        ack, ok := reg.acks[msg.Seq]
+        if ok {
+            close(ack)
+            delete(reg.acks, msg.Seq)
+        }
+        relay, ok := reg.relays[msg.Seq]
+        if !ok {
+            reg.mu.Unlock()
+            return
+        }
+        delete(reg.relays, msg.Seq)
+        forward := reg.newMsgLocked(gossipAck, relay.seq, msg.Target)
+        reg.mu.Unlock()
+        reg.send(relay.requester, forward)
+
+    case gossipSync:
+        if !reg.syncReceived(msg) {
+            reg.mu.Unlock()
+            return
+        }
+        replies := reg.syncMsgsLocked(gossipSyncReply)
+        reg.mu.Unlock()
+        reg.sendAll(msg.From, replies)
+
+    case gossipSyncReply:
+        reg.syncReceived(msg)
+        reg.mu.Unlock()
+
+    default:
+        reg.mu.Unlock()
+    }
+}
+
+//
+// Failure detection
+//
+
+func (reg *gossipRegistry) run() {
+    ticker := time.NewTicker(reg.cfg.ProbeInterval)
+    defer ticker.Stop()
+    lastPushPull := time.Now()
+
+    for {
+        select {
+        case <-reg.stop:
+            return
+        case <-ticker.C:
+        }
+
+        reg.probe()
+        reg.expire()
+        if time.Since(lastPushPull) >= reg.cfg.PushPullInterval {
+            reg.pushPull()
+            lastPushPull = time.Now()
+        }
+    }
+}
+
+// Probe the next member, and suspect it if neither it nor anyone probing on
+// our behalf gets an ack.
+func (reg *gossipRegistry) probe() {
+    reg.mu.Lock()
+    target := reg.nextProbeTarget()
+    if target == "" {
+        reg.mu.Unlock()
+        return
+    }
+    reg.seq++
+    seq := reg.seq
+    ack := make(chan struct{})
+    reg.acks[seq] = ack
+    ping := reg.newMsgLocked(gossipPing, seq, target)
+    reg.mu.Unlock()
+
+    defer func() {
+        reg.mu.Lock()
+        delete(reg.acks, seq)
+        reg.mu.Unlock()
+    }()
+
+    reg.send(target, ping)
+    select {
+    case <-ack:
+        return
+    case <-reg.stop:
+        return
+    case <-time.After(reg.cfg.ProbeTimeout):
+    }
+
+    // Ask others to try
+    reg.mu.Lock()
+    helpers := reg.liveNodes(target)
+    rand.Shuffle(len(helpers), func(i, j int) {
+        helpers[i], helpers[j] = helpers[j], helpers[i]
+    })
+    if len(helpers) > reg.cfg.IndirectChecks {
+        helpers = helpers[:reg.cfg.IndirectChecks]
+    }
+    msgs := make([]*gossipMsg, len(helpers))
+    for i := range helpers {
+        msgs[i] = reg.newMsgLocked(gossipPingReq, seq, target)
+    }
+    reg.mu.Unlock()
+    for i, helper := range helpers {
+        reg.send(helper, msgs[i])
+    }
+
+    select {
+    case <-ack:
+        return
+    case <-reg.stop:
+        return
+    case <-time.After(reg.cfg.ProbeInterval - reg.cfg.ProbeTimeout):
+    }
+
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    node := reg.nodes[target]
+    if node != nil && node.State == nodeAlive {
+        node.State = nodeSuspect
+        node.stateSince = time.Now()
+        reg.enqueue(nodeUpdateKey(target))
+        reg.checkLeader(node.stateSince)
+        log.Warn("Pigeon: Gossip node ", target, " is suspect")
+    }
+}
+
+// Get the next member to probe, starting a new shuffled round when the last
+// one is done.  Caller must hold reg.mu.
+func (reg *gossipRegistry) nextProbeTarget() string {
+    for {
+        if len(reg.probeOrder) == 0 {
+            reg.probeOrder = reg.liveNodes("")
+            if len(reg.probeOrder) == 0 {
+                return ""
+            }
+            rand.Shuffle(len(reg.probeOrder), func(i, j int) {
+                reg.probeOrder[i], reg.probeOrder[j] = reg.probeOrder[j], reg.probeOrder[i]
+            })
+        }
+        target := reg.probeOrder[0]
+        reg.probeOrder = reg.probeOrder[1:]
+        node := reg.nodes[target]
+        if node != nil && (node.State == nodeAlive || node.State == nodeSuspect) {
+            return target
+        }
+    }
+}
+
+// Declare suspects that did not refute in time dead, forget long dead nodes,
+// and drop stale relays.
+func (reg *gossipRegistry) expire() {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    now := time.Now()
+
+    for addr, node := range reg.nodes {
+        switch {
+        case node.State == nodeSuspect && now.Sub(node.stateSince) >= reg.cfg.SuspicionTimeout:
+            node.State = nodeDead
+            node.stateSince = now
+            reg.enqueue(nodeUpdateKey(addr))
+            log.Warn("Pigeon: Gossip node ", addr, " is dead")
+
+        case (node.State == nodeDead || node.State == nodeLeft) && now.Sub(node.stateSince) >= reg.cfg.DeadRetention:
+            delete(reg.nodes, addr)
+            delete(reg.updates, nodeUpdateKey(addr))
+            delete(reg.synced, addr)
+            delete(reg.syncing, addr)
+            for hostname, server := range reg.servers {
+                if server.Node == addr {
+                    reg.dropServer(hostname)
+                }
+            }
+        }
+    }
+
+    for seq, relay := range reg.relays {
+        if now.After(relay.expires) {
+            delete(reg.relays, seq)
+        }
+    }
+    reg.checkLeader(now)
+}
+
+// Exchange full state with a random member, or with a seed if we know of
+// none.
+func (reg *gossipRegistry) pushPull() {
+    reg.mu.Lock()
+    peers := reg.liveNodes("")
+    if len(peers) == 0 {
+        for _, seed := range reg.cfg.Seeds {
+            if seed != reg.self {
+                peers = append(peers, seed)
+            }
+        }
+    }
+    if len(peers) == 0 {
+        reg.mu.Unlock()
+        return
+    }
+    peer := peers[rand.Intn(len(peers))]
+    msgs := reg.syncMsgsLocked(gossipSync)
+    reg.mu.Unlock()
+
+    reg.sendAll(peer, msgs)
+}
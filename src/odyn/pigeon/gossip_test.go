@@ -0,0 +1,368 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "fmt"
+    "net"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func freeGossipAddr(t *testing.T) string {
+    conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    return conn.LocalAddr().String()
+}
+
+func fastGossipConfig() GossipConfig {
+    return GossipConfig{
+        ProbeInterval: 50 * time.Millisecond,
+        SuspicionTimeout: 300 * time.Millisecond,
+        PushPullInterval: 200 * time.Millisecond,
+    }
+}
+
+// Start <n> gossip nodes on loopback, each seeded with every address.
+func newGossipCluster(t *testing.T, n int, cfg GossipConfig) []*gossipRegistry {
+    cfg.Seeds = []string{}
+    for i := 0; i < n; i++ {
+        cfg.Seeds = append(cfg.Seeds, freeGossipAddr(t))
+    }
+    nodes := []*gossipRegistry{}
+    for _, addr := range cfg.Seeds {
+        cfg.BindAddr = addr
+        reg, err := NewGossipRegistry(cfg)
+        if err != nil {
+            t.Fatal(err)
+        }
+        t.Cleanup(func() { reg.Leave() })
+        nodes = append(nodes, reg.(*gossipRegistry))
+    }
+    return nodes
+}
+
+// Stop <reg> without telling anyone, as if its process died.
+func crashGossipNode(reg *gossipRegistry) {
+    reg.mu.Lock()
+    reg.left = true
+    reg.mu.Unlock()
+    close(reg.stop)
+    reg.conn.Close()
+}
+
+// Wait for <cond> to hold, failing with <what> if it doesn't within 5
+// seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for !cond() {
+        if time.Now().After(deadline) {
+            t.Fatal("Timed out waiting for ", what)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+func memberState(reg *gossipRegistry, addr string) string {
+    for _, member := range reg.Members() {
+        if member.Addr == addr {
+            return member.State
+        }
+    }
+    return ""
+}
+
+func workerStatus(t *testing.T, reg Registry, hostname string) StatusEnum {
+    info, err := reg.GetWorker(hostname)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return info.Status
+}
+
+func TestGossipJoin(t *testing.T) {
+    nodes := newGossipCluster(t, 3, fastGossipConfig())
+    for _, reg := range nodes {
+        eventually(t, reg.self + " to see every node alive", func() bool {
+            for _, other := range nodes {
+                if memberState(reg, other.self) != "alive" {
+                    return false
+                }
+            }
+            return true
+        })
+    }
+}
+
+func TestGossipDeadNode(t *testing.T) {
+    nodes := newGossipCluster(t, 3, fastGossipConfig())
+    a, b, c := nodes[0], nodes[1], nodes[2]
+    err := c.RegisterWorker("host-c")
+    if err != nil {
+        t.Fatal(err)
+    }
+    eventually(t, "host-c to reach every node", func() bool {
+        return workerStatus(t, a, "host-c") == RUNNING && workerStatus(t, b, "host-c") == RUNNING
+    })
+
+    crashGossipNode(c)
+    eventually(t, "c to be suspected", func() bool {
+        return memberState(a, c.self) == "suspect" || memberState(b, c.self) == "suspect"
+    })
+    for _, reg := range []*gossipRegistry{a, b} {
+        eventually(t, reg.self + " to declare c dead", func() bool {
+            return memberState(reg, c.self) == "dead"
+        })
+        if status := workerStatus(t, reg, "host-c"); status != UNRESPONSIVE {
+            t.Errorf("%s reports host-c as %v, expected UNRESPONSIVE", reg.self, status)
+        }
+        marked, err := reg.MarkUnresponsive(time.Now())
+        if err != nil || !reflect.DeepEqual(marked, []string{"host-c"}) {
+            t.Errorf("%s marked %v (%v), expected [host-c]", reg.self, marked, err)
+        }
+        marked, _ = reg.MarkUnresponsive(time.Now())
+        if len(marked) != 0 {
+            t.Errorf("%s marked %v again", reg.self, marked)
+        }
+    }
+}
+
+func TestGossipRefutesSuspicion(t *testing.T) {
+    cfg := fastGossipConfig()
+    cfg.SuspicionTimeout = time.Minute
+    nodes := newGossipCluster(t, 3, cfg)
+    a, b := nodes[0], nodes[1]
+    eventually(t, "b to see a", func() bool {
+        return memberState(b, a.self) == "alive"
+    })
+
+    // b wrongly suspects a, and gossips it
+    b.mu.Lock()
+    suspected := b.nodes[a.self].Incarnation
+    b.nodes[a.self].State = nodeSuspect
+    b.nodes[a.self].stateSince = time.Now()
+    b.enqueue(nodeUpdateKey(a.self))
+    b.mu.Unlock()
+
+    eventually(t, "a to refute the suspicion", func() bool {
+        for _, member := range b.Members() {
+            if member.Addr == a.self {
+                return member.State == "alive" && member.Incarnation > suspected
+            }
+        }
+        return false
+    })
+    if state := memberState(a, a.self); state != "alive" {
+        t.Errorf("a thinks it is %s", state)
+    }
+}
+
+func TestGossipLeave(t *testing.T) {
+    nodes := newGossipCluster(t, 3, fastGossipConfig())
+    a, b, c := nodes[0], nodes[1], nodes[2]
+    c.RegisterWorker("host-c")
+    eventually(t, "host-c to reach every node", func() bool {
+        return workerStatus(t, a, "host-c") == RUNNING && workerStatus(t, b, "host-c") == RUNNING
+    })
+
+    err := c.Leave()
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, reg := range []*gossipRegistry{a, b} {
+        eventually(t, reg.self + " to see c leave", func() bool {
+            return memberState(reg, c.self) == "left" && workerStatus(t, reg, "host-c") == STOPPED
+        })
+        marked, _ := reg.MarkUnresponsive(time.Now())
+        if len(marked) != 0 {
+            t.Errorf("%s marked %v after a clean leave", reg.self, marked)
+        }
+    }
+}
+
+func TestGossipListenersConverge(t *testing.T) {
+    nodes := newGossipCluster(t, 3, fastGossipConfig())
+    hostnames := []string{}
+    for i, reg := range nodes {
+        hostname := fmt.Sprintf("host-%d", i)
+        hostnames = append(hostnames, hostname)
+        reg.RegisterWorker(hostname)
+        err := reg.RegisterListener(hostname, fmt.Sprintf("device.%d.status", i))
+        if err != nil {
+            t.Fatal(err)
+        }
+        reg.RegisterListener(hostname, "device.*.status")
+    }
+    err := nodes[0].RegisterListener("host-1", "device.>")
+    if err == nil {
+        t.Error("Registered a listener for a server owned by another node")
+    }
+
+    for _, reg := range nodes {
+        eventually(t, reg.self + " to learn every listener", func() bool {
+            hosts, err := reg.GetListeners("device.1.status")
+            return err == nil && reflect.DeepEqual(hosts, hostnames)
+        })
+        hosts, _ := reg.GetListeners("device.2.status.extra")
+        if len(hosts) != 0 {
+            t.Errorf("%s matched %v for device.2.status.extra", reg.self, hosts)
+        }
+    }
+
+    nodes[1].UnregisterListener("host-1", "device.*.status")
+    for _, reg := range nodes {
+        eventually(t, reg.self + " to drop host-1", func() bool {
+            hosts, _ := reg.GetListeners("device.0.status")
+            return reflect.DeepEqual(hosts, []string{"host-0", "host-2"})
+        })
+    }
+}
+
+func TestGossipLargeSync(t *testing.T) {
+    cfg := fastGossipConfig()
+    first := newGossipCluster(t, 1, cfg)[0]
+
+    // Far more state than fits in one datagram
+    const servers = 300
+    for i := 0; i < servers; i++ {
+        hostname := fmt.Sprintf("host-%03d", i)
+        first.RegisterWorker(hostname)
+        for j := 0; j < 10; j++ {
+            first.RegisterListener(hostname, fmt.Sprintf("device.%s.sensor%02d", hostname, j))
+        }
+    }
+    msgs := first.syncMsgs(gossipSync)
+    if len(msgs) < 2 {
+        t.Fatalf("Full state fits in %d message", len(msgs))
+    }
+
+    cfg.BindAddr = freeGossipAddr(t)
+    cfg.Seeds = []string{first.self}
+    reg, err := NewGossipRegistry(cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer reg.Leave()
+    eventually(t, "every server to be synced", func() bool {
+        hosts, _ := reg.GetListeners("device.host-299.sensor09")
+        info, _ := reg.GetWorker("host-000")
+        return len(hosts) == 1 && info.Status == RUNNING
+    })
+}
+
+func TestGossipLease(t *testing.T) {
+    nodes := newGossipCluster(t, 3, fastGossipConfig())
+    const ttl = 200 * time.Millisecond
+
+    granted := func() []*gossipRegistry {
+        holders := []*gossipRegistry{}
+        for _, reg := range nodes {
+            ok, err := reg.AcquireLease("test", reg.self, ttl)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if ok {
+                holders = append(holders, reg)
+            }
+        }
+        return holders
+    }
+    var leader *gossipRegistry
+    eventually(t, "a lease to be granted", func() bool {
+        holders := granted()
+        if len(holders) > 1 {
+            t.Fatalf("%d nodes granted the lease", len(holders))
+        }
+        if len(holders) == 1 {
+            leader = holders[0]
+        }
+        return leader != nil
+    })
+    for _, reg := range nodes {
+        if reg.self < leader.self {
+            t.Errorf("%s granted the lease, but %s is lower", leader.self, reg.self)
+        }
+    }
+
+    ok, _ := leader.AcquireLease("test", "other", ttl)
+    if ok {
+        t.Error("Lease granted to a second holder")
+    }
+    ok, _ = leader.AcquireLease("test", leader.self, ttl)
+    if !ok {
+        t.Error("Lease not renewed")
+    }
+
+    // Once the leader dies, the next lowest node takes over, but only after
+    // the old leases could have expired
+    crashGossipNode(leader)
+    var next *gossipRegistry
+    for _, reg := range nodes {
+        if reg != leader && (next == nil || reg.self < next.self) {
+            next = reg
+        }
+    }
+    eventually(t, "the next leader to see the old one dead", func() bool {
+        return memberState(next, leader.self) == "dead"
+    })
+    eventually(t, "the next leader to grant the lease", func() bool {
+        ok, _ := next.AcquireLease("test", "other", ttl)
+        return ok
+    })
+    next.mu.Lock()
+    since := next.leaderSince
+    next.mu.Unlock()
+    if time.Since(since) < ttl {
+        t.Errorf("Lease granted %s after becoming the leader", time.Since(since))
+    }
+}
+
+func TestGossipLeaseWaitsForSync(t *testing.T) {
+    cfg := fastGossipConfig()
+    cfg.PushPullInterval = time.Hour
+    cfg.SuspicionTimeout = time.Minute
+    reg := newGossipCluster(t, 1, cfg)[0]
+
+    // A member we have not exchanged state with may know of a lower node
+    reg.mu.Lock()
+    reg.mergeNode(gossipNode{Addr: "127.0.0.1:1", Incarnation: 1, State: nodeAlive})
+    reg.mu.Unlock()
+
+    ok, _ := reg.AcquireLease("test", "holder", 0)
+    if ok {
+        t.Error("Lease granted by a node that is not the lowest")
+    }
+    reg.mu.Lock()
+    delete(reg.nodes, "127.0.0.1:1")
+    reg.mergeNode(gossipNode{Addr: "127.0.0.2:65535", Incarnation: 1, State: nodeAlive})
+    reg.mu.Unlock()
+    ok, _ = reg.AcquireLease("test", "holder", 0)
+    if ok {
+        t.Error("Lease granted before syncing with every member")
+    }
+
+    reg.mu.Lock()
+    reg.synced["127.0.0.2:65535"] = true
+    reg.mu.Unlock()
+    ok, _ = reg.AcquireLease("test", "holder", 0)
+    if !ok {
+        t.Error("Lease refused after syncing with every member")
+    }
+}
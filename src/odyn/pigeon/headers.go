@@ -0,0 +1,145 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "context"
+    "strconv"
+    "time"
+)
+
+// Headers Pigeon fills in on every request.  Handlers read them with
+// Request.Header.
+const (
+    // Name of the sending System (SystemConfig.Name).
+    HEADER_SENDER = "Sender"
+
+    // ID shared by a request and every request made while handling it.
+    // Taken from the context passed to the Outbox (see WithCorrelationID),
+    // or generated if there is none.
+    HEADER_CORRELATION_ID = "Correlation-Id"
+
+    // When the sender will stop waiting, in RFC 3339 format.  Absent if the
+    // sender has no deadline.
+    HEADER_DEADLINE = "Deadline"
+
+    // Delivery attempt of a Queue job, starting at 1.  Absent for requests
+    // not sent through a Queue.
+    HEADER_ATTEMPT = "Attempt"
+)
+
+// Headers senders set with WithHeader.
+const (
+    // How urgent the request is: "low", "normal" (the default) or "high".
+    // Servers start waiting requests in priority order; see WithPriority.
+    HEADER_PRIORITY = "Priority"
+
+    // Msg key the handler should send its results to, for requests whose
+    // sender does not wait for a response.
+    HEADER_REPLY_TO = "Reply-To"
+
+    // Identifies a request across retries.  Servers send the response to
+    // the first request with a key to later requests with the same key and
+    // msg key, without calling the handler; see WithIdempotencyKey.
+    // Requests from a Queue use their job ID.
+    HEADER_IDEMPOTENCY_KEY = "Idempotency-Key"
+)
+
+// Headers Pigeon sets on responses, besides HEADER_CORRELATION_ID.  Senders
+// read them with Response.Header.
+const (
+    // "true" if the response was saved from an earlier request with the
+    // same HEADER_IDEMPOTENCY_KEY, so the handler did not run.
+    HEADER_REPLAYED = "Replayed"
+)
+
+type headersKey struct{}
+
+// Get a context that adds header <name> to requests launched with it.
+// Headers that Pigeon fills in itself (except HEADER_CORRELATION_ID) are
+// overwritten.
+func WithHeader(ctx context.Context, name, value string) context.Context {
+    headers := map[string]string{}
+    for n, v := range HeadersFrom(ctx) {
+        headers[n] = v
+    }
+    headers[name] = value
+    return context.WithValue(ctx, headersKey{}, headers)
+}
+
+// Get a context that makes requests launched with it share correlation ID
+// <id>.  Handlers' Request.Context() already carries the correlation ID of
+// the request being handled, so requests they launch with it are
+// correlated automatically.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+    return WithHeader(ctx, HEADER_CORRELATION_ID, id)
+}
+
+// Get a context that gives requests launched with it idempotency key <key>,
+// so that retries of them are handled at most once.  Keys should be unique
+// to each operation, such as "unlock/<device>/<command ID>", since a request
+// with a reused key gets the old response for up to DedupConfig.Window.
+// Only successful responses are remembered, so a request whose handler
+// failed is handled again when retried.
+//
+// Servers handle requests with the same key one at a time, but servers that
+// do not share a DedupConfig.Conn do not know about each other's requests.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+    return WithHeader(ctx, HEADER_IDEMPOTENCY_KEY, key)
+}
+
+// Get the headers added to <ctx> with WithHeader.  Must not be modified.
+func HeadersFrom(ctx context.Context) map[string]string {
+    headers, _ := ctx.Value(headersKey{}).(map[string]string)
+    return headers
+}
+
+// Get the correlation ID carried by <ctx>, or "".
+func CorrelationIDFrom(ctx context.Context) string {
+    return HeadersFrom(ctx)[HEADER_CORRELATION_ID]
+}
+
+// Build the headers for <req>, sent with context <ctx>: the caller's headers
+// from <ctx>, then Pigeon's own.
+func (outbox *PigeonOutbox) requestHeaders(ctx context.Context, req *PigeonRequest) map[string]string {
+    headers := map[string]string{}
+    for name, value := range HeadersFrom(ctx) {
+        headers[name] = value
+    }
+    if headers[HEADER_CORRELATION_ID] == "" {
+        headers[HEADER_CORRELATION_ID], _ = randomID()
+    }
+    headers[HEADER_SENDER] = outbox.sys.cfg.Name
+    if headers[HEADER_PRIORITY] == "" && outbox.priority != PRIORITY_NORMAL {
+        headers[HEADER_PRIORITY] = outbox.priority.String()
+    }
+
+    delete(headers, HEADER_DEADLINE)
+    deadline, hasDeadline := ctx.Deadline()
+    if hasDeadline {
+        headers[HEADER_DEADLINE] = deadline.UTC().Format(time.RFC3339Nano)
+    }
+
+    delete(headers, HEADER_ATTEMPT)
+    if req.ReqAttempt > 0 {
+        headers[HEADER_ATTEMPT] = strconv.Itoa(req.ReqAttempt)
+    }
+
+    // Redelivered jobs are the same request
+    if headers[HEADER_IDEMPOTENCY_KEY] == "" && req.ReqJobID != "" {
+        headers[HEADER_IDEMPOTENCY_KEY] = req.ReqJobID
+    }
+    return headers
+}
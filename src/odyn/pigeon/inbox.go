@@ -15,22 +15,140 @@
 package jobqueue
 
 import (
+    "context"
+    "errors"
     "fmt"
+    "sync"
+    "time"
 )
 
+type inboxState int
+const (
+    inboxActive inboxState = iota
+    inboxSuspended
+    inboxClosed
+)
+
+var errInboxClosed = errors.New("Inbox closed")
+
 type PigeonInbox struct {
     server *PigeonServer
     msgKey string
+
+    // Protects the fields below
+    mu sync.Mutex
     handler Handler
     userCtx interface{}
+    state inboxState
+
+    // Number of handler calls in progress, and a channel closed when that
+    // drops to zero while someone is waiting in drain().
+    inflight int
+    drained chan struct{}
+
+    // Semaphore limiting handler calls running at once, or nil for no
+    // limit.  This is the inbox's worker pool.
+    slots chan struct{}
 }
 
 type funcHandler struct {
     fn HandlerFunc
 }
 
+// Admit a message.  Returns the handler and user context to call, and a
+// function to call once the handler returns.  The function is nil if the
+// inbox is not active or has no handler, or if it is at its concurrency limit
+// and <wait> is false.  If <wait> is true, waits for a free slot until <ctx>
+// is done, in which case <ctx>'s error is returned.
+func (inbox *PigeonInbox) beginHandling(ctx context.Context, wait bool) (Handler, interface{}, func(), error) {
+    inbox.mu.Lock()
+    if inbox.state != inboxActive || inbox.handler == nil {
+        inbox.mu.Unlock()
+        return nil, nil, nil, nil
+    }
+    slots := inbox.slots
+    inbox.mu.Unlock()
+
+    releaseSlot, err := acquireSlot(ctx, slots, wait)
+    if releaseSlot == nil {
+        return nil, nil, nil, err
+    }
+
+    // The inbox may have been suspended while we waited
+    inbox.mu.Lock()
+    defer inbox.mu.Unlock()
+    if inbox.state != inboxActive || inbox.handler == nil {
+        releaseSlot()
+        return nil, nil, nil, nil
+    }
+    inbox.inflight++
+    release := func() {
+        releaseSlot()
+        inbox.endHandling()
+    }
+    return inbox.handler, inbox.userCtx, release, nil
+}
+
+func (inbox *PigeonInbox) endHandling() {
+    inbox.mu.Lock()
+    defer inbox.mu.Unlock()
+    inbox.inflight--
+    if inbox.inflight == 0 && inbox.drained != nil {
+        close(inbox.drained)
+        inbox.drained = nil
+    }
+}
+
+// Number of handler calls in progress.
+func (inbox *PigeonInbox) load() int {
+    inbox.mu.Lock()
+    defer inbox.mu.Unlock()
+    return inbox.inflight
+}
+
+func (inbox *PigeonInbox) isActive() bool {
+    inbox.mu.Lock()
+    defer inbox.mu.Unlock()
+    return inbox.state == inboxActive
+}
+
+// Wait for handler calls in progress to finish, up to the system's drain
+// timeout.
+func (inbox *PigeonInbox) drain() error {
+    inbox.mu.Lock()
+    if inbox.inflight == 0 {
+        inbox.mu.Unlock()
+        return nil
+    }
+    if inbox.drained == nil {
+        inbox.drained = make(chan struct{})
+    }
+    drained := inbox.drained
+    inbox.mu.Unlock()
+
+    select {
+    case <-drained:
+        return nil
+    case <-time.After(inbox.server.sys.cfg.DrainTimeout):
+        return fmt.Errorf("Pigeon: Timed out waiting for %s handlers to finish on %s", inbox.msgKey, inbox.server.hostname)
+    }
+}
+
 func (inbox *PigeonInbox) Close() error {
-    return fmt.Errorf("Close not implemented")
+    inbox.mu.Lock()
+    if inbox.state == inboxClosed {
+        inbox.mu.Unlock()
+        return errInboxClosed
+    }
+    inbox.state = inboxClosed
+    inbox.mu.Unlock()
+
+    err := inbox.server.removeInbox(inbox)
+    if err != nil {
+        return err
+    }
+
+    return inbox.drain()
 }
 
 func (inbox *PigeonInbox) MsgKey() string {
@@ -38,7 +156,19 @@ func (inbox *PigeonInbox) MsgKey() string {
 }
 
 func (inbox *PigeonInbox) Resume() error {
-    return fmt.Errorf("Resume not implemented")
+    inbox.mu.Lock()
+    switch inbox.state {
+    case inboxClosed:
+        inbox.mu.Unlock()
+        return errInboxClosed
+    case inboxActive:
+        inbox.mu.Unlock()
+        return fmt.Errorf("Pigeon: Inbox %s is not suspended", inbox.msgKey)
+    }
+    inbox.state = inboxActive
+    inbox.mu.Unlock()
+
+    return inbox.server.updateListener(inbox.msgKey)
 }
 
 func (inbox *PigeonInbox) Server() Server {
@@ -46,20 +176,58 @@ func (inbox *PigeonInbox) Server() Server {
 }
 
 func (inbox *PigeonInbox) SetHandler(handler Handler) error {
+    inbox.mu.Lock()
+    defer inbox.mu.Unlock()
+    if inbox.state == inboxClosed {
+        return errInboxClosed
+    }
     inbox.handler = handler
     return nil
 }
 
 func (inbox *PigeonInbox) SetHandlerFunc(fn HandlerFunc) error {
-    inbox.handler = &funcHandler{fn}
-    return nil
+    return inbox.SetHandler(&funcHandler{fn})
 }
 
 func (inbox *PigeonInbox) Suspend() error {
-    return fmt.Errorf("Suspend not implemented")
+    inbox.mu.Lock()
+    switch inbox.state {
+    case inboxClosed:
+        inbox.mu.Unlock()
+        return errInboxClosed
+    case inboxSuspended:
+        inbox.mu.Unlock()
+        return fmt.Errorf("Pigeon: Inbox %s is already suspended", inbox.msgKey)
+    }
+    inbox.state = inboxSuspended
+    inbox.mu.Unlock()
+
+    err := inbox.server.updateListener(inbox.msgKey)
+    if err != nil {
+        return err
+    }
+
+    return inbox.drain()
+}
+
+func (inbox *PigeonInbox) SetMaxConcurrency(max int) error {
+    inbox.mu.Lock()
+    defer inbox.mu.Unlock()
+    if inbox.state == inboxClosed {
+        return errInboxClosed
+    }
+    if max <= 0 {
+        inbox.slots = nil
+        return nil
+    }
+    // Calls already running release their slot to the old semaphore
+    inbox.slots = make(chan struct{}, max)
+    return nil
 }
 
 func (inbox *PigeonInbox) SetUserCtx(userCtx interface{}) {
+    inbox.mu.Lock()
+    defer inbox.mu.Unlock()
     inbox.userCtx = userCtx
 }
 
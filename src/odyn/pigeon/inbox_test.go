@@ -0,0 +1,174 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "testing"
+    "time"
+)
+
+// Create an inbox for "work" whose handler blocks until <release> is closed.
+// Returns the inbox and a channel that receives once per handler call.
+func newBlockingInbox(t *testing.T, server Server, release chan struct{}) (Inbox, chan struct{}) {
+    started := make(chan struct{}, 10)
+    inbox := newTestInbox(t, server, "work", func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        started <- struct{}{}
+        <-release
+        resp.SetBody(map[string]interface{}{"ok": true})
+    })
+    return inbox, started
+}
+
+// Run <fn> in the background, checking that it is still waiting after a
+// moment.  Returns a channel with its result.
+func expectBlocked(t *testing.T, what string, fn func() error) chan error {
+    t.Helper()
+    result := make(chan error, 1)
+    go func() {
+        result <- fn()
+    }()
+    select {
+    case err := <-result:
+        t.Fatalf("%s returned %v before handlers finished", what, err)
+    case <-time.After(50 * time.Millisecond):
+    }
+    return result
+}
+
+func TestSuspendDrainsInFlight(t *testing.T) {
+    sys, server := newTestServer(t, "local")
+    release := make(chan struct{})
+    inbox, started := newBlockingInbox(t, server, release)
+
+    outbox := sys.NewOutbox()
+    respChan, err := outbox.Launch("work", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    <-started
+
+    suspended := expectBlocked(t, "Suspend", inbox.Suspend)
+    close(release)
+    if err := <-suspended; err != nil {
+        t.Fatal(err)
+    }
+    resp := waitResponse(t, respChan)
+    if resp.Err() != nil || resp.Body()["ok"] != true {
+        t.Errorf("In-flight request got %v (%v)", resp.Body(), resp.Err())
+    }
+
+    // Nothing is delivered while suspended
+    _, err = outbox.Launch("work", nil)
+    if err == nil {
+        t.Error("Launch reached a suspended inbox")
+    }
+    if inbox.Suspend() == nil {
+        t.Error("Suspended twice")
+    }
+
+    err = inbox.Resume()
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp = waitResponse(t, launchOrFail(t, outbox))
+    if resp.Err() != nil {
+        t.Errorf("Launch after Resume failed: %v", resp.Err())
+    }
+    if inbox.Resume() == nil {
+        t.Error("Resumed an active inbox")
+    }
+}
+
+func TestCloseDrainsInFlight(t *testing.T) {
+    sys, server := newTestServer(t, "local")
+    release := make(chan struct{})
+    inbox, started := newBlockingInbox(t, server, release)
+
+    outbox := sys.NewOutbox()
+    respChans := []<-chan Response{launchOrFail(t, outbox), launchOrFail(t, outbox)}
+    <-started
+    <-started
+
+    closed := expectBlocked(t, "Close", inbox.Close)
+    close(release)
+    if err := <-closed; err != nil {
+        t.Fatal(err)
+    }
+    for _, respChan := range respChans {
+        resp := waitResponse(t, respChan)
+        if resp.Err() != nil {
+            t.Errorf("In-flight request failed: %v", resp.Err())
+        }
+    }
+    _, err := outbox.Launch("work", nil)
+    if err == nil {
+        t.Error("Launch reached a closed inbox")
+    }
+}
+
+func TestDrainTimeout(t *testing.T) {
+    sys := NewPigeonSystem(SystemConfig{DrainTimeout: 50 * time.Millisecond})
+    defer sys.Close()
+    server, err := sys.StartServer("local")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer server.Stop()
+    release := make(chan struct{})
+    defer close(release)
+    inbox, started := newBlockingInbox(t, server, release)
+
+    launchOrFail(t, sys.NewOutbox())
+    <-started
+    err = inbox.Suspend()
+    if err == nil {
+        t.Error("Suspend returned before the handler finished")
+    }
+}
+
+func TestClosedInbox(t *testing.T) {
+    _, server := newTestServer(t, "local")
+    inbox := newTestInbox(t, server, "work", func(msgKey string, userCtx interface{}, req Request, resp Response) {})
+    err := inbox.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    calls := map[string]func() error{
+        "Close": inbox.Close,
+        "Suspend": inbox.Suspend,
+        "Resume": inbox.Resume,
+        "SetHandler": func() error {
+            return inbox.SetHandlerFunc(func(msgKey string, userCtx interface{}, req Request, resp Response) {})
+        },
+        "SetMaxConcurrency": func() error {
+            return inbox.SetMaxConcurrency(1)
+        },
+    }
+    for name, fn := range calls {
+        if err := fn(); err != errInboxClosed {
+            t.Errorf("%s on a closed inbox returned %v", name, err)
+        }
+    }
+}
+
+func launchOrFail(t *testing.T, outbox Outbox) <-chan Response {
+    t.Helper()
+    respChan, err := outbox.Launch("work", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return respChan
+}
@@ -0,0 +1,360 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+    "reflect"
+    "regexp"
+    "sort"
+    "unicode/utf8"
+)
+
+// A compiled JSON schema.  Pigeon supports the subset of JSON Schema that
+// describes message payloads:
+//
+//      type                    "object", "array", "string", "number",
+//                              "integer", "boolean" or "null", or a list
+//      properties, required    for objects
+//      additionalProperties    false, or a schema for the other properties
+//      items                   schema for every element of an array
+//      minItems, maxItems
+//      minLength, maxLength    in characters
+//      pattern                 regular expression (Go syntax)
+//      minimum, maximum
+//      enum                    list of allowed values
+//
+// Annotations ($schema, $id, title, description, default, examples) are
+// ignored.  Any other keyword is an error, so that a schema never appears to
+// check more than it does.
+type jsonSchema struct {
+    types []string
+
+    properties map[string]*jsonSchema
+    required []string
+    // Schema for properties not in <properties>.  nil allows anything.
+    additional *jsonSchema
+    noAdditional bool
+
+    items *jsonSchema
+    minItems, maxItems *int
+
+    minLength, maxLength *int
+    pattern *regexp.Regexp
+
+    minimum, maximum *float64
+
+    enum []interface{}
+}
+
+var jsonSchemaAnnotations = map[string]bool{
+    "$schema": true,
+    "$id": true,
+    "title": true,
+    "description": true,
+    "default": true,
+    "examples": true,
+}
+
+var jsonSchemaTypes = map[string]bool{
+    "object": true,
+    "array": true,
+    "string": true,
+    "number": true,
+    "integer": true,
+    "boolean": true,
+    "null": true,
+}
+
+// Parse and compile JSON schema <text>.
+func compileJSONSchema(text string) (*jsonSchema, error) {
+    var raw interface{}
+    err := json.Unmarshal([]byte(text), &raw)
+    if err != nil {
+        return nil, fmt.Errorf("Pigeon: Invalid JSON schema: %s", err.Error())
+    }
+    return compileJSONSchemaValue(raw, "")
+}
+
+func compileJSONSchemaValue(raw interface{}, path string) (*jsonSchema, error) {
+    obj, ok := raw.(map[string]interface{})
+    if !ok {
+        return nil, schemaError(path, "schema must be an object")
+    }
+
+    schema := &jsonSchema{}
+    for keyword, value := range obj {
+        var err error
+        switch keyword {
+        case "type":
+            schema.types, err = compileSchemaTypes(value, path)
+        case "properties":
+            props, ok := value.(map[string]interface{})
+            if !ok {
+                return nil, schemaError(path, "properties must be an object")
+            }
+            schema.properties = map[string]*jsonSchema{}
+            for name, propRaw := range props {
+                schema.properties[name], err = compileJSONSchemaValue(propRaw, joinPath(path, name))
+                if err != nil {
+                    return nil, err
+                }
+            }
+        case "required":
+            schema.required, err = schemaStrings(value, path, keyword)
+        case "additionalProperties":
+            allowed, isBool := value.(bool)
+            if isBool {
+                schema.noAdditional = !allowed
+            } else {
+                schema.additional, err = compileJSONSchemaValue(value, joinPath(path, "*"))
+            }
+        case "items":
+            schema.items, err = compileJSONSchemaValue(value, path + "[]")
+        case "minItems":
+            schema.minItems, err = schemaCount(value, path, keyword)
+        case "maxItems":
+            schema.maxItems, err = schemaCount(value, path, keyword)
+        case "minLength":
+            schema.minLength, err = schemaCount(value, path, keyword)
+        case "maxLength":
+            schema.maxLength, err = schemaCount(value, path, keyword)
+        case "pattern":
+            pattern, ok := value.(string)
+            if !ok {
+                return nil, schemaError(path, "pattern must be a string")
+            }
+            schema.pattern, err = regexp.Compile(pattern)
+        case "minimum":
+            schema.minimum, err = schemaNumber(value, path, keyword)
+        case "maximum":
+            schema.maximum, err = schemaNumber(value, path, keyword)
+        case "enum":
+            values, ok := value.([]interface{})
+            if !ok {
+                return nil, schemaError(path, "enum must be an array")
+            }
+            schema.enum = values
+        default:
+            if !jsonSchemaAnnotations[keyword] {
+                return nil, schemaError(path, fmt.Sprintf("unsupported keyword %q", keyword))
+            }
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+    return schema, nil
+}
+
+func compileSchemaTypes(value interface{}, path string) ([]string, error) {
+    name, ok := value.(string)
+    if ok {
+        value = []interface{}{name}
+    }
+    types, err := schemaStrings(value, path, "type")
+    if err != nil {
+        return nil, err
+    }
+    for _, t := range types {
+        if !jsonSchemaTypes[t] {
+            return nil, schemaError(path, fmt.Sprintf("unknown type %q", t))
+        }
+    }
+    return types, nil
+}
+
+func schemaStrings(value interface{}, path, keyword string) ([]string, error) {
+    list, ok := value.([]interface{})
+    if !ok {
+        return nil, schemaError(path, keyword + " must be an array of strings")
+    }
+    strs := make([]string, len(list))
+    for i, item := range list {
+        strs[i], ok = item.(string)
+        if !ok {
+            return nil, schemaError(path, keyword + " must be an array of strings")
+        }
+    }
+    return strs, nil
+}
+
+func schemaCount(value interface{}, path, keyword string) (*int, error) {
+    num, ok := value.(float64)
+    if !ok || num < 0 || num != math.Trunc(num) {
+        return nil, schemaError(path, keyword + " must be a non-negative integer")
+    }
+    count := int(num)
+    return &count, nil
+}
+
+func schemaNumber(value interface{}, path, keyword string) (*float64, error) {
+    num, ok := value.(float64)
+    if !ok {
+        return nil, schemaError(path, keyword + " must be a number")
+    }
+    return &num, nil
+}
+
+func schemaError(path, problem string) error {
+    return fmt.Errorf("Pigeon: Invalid JSON schema at %s: %s", displayPath(path), problem)
+}
+
+// Path of property <name> within <path>.
+func joinPath(path, name string) string {
+    if path == "" {
+        return name
+    }
+    return path + "." + name
+}
+
+func displayPath(path string) string {
+    if path == "" {
+        return "payload"
+    }
+    return path
+}
+
+// Get the JSON type of decoded JSON value <v>.  Whole numbers are
+// "integer", which "number" also matches.
+func jsonTypeOf(v interface{}) string {
+    switch v := v.(type) {
+    case nil:
+        return "null"
+    case bool:
+        return "boolean"
+    case float64:
+        if v == math.Trunc(v) {
+            return "integer"
+        }
+        return "number"
+    case string:
+        return "string"
+    case []interface{}:
+        return "array"
+    case map[string]interface{}:
+        return "object"
+    }
+    return fmt.Sprintf("%T", v)
+}
+
+func (schema *jsonSchema) allowsType(actual string) bool {
+    if len(schema.types) == 0 {
+        return true
+    }
+    for _, t := range schema.types {
+        if t == actual || (t == "number" && actual == "integer") {
+            return true
+        }
+    }
+    return false
+}
+
+// Check decoded JSON value <v>, found at <path>.  Returns a description of
+// each problem, prefixed with where it was found.
+func (schema *jsonSchema) validate(v interface{}, path string) []string {
+    problems := []string{}
+    fail := func(format string, args ...interface{}) {
+        problems = append(problems, displayPath(path) + ": " + fmt.Sprintf(format, args...))
+    }
+
+    actual := jsonTypeOf(v)
+    if !schema.allowsType(actual) {
+        fail("expected %s, got %s", joinTypes(schema.types), actual)
+        return problems
+    }
+
+    if schema.enum != nil {
+        found := false
+        for _, allowed := range schema.enum {
+            if reflect.DeepEqual(v, allowed) {
+                found = true
+                break
+            }
+        }
+        if !found {
+            fail("%v is not one of %v", v, schema.enum)
+        }
+    }
+
+    switch v := v.(type) {
+    case map[string]interface{}:
+        for _, name := range schema.required {
+            _, ok := v[name]
+            if !ok {
+                problems = append(problems, joinPath(path, name) + ": required")
+            }
+        }
+        names := make([]string, 0, len(v))
+        for name := range v {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        for _, name := range names {
+            prop := schema.properties[name]
+            switch {
+            case prop != nil:
+                problems = append(problems, prop.validate(v[name], joinPath(path, name))...)
+            case schema.noAdditional:
+                problems = append(problems, joinPath(path, name) + ": unexpected property")
+            case schema.additional != nil:
+                problems = append(problems, schema.additional.validate(v[name], joinPath(path, name))...)
+            }
+        }
+
+    case []interface{}:
+        if schema.minItems != nil && len(v) < *schema.minItems {
+            fail("has %d items, fewer than %d", len(v), *schema.minItems)
+        }
+        if schema.maxItems != nil && len(v) > *schema.maxItems {
+            fail("has %d items, more than %d", len(v), *schema.maxItems)
+        }
+        if schema.items != nil {
+            for i, item := range v {
+                problems = append(problems, schema.items.validate(item, fmt.Sprintf("%s[%d]", displayPath(path), i))...)
+            }
+        }
+
+    case string:
+        length := utf8.RuneCountInString(v)
+        if schema.minLength != nil && length < *schema.minLength {
+            fail("shorter than %d characters", *schema.minLength)
+        }
+        if schema.maxLength != nil && length > *schema.maxLength {
+            fail("longer than %d characters", *schema.maxLength)
+        }
+        if schema.pattern != nil && !schema.pattern.MatchString(v) {
+            fail("does not match %s", schema.pattern.String())
+        }
+
+    case float64:
+        if schema.minimum != nil && v < *schema.minimum {
+            fail("%v is less than %v", v, *schema.minimum)
+        }
+        if schema.maximum != nil && v > *schema.maximum {
+            fail("%v is greater than %v", v, *schema.maximum)
+        }
+    }
+    return problems
+}
+
+func joinTypes(types []string) string {
+    if len(types) == 1 {
+        return types[0]
+    }
+    return fmt.Sprintf("one of %v", types)
+}
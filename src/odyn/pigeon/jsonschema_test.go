@@ -0,0 +1,103 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "encoding/json"
+    "reflect"
+    "testing"
+)
+
+func TestJSONSchemaKeywords(t *testing.T) {
+    cases := []struct {
+        schema string
+        value string
+        problems []string
+    }{
+        {`{"type": "string"}`, `"x"`, nil},
+        {`{"type": "string"}`, `1`, []string{"payload: expected string, got integer"}},
+        {`{"type": "number"}`, `1`, nil},
+        {`{"type": "integer"}`, `1.5`, []string{"payload: expected integer, got number"}},
+        {`{"type": ["string", "null"]}`, `null`, nil},
+        {`{"type": ["string", "null"]}`, `true`, []string{"payload: expected one of [string null], got boolean"}},
+
+        {`{"properties": {"a": {"type": "string"}}}`, `{"a": 1}`, []string{"a: expected string, got integer"}},
+        {`{"required": ["a", "b"]}`, `{"a": 1}`, []string{"b: required"}},
+        {`{"properties": {"a": {}}, "additionalProperties": false}`, `{"a": 1, "b": 2}`, []string{"b: unexpected property"}},
+        {`{"additionalProperties": {"type": "integer"}}`, `{"a": 1, "b": "x"}`, []string{"b: expected integer, got string"}},
+        {`{"properties": {"a": {"properties": {"b": {"type": "boolean"}}}}}`, `{"a": {"b": 0}}`, []string{"a.b: expected boolean, got integer"}},
+
+        {`{"items": {"type": "integer"}}`, `[1, "x"]`, []string{"payload[1]: expected integer, got string"}},
+        {`{"minItems": 2}`, `[1]`, []string{"payload: has 1 items, fewer than 2"}},
+        {`{"maxItems": 1}`, `[1, 2]`, []string{"payload: has 2 items, more than 1"}},
+
+        {`{"minLength": 2}`, `"é"`, []string{"payload: shorter than 2 characters"}},
+        {`{"maxLength": 1}`, `"é"`, nil},
+        {`{"maxLength": 1}`, `"ab"`, []string{"payload: longer than 1 characters"}},
+        {`{"pattern": "^[a-z]+$"}`, `"Leela"`, []string{"payload: does not match ^[a-z]+$"}},
+
+        {`{"minimum": 0}`, `-1`, []string{"payload: -1 is less than 0"}},
+        {`{"maximum": 10}`, `10`, nil},
+        {`{"maximum": 10}`, `10.5`, []string{"payload: 10.5 is greater than 10"}},
+
+        {`{"enum": ["on", "off"]}`, `"off"`, nil},
+        {`{"enum": ["on", "off"]}`, `"dim"`, []string{"payload: dim is not one of [on off]"}},
+
+        {`{"title": "Anything", "description": "goes", "default": 1}`, `{"a": 1}`, nil},
+    }
+    for _, c := range cases {
+        schema, err := compileJSONSchema(c.schema)
+        if err != nil {
+            t.Errorf("%s: %s", c.schema, err)
+            continue
+        }
+        var value interface{}
+        err = json.Unmarshal([]byte(c.value), &value)
+        if err != nil {
+            t.Fatal(err)
+        }
+        problems := schema.validate(value, "")
+        if len(problems) == 0 {
+            problems = nil
+        }
+        if !reflect.DeepEqual(problems, c.problems) {
+            t.Errorf("%s with %s: problems are %q, expected %q", c.schema, c.value, problems, c.problems)
+        }
+    }
+}
+
+func TestJSONSchemaRejectsBadSchemas(t *testing.T) {
+    for _, schema := range []string{
+        `not json`,
+        `[]`,
+        `{"type": "thing"}`,
+        `{"type": 1}`,
+        `{"properties": []}`,
+        `{"properties": {"a": 1}}`,
+        `{"required": "a"}`,
+        `{"items": true}`,
+        `{"minItems": -1}`,
+        `{"maxLength": 1.5}`,
+        `{"pattern": "("}`,
+        `{"minimum": "0"}`,
+        `{"enum": "a"}`,
+        `{"oneOf": []}`,
+    } {
+        _, err := compileJSONSchema(schema)
+        if err == nil {
+            t.Errorf("%s was accepted", schema)
+        }
+    }
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// MessagePack codec for Pigeon's TCP transport.
+//
+// Importing this package registers the codec as pigeon.CODEC_MSGPACK:
+//
+//      import _ "odyn/pigeon/msgpackcodec"
+//
+// It lives in its own package so that Pigeon itself does not depend on the
+// msgpack library.
+package msgpackcodec
+
+import (
+    "bytes"
+    "gopkg.in/vmihailenco/msgpack.v2"
+    pigeon "odyn/pigeon"
+)
+
+type msgpackCodec struct {
+}
+
+func init() {
+    pigeon.RegisterCodec(&msgpackCodec{})
+}
+
+func (codec *msgpackCodec) ID() byte {
+    return pigeon.CODEC_MSGPACK
+}
+
+func (codec *msgpackCodec) Name() string {
+    return "msgpack"
+}
+
+func (codec *msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+    return msgpack.Marshal(v)
+}
+
+func (codec *msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+    decoder := msgpack.NewDecoder(bytes.NewReader(data))
+    decoder.DecodeMapFunc = decodeStringMap
+    return decoder.Decode(v)
+}
+
+// Decode maps inside interface{} values as map[string]interface{}, like the
+// gob and JSON codecs, instead of msgpack's map[interface{}]interface{}.
+func decodeStringMap(decoder *msgpack.Decoder) (interface{}, error) {
+    n, err := decoder.DecodeMapLen()
+    if err != nil {
+        return nil, err
+    }
+    if n == -1 {
+        return nil, nil
+    }
+
+    m := make(map[string]interface{}, n)
+    for i := 0; i < n; i++ {
+        key, err := decoder.DecodeString()
+        if err != nil {
+            return nil, err
+        }
+        value, err := decoder.DecodeInterface()
+        if err != nil {
+            return nil, err
+        }
+        m[key] = value
+    }
+    return m, nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package msgpackcodec
+
+import (
+    pigeon "odyn/pigeon"
+    "testing"
+)
+
+// Nested maps decode as map[string]interface{}, so handlers see the same
+// shapes as with the other codecs.
+func TestNestedPayloadRoundTrip(t *testing.T) {
+    codec := &msgpackCodec{}
+    req := &pigeon.PigeonRequest{
+        ReqJobKey: "work",
+        ReqBody: map[string]interface{}{
+            "user": map[string]interface{}{
+                "name": "ann",
+                "tags": []interface{}{"a", map[string]interface{}{"b": "c"}},
+            },
+        },
+    }
+    data, err := codec.Marshal(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    decoded := &pigeon.PigeonRequest{}
+    err = codec.Unmarshal(data, decoded)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    user, ok := decoded.Body()["user"].(map[string]interface{})
+    if !ok {
+        t.Fatalf("user decoded as %T", decoded.Body()["user"])
+    }
+    if user["name"] != "ann" {
+        t.Errorf("name decoded as %v", user["name"])
+    }
+    tags, ok := user["tags"].([]interface{})
+    if !ok || len(tags) != 2 {
+        t.Fatalf("tags decoded as %#v", user["tags"])
+    }
+    inner, ok := tags[1].(map[string]interface{})
+    if !ok || inner["b"] != "c" {
+        t.Errorf("Map inside a list decoded as %#v", tags[1])
+    }
+
+    // Empty and nil maps survive too
+    req.ReqBody = map[string]interface{}{"empty": map[string]interface{}{}, "none": nil}
+    data, err = codec.Marshal(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    decoded = &pigeon.PigeonRequest{}
+    err = codec.Unmarshal(data, decoded)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if empty, ok := decoded.Body()["empty"].(map[string]interface{}); !ok || len(empty) != 0 {
+        t.Errorf("Empty map decoded as %#v", decoded.Body()["empty"])
+    }
+    if decoded.Body()["none"] != nil {
+        t.Errorf("nil decoded as %#v", decoded.Body()["none"])
+    }
+}
@@ -15,70 +15,196 @@
 package jobqueue
 
 import (
+    "context"
     "odyn/log"
     "fmt"
-    "net/rpc"
     "math/rand"
+    "sort"
+    "sync"
+    "time"
 )
 
 type PigeonOutbox struct {
     sys *PigeonSystem
     timeoutms int32
+    router Router
+    priority Priority
+
+    // Semaphore with one slot per launched request awaiting a response, or
+    // nil for no limit.
+    pending chan struct{}
 }
 
-func (outbox *PigeonOutbox) send(hostname string, request *PigeonRequest, respChan chan<- Response) error {
-    resp := &PigeonResponse{}
+// Apply the outbox's timeout, if any, to <ctx>.
+func (outbox *PigeonOutbox) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+    if outbox.timeoutms < 0 {
+        return context.WithCancel(ctx)
+    }
+    return context.WithTimeout(ctx, time.Duration(outbox.timeoutms) * time.Millisecond)
+}
 
-    // Dial the server
-    // TODO: Inefficient to dial each time?
-    log.Info("RPC Dialing")
-    rpcClient, err := rpc.DialHTTP("tcp", hostname + ":1888")
+// Wait for a free pending slot, until <ctx> is done.  Returns a function to
+// release the slot.
+func (outbox *PigeonOutbox) acquirePending(ctx context.Context, key string) (func(), error) {
+    release, err := acquireSlot(ctx, outbox.pending, true)
     if err != nil {
-        return fmt.Errorf("Pigeon: (dialing) %s", err.Error())
+        return nil, fmt.Errorf("Pigeon: Gave up waiting to send %s: too many requests pending (%s)", key, err.Error())
     }
-    defer rpcClient.Close()
+    return release, nil
+}
 
-    // Make the call
-    log.Info("RPC Calling")
-    err = rpcClient.Call("PigeonServer.RPCHandleRequest", request, resp)
+func (outbox *PigeonOutbox) Broadcast(key string, payload map[string]interface{}) (*BroadcastReport, error) {
+    return outbox.BroadcastContext(context.Background(), key, payload)
+}
+
+func (outbox *PigeonOutbox) BroadcastContext(ctx context.Context, key string, payload map[string]interface{}) (*BroadcastReport, error) {
+    log.Info("Broadcasting ", key)
+
+    err := validateMsgKey(key)
     if err != nil {
-        log.Error("Pigeon: (calling) ", err.Error())
-        // Send error response to channel
-        respChan <- resp
-        return fmt.Errorf("Pigeon: (calling) %s", err.Error())
+        return nil, err
     }
 
-    // Send response to channel
-    respChan <- resp
-    
-    return nil
+    req := PigeonRequest {
+        ReqJobKey: key,
+        ReqBody: payload,
+        ReqBroadcast: true,
+    }
+    ctx, cancel := outbox.withTimeout(ctx)
+    defer cancel()
+    req.ReqHeaders = outbox.requestHeaders(ctx, &req)
+
+    // Get list of all servers interested in these keys
+    serverHosts, err := outbox.sys.registry.GetListeners(key)
+    if err != nil {
+        return nil, err
+    }
+
+    report := &BroadcastReport{
+        Succeeded: []string{},
+        Failed: map[string]error{},
+    }
+
+    // Send message to each server in parallel.  Servers in this process are
+    // called directly.
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+    for _, serverHost := range serverHosts {
+        wg.Add(1)
+        go func(serverHost string) {
+            defer wg.Done()
+            err := outbox.sys.call(ctx, serverHost, &req, &PigeonResponse{})
+
+            mu.Lock()
+            defer mu.Unlock()
+            if err != nil {
+                log.Warn("Pigeon: Broadcast to ", serverHost, " failed: ", err)
+                report.Failed[serverHost] = err
+            } else {
+                report.Succeeded = append(report.Succeeded, serverHost)
+            }
+        }(serverHost)
+    }
+    wg.Wait()
+
+    sort.Strings(report.Succeeded)
+
+    return report, nil
 }
 
-func (outbox *PigeonOutbox) Broadcast(key string, payload map[string]interface{}) error {
-    // Get list of all workers interested in these keys
-    //workerHosts, err := launcher.sys.dl.GetListeners(key)
-    //if err != nil {
-    //    return err
-    //}
+func (outbox *PigeonOutbox) Gather(ctx context.Context, key string, payload map[string]interface{}, quorum int) (*GatherReport, error) {
+    log.Info("Gathering ", key)
 
-    // Send message to each worker
-    //for _, workerHost := range workerHosts {
-        //launcher.send(workerHost, payload)
-    //}
+    err := validateMsgKey(key)
+    if err != nil {
+        return nil, err
+    }
 
-    return nil
+    // Get list of all servers interested in these keys
+    serverHosts, err := outbox.sys.registry.GetListeners(key)
+    if err != nil {
+        return nil, err
+    }
+
+    // Cancelled early once we have a quorum
+    ctx, cancel := outbox.withTimeout(ctx)
+    defer cancel()
+
+    req := PigeonRequest{
+        ReqJobKey: key,
+        ReqBody: payload,
+    }
+    req.ReqHeaders = outbox.requestHeaders(ctx, &req)
+
+    type result struct {
+        hostname string
+        resp *PigeonResponse
+        err error
+    }
+
+    // Ask each server in parallel.  Servers in this process are called
+    // directly.
+    results := make(chan result, len(serverHosts))
+    for _, serverHost := range serverHosts {
+        go func(serverHost string) {
+            resp := &PigeonResponse{}
+            err := outbox.sys.call(ctx, serverHost, &req, resp)
+            results <- result{serverHost, resp, err}
+        }(serverHost)
+    }
+
+    report := &GatherReport{
+        Responses: map[string]Response{},
+        Failed: map[string]error{},
+        Unanswered: []string{},
+    }
+    quorumReached := false
+    for range serverHosts {
+        res := <-results
+        switch {
+        case res.err == nil:
+            report.Responses[res.hostname] = res.resp
+            if quorum > 0 && len(report.Responses) == quorum {
+                // Stop waiting for the rest
+                quorumReached = true
+                cancel()
+            }
+        case quorumReached && res.resp.RespStatus == RESP_CANCELLED:
+            report.Unanswered = append(report.Unanswered, res.hostname)
+        default:
+            log.Warn("Pigeon: Gathering ", key, " from ", res.hostname, " failed: ", res.err)
+            report.Failed[res.hostname] = res.err
+        }
+    }
+
+    sort.Strings(report.Unanswered)
+
+    return report, nil
 }
 
 func (outbox *PigeonOutbox) Launch(key string, payload map[string]interface{}) (<-chan Response, error) {
-    log.Info("Launching ", key)
+    return outbox.LaunchContext(context.Background(), key, payload)
+}
 
-    req := PigeonRequest {
+func (outbox *PigeonOutbox) LaunchContext(ctx context.Context, key string, payload map[string]interface{}) (<-chan Response, error) {
+    return outbox.launch(ctx, &PigeonRequest{
         ReqJobKey: key,
         ReqBody: payload,
+    })
+}
+
+// Send <req> to one server chosen by the outbox's router.
+func (outbox *PigeonOutbox) launch(ctx context.Context, req *PigeonRequest) (<-chan Response, error) {
+    key := req.ReqJobKey
+    log.Info("Launching ", key)
+
+    err := validateMsgKey(key)
+    if err != nil {
+        return nil, err
     }
 
     // Get list of all workers interested in these keys
-    serverHosts, err := outbox.sys.dl.GetListeners(key)
+    serverHosts, err := outbox.sys.registry.GetListeners(key)
     if err != nil {
         return nil, err
     }
@@ -88,41 +214,211 @@ func (outbox *PigeonOutbox) Launch(key string, payload map[string]interface{}) (
         return nil, fmt.Errorf("Pigeon: No listeners found for %s", key)
     }
 
-    // For now, pick one at random
-    serverHost := serverHosts[rand.Intn(len(serverHosts))]
+    ctx, cancel := outbox.withTimeout(ctx)
+    releasePending, err := outbox.acquirePending(ctx, key)
+    if err != nil {
+        cancel()
+        return nil, err
+    }
 
-    log.Info("Making RPC call ", key)
-    respChan := make(chan Response)
-    go outbox.send(serverHost, &req, respChan)
+    router := outbox.router
+    serverHost, err := router.Pick(key, req.ReqBody, serverHosts, outbox.sys.registry)
+    if err != nil {
+        releasePending()
+        cancel()
+        return nil, err
+    }
+
+    reqCopy := *req
+    reqCopy.ReqHeaders = outbox.requestHeaders(ctx, req)
+    req = &reqCopy
+
+    log.Info("Making RPC call ", key, " to ", serverHost, " correlation ", req.ReqHeaders[HEADER_CORRELATION_ID])
+    respChan := make(chan Response, 1)
+    go func() {
+        defer cancel()
+        defer releasePending()
+        outbox.sendRerouting(ctx, router, serverHosts, serverHost, req, respChan)
+    }()
     log.Info("Returned from send", key)
 
     return respChan, nil
 }
 
+// Send <req> to <serverHost>, which <router> chose from <serverHosts>.  While
+// servers answer that they are busy, let <router> choose another from those
+// not tried yet.  Delivers the last response to <respChan>.
+func (outbox *PigeonOutbox) sendRerouting(ctx context.Context, router Router, serverHosts []string, serverHost string, req *PigeonRequest, respChan chan<- Response) {
+    for {
+        resp := &PigeonResponse{}
+        err := outbox.sys.call(ctx, serverHost, req, resp)
+        router.Done(serverHost)
+        if err != nil {
+            log.Error("Pigeon: (sending) ", err.Error())
+        }
+
+        // Streams may have handed input to the busy server, so they are
+        // not rerouted.
+        if resp.RespStatus != RESP_BUSY || req.ReqStream || ctx.Err() != nil {
+            respChan <- resp
+            return
+        }
+
+        remaining := []string{}
+        for _, hostname := range serverHosts {
+            if hostname != serverHost {
+                remaining = append(remaining, hostname)
+            }
+        }
+        if len(remaining) == 0 {
+            respChan <- resp
+            return
+        }
+
+        log.Warn("Pigeon: ", serverHost, " is busy, rerouting ", req.ReqJobKey)
+        next, err := router.Pick(req.ReqJobKey, req.ReqBody, remaining, outbox.sys.registry)
+        if err != nil {
+            respChan <- resp
+            return
+        }
+        serverHosts = remaining
+        serverHost = next
+    }
+}
+
 func (outbox *PigeonOutbox) LaunchIdempotent(key string, numParallel uint32, payload map[string]interface{}) (<-chan Response, error) {
-    // Get list of all workers interested in these keys
-    //workerHosts, err := outbox.sys.dl.GetListeners(key)
-    //if err != nil {
-    //    return nil, err
-    //}
+    return outbox.LaunchIdempotentContext(context.Background(), key, numParallel, payload)
+}
+
+func (outbox *PigeonOutbox) LaunchIdempotentContext(ctx context.Context, key string, numParallel uint32, payload map[string]interface{}) (<-chan Response, error) {
+    log.Info("Launching idempotent ", key)
+
+    err := validateMsgKey(key)
+    if err != nil {
+        return nil, err
+    }
 
-    //if len(workerHosts) == 0 {
-    //    return nil, fmt.Errorf("Pigeon: No listeners found for %s", key)
-    //}
+    req := PigeonRequest {
+        ReqJobKey: key,
+        ReqBody: payload,
+    }
 
-    // For now, pick a random subset of numParallel workers
-    //workerHostsSubset := random.SelectionStrings(workerHosts, numParallel)
+    // Get list of all servers interested in these keys
+    serverHosts, err := outbox.sys.registry.GetListeners(key)
+    if err != nil {
+        return nil, err
+    }
 
-    // Send payload to each of the workers
-    //for _, worker := range workerHostsSubset {
-        // TODO: take response of first responder
-        //outbox.send(worker, payload)
-    //}
+    if len(serverHosts) == 0 {
+        log.Info("No listeners found", key)
+        return nil, fmt.Errorf("Pigeon: No listeners found for %s", key)
+    }
 
-    return nil, fmt.Errorf("Not fully implemented")
+    if numParallel == 0 {
+        numParallel = 1
+    }
+
+    // Shuffle the servers.  The first numParallel are sent the request
+    // immediately, the rest are used as fallbacks if any of those fail.
+    shuffled := make([]string, len(serverHosts))
+    for i, j := range rand.Perm(len(serverHosts)) {
+        shuffled[i] = serverHosts[j]
+    }
+
+    ctx, cancel := outbox.withTimeout(ctx)
+    releasePending, err := outbox.acquirePending(ctx, key)
+    if err != nil {
+        cancel()
+        return nil, err
+    }
+
+    req.ReqHeaders = outbox.requestHeaders(ctx, &req)
+    log.Info("Racing ", key, " correlation ", req.ReqHeaders[HEADER_CORRELATION_ID])
+
+    respChan := make(chan Response, 1)
+    go func() {
+        // Cancels the losers once there is a winner
+        defer cancel()
+        defer releasePending()
+        outbox.race(ctx, shuffled, int(numParallel), &req, respChan)
+    }()
+
+    return respChan, nil
+}
+
+// Send <request> to the first <numParallel> servers in <serverHosts> and
+// deliver the first successful response to <respChan>.  Each failure is
+// replaced by a request to the next unused server.  If every server fails,
+// the last failed response is delivered.  Later responses are ignored.  No new
+// servers are tried once <ctx> is done.
+func (outbox *PigeonOutbox) race(ctx context.Context, serverHosts []string, numParallel int, request *PigeonRequest, respChan chan<- Response) {
+    type result struct {
+        hostname string
+        resp *PigeonResponse
+        err error
+    }
+
+    // Buffered so that stragglers never block after a winner is chosen
+    results := make(chan result, len(serverHosts))
+    next := 0
+    outstanding := 0
+    sendNext := func() {
+        hostname := serverHosts[next]
+        next++
+        outstanding++
+        go func() {
+            resp := &PigeonResponse{}
+            err := outbox.sys.call(ctx, hostname, request, resp)
+            results <- result{hostname, resp, err}
+        }()
+    }
+
+    for next < numParallel && next < len(serverHosts) {
+        sendNext()
+    }
+
+    var lastResp *PigeonResponse
+    for outstanding > 0 {
+        res := <-results
+        outstanding--
+        if res.err == nil {
+            respChan <- res.resp
+            return
+        }
+
+        log.Warn("Pigeon: ", request.ReqJobKey, " failed on ", res.hostname, ": ", res.err)
+        lastResp = res.resp
+        if next < len(serverHosts) && ctx.Err() == nil {
+            sendNext()
+        }
+    }
+
+    // Everyone failed
+    respChan <- lastResp
 }
 
 func (outbox *PigeonOutbox) SetTimeoutms(timeout int32) {
     outbox.timeoutms = timeout
 }
 
+func (outbox *PigeonOutbox) SetRouter(router Router) {
+    outbox.router = router
+}
+
+func (outbox *PigeonOutbox) SetPriority(priority Priority) error {
+    err := validatePriority(priority)
+    if err != nil {
+        return err
+    }
+    outbox.priority = priority
+    return nil
+}
+
+func (outbox *PigeonOutbox) SetMaxPending(max int) {
+    if max <= 0 {
+        outbox.pending = nil
+        return
+    }
+    outbox.pending = make(chan struct{}, max)
+}
+
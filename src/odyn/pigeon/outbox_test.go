@@ -0,0 +1,226 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "context"
+    "errors"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestBroadcastTimesOut(t *testing.T) {
+    sys, server := newTestServer(t, "fast")
+    slow, err := sys.StartServer("slow")
+    if err != nil {
+        t.Fatal(err)
+    }
+    release := make(chan struct{})
+    defer slow.Stop()
+    defer close(release)
+
+    newTestInbox(t, server, "announce", func(msgKey string, userCtx interface{}, req Request, resp Response) {})
+    newTestInbox(t, slow, "announce", func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        <-release
+    })
+
+    outbox := sys.NewOutbox()
+    outbox.SetTimeoutms(50)
+    start := time.Now()
+    report, err := outbox.Broadcast("announce", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if time.Since(start) > 2 * time.Second {
+        t.Errorf("Broadcast took %s", time.Since(start))
+    }
+    if len(report.Succeeded) != 1 || report.Succeeded[0] != "fast" {
+        t.Errorf("Succeeded: %v", report.Succeeded)
+    }
+    if !IsTimeout(report.Failed["slow"]) {
+        t.Errorf("Failed: %v", report.Failed)
+    }
+}
+
+func TestBroadcastContextCancelled(t *testing.T) {
+    sys, server := newTestServer(t, "local")
+    release := make(chan struct{})
+    defer close(release)
+    newTestInbox(t, server, "announce", func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        <-release
+    })
+
+    outbox := sys.NewOutbox()
+    outbox.SetTimeoutms(-1)
+    ctx, cancel := context.WithCancel(context.Background())
+    time.AfterFunc(20 * time.Millisecond, cancel)
+    report, err := outbox.BroadcastContext(ctx, "announce", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if report.Failed["local"] == nil {
+        t.Errorf("Report: %+v", report)
+    }
+}
+
+// Servers still working when Gather reaches its quorum are cancelled, even in
+// other processes.
+func TestGatherCancelsRemoteStragglers(t *testing.T) {
+    registry := NewMemRegistry()
+    startRemote := func(fn HandlerFunc) string {
+        cfg := DefaultTCPTransportConfig
+        cfg.ListenHost = "127.0.0.1"
+        transport, err := NewTCPTransportWithConfig(cfg)
+        if err != nil {
+            t.Fatal(err)
+        }
+        sys := NewPigeonSystem(SystemConfig{Registry: registry, Transport: transport, DrainTimeout: time.Second})
+        hostname := freeHostname(t)
+        server, err := sys.StartServer(hostname)
+        if err != nil {
+            t.Fatal(err)
+        }
+        t.Cleanup(func() {
+            server.Stop()
+        })
+        newTestInbox(t, server, "census", fn)
+        return hostname
+    }
+
+    startRemote(func(msgKey string, userCtx interface{}, req Request, resp Response) {})
+    cancelled := make(chan struct{})
+    slow := startRemote(func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        select {
+        case <-req.Context().Done():
+            close(cancelled)
+        case <-time.After(5 * time.Second):
+        }
+    })
+
+    transport, err := NewTCPTransport()
+    if err != nil {
+        t.Fatal(err)
+    }
+    sys := NewPigeonSystem(SystemConfig{Registry: registry, Transport: transport})
+    report, err := sys.NewOutbox().Gather(context.Background(), "census", nil, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(report.Unanswered) != 1 || report.Unanswered[0] != slow {
+        t.Errorf("Report: %+v", report)
+    }
+    select {
+    case <-cancelled:
+    case <-time.After(2 * time.Second):
+        t.Error("Straggler's handler was not cancelled")
+    }
+}
+
+// Start servers <hostnames> on <sys>, stopped when the test ends.
+func startTestServers(t *testing.T, sys System, hostnames ...string) []Server {
+    servers := []Server{}
+    for _, hostname := range hostnames {
+        server, err := sys.StartServer(hostname)
+        if err != nil {
+            t.Fatal(err)
+        }
+        t.Cleanup(func() { server.Stop() })
+        servers = append(servers, server)
+    }
+    return servers
+}
+
+func TestLaunchIdempotentFirstResponseWins(t *testing.T) {
+    sys, fast := newTestServer(t, "fast")
+    slow := startTestServers(t, sys, "slow")[0]
+    cancelled := make(chan struct{})
+    newTestInbox(t, fast, "lookup", func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        resp.SetBody(map[string]interface{}{"from": "fast"})
+    })
+    newTestInbox(t, slow, "lookup", func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        select {
+        case <-req.Context().Done():
+            close(cancelled)
+        case <-time.After(5 * time.Second):
+        }
+        resp.SetBody(map[string]interface{}{"from": "slow"})
+    })
+
+    respChan, err := sys.NewOutbox().LaunchIdempotent("lookup", 2, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp := waitResponse(t, respChan)
+    if resp.Err() != nil || resp.Body()["from"] != "fast" {
+        t.Errorf("Got %v (%v), expected the fast server's response", resp.Body(), resp.Err())
+    }
+
+    // The loser is cancelled once there is a winner
+    select {
+    case <-cancelled:
+    case <-time.After(2 * time.Second):
+        t.Error("Losing call was not cancelled")
+    }
+}
+
+func TestLaunchIdempotentFallsBack(t *testing.T) {
+    sys := NewPigeonSystem(SystemConfig{DrainTimeout: time.Second})
+    servers := startTestServers(t, sys, "bad1", "bad2", "good")
+    var mu sync.Mutex
+    tried := map[string]int{}
+    for i, server := range servers {
+        hostname := []string{"bad1", "bad2", "good"}[i]
+        newTestInbox(t, server, "lookup", func(msgKey string, userCtx interface{}, req Request, resp Response) {
+            mu.Lock()
+            tried[hostname]++
+            mu.Unlock()
+            if hostname != "good" {
+                resp.SetError(errors.New("broken"))
+                return
+            }
+            resp.SetBody(map[string]interface{}{"from": hostname})
+        })
+    }
+
+    // Servers are tried in random order, one at a time
+    outbox := sys.NewOutbox()
+    for i := 0; i < 20; i++ {
+        respChan, err := outbox.LaunchIdempotent("lookup", 1, nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        resp := waitResponse(t, respChan)
+        if resp.Err() != nil || resp.Body()["from"] != "good" {
+            t.Fatalf("Got %v (%v), expected the good server's response", resp.Body(), resp.Err())
+        }
+    }
+    mu.Lock()
+    if tried["good"] != 20 || tried["bad1"] + tried["bad2"] == 0 {
+        t.Errorf("Tried %v", tried)
+    }
+    mu.Unlock()
+
+    // If every server fails, the last failure is delivered
+    servers[2].Stop()
+    respChan, err := outbox.LaunchIdempotent("lookup", 1, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp := waitResponse(t, respChan)
+    if resp.Err() == nil {
+        t.Error("Launch succeeded with every server failing")
+    }
+}
@@ -0,0 +1,293 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "reflect"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// The payload type registered for a msg key.
+type messageType struct {
+    // Struct type payloads decode into
+    typ reflect.Type
+
+    // nil if no schema was registered
+    schema *jsonSchema
+}
+
+var messageTypesMu sync.RWMutex
+var messageTypes = map[string]*messageType{}
+
+// Declare that payloads for msg key <msgKey> are Go struct <prototype>,
+// such as Telemetry{}, encoded as JSON (so the struct's json tags apply).
+// If <jsonSchema> is not "", payloads must also match it; see jsonschema.go
+// for the supported subset.  Otherwise the struct is the schema: payloads
+// must have every field not tagged omitempty, and no others.  Replaces any
+// type registered for <msgKey>.
+//
+// Servers check payloads for registered msg keys before calling the
+// handler, which gets the decoded struct from Request.Payload().  Payloads
+// that do not match are rejected with RESP_INVALID_PAYLOAD.  Both ends
+// should register the same types, and senders should build payloads with
+// EncodePayload.
+func RegisterMessageType(msgKey string, prototype interface{}, jsonSchema string) error {
+    err := validateMsgKey(msgKey)
+    if err != nil {
+        return err
+    }
+
+    typ := reflect.TypeOf(prototype)
+    if typ != nil && typ.Kind() == reflect.Ptr {
+        typ = typ.Elem()
+    }
+    if typ == nil || typ.Kind() != reflect.Struct {
+        return fmt.Errorf("Pigeon: Payload type for %s must be a struct, not %v", msgKey, typ)
+    }
+
+    mt := &messageType{
+        typ: typ,
+    }
+    if jsonSchema != "" {
+        mt.schema, err = compileJSONSchema(jsonSchema)
+        if err != nil {
+            return err
+        }
+    }
+
+    messageTypesMu.Lock()
+    defer messageTypesMu.Unlock()
+    messageTypes[msgKey] = mt
+    return nil
+}
+
+// Forget the payload type registered for <msgKey>.
+func UnregisterMessageType(msgKey string) {
+    messageTypesMu.Lock()
+    defer messageTypesMu.Unlock()
+    delete(messageTypes, msgKey)
+}
+
+func lookupMessageType(msgKey string) *messageType {
+    messageTypesMu.RLock()
+    defer messageTypesMu.RUnlock()
+    return messageTypes[msgKey]
+}
+
+// Convert struct <v> to a payload for <msgKey>.  If a type is registered
+// for <msgKey>, <v> must be of that type (or a pointer to it) and match its
+// schema.  Errors are of type *Error with status RESP_INVALID_PAYLOAD.
+func EncodePayload(msgKey string, v interface{}) (map[string]interface{}, error) {
+    mt := lookupMessageType(msgKey)
+    if mt != nil {
+        typ := reflect.TypeOf(v)
+        if typ != nil && typ.Kind() == reflect.Ptr {
+            typ = typ.Elem()
+        }
+        if typ != mt.typ {
+            return nil, invalidPayload(msgKey, []string{fmt.Sprintf("payload: expected %v, got %v", mt.typ, typ)})
+        }
+    }
+
+    data, err := json.Marshal(v)
+    if err != nil {
+        return nil, invalidPayload(msgKey, []string{"payload: " + err.Error()})
+    }
+    var payload map[string]interface{}
+    err = json.Unmarshal(data, &payload)
+    if err != nil || payload == nil {
+        return nil, invalidPayload(msgKey, []string{"payload: must encode as a JSON object"})
+    }
+
+    if mt != nil && mt.schema != nil {
+        problems := mt.schema.validate(payload, "")
+        if len(problems) > 0 {
+            return nil, invalidPayload(msgKey, problems)
+        }
+    }
+    return payload, nil
+}
+
+// Decode payload <body> into <v>, which must be a pointer, through JSON.
+func decodePayload(body map[string]interface{}, v interface{}) error {
+    data, err := json.Marshal(body)
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(data, v)
+}
+
+// Check <body> against the type registered for <msgKey>, if any, and decode
+// it.  Returns a pointer to the decoded struct, or nil if no type is
+// registered.
+func checkPayload(msgKey string, body map[string]interface{}) (interface{}, error) {
+    mt := lookupMessageType(msgKey)
+    if mt == nil {
+        return nil, nil
+    }
+
+    data, err := json.Marshal(body)
+    if err != nil {
+        return nil, invalidPayload(msgKey, []string{"payload: " + err.Error()})
+    }
+
+    var doc interface{}
+    err = json.Unmarshal(data, &doc)
+    if err != nil {
+        return nil, invalidPayload(msgKey, []string{"payload: " + err.Error()})
+    }
+    var problems []string
+    if mt.schema != nil {
+        problems = mt.schema.validate(doc, "")
+    } else {
+        problems = missingFields(mt.typ, doc, "")
+    }
+    if len(problems) > 0 {
+        return nil, invalidPayload(msgKey, problems)
+    }
+
+    decoded := reflect.New(mt.typ).Interface()
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    if mt.schema == nil {
+        decoder.DisallowUnknownFields()
+    }
+    err = decoder.Decode(decoded)
+    if err != nil {
+        typeErr, ok := err.(*json.UnmarshalTypeError)
+        if ok {
+            return nil, invalidPayload(msgKey, []string{fmt.Sprintf("%s: expected %v, got %s", displayPath(typeErr.Field), typeErr.Type, typeErr.Value)})
+        }
+        if strings.HasPrefix(err.Error(), "json: unknown field ") {
+            name, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+            return nil, invalidPayload(msgKey, []string{name + ": unexpected property"})
+        }
+        return nil, invalidPayload(msgKey, []string{"payload: " + err.Error()})
+    }
+    return decoded, nil
+}
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// List the fields of struct type <typ> missing from decoded JSON value <v>,
+// found at <path>, except those tagged omitempty.  Fields of nested structs
+// are checked too, unless they decode themselves.
+func missingFields(typ reflect.Type, v interface{}, path string) []string {
+    for typ.Kind() == reflect.Ptr {
+        typ = typ.Elem()
+    }
+    if reflect.PtrTo(typ).Implements(jsonUnmarshalerType) {
+        return nil
+    }
+
+    problems := []string{}
+    switch typ.Kind() {
+    case reflect.Struct:
+        obj, ok := v.(map[string]interface{})
+        if !ok {
+            // The decoder reports the type mismatch
+            return nil
+        }
+        for i := 0; i < typ.NumField(); i++ {
+            field := typ.Field(i)
+            name, omitEmpty, ok := jsonFieldName(field)
+            if !ok {
+                continue
+            }
+            if name == "" {
+                // Embedded struct, whose fields are promoted
+                problems = append(problems, missingFields(field.Type, obj, path)...)
+                continue
+            }
+            value, found := lookupJSONField(obj, name)
+            if !found {
+                if !omitEmpty {
+                    problems = append(problems, joinPath(path, name) + ": required")
+                }
+                continue
+            }
+            problems = append(problems, missingFields(field.Type, value, joinPath(path, name))...)
+        }
+
+    case reflect.Slice, reflect.Array:
+        items, _ := v.([]interface{})
+        for i, item := range items {
+            problems = append(problems, missingFields(typ.Elem(), item, fmt.Sprintf("%s[%d]", displayPath(path), i))...)
+        }
+    }
+    return problems
+}
+
+// Get the JSON name of <field> and whether it is tagged omitempty, as
+// encoding/json sees them.  Returns a name of "" for embedded structs whose
+// fields are promoted, and false for fields JSON ignores.
+func jsonFieldName(field reflect.StructField) (string, bool, bool) {
+    tag := field.Tag.Get("json")
+    if tag == "-" {
+        return "", false, false
+    }
+    parts := strings.Split(tag, ",")
+    name := parts[0]
+    omitEmpty := false
+    for _, option := range parts[1:] {
+        if option == "omitempty" {
+            omitEmpty = true
+        }
+    }
+
+    if field.Anonymous && name == "" {
+        typ := field.Type
+        if typ.Kind() == reflect.Ptr {
+            typ = typ.Elem()
+        }
+        if typ.Kind() == reflect.Struct {
+            return "", omitEmpty, true
+        }
+    }
+    if field.PkgPath != "" {
+        // Unexported
+        return "", false, false
+    }
+    if name == "" {
+        name = field.Name
+    }
+    return name, omitEmpty, true
+}
+
+// Find property <name> in <obj>, matching case-insensitively if there is no
+// exact match, as encoding/json does.
+func lookupJSONField(obj map[string]interface{}, name string) (interface{}, bool) {
+    value, ok := obj[name]
+    if ok {
+        return value, true
+    }
+    for key, value := range obj {
+        if strings.EqualFold(key, name) {
+            return value, true
+        }
+    }
+    return nil, false
+}
+
+func invalidPayload(msgKey string, problems []string) *Error {
+    err := NewError(RESP_INVALID_PAYLOAD, "Payload does not match the type registered for %s", msgKey)
+    err.MsgKey = msgKey
+    err.Details = problems
+    return err
+}
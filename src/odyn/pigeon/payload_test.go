@@ -0,0 +1,137 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "reflect"
+    "testing"
+)
+
+type testLocation struct {
+    Lat float64 `json:"lat"`
+    Lon float64 `json:"lon"`
+}
+
+type testMeta struct {
+    Firmware string `json:"firmware,omitempty"`
+}
+
+type testTelemetry struct {
+    testMeta
+    Device string `json:"device"`
+    Temp float64 `json:"temp"`
+    Note string `json:"note,omitempty"`
+    Where *testLocation `json:"where,omitempty"`
+    Path []testLocation `json:"path,omitempty"`
+    Ignored string `json:"-"`
+    Name string
+    internal string
+}
+
+func registerTestTelemetry(t *testing.T, schema string) {
+    err := RegisterMessageType("test.telemetry", testTelemetry{}, schema)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        UnregisterMessageType("test.telemetry")
+    })
+}
+
+func TestCheckPayloadWithoutSchema(t *testing.T) {
+    registerTestTelemetry(t, "")
+
+    cases := []struct {
+        name string
+        body map[string]interface{}
+        problems []string
+    }{
+        {"complete", map[string]interface{}{"device": "Leela", "temp": 21.5, "Name": "x"}, nil},
+        {"with optional fields", map[string]interface{}{
+            "device": "Leela", "temp": 21.5, "name": "x", "firmware": "1.2",
+            "where": map[string]interface{}{"lat": 1, "lon": 2},
+            "path": []interface{}{map[string]interface{}{"lat": 1, "lon": 2}},
+        }, nil},
+        {"missing fields", map[string]interface{}{"device": "Leela"}, []string{"temp: required", "Name: required"}},
+        {"missing nested field", map[string]interface{}{
+            "device": "Leela", "temp": 21.5, "Name": "x",
+            "where": map[string]interface{}{"lat": 1},
+        }, []string{"where.lon: required"}},
+        {"missing field in list", map[string]interface{}{
+            "device": "Leela", "temp": 21.5, "Name": "x",
+            "path": []interface{}{map[string]interface{}{"lon": 2}},
+        }, []string{"path[0].lat: required"}},
+        {"unknown field", map[string]interface{}{"device": "Leela", "temp": 21.5, "Name": "x", "humidity": 3}, []string{"humidity: unexpected property"}},
+        {"ignored field", map[string]interface{}{"device": "Leela", "temp": 21.5, "Name": "x", "Ignored": "y"}, []string{"Ignored: unexpected property"}},
+        {"wrong type", map[string]interface{}{"device": "Leela", "temp": "hot", "Name": "x"}, []string{"temp: expected float64, got string"}},
+    }
+    for _, c := range cases {
+        decoded, err := checkPayload("test.telemetry", c.body)
+        if c.problems == nil {
+            if err != nil {
+                t.Errorf("%s: %s", c.name, err)
+            } else if decoded.(*testTelemetry).Device != "Leela" {
+                t.Errorf("%s: decoded %+v", c.name, decoded)
+            }
+            continue
+        }
+        pigeonErr, ok := err.(*Error)
+        if !ok || pigeonErr.Status != RESP_INVALID_PAYLOAD {
+            t.Errorf("%s: got %v", c.name, err)
+            continue
+        }
+        if !reflect.DeepEqual(pigeonErr.Details, c.problems) {
+            t.Errorf("%s: problems are %q, expected %q", c.name, pigeonErr.Details, c.problems)
+        }
+    }
+}
+
+func TestCheckPayloadWithSchema(t *testing.T) {
+    // The schema decides what is required and allowed
+    registerTestTelemetry(t, `{
+        "type": "object",
+        "properties": {"temp": {"type": "number", "maximum": 100}},
+        "required": ["device"]
+    }`)
+
+    _, err := checkPayload("test.telemetry", map[string]interface{}{"device": "Leela", "extra": true})
+    if err != nil {
+        t.Error(err)
+    }
+    _, err = checkPayload("test.telemetry", map[string]interface{}{"device": "Leela", "temp": 120})
+    if err == nil {
+        t.Error("Payload breaking the schema was accepted")
+    }
+}
+
+func TestEncodePayloadRoundTrip(t *testing.T) {
+    registerTestTelemetry(t, "")
+    body, err := EncodePayload("test.telemetry", &testTelemetry{Device: "Leela", Temp: 21.5})
+    if err != nil {
+        t.Fatal(err)
+    }
+    decoded, err := checkPayload("test.telemetry", body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if decoded.(*testTelemetry).Temp != 21.5 {
+        t.Errorf("Decoded %+v", decoded)
+    }
+
+    _, err = EncodePayload("test.telemetry", testLocation{})
+    if err == nil {
+        t.Error("EncodePayload accepted the wrong type")
+    }
+}
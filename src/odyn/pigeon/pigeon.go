@@ -15,23 +15,91 @@
 package jobqueue
 
 import (
-    "canopy/datalayer"
+    "context"
     "errors"
     "fmt"
+    "io"
+    "sync"
     "time"
 )
 
 type PigeonSystem struct {
-    dl datalayer.PigeonSystem
+    cfg SystemConfig
+    registry Registry
+    transport Transport
+
+    // nil if cfg.Storage is not set
+    scheduler *scheduler
+
+    // Servers running in this process, by hostname.
+    mu sync.RWMutex
+    servers map[string]*PigeonServer
 }
 
 type PigeonRequest struct {
     ReqJobKey string
     ReqBody map[string]interface{}
+
+    // If true, every inbox on the server handles the request.
+    ReqBroadcast bool
+
+    // Metadata about the request, such as HEADER_SENDER and
+    // HEADER_CORRELATION_ID.  See headers.go.
+    ReqHeaders map[string]string
+
+    // When the sender will stop waiting for a response.  Zero if the sender
+    // has no deadline.
+    ReqDeadline time.Time
+
+    // ID of the durable job this request delivers, and which delivery
+    // attempt this is (starting at 1).  Empty for requests not sent through
+    // a Queue.
+    ReqJobID string
+    ReqAttempt int
+
+    // If true, the handler may send partial responses, and the sender may
+    // send input chunks.  See Outbox.Stream.
+    ReqStream bool
+
+    // For streams: called with each partial response, and the sender's
+    // input chunks (closed after the last one).  Not sent over the wire.
+    partials func(body map[string]interface{}) error
+    input <-chan map[string]interface{}
+
+    // Set by the server for the handler.  Not sent over the wire.
+    ctx context.Context
+
+    // Payload decoded into the type registered for ReqJobKey, if any.  Set
+    // by the server.
+    payload interface{}
 }
 
 type PigeonResponse struct {
     RespBody map[string]interface{}
+
+    // RESP_OK unless the request could not be handled.
+    RespStatus ResponseStatus
+
+    // Description of the failure, if RespStatus is not RESP_OK.
+    RespError string
+
+    // Problems with the request, for RESP_INVALID_PAYLOAD.  See
+    // Error.Details.
+    RespDetails []string
+
+    // Metadata set by the handler, and by the server: the request's
+    // HEADER_CORRELATION_ID.
+    RespHeaders map[string]string
+
+    // Where the request was sent.  Filled in by the sender for Err().
+    msgKey string
+    hostname string
+
+    // True for partial responses from a stream
+    partial bool
+
+    // Set by the server for streams.  Delivers a partial response.
+    sendPartial func(body map[string]interface{}) error
 }
 
 type PigeonRecieveHandler struct {
@@ -68,9 +136,17 @@ func (pigeon *PigeonSystem) NewOutbox() Outbox {
     return &PigeonOutbox{
         sys: pigeon,
         timeoutms: -1,
+        router: NewRandomRouter(),
     }
 }
 
+func (pigeon *PigeonSystem) Close() error {
+    if pigeon.scheduler != nil {
+        pigeon.scheduler.stop()
+    }
+    return pigeon.transport.Close()
+}
+
 func (pigeon *PigeonSystem) NewResponse() Response {
     return &PigeonResponse{}
 }
@@ -79,8 +155,12 @@ func (pigeon *PigeonSystem) StartServer(hostname string) (Server, error) {
     server := &PigeonServer{
         sys : pigeon,
         hostname: hostname,
-        inboxesByMsgKey: map[string]([]*PigeonInbox){},
+        keyLimits: map[string]chan struct{}{},
+        keyRates: map[string]*tokenBucket{},
     }
+    server.lanes, _ = newLaneScheduler(LaneConfig{})
+    server.dedup, _ = newDedupStore(hostname, DedupConfig{Conn: pigeon.cfg.Storage})
+    server.routes.Store(newRouteTable(map[string][]*PigeonInbox{}))
 
     err := server.Start()
     if err != nil {
@@ -90,6 +170,80 @@ func (pigeon *PigeonSystem) StartServer(hostname string) (Server, error) {
     return server, nil
 }
 
+// Deliver <req> to server <hostname>.  If the server is running in this
+// process the handler is called directly, otherwise the request goes through
+// the Transport.  Gives up when <ctx> is done, returning a TimeoutError if its
+// deadline passed.
+func (pigeon *PigeonSystem) call(ctx context.Context, hostname string, req *PigeonRequest, resp *PigeonResponse) error {
+    var err error
+    server := pigeon.localServer(hostname)
+    if server != nil {
+        err = pigeon.callLocal(ctx, server, req, resp)
+    } else {
+        err = pigeon.transport.Call(ctx, hostname, req, resp)
+    }
+
+    if err != nil {
+        switch {
+        case ctx.Err() == context.DeadlineExceeded:
+            resp.setStatus(RESP_TIMEOUT, "Request timed out")
+        case ctx.Err() != nil:
+            resp.setStatus(RESP_CANCELLED, "Request cancelled")
+        default:
+            resp.setStatus(RESP_TRANSPORT_FAILURE, "%s", err.Error())
+        }
+    }
+
+    resp.msgKey = req.ReqJobKey
+    resp.hostname = hostname
+    return resp.Err()
+}
+
+// Status for a request abandoned because of context error <err>.
+func contextStatus(err error) ResponseStatus {
+    if err == context.DeadlineExceeded {
+        return RESP_TIMEOUT
+    }
+    return RESP_CANCELLED
+}
+
+func (pigeon *PigeonSystem) callLocal(ctx context.Context, server *PigeonServer, req *PigeonRequest, resp *PigeonResponse) error {
+    if ctx.Done() == nil {
+        // Can never be cancelled, so don't bother with a goroutine
+        server.rpcHandleRequest(ctx, req, resp)
+        return nil
+    }
+
+    // The handler keeps running after we give up, so it gets its own
+    // response object.
+    done := make(chan bool, 1)
+    localResp := &PigeonResponse{}
+    go func() {
+        server.rpcHandleRequest(ctx, req, localResp)
+        done <- true
+    }()
+
+    select {
+    case <-done:
+        *resp = *localResp
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+func (pigeon *PigeonSystem) localServer(hostname string) *PigeonServer {
+    pigeon.mu.RLock()
+    defer pigeon.mu.RUnlock()
+    return pigeon.servers[hostname]
+}
+
+func (pigeon *PigeonSystem) addLocalServer(server *PigeonServer) {
+    pigeon.mu.Lock()
+    defer pigeon.mu.Unlock()
+    pigeon.servers[server.hostname] = server
+}
+
 func (pigeon *PigeonSystem) Server(hostname string) (Server, error) {
     return nil, fmt.Errorf("Not Implemented")
 }
@@ -102,6 +256,65 @@ func (resp *PigeonResponse) Body() map[string]interface{} {
     return resp.RespBody
 }
 
+func (resp *PigeonResponse) Err() error {
+    if resp.RespStatus == RESP_OK {
+        return nil
+    }
+    return &Error{
+        Status: resp.RespStatus,
+        MsgKey: resp.msgKey,
+        Hostname: resp.hostname,
+        Message: resp.RespError,
+        Details: resp.RespDetails,
+    }
+}
+
+func (resp *PigeonResponse) Reject(reason string) {
+    resp.setStatus(RESP_REJECTED, "%s", reason)
+}
+
+func (resp *PigeonResponse) SetError(err error) {
+    pigeonErr, ok := err.(*Error)
+    if ok {
+        resp.setStatus(pigeonErr.Status, "%s", pigeonErr.Message)
+        resp.RespDetails = pigeonErr.Details
+    } else {
+        resp.setStatus(RESP_HANDLER_ERROR, "%s", err.Error())
+    }
+}
+
+func (resp *PigeonResponse) Status() ResponseStatus {
+    return resp.RespStatus
+}
+
+func (resp *PigeonResponse) setStatus(status ResponseStatus, format string, args ...interface{}) {
+    resp.RespStatus = status
+    resp.RespError = fmt.Sprintf(format, args...)
+}
+
+func (resp *PigeonResponse) Send(body map[string]interface{}) error {
+    if resp.sendPartial == nil {
+        // The sender isn't listening for partial responses
+        return nil
+    }
+    return resp.sendPartial(body)
+}
+
+func (resp *PigeonResponse) Final() bool {
+    return !resp.partial
+}
+
+func (resp *PigeonResponse) Header(name string) string {
+    return resp.RespHeaders[name]
+}
+
+func (resp *PigeonResponse) SetHeader(name, value string) {
+    if resp.RespHeaders == nil {
+        resp.RespHeaders = map[string]string{}
+    }
+    resp.RespHeaders[name] = value
+}
+
 func (resp *PigeonResponse) SetBody(body map[string]interface{}) {
     resp.RespBody = body
 }
@@ -114,4 +327,58 @@ func (req *PigeonRequest) Body() map[string]interface{} {
     return req.ReqBody
 }
 
+func (req *PigeonRequest) Recv() (map[string]interface{}, error) {
+    if req.input == nil {
+        return nil, io.EOF
+    }
+    select {
+    case chunk, ok := <-req.input:
+        if !ok {
+            return nil, io.EOF
+        }
+        return chunk, nil
+    case <-req.Context().Done():
+        return nil, req.Context().Err()
+    }
+}
+
+func (req *PigeonRequest) JobID() string {
+    return req.ReqJobID
+}
+
+func (req *PigeonRequest) Attempt() int {
+    return req.ReqAttempt
+}
+
+func (req *PigeonRequest) Payload() interface{} {
+    return req.payload
+}
+
+func (req *PigeonRequest) Decode(v interface{}) error {
+    return decodePayload(req.ReqBody, v)
+}
+
+func (req *PigeonRequest) Header(name string) string {
+    return req.ReqHeaders[name]
+}
+
+func (req *PigeonRequest) Headers() map[string]string {
+    headers := make(map[string]string, len(req.ReqHeaders))
+    for name, value := range req.ReqHeaders {
+        headers[name] = value
+    }
+    return headers
+}
+
+func (req *PigeonRequest) CorrelationID() string {
+    return req.ReqHeaders[HEADER_CORRELATION_ID]
+}
+
+func (req *PigeonRequest) Context() context.Context {
+    if req.ctx == nil {
+        return context.Background()
+    }
+    return req.ctx
+}
+
 
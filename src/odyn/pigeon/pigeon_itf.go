@@ -16,8 +16,12 @@
 //
 //  Pigeon is Odyn's distributed message passing system.  Pigeon can
 //  efficient pass messages locally or to remote servers and integrates
-//  naturally with golang's native channels.  Pigeon uses Canopy's database to
-//  persistently store routing info, server status and load.
+//  naturally with golang's native channels.  Pigeon uses a Registry to store
+//  routing info, server status and load.  Outboxes use a Router to choose
+//  which server handles each request, optionally based on that load.  The
+//  Registry may live in memory (for single-node servers and tests), in
+//  Odyn's storage engine, or be gossiped between the servers themselves (see
+//  gossip.go), so that small clusters need no database.
 //
 //  A "Message" consists of:
 //      - A string label called the "MsgKey" that controls where the message
@@ -32,15 +36,40 @@
 //  for MsgKey.
 //
 //  The "Inbox" interface allows you to recieve messages with a particular
-//  MsgKey.
+//  MsgKey, or with any MsgKey matching a pattern.  MsgKeys are tokens
+//  separated by ".", and in patterns "*" matches any one token while ">"
+//  matches all remaining tokens.
 //
 //  To create an Inbox, you must first be running a Pigeon RPC Server.
 //
+//  Payloads for a MsgKey can be given a Go struct type, and optionally a JSON
+//  schema, with RegisterMessageType.  Servers then check and decode payloads
+//  before handlers see them.
+//
+//  A "Queue" is a durable alternative to outbox.Launch.  Jobs added to a
+//  Queue are saved in Odyn's storage engine and delivered to exactly one
+//  inbox at a time until a handler succeeds.  Jobs that keep failing are moved
+//  to a dead letter list, where they can be inspected and replayed.
+//
+//  Messages between servers in the same process are delivered directly,
+//  without any network hops.  Messages to other processes go through the
+//  System's Transport.
+//
+//  Servers can limit how fast they accept messages.  A Server over its limit
+//  answers "busy", and outbox.Launch tries another Server instead.
+//
+//  Messages may be delivered more than once, for example when a Queue
+//  retries a job whose response was lost.  A message sent with an
+//  idempotency key is handled once: Servers remember the response and send
+//  it again to retries, without calling the handler.
+//
 package jobqueue
 
 import (
-    "canopy/config"
-    "canopy/datalayer/cassandra_datalayer"
+    "context"
+    "fmt"
+    "odyn/storage"
+    "os"
     "time"
 )
 
@@ -61,6 +90,46 @@ const (
     UNRESPONSIVE
 )
 
+// ResponseStatus says whether a request was handled, and if not, why.
+type ResponseStatus int
+const (
+    // RESP_OK means the handler ran and did not report an error.
+    RESP_OK ResponseStatus = iota
+
+    // RESP_NOT_FOUND means the Server has no inbox (or no handler) for the
+    // msg key.
+    RESP_NOT_FOUND
+
+    // RESP_HANDLER_PANIC means the handler crashed.
+    RESP_HANDLER_PANIC
+
+    // RESP_HANDLER_ERROR means the handler reported an error with SetError.
+    RESP_HANDLER_ERROR
+
+    // RESP_TIMEOUT means no response arrived before the deadline.
+    RESP_TIMEOUT
+
+    // RESP_CANCELLED means the sender gave up on the request.
+    RESP_CANCELLED
+
+    // RESP_TRANSPORT_FAILURE means the request or response could not be
+    // delivered, for example because the Server could not be reached.
+    RESP_TRANSPORT_FAILURE
+
+    // RESP_REJECTED means the request was refused.
+    RESP_REJECTED
+
+    // RESP_BUSY means the Server turned the request away because a rate
+    // limit was exceeded.  The handler did not run, so the request can be
+    // sent elsewhere; Outbox.Launch does this automatically.
+    RESP_BUSY
+
+    // RESP_INVALID_PAYLOAD means the payload did not match the type
+    // registered for its msg key (see RegisterMessageType).  The handler
+    // did not run.  The error's Details list the problems.
+    RESP_INVALID_PAYLOAD
+)
+
 type HandlerFunc func(msgKey string, userCtx interface{}, req Request, resp Response)
 
 type Handler interface {
@@ -78,6 +147,15 @@ type System interface {
     // sets its status to "active".
     StartServer(hostname string) (Server, error)
 
+    // Open the durable job queue for <msgKey> and start delivering its jobs.
+    NewQueue(msgKey string, cfg QueueConfig) (Queue, error)
+
+    // Stop checking for delayed and scheduled launches, and close the
+    // Transport, so Servers no longer receive requests from other processes.
+    // Servers keep serving this System until they are stopped with
+    // Server.Stop.
+    Close() error
+
     // Lookup a specific Server by hostname.
     //Server(hostname string) (Server, error)
 
@@ -87,26 +165,59 @@ type System interface {
 
 type Server interface {
     // Create (and register) a new Inbox that recieves messages labelled
-    // msgKey.
+    // msgKey.  msgKey may be a pattern such as "device.*.telemetry" or
+    // "device.Leela.>" (see trie.go), to receive every matching message.
     CreateInbox(msgKey string) (Inbox, error)
 
-    // Set the Server's status to "active".  Does nothing if server is already
-    // "active".
+    // Set the Server's status to "active", (re-)register its inboxes and
+    // start sending heartbeats.  Does nothing if server is already "active".
     Start() error
 
     // Get the Server's status
     Status() (StatusEnum, error)
 
+    // Limit the number of handler calls for messages labelled msgKey that
+    // run at once on this Server, across all of its inboxes.  Messages over
+    // the limit wait for a free slot until the sender gives up.  Use 0 for
+    // no limit (the default).
+    SetMaxConcurrency(msgKey string, max int) error
+
+    // Limit messages labelled msgKey to perSecond per second on this
+    // Server, allowing bursts of up to burst messages.  Messages over the
+    // limit are rejected with RESP_BUSY.  Use 0 for no limit (the default).
+    SetRateLimit(msgKey string, perSecond float64, burst int) error
+
+    // Same as SetRateLimit, but limits each sending System (identified by
+    // HEADER_SENDER) separately, across all msg keys.
+    SetSenderRateLimit(perSecond float64, burst int) error
+
+    // Limit how many handler calls run at once on this Server, and how the
+    // workers are shared between priorities while requests wait.  See
+    // LaneConfig.  By default there is no limit.
+    SetLanes(cfg LaneConfig) error
+
+    // Get the number of handler calls running, and the state of each
+    // priority's lane.
+    Stats() ServerStats
+
+    // Control how long the Server remembers the responses to requests with
+    // idempotency keys (see HEADER_IDEMPOTENCY_KEY), and where it saves
+    // them.  See DedupConfig.  By default the last 10000 responses from the
+    // past 24 hours are kept in memory, and saved to the System's Storage if
+    // it has one.
+    SetDeduplication(cfg DedupConfig) error
+
     // Set the Server's status to "stopped".  It will no longer recieve
-    // requests until started again.  Does nothing if worker is already
-    // "stopped".
+    // requests until started again.  Waits for requests that are being
+    // handled to finish.  Does nothing if worker is already "stopped".
     Stop() error
 }
 
 type Inbox interface {
     // Close (cleanup & shutdown) this inbox.
     // After this is called Handler will no longer be triggered and this
-    // object's methods will all return "Inbox closed" errors.
+    // object's methods will all return "Inbox closed" errors.  Waits for
+    // handler calls in progress to finish, up to the system's DrainTimeout.
     Close() error
 
     // Get the MsgKey that this inbox is listening for.
@@ -129,19 +240,47 @@ type Inbox interface {
     SetHandlerFunc(fn HandlerFunc) error
 
     // Temporarily stop listening for MsgKey.  Call .Resume() to resume.
-    // Returns an error if inbox is already suspended.
+    // Returns an error if inbox is already suspended.  Waits for handler
+    // calls in progress to finish, up to the system's DrainTimeout.
     Suspend() error
 
     // Set additional data that should be passed to handler.
     SetUserCtx(userCtx interface{})
+
+    // Limit the number of handler calls this inbox runs at once.  Messages
+    // over the limit go to another inbox for the msg key if one is free, or
+    // else wait for a free slot until the sender gives up.  Use 0 for no
+    // limit (the default).
+    SetMaxConcurrency(max int) error
 }
 
 type Outbox interface {
-    // Broadcast a request to every interested Inbox
-    Broadcast(msgKey string, payload map[string]interface{}) error
+    // Broadcast a request to every interested Inbox, on every Server.
+    // Servers are contacted in parallel.  Returns a report of which Servers
+    // received the message.  Handler responses are discarded.  Servers
+    // that have not answered when the outbox's timeout expires are reported
+    // as Failed with RESP_TIMEOUT.
+    Broadcast(msgKey string, payload map[string]interface{}) (*BroadcastReport, error)
+
+    // Same as Broadcast, but Servers that have not answered when <ctx> is
+    // cancelled or its deadline passes are reported as Failed.
+    BroadcastContext(ctx context.Context, msgKey string, payload map[string]interface{}) (*BroadcastReport, error)
+
+    // Send a request to every Server listening for msgKey (one inbox on
+    // each) and collect their responses.  Returns once every Server has
+    // answered, <quorum> Servers have answered successfully (if quorum is
+    // above 0), or <ctx> or the outbox's timeout expires.  Servers that had
+    // not answered by the deadline are reported as Failed with
+    // RESP_TIMEOUT.
+    Gather(ctx context.Context, msgKey string, payload map[string]interface{}, quorum int) (*GatherReport, error)
 
     // Launches a request that will be handled by exactly one Server
     Launch(msgKey string, payload map[string]interface{}) (<-chan Response, error)
+
+    // Same as Launch, but the request is abandoned when <ctx> is cancelled or
+    // its deadline passes.  The deadline is passed along to the handler.  If
+    // the request is abandoned, the Response's Err() says why.
+    LaunchContext(ctx context.Context, msgKey string, payload map[string]interface{}) (<-chan Response, error)
     
     // Launches a request that is idemponent and can be consumed by multiple
     // Servers without ill effect.  This allows the job to be sent to
@@ -149,9 +288,237 @@ type Outbox interface {
     // responds first wins).
     LaunchIdempotent(msgKey string, numParallel uint32, payload map[string]interface{}) (<-chan Response, error)
 
-    // Set the timeout for non-broadcast requests.
+    // Same as LaunchIdempotent, but the request is abandoned when <ctx> is
+    // cancelled or its deadline passes.
+    LaunchIdempotentContext(ctx context.Context, msgKey string, numParallel uint32, payload map[string]interface{}) (<-chan Response, error)
+
+    // Set the timeout for requests.  The timeout covers connecting to the
+    // Server and waiting for the handler.  When it expires, the Response's
+    // Status() is RESP_TIMEOUT.
     // Use a negative value for no timeout.
     SetTimeoutms(timeout int32)
+
+    // Set how Launch chooses a Server.  Defaults to NewRandomRouter().
+    SetRouter(router Router)
+
+    // Set the priority of requests sent through this outbox, unless their
+    // context says otherwise (see WithPriority).  Defaults to
+    // PRIORITY_NORMAL.
+    SetPriority(priority Priority) error
+
+    // Limit the number of requests from Launch and LaunchIdempotent that
+    // are waiting for a response at once.  Further launches block until one
+    // finishes, or until their context or the outbox's timeout expires, in
+    // which case they return an error.  Use 0 for no limit (the default).
+    SetMaxPending(max int)
+
+    // Same as LaunchContext, but the handler's partial responses are
+    // delivered as they are sent, followed by the final response, and the
+    // caller can send input to the handler while it runs.
+    Stream(ctx context.Context, msgKey string, payload map[string]interface{}) (Stream, error)
+
+    // Launch a request at time <at>.  The request is saved in the System's
+    // Storage, so it is sent even if this process restarts in the meantime.
+    // Returns an ID that can be passed to CancelScheduled.
+    LaunchAt(at time.Time, msgKey string, payload map[string]interface{}) (string, error)
+
+    // Same as LaunchAt, but launches the request after <delay>.
+    LaunchAfter(delay time.Duration, msgKey string, payload map[string]interface{}) (string, error)
+
+    // Launch a request every time cron spec <spec> matches, such as
+    // "0 3 * * *" for 03:00 every day.  See cron.go for the syntax.
+    // Replaces any schedule with the same <name>, which must not be empty
+    // or contain "/".
+    Schedule(name string, spec string, msgKey string, payload map[string]interface{}) error
+
+    // Cancel a delayed launch (by ID) or a schedule (by name).
+    CancelScheduled(id string) error
+}
+
+// Stream is a request in progress, started with Outbox.Stream.
+type Stream interface {
+    // Get the handler's partial responses, then its final response (for
+    // which Final() is true).  The channel is closed after the final
+    // response.  The handler's Response.Send blocks while the channel is
+    // full.
+    Responses() <-chan Response
+
+    // Send an input chunk to the handler, which reads it with
+    // Request.Recv().  Blocks if the handler is not keeping up.  Returns an
+    // error once the handler has finished or the context is done.
+    Send(chunk map[string]interface{}) error
+
+    // Tell the handler there is no more input.
+    CloseSend() error
+}
+
+// ServerInfo is what the Registry knows about a Server.
+type ServerInfo struct {
+    Hostname string
+    Status StatusEnum
+
+    // When the Server last reported that it is alive.
+    LastHeartbeat time.Time
+
+    // Number of requests the Server was handling at its last heartbeat.
+    Load int
+}
+
+// Registry stores Pigeon's routing info: which servers exist, whether they
+// are alive, and which msg keys each server is listening for.
+type Registry interface {
+    // Add a server to the registry, if not already present, and set its
+    // status to RUNNING.
+    RegisterWorker(hostname string) error
+
+    // Record that server <hostname> is alive and handling <load> requests.
+    // An UNRESPONSIVE server becomes RUNNING again.
+    Heartbeat(hostname string, load int) error
+
+    // Set the status of server <hostname>.
+    SetWorkerStatus(hostname string, status StatusEnum) error
+
+    // Mark every RUNNING server whose last heartbeat is before <cutoff> as
+    // UNRESPONSIVE.  Returns the hostnames of the servers marked.
+    MarkUnresponsive(cutoff time.Time) ([]string, error)
+
+    // Get what the registry knows about server <hostname>.  The status is
+    // DOES_NOT_EXIST for unknown servers.
+    GetWorker(hostname string) (ServerInfo, error)
+
+    // Record that server <hostname> has an inbox for <msgKey>.
+    RegisterListener(hostname, msgKey string) error
+
+    // Record that server <hostname> no longer has an inbox for <msgKey>.
+    UnregisterListener(hostname, msgKey string) error
+
+    // Get the hostnames of all RUNNING servers that have an inbox for
+    // <msgKey>.
+    GetListeners(msgKey string) ([]string, error)
+
+    // Take lease <name> for <holder> until <ttl> from now, or extend it if
+    // <holder> already has it.  Returns false if another holder has a lease
+    // that has not expired.
+    AcquireLease(name, holder string, ttl time.Duration) (bool, error)
+}
+
+// Transport carries requests between Pigeon servers in different processes.
+type Transport interface {
+    // Start accepting requests from remote outboxes on behalf of <server>.
+    Listen(server *PigeonServer) error
+
+    // Deliver <req> to the server running on <hostname> and fill in <resp>
+    // with the handler's response.  Must give up when <ctx> is done, and
+    // should tell the remote server about <ctx>'s deadline, and that the
+    // caller gave up, so the handler's Request.Context() is cancelled.
+    Call(ctx context.Context, hostname string, req *PigeonRequest, resp *PigeonResponse) error
+
+    // Stop listening for every server, and close connections to other
+    // servers.  Calls in progress fail, and later calls return errors.
+    Close() error
+}
+
+// BroadcastReport describes the outcome of Outbox.Broadcast.
+type BroadcastReport struct {
+    // Hostnames of Servers whose inboxes all handled the message.
+    Succeeded []string
+
+    // Servers that failed to handle the message, with the reason.
+    Failed map[string]error
+}
+
+// GatherReport describes the outcome of Outbox.Gather.
+type GatherReport struct {
+    // Successful responses, by the hostname of the Server that sent them.
+    Responses map[string]Response
+
+    // Servers that failed to handle the request, with the reason.
+    Failed map[string]error
+
+    // Servers that were still working on the request when the quorum was
+    // reached.  Their handlers' Request.Context() is cancelled, for remote
+    // Servers once the transport delivers the cancellation (the TCP
+    // transport sends FRAME_CANCEL).  Handlers that ignore it run to the
+    // end, and their responses are discarded.
+    Unanswered []string
+}
+
+// Queue is a durable job queue for one msg key.  Each job is delivered to
+// one inbox at a time, like Outbox.Launch, until a handler succeeds.  A
+// handler acknowledges a job by returning without calling SetError or
+// Reject.  Failed and timed out deliveries are retried with exponential
+// backoff; after QueueConfig.MaxAttempts failures the job becomes a dead
+// letter.
+//
+// Delivery is at-least-once: a job may be delivered again if this process
+// dies before recording the outcome, so handlers should check
+// Request.JobID().  Only one process should open a Queue for a given msg
+// key at a time.
+type Queue interface {
+    // Save a job and schedule it for delivery.  Returns the job's ID.  The
+    // payload is stored as JSON, so numbers are delivered as float64.
+    Enqueue(payload map[string]interface{}) (string, error)
+
+    // List jobs that have not been delivered yet, oldest first.
+    Pending() ([]JobInfo, error)
+
+    // List jobs that failed too many times, oldest first.
+    DeadLetters() ([]JobInfo, error)
+
+    // Move dead letter <jobID> back onto the queue, with its attempt count
+    // reset.
+    Replay(jobID string) error
+
+    // Delete dead letter <jobID>.
+    Discard(jobID string) error
+
+    // Stop delivering jobs.  Waits for deliveries in progress to finish.
+    // Undelivered jobs stay in storage until the queue is opened again.
+    Close() error
+}
+
+// JobInfo describes a job in a Queue.
+type JobInfo struct {
+    ID string
+    MsgKey string
+    Payload map[string]interface{}
+    Created time.Time
+
+    // Number of times delivery has been attempted.
+    Attempts int
+
+    // When the job will next be delivered.
+    NextAttempt time.Time
+
+    // Why the last delivery failed.
+    LastError string
+}
+
+// QueueConfig controls a Queue.
+type QueueConfig struct {
+    // Where jobs are saved.  Required.
+    Conn storage.Connection
+
+    // Jobs become dead letters after failing this many times.  Defaults
+    // to 5.
+    MaxAttempts int
+
+    // After a failure, wait MinBackoff before delivering the job again.
+    // The wait doubles with each failure, up to MaxBackoff.  Default to 1
+    // second and 5 minutes.
+    MinBackoff time.Duration
+    MaxBackoff time.Duration
+
+    // How long a handler has to respond before the delivery counts as
+    // failed.  Defaults to 30 seconds.
+    AckTimeout time.Duration
+
+    // Maximum number of jobs being delivered at once.  Defaults to 16.
+    MaxInFlight int
+
+    // How to choose a server for each delivery.  Defaults to
+    // NewRandomRouter().
+    Router Router
 }
 
 type RecieveHandler interface {
@@ -165,27 +532,178 @@ func NewRecieveHandler() RecieveHandler{
 
 type Request interface {
     Body() map[string]interface{}
+
+    // Get the payload decoded into the type registered for the msg key
+    // with RegisterMessageType, as a pointer such as *Telemetry.  nil if
+    // no type is registered.
+    Payload() interface{}
+
+    // Decode the payload into <v>, a pointer to a struct, using its json
+    // tags.
+    Decode(v interface{}) error
+
+    // Get a context that is done when the sender stops waiting for a
+    // response.  Long-running handlers should give up when it is done.
+    Context() context.Context
+
+    // Get the ID of the durable job being delivered, or "" if the request
+    // was not sent through a Queue.  A job may be delivered more than once,
+    // so handlers can use this to skip work they have already done.
+    JobID() string
+
+    // Get which delivery attempt of the job this is, starting at 1.  0 if
+    // the request was not sent through a Queue.
+    Attempt() int
+
+    // Get the next input chunk from a sender using Outbox.Stream.  Returns
+    // io.EOF once the sender calls CloseSend (and straight away for requests
+    // that are not streams), or the context's error if the sender gives up.
+    Recv() (map[string]interface{}, error)
+
+    // Get header <name>, such as HEADER_SENDER, or "" if the sender did not
+    // set it.  See headers.go.
+    Header(name string) string
+
+    // Get a copy of all of the request's headers.
+    Headers() map[string]string
+
+    // Get the request's HEADER_CORRELATION_ID.  Context() carries it too, so
+    // requests launched with Context() share it.
+    CorrelationID() string
 }
 
 type Response interface {
     Body() map[string]interface{}
 
+    // Get the reason the request could not be handled, or nil.  Non-nil
+    // errors are of type *Error.
+    Err() error
+
+    // Called by a handler to refuse a request.  Sets the status to
+    // RESP_REJECTED.
+    Reject(reason string)
+
+    // Called by a handler to report that it failed.  Sets the status to
+    // RESP_HANDLER_ERROR, or to err.Status if <err> is an *Error.
+    SetError(err error)
+
+    // Get the status of the request.  RESP_OK means it was handled.
+    Status() ResponseStatus
+
+    // Called by a handler to send a partial response, such as a progress
+    // update, before it returns.  Senders using Outbox.Stream receive it
+    // straight away; others never see it.  Must not be called after the
+    // handler returns.
+    Send(body map[string]interface{}) error
+
+    // False for partial responses sent with Send.  The final response is
+    // the one the handler leaves when it returns.
+    Final() bool
+
     // Must be a gob-able value
     SetBody(body map[string]interface{})
 
     // <value> must be a gob-able value
     AppendToBody(key string, value interface{})
+
+    // Get header <name> set by the handler, or "".  The Server sets
+    // HEADER_CORRELATION_ID to the request's.
+    Header(name string) string
+
+    // Called by a handler to set a header for the sender.
+    SetHeader(name, value string)
 }
 
-func NewPigeonSystem(cfg config.Config) (System, error) {
-    dl := cassandra_datalayer.NewDatalayer(cfg)
-    // TODO: share DB connection
-    conn, err := dl.Connect()
-    if err != nil {
-        return nil, err
+// SystemConfig controls how a Pigeon System finds and talks to servers.
+type SystemConfig struct {
+    // Identifies this System to the Servers it sends requests to, in the
+    // HEADER_SENDER header and for Server.SetSenderRateLimit.  Defaults to
+    // "<hostname>/<pid>".
+    Name string
+
+    // Where routing info is stored.  Defaults to an in-memory registry.
+    Registry Registry
+
+    // How requests reach servers in other processes.  Defaults to a
+    // transport that can only reach servers in this process.
+    Transport Transport
+
+    // How often each running Server records a heartbeat in the Registry.
+    // Defaults to 5 seconds.
+    HeartbeatInterval time.Duration
+
+    // Servers that have not sent a heartbeat for this long are marked
+    // UNRESPONSIVE and no longer receive requests.  Defaults to 3
+    // heartbeat intervals.
+    UnresponsiveAfter time.Duration
+
+    // How long Server.Stop waits for requests that are being handled to
+    // finish.  Defaults to 30 seconds.
+    DrainTimeout time.Duration
+
+    // Where delayed and scheduled launches are saved.  Without it,
+    // Outbox.LaunchAt and Outbox.Schedule return errors.  Every System
+    // sharing a Storage checks for due launches, but only the one holding
+    // the scheduler lease in the Registry sends them.  Servers also save
+    // the responses to requests with idempotency keys here, unless
+    // DedupConfig.Conn says otherwise.
+    Storage storage.Connection
+
+    // How often to check for due launches.  Defaults to 1 second.
+    SchedulerInterval time.Duration
+
+    // How long the scheduler lease lasts without being renewed.  If the
+    // System holding it dies, another takes over after this long.  Defaults
+    // to 15 seconds.
+    SchedulerLease time.Duration
+}
+
+func NewPigeonSystem(cfg SystemConfig) System {
+    if cfg.Name == "" {
+        hostname, _ := os.Hostname()
+        cfg.Name = fmt.Sprintf("%s/%d", hostname, os.Getpid())
+    }
+    if cfg.Registry == nil {
+        cfg.Registry = NewMemRegistry()
+    }
+    if cfg.Transport == nil {
+        cfg.Transport = NewLocalTransport()
+    }
+    if cfg.HeartbeatInterval <= 0 {
+        cfg.HeartbeatInterval = 5 * time.Second
+    }
+    if cfg.UnresponsiveAfter <= 0 {
+        cfg.UnresponsiveAfter = 3 * cfg.HeartbeatInterval
+    }
+    if cfg.DrainTimeout <= 0 {
+        cfg.DrainTimeout = 30 * time.Second
+    }
+    if cfg.SchedulerInterval <= 0 {
+        cfg.SchedulerInterval = time.Second
+    }
+    if cfg.SchedulerLease <= 0 {
+        cfg.SchedulerLease = 15 * time.Second
+    }
+    if cfg.SchedulerLease < 2 * cfg.SchedulerInterval {
+        cfg.SchedulerLease = 2 * cfg.SchedulerInterval
     }
 
-    dlpigeon := conn.PigeonSystem()
-    
-    return &PigeonSystem{dlpigeon}, nil
+    sys := &PigeonSystem{
+        cfg: cfg,
+        registry: cfg.Registry,
+        transport: cfg.Transport,
+        servers: map[string]*PigeonServer{},
+    }
+    if cfg.Storage != nil {
+        sys.scheduler = newScheduler(sys)
+        go sys.scheduler.run()
+    }
+    return sys
+}
+
+// Create a Pigeon System that runs entirely in this process.  All servers
+// started with it share an in-memory registry and exchange messages without
+// touching the network.
+func NewLocalPigeonSystem() System {
+    return NewPigeonSystem(SystemConfig{})
 }
@@ -0,0 +1,201 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+)
+
+// Start a System with a server called <hostname>, stopped when the test ends.
+func newTestServer(t *testing.T, hostname string) (*PigeonSystem, *PigeonServer) {
+    sys := NewPigeonSystem(SystemConfig{DrainTimeout: time.Second}).(*PigeonSystem)
+    server, err := sys.StartServer(hostname)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        server.Stop()
+    })
+    return sys, server.(*PigeonServer)
+}
+
+// Create an inbox for <msgKey> on <server> that calls <fn>.
+func newTestInbox(t *testing.T, server Server, msgKey string, fn HandlerFunc) Inbox {
+    inbox, err := server.CreateInbox(msgKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = inbox.SetHandlerFunc(fn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return inbox
+}
+
+// Wait for the response to a launch, failing the test if it takes too long.
+func waitResponse(t *testing.T, respChan <-chan Response) Response {
+    t.Helper()
+    select {
+    case resp := <-respChan:
+        return resp
+    case <-time.After(5 * time.Second):
+        t.Fatal("No response")
+    }
+    return nil
+}
+
+// In-memory storage.Connection.  Documents are stored as JSON, as a real
+// backend would.
+type memConn struct {
+    mu sync.Mutex
+    docs map[string][]byte
+}
+
+func newMemConn() *memConn {
+    return &memConn{docs: map[string][]byte{}}
+}
+
+func (conn *memConn) Close() {}
+
+func (conn *memConn) DeleteDocument(path string) error {
+    conn.mu.Lock()
+    defer conn.mu.Unlock()
+    _, ok := conn.docs[path]
+    if !ok {
+        return fmt.Errorf("no document %s", path)
+    }
+    delete(conn.docs, path)
+    return nil
+}
+
+func (conn *memConn) LoadDocument(path string) (interface{}, error) {
+    conn.mu.Lock()
+    defer conn.mu.Unlock()
+    data, ok := conn.docs[path]
+    if !ok {
+        return nil, fmt.Errorf("no document %s", path)
+    }
+    var doc map[string]interface{}
+    err := json.Unmarshal(data, &doc)
+    return doc, err
+}
+
+func (conn *memConn) SaveDocument(path string, doc interface{}) error {
+    conn.mu.Lock()
+    defer conn.mu.Unlock()
+    data, err := json.Marshal(doc)
+    if err != nil {
+        return err
+    }
+    conn.docs[path] = data
+    return nil
+}
+
+func TestLocalLaunch(t *testing.T) {
+    sys, server := newTestServer(t, "local")
+    newTestInbox(t, server, "greet", func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        resp.SetBody(map[string]interface{}{"greeting": "Hello " + req.Body()["name"].(string)})
+    })
+
+    respChan, err := sys.NewOutbox().Launch("greet", map[string]interface{}{"name": "Leela"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp := waitResponse(t, respChan)
+    if resp.Err() != nil {
+        t.Fatal(resp.Err())
+    }
+    if resp.Body()["greeting"] != "Hello Leela" {
+        t.Errorf("Body is %v", resp.Body())
+    }
+}
+
+func TestLocalLaunchTimeout(t *testing.T) {
+    sys, server := newTestServer(t, "local")
+    release := make(chan struct{})
+    newTestInbox(t, server, "slow", func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        <-release
+    })
+    defer close(release)
+
+    outbox := sys.NewOutbox()
+    outbox.SetTimeoutms(20)
+    respChan, err := outbox.Launch("slow", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !IsTimeout(waitResponse(t, respChan).Err()) {
+        t.Error("Expected a timeout")
+    }
+}
+
+func TestCallLocalTimeoutLeavesResponse(t *testing.T) {
+    sys, server := newTestServer(t, "local")
+    finished := make(chan struct{})
+    newTestInbox(t, server, "slow", func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        defer close(finished)
+        time.Sleep(50 * time.Millisecond)
+        resp.SetBody(map[string]interface{}{"late": true})
+        resp.SetError(fmt.Errorf("too late"))
+    })
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+    defer cancel()
+    resp := &PigeonResponse{RespBody: map[string]interface{}{"mine": true}}
+    err := sys.callLocal(ctx, server, &PigeonRequest{ReqJobKey: "slow"}, resp)
+    if err != context.DeadlineExceeded {
+        t.Errorf("callLocal returned %v", err)
+    }
+
+    // The handler finishing later must not touch our response
+    <-finished
+    time.Sleep(10 * time.Millisecond)
+    if resp.RespStatus != RESP_OK || resp.RespBody["mine"] != true || resp.RespBody["late"] != nil {
+        t.Errorf("Response was changed to %+v", resp)
+    }
+}
+
+func TestLocalCallNotFound(t *testing.T) {
+    sys, server := newTestServer(t, "local")
+    newTestInbox(t, server, "greet", func(msgKey string, userCtx interface{}, req Request, resp Response) {})
+
+    resp := &PigeonResponse{}
+    err := sys.call(context.Background(), "local", &PigeonRequest{ReqJobKey: "unknown"}, resp)
+    if err == nil || resp.RespStatus != RESP_NOT_FOUND {
+        t.Errorf("Expected RESP_NOT_FOUND, got %v", err)
+    }
+
+    _, err = sys.NewOutbox().Launch("unknown", nil)
+    if err == nil {
+        t.Error("Launch found a listener for an unknown msg key")
+    }
+}
+
+func TestLocalCallStoppedServer(t *testing.T) {
+    sys, server := newTestServer(t, "local")
+    newTestInbox(t, server, "greet", func(msgKey string, userCtx interface{}, req Request, resp Response) {})
+    server.Stop()
+
+    resp := &PigeonResponse{}
+    sys.call(context.Background(), "local", &PigeonRequest{ReqJobKey: "greet"}, resp)
+    if resp.RespStatus != RESP_REJECTED {
+        t.Errorf("Expected RESP_REJECTED, got %s", resp.Err())
+    }
+}
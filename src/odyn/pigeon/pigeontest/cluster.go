@@ -0,0 +1,198 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Test harness for Pigeon.
+//
+// A Cluster runs several Pigeon servers in this process, each with its own
+// System, talking to each other over TCP on loopback ports.  Because the
+// servers do not share a System, requests between them go through the
+// Transport, where Faults can drop, delay, duplicate or reorder them, or
+// partition the cluster:
+//
+//      cluster, err := pigeontest.NewCluster("a", "b", "c")
+//      ...
+//      defer cluster.Close()
+//
+//      inbox, _ := cluster.Node("b").Server.CreateInbox("greet")
+//      inbox.SetHandlerFunc(...)
+//
+//      cluster.Faults.Partition("a")
+//      outbox := cluster.Node("a").System.NewOutbox()
+//      outbox.SetTimeoutms(100)
+//      respChan, _ := outbox.Launch("greet", nil)
+//      // (<-respChan).Err() is a RESP_TIMEOUT error
+//
+// Requests a System sends to its own server skip the Transport, so they never
+// suffer faults.
+package pigeontest
+
+import (
+    "fmt"
+    "net"
+    pigeon "odyn/pigeon"
+)
+
+// ClusterConfig controls a Cluster.
+type ClusterConfig struct {
+    // Template for each node's System.  The Registry (shared by the
+    // cluster) and Transport are filled in by the Cluster, and Name is set
+    // to the node's name.
+    System pigeon.SystemConfig
+
+    // Configuration of the TCP Transport under each node's FaultTransport.
+    // ListenHost is always the loopback interface.
+    TCP pigeon.TCPTransportConfig
+
+    // Random source for the Faults.
+    Seed int64
+}
+
+var DefaultClusterConfig = ClusterConfig{
+    TCP: pigeon.DefaultTCPTransportConfig,
+    Seed: 1,
+}
+
+// Cluster is a set of Pigeon servers running in this process.
+type Cluster struct {
+    // Faults injected into requests between nodes
+    Faults *Faults
+
+    // Registry shared by every node
+    Registry pigeon.Registry
+
+    nodes []*Node
+    byName map[string]*Node
+}
+
+// Node is one server in a Cluster.
+type Node struct {
+    Name string
+
+    // Hostname of the server, "127.0.0.1:<port>"
+    Hostname string
+
+    System pigeon.System
+    Server pigeon.Server
+    Transport *FaultTransport
+}
+
+// Start a cluster with a server for each of <names>, using
+// DefaultClusterConfig.
+func NewCluster(names ...string) (*Cluster, error) {
+    return NewClusterWithConfig(DefaultClusterConfig, names...)
+}
+
+// Start a cluster with a server for each of <names>.
+func NewClusterWithConfig(cfg ClusterConfig, names ...string) (*Cluster, error) {
+    cfg.TCP.ListenHost = "127.0.0.1"
+
+    cluster := &Cluster{
+        Faults: NewFaults(cfg.Seed),
+        Registry: pigeon.NewMemRegistry(),
+        byName: map[string]*Node{},
+    }
+    for _, name := range names {
+        _, exists := cluster.byName[name]
+        if exists {
+            cluster.Close()
+            return nil, fmt.Errorf("pigeontest: Node %s named twice", name)
+        }
+        node, err := cluster.startNode(cfg, name)
+        if err != nil {
+            cluster.Close()
+            return nil, err
+        }
+        cluster.nodes = append(cluster.nodes, node)
+        cluster.byName[name] = node
+    }
+    return cluster, nil
+}
+
+func (cluster *Cluster) startNode(cfg ClusterConfig, name string) (*Node, error) {
+    port, err := freePort()
+    if err != nil {
+        return nil, err
+    }
+    hostname := fmt.Sprintf("127.0.0.1:%d", port)
+    cluster.Faults.SetName(hostname, name)
+
+    tcp, err := pigeon.NewTCPTransportWithConfig(cfg.TCP)
+    if err != nil {
+        return nil, err
+    }
+    transport := NewFaultTransport(tcp, name, cluster.Faults)
+
+    sysCfg := cfg.System
+    sysCfg.Name = name
+    sysCfg.Registry = cluster.Registry
+    sysCfg.Transport = transport
+    sys := pigeon.NewPigeonSystem(sysCfg)
+
+    server, err := sys.StartServer(hostname)
+    if err != nil {
+        sys.Close()
+        return nil, fmt.Errorf("pigeontest: Cannot start node %s: %s", name, err.Error())
+    }
+
+    return &Node{
+        Name: name,
+        Hostname: hostname,
+        System: sys,
+        Server: server,
+        Transport: transport,
+    }, nil
+}
+
+// Find a loopback port that nothing is listening on.
+func freePort() (int, error) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        return 0, err
+    }
+    defer l.Close()
+    return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// Get the node called <name>, or nil.
+func (cluster *Cluster) Node(name string) *Node {
+    return cluster.byName[name]
+}
+
+// Get every node, in the order they were named.
+func (cluster *Cluster) Nodes() []*Node {
+    return append([]*Node{}, cluster.nodes...)
+}
+
+// Create an outbox that sends from node <name>.
+func (cluster *Cluster) Outbox(name string) pigeon.Outbox {
+    return cluster.byName[name].System.NewOutbox()
+}
+
+// Remove every fault, then stop every server and close its System, which
+// closes its Transport.
+func (cluster *Cluster) Close() error {
+    cluster.Faults.Heal()
+    var firstErr error
+    for _, node := range cluster.nodes {
+        err := node.Server.Stop()
+        if err != nil && firstErr == nil {
+            firstErr = err
+        }
+        err = node.System.Close()
+        if err != nil && firstErr == nil {
+            firstErr = err
+        }
+    }
+    return firstErr
+}
@@ -0,0 +1,351 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pigeontest
+
+import (
+    "context"
+    "net"
+    pigeon "odyn/pigeon"
+    "reflect"
+    "sort"
+    "sync"
+    "testing"
+    "time"
+)
+
+// Short timeout for requests that are expected to be lost.
+const lostTimeoutms = 100
+
+func newTestCluster(t *testing.T, names ...string) *Cluster {
+    cluster, err := NewCluster(names...)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { cluster.Close() })
+    return cluster
+}
+
+// Records the "n" of each request a node handles.
+type handled struct {
+    mu sync.Mutex
+    seen []int
+}
+
+func (h *handled) list() []int {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return append([]int{}, h.seen...)
+}
+
+// Create an inbox for "work" on node <name> that records each request and
+// answers with the node's name.
+func serveWork(t *testing.T, cluster *Cluster, name string) *handled {
+    h := &handled{}
+    inbox, err := cluster.Node(name).Server.CreateInbox("work")
+    if err != nil {
+        t.Fatal(err)
+    }
+    inbox.SetHandlerFunc(func(msgKey string, userCtx interface{}, req pigeon.Request, resp pigeon.Response) {
+        // Numbers arrive as ints with gob, and as float64s with JSON
+        n := 0
+        switch value := req.Body()["n"].(type) {
+        case int:
+            n = value
+        case float64:
+            n = int(value)
+        }
+        h.mu.Lock()
+        h.seen = append(h.seen, n)
+        h.mu.Unlock()
+        resp.SetBody(map[string]interface{}{"from": name})
+    })
+    return h
+}
+
+func launch(t *testing.T, outbox pigeon.Outbox, n int) <-chan pigeon.Response {
+    respChan, err := outbox.Launch("work", map[string]interface{}{"n": n})
+    if err != nil {
+        t.Fatal(err)
+    }
+    return respChan
+}
+
+func wait(t *testing.T, respChan <-chan pigeon.Response) pigeon.Response {
+    t.Helper()
+    select {
+    case resp := <-respChan:
+        return resp
+    case <-time.After(5 * time.Second):
+        t.Fatal("No response")
+    }
+    return nil
+}
+
+func expectTimeout(t *testing.T, resp pigeon.Response) {
+    t.Helper()
+    if !pigeon.IsTimeout(resp.Err()) {
+        t.Errorf("Expected a timeout, got %v (%v)", resp.Status(), resp.Err())
+    }
+}
+
+func TestLaunchBetweenNodes(t *testing.T) {
+    cluster := newTestCluster(t, "a", "b")
+    h := serveWork(t, cluster, "b")
+
+    resp := wait(t, launch(t, cluster.Outbox("a"), 1))
+    if resp.Err() != nil {
+        t.Fatal(resp.Err())
+    }
+    if resp.Body()["from"] != "b" {
+        t.Errorf("Answered by %v", resp.Body()["from"])
+    }
+    if !reflect.DeepEqual(h.list(), []int{1}) {
+        t.Errorf("b handled %v", h.list())
+    }
+}
+
+func TestDrop(t *testing.T) {
+    cluster := newTestCluster(t, "a", "b")
+    h := serveWork(t, cluster, "b")
+    cluster.Faults.Drop("a", "b", 1)
+
+    outbox := cluster.Outbox("a")
+    outbox.SetTimeoutms(lostTimeoutms)
+    expectTimeout(t, wait(t, launch(t, outbox, 1)))
+    if len(h.list()) != 0 {
+        t.Errorf("Dropped request was handled: %v", h.list())
+    }
+    if stats := cluster.Faults.Stats(); stats.Dropped != 1 {
+        t.Errorf("Stats %+v", stats)
+    }
+
+    // Drops without a deadline fail at once
+    outbox.SetTimeoutms(-1)
+    resp := wait(t, launch(t, outbox, 2))
+    if resp.Err() == nil {
+        t.Error("Dropped request succeeded")
+    }
+}
+
+func TestDropResponses(t *testing.T) {
+    cluster := newTestCluster(t, "a", "b")
+    h := serveWork(t, cluster, "b")
+    cluster.Faults.DropResponses(ANY, "b", 1)
+
+    outbox := cluster.Outbox("a")
+    outbox.SetTimeoutms(lostTimeoutms)
+    expectTimeout(t, wait(t, launch(t, outbox, 1)))
+    if !reflect.DeepEqual(h.list(), []int{1}) {
+        t.Errorf("b handled %v", h.list())
+    }
+    if stats := cluster.Faults.Stats(); stats.DroppedResponses != 1 {
+        t.Errorf("Stats %+v", stats)
+    }
+}
+
+func TestDelay(t *testing.T) {
+    cluster := newTestCluster(t, "a", "b")
+    serveWork(t, cluster, "b")
+    const delay = 100 * time.Millisecond
+    cluster.Faults.Delay("a", "b", delay)
+
+    start := time.Now()
+    resp := wait(t, launch(t, cluster.Outbox("a"), 1))
+    if resp.Err() != nil {
+        t.Fatal(resp.Err())
+    }
+    if elapsed := time.Since(start); elapsed < delay {
+        t.Errorf("Delayed request answered after %s", elapsed)
+    }
+}
+
+func TestDuplicate(t *testing.T) {
+    cluster := newTestCluster(t, "a", "b")
+    h := serveWork(t, cluster, "b")
+    cluster.Faults.Duplicate("a", "b", 1)
+
+    resp := wait(t, launch(t, cluster.Outbox("a"), 1))
+    if resp.Err() != nil {
+        t.Fatal(resp.Err())
+    }
+    deadline := time.Now().Add(5 * time.Second)
+    for len(h.list()) < 2 && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if !reflect.DeepEqual(h.list(), []int{1, 1}) {
+        t.Errorf("b handled %v", h.list())
+    }
+}
+
+func TestReorder(t *testing.T) {
+    cluster := newTestCluster(t, "a", "b")
+    h := serveWork(t, cluster, "b")
+    cluster.Faults.Reorder("a", "b", 3, 5 * time.Second)
+
+    outbox := cluster.Outbox("a")
+    respChans := []<-chan pigeon.Response{}
+    for n := 1; n <= 3; n++ {
+        respChans = append(respChans, launch(t, outbox, n))
+        // Let each request reach the queue before the next
+        time.Sleep(20 * time.Millisecond)
+    }
+    for _, respChan := range respChans {
+        resp := wait(t, respChan)
+        if resp.Err() != nil {
+            t.Fatal(resp.Err())
+        }
+    }
+    if !reflect.DeepEqual(h.list(), []int{3, 2, 1}) {
+        t.Errorf("b handled %v", h.list())
+    }
+
+    // A partial batch is sent after maxWait
+    cluster.Faults.Heal()
+    cluster.Faults.Reorder("a", "b", 3, 50 * time.Millisecond)
+    resp := wait(t, launch(t, outbox, 4))
+    if resp.Err() != nil {
+        t.Fatal(resp.Err())
+    }
+}
+
+func TestPartition(t *testing.T) {
+    cluster := newTestCluster(t, "a", "b", "c")
+    h := serveWork(t, cluster, "b")
+    cluster.Faults.Partition("a")
+
+    outbox := cluster.Outbox("a")
+    outbox.SetTimeoutms(lostTimeoutms)
+    expectTimeout(t, wait(t, launch(t, outbox, 1)))
+
+    resp := wait(t, launch(t, cluster.Outbox("c"), 2))
+    if resp.Err() != nil {
+        t.Fatal(resp.Err())
+    }
+    if !reflect.DeepEqual(h.list(), []int{2}) {
+        t.Errorf("b handled %v", h.list())
+    }
+
+    cluster.Faults.Heal()
+    resp = wait(t, launch(t, outbox, 3))
+    if resp.Err() != nil {
+        t.Fatal(resp.Err())
+    }
+}
+
+func TestBroadcast(t *testing.T) {
+    cluster := newTestCluster(t, "a", "b", "c")
+    serveWork(t, cluster, "b")
+    serveWork(t, cluster, "c")
+
+    outbox := cluster.Outbox("a")
+    outbox.SetTimeoutms(lostTimeoutms)
+    report, err := outbox.Broadcast("work", map[string]interface{}{"n": 1})
+    if err != nil {
+        t.Fatal(err)
+    }
+    succeeded := append([]string{}, report.Succeeded...)
+    sort.Strings(succeeded)
+    expected := []string{cluster.Node("b").Hostname, cluster.Node("c").Hostname}
+    sort.Strings(expected)
+    if !reflect.DeepEqual(succeeded, expected) || len(report.Failed) != 0 {
+        t.Errorf("Report %+v", report)
+    }
+
+    cluster.Faults.Partition("a", "b")
+    report, err = outbox.Broadcast("work", map[string]interface{}{"n": 2})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(report.Succeeded, []string{cluster.Node("b").Hostname}) {
+        t.Errorf("Succeeded %v", report.Succeeded)
+    }
+    if !pigeon.IsTimeout(report.Failed[cluster.Node("c").Hostname]) {
+        t.Errorf("Failed %v", report.Failed)
+    }
+}
+
+func TestTimeout(t *testing.T) {
+    cluster := newTestCluster(t, "a", "b")
+    serveWork(t, cluster, "b")
+    cluster.Faults.Delay("a", "b", time.Second)
+
+    outbox := cluster.Outbox("a")
+    outbox.SetTimeoutms(lostTimeoutms)
+    start := time.Now()
+    expectTimeout(t, wait(t, launch(t, outbox, 1)))
+    if elapsed := time.Since(start); elapsed >= time.Second {
+        t.Errorf("Timed out after %s", elapsed)
+    }
+
+    // A context deadline works the same way
+    ctx, cancel := context.WithTimeout(context.Background(), lostTimeoutms * time.Millisecond)
+    defer cancel()
+    outbox.SetTimeoutms(-1)
+    respChan, err := outbox.LaunchContext(ctx, "work", map[string]interface{}{"n": 2})
+    if err != nil {
+        t.Fatal(err)
+    }
+    expectTimeout(t, wait(t, respChan))
+}
+
+// A retry with the same idempotency key, after the response was lost, gets
+// the saved response instead of running the handler again.
+func TestRetryAfterLostResponse(t *testing.T) {
+    cluster := newTestCluster(t, "a", "b")
+    h := serveWork(t, cluster, "b")
+    cluster.Faults.DropResponses("a", "b", 1)
+
+    outbox := cluster.Outbox("a")
+    outbox.SetTimeoutms(lostTimeoutms)
+    ctx := pigeon.WithIdempotencyKey(context.Background(), "job-1")
+    respChan, err := outbox.LaunchContext(ctx, "work", map[string]interface{}{"n": 1})
+    if err != nil {
+        t.Fatal(err)
+    }
+    expectTimeout(t, wait(t, respChan))
+
+    cluster.Faults.Heal()
+    respChan, err = outbox.LaunchContext(ctx, "work", map[string]interface{}{"n": 1})
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp := wait(t, respChan)
+    if resp.Err() != nil {
+        t.Fatal(resp.Err())
+    }
+    if resp.Header(pigeon.HEADER_REPLAYED) != "true" || resp.Body()["from"] != "b" {
+        t.Errorf("Retry got %v %v", resp.Header(pigeon.HEADER_REPLAYED), resp.Body())
+    }
+    if !reflect.DeepEqual(h.list(), []int{1}) {
+        t.Errorf("b handled %v", h.list())
+    }
+}
+
+func TestCloseStopsListening(t *testing.T) {
+    cluster, err := NewCluster("a", "b")
+    if err != nil {
+        t.Fatal(err)
+    }
+    hostname := cluster.Node("b").Hostname
+    err = cluster.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+    conn, err := net.Dial("tcp", hostname)
+    if err == nil {
+        conn.Close()
+        t.Errorf("%s still listening after Close", hostname)
+    }
+}
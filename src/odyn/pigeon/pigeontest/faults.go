@@ -0,0 +1,363 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pigeontest
+
+import (
+    "context"
+    "errors"
+    "math/rand"
+    pigeon "odyn/pigeon"
+    "sync"
+    "time"
+)
+
+// Matches any server in fault rules.
+const ANY = "*"
+
+// Gap between the requests a Reorder rule releases.
+const REORDER_GAP = 5 * time.Millisecond
+
+// Returned for dropped requests when the sender has no deadline to wait for.
+var ErrDropped = errors.New("pigeontest: Request dropped")
+
+type faultKind int
+const (
+    faultDrop faultKind = iota
+    faultDropResponse
+    faultDelay
+    faultDuplicate
+    faultReorder
+)
+
+// A fault applied to requests from server <from> to server <to>.
+type faultRule struct {
+    kind faultKind
+    from string
+    to string
+    probability float64
+    delay time.Duration
+    reorder *reorderQueue
+}
+
+// Faults is a set of faults to inject into requests between servers.  Rules
+// name servers by the names given to NewCluster (or SetName), or ANY.
+// Probabilistic rules draw from a random source seeded when the Faults are
+// created, so a test that sends requests in a fixed order sees the same
+// faults every run.
+type Faults struct {
+    mu sync.Mutex
+    rand *rand.Rand
+    rules []*faultRule
+
+    // Servers that can only reach each other, by name.  Empty if there is
+    // no partition.
+    sides map[string]int
+
+    // Server names by hostname
+    names map[string]string
+
+    stats FaultStats
+}
+
+// FaultStats counts the faults injected so far.
+type FaultStats struct {
+    Dropped int
+    DroppedResponses int
+    Delayed int
+    Duplicated int
+    Reordered int
+    Partitioned int
+}
+
+// What to do to one request.
+type faultPlan struct {
+    drop bool
+    dropResponse bool
+    delay time.Duration
+    duplicate bool
+    reorder *reorderQueue
+}
+
+// Requests held by a Reorder rule until a batch is complete.
+type reorderQueue struct {
+    batch int
+    maxWait time.Duration
+
+    mu sync.Mutex
+    waiting []chan struct{}
+}
+
+// FaultTransport is a pigeon Transport that injects Faults into the
+// requests one server sends, and passes the rest to another Transport.
+type FaultTransport struct {
+    inner pigeon.Transport
+    from string
+    faults *Faults
+}
+
+// Create an empty set of faults, with random source <seed>.
+func NewFaults(seed int64) *Faults {
+    return &Faults{
+        rand: rand.New(rand.NewSource(seed)),
+        sides: map[string]int{},
+        names: map[string]string{},
+    }
+}
+
+// Wrap <inner> so that requests sent by server <from> suffer <faults>.
+func NewFaultTransport(inner pigeon.Transport, from string, faults *Faults) *FaultTransport {
+    return &FaultTransport{
+        inner: inner,
+        from: from,
+        faults: faults,
+    }
+}
+
+// Refer to server <hostname> as <name> in rules.
+func (faults *Faults) SetName(hostname, name string) {
+    faults.mu.Lock()
+    defer faults.mu.Unlock()
+    faults.names[hostname] = name
+}
+
+func (faults *Faults) addRule(rule *faultRule) {
+    faults.mu.Lock()
+    defer faults.mu.Unlock()
+    faults.rules = append(faults.rules, rule)
+}
+
+// Lose requests from <from> to <to> with <probability>.  The handler never
+// runs.  The sender waits until its context is done, or gets ErrDropped if
+// it has no deadline.
+func (faults *Faults) Drop(from, to string, probability float64) {
+    faults.addRule(&faultRule{kind: faultDrop, from: from, to: to, probability: probability})
+}
+
+// Lose responses to requests from <from> to <to> with <probability>.  The
+// handler runs, but the sender behaves as for Drop.
+func (faults *Faults) DropResponses(from, to string, probability float64) {
+    faults.addRule(&faultRule{kind: faultDropResponse, from: from, to: to, probability: probability})
+}
+
+// Hold requests from <from> to <to> for <delay> before sending them.
+func (faults *Faults) Delay(from, to string, delay time.Duration) {
+    faults.addRule(&faultRule{kind: faultDelay, from: from, to: to, probability: 1, delay: delay})
+}
+
+// Send requests from <from> to <to> twice with <probability>, so the
+// handler runs twice.  The sender gets the first response.
+func (faults *Faults) Duplicate(from, to string, probability float64) {
+    faults.addRule(&faultRule{kind: faultDuplicate, from: from, to: to, probability: probability})
+}
+
+// Hold requests from <from> to <to> until <batch> of them are waiting, then
+// send them in reverse order, REORDER_GAP apart.  A partial batch is sent
+// once its first request has waited <maxWait>.
+func (faults *Faults) Reorder(from, to string, batch int, maxWait time.Duration) {
+    faults.addRule(&faultRule{
+        kind: faultReorder,
+        from: from,
+        to: to,
+        probability: 1,
+        reorder: &reorderQueue{batch: batch, maxWait: maxWait},
+    })
+}
+
+// Split the servers in two: those named in <side> can only reach each
+// other, and the rest can only reach each other.  Requests across the
+// partition are dropped.  Replaces any previous partition.
+func (faults *Faults) Partition(side ...string) {
+    faults.mu.Lock()
+    defer faults.mu.Unlock()
+    faults.sides = map[string]int{}
+    for _, name := range side {
+        faults.sides[name] = 1
+    }
+}
+
+// Remove every fault, including partitions.
+func (faults *Faults) Heal() {
+    faults.mu.Lock()
+    defer faults.mu.Unlock()
+    faults.rules = nil
+    faults.sides = map[string]int{}
+}
+
+func (faults *Faults) Stats() FaultStats {
+    faults.mu.Lock()
+    defer faults.mu.Unlock()
+    return faults.stats
+}
+
+func (faults *Faults) nameOf(hostname string) string {
+    faults.mu.Lock()
+    defer faults.mu.Unlock()
+    name, ok := faults.names[hostname]
+    if !ok {
+        return hostname
+    }
+    return name
+}
+
+func (rule *faultRule) matches(from, to string) bool {
+    return (rule.from == ANY || rule.from == from) && (rule.to == ANY || rule.to == to)
+}
+
+// Decide what happens to the next request from <from> to <to>.
+func (faults *Faults) plan(from, to string) faultPlan {
+    faults.mu.Lock()
+    defer faults.mu.Unlock()
+
+    plan := faultPlan{}
+    if len(faults.sides) > 0 && faults.sides[from] != faults.sides[to] {
+        faults.stats.Partitioned++
+        plan.drop = true
+        return plan
+    }
+
+    for _, rule := range faults.rules {
+        if !rule.matches(from, to) || faults.rand.Float64() >= rule.probability {
+            continue
+        }
+        switch rule.kind {
+        case faultDrop:
+            if !plan.drop {
+                faults.stats.Dropped++
+            }
+            plan.drop = true
+        case faultDropResponse:
+            if !plan.dropResponse {
+                faults.stats.DroppedResponses++
+            }
+            plan.dropResponse = true
+        case faultDelay:
+            faults.stats.Delayed++
+            plan.delay += rule.delay
+        case faultDuplicate:
+            if !plan.duplicate {
+                faults.stats.Duplicated++
+            }
+            plan.duplicate = true
+        case faultReorder:
+            if plan.reorder == nil {
+                faults.stats.Reordered++
+                plan.reorder = rule.reorder
+            }
+        }
+    }
+    return plan
+}
+
+// Wait until the request's batch is released, or <ctx> is done.
+func (queue *reorderQueue) wait(ctx context.Context) error {
+    ready := make(chan struct{})
+    queue.mu.Lock()
+    queue.waiting = append(queue.waiting, ready)
+    switch {
+    case len(queue.waiting) >= queue.batch:
+        queue.releaseLocked()
+    case len(queue.waiting) == 1:
+        time.AfterFunc(queue.maxWait, queue.releaseStale(ready))
+    }
+    queue.mu.Unlock()
+
+    select {
+    case <-ready:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// Get a function that releases the batch started by <first>, if it is still
+// waiting.
+func (queue *reorderQueue) releaseStale(first chan struct{}) func() {
+    return func() {
+        queue.mu.Lock()
+        defer queue.mu.Unlock()
+        if len(queue.waiting) > 0 && queue.waiting[0] == first {
+            queue.releaseLocked()
+        }
+    }
+}
+
+// Release the waiting requests, last first.  Caller must hold queue.mu.
+func (queue *reorderQueue) releaseLocked() {
+    batch := queue.waiting
+    queue.waiting = nil
+    go func() {
+        for i := len(batch) - 1; i >= 0; i-- {
+            close(batch[i])
+            time.Sleep(REORDER_GAP)
+        }
+    }()
+}
+
+// Wait for <ctx>'s deadline, as a sender does for a lost message.  Senders
+// without a deadline would wait forever, so they get ErrDropped instead.
+func lost(ctx context.Context) error {
+    _, hasDeadline := ctx.Deadline()
+    if !hasDeadline {
+        return ErrDropped
+    }
+    <-ctx.Done()
+    return ctx.Err()
+}
+
+func (transport *FaultTransport) Listen(server *pigeon.PigeonServer) error {
+    return transport.inner.Listen(server)
+}
+
+func (transport *FaultTransport) Close() error {
+    return transport.inner.Close()
+}
+
+func (transport *FaultTransport) Call(ctx context.Context, hostname string, req *pigeon.PigeonRequest, resp *pigeon.PigeonResponse) error {
+    plan := transport.faults.plan(transport.from, transport.faults.nameOf(hostname))
+    if plan.drop {
+        return lost(ctx)
+    }
+
+    if plan.delay > 0 {
+        select {
+        case <-time.After(plan.delay):
+        case <-ctx.Done():
+            return ctx.Err()
+        }
+    }
+
+    if plan.reorder != nil {
+        err := plan.reorder.wait(ctx)
+        if err != nil {
+            return err
+        }
+    }
+
+    if plan.duplicate {
+        go transport.inner.Call(ctx, hostname, req, &pigeon.PigeonResponse{})
+    }
+
+    // Leave <resp> alone if the response is lost
+    reply := &pigeon.PigeonResponse{}
+    err := transport.inner.Call(ctx, hostname, req, reply)
+    if err != nil {
+        return err
+    }
+    if plan.dropResponse {
+        return lost(ctx)
+    }
+    *resp = *reply
+    return nil
+}
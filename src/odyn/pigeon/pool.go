@@ -0,0 +1,303 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "odyn/log"
+    "sync"
+    "time"
+)
+
+// Pool of long-lived Pigeon connections, keyed by server address.
+//
+// Each connection multiplexes any number of concurrent calls, so a few
+// connections per host are plenty.  Connections are dropped once they close
+// (for example, when a call fails mid-frame or the server hangs up), when
+// they sit idle too long, and when they don't answer a ping.  Idle
+// connections are pinged every cfg.HealthCheckInterval, and one that is due
+// a ping when a call wants it is pinged before the call uses it, so that
+// requests are not lost to connections that died silently (for example,
+// behind a NAT that forgot them).  After a failed dial, the host is not
+// redialed until a backoff period (which doubles on each consecutive
+// failure) has passed.
+type connPool struct {
+    cfg TCPTransportConfig
+    dial func(ctx context.Context, address string) (*wireConn, error)
+
+    mu sync.Mutex
+    hosts map[string]*poolHost
+    janitorRunning bool
+    closed bool
+}
+
+type poolHost struct {
+    conns []*pooledConn
+
+    // Dials in progress, counted towards cfg.ConnsPerHost
+    dialing int
+
+    // Consecutive dial failures, and when we may dial again
+    failures int
+    retryAt time.Time
+}
+
+type pooledConn struct {
+    *wireConn
+    inflight int
+    lastUsed time.Time
+
+    // When the connection last answered a ping, and whether a ping is in
+    // progress
+    lastChecked time.Time
+    checking bool
+}
+
+var errPoolClosed = errors.New("transport closed")
+
+func newConnPool(cfg TCPTransportConfig, dial func(ctx context.Context, address string) (*wireConn, error)) *connPool {
+    return &connPool{
+        cfg: cfg,
+        dial: dial,
+        hosts: map[string]*poolHost{},
+    }
+}
+
+// Check out a connection to <address>, dialing a new one if every existing
+// connection is busy and the host has room for more.  Must be followed by a
+// call to put().
+func (pool *connPool) get(ctx context.Context, address string) (*pooledConn, error) {
+    for {
+        pc, stale, err := pool.checkout(ctx, address)
+        if err != nil || !stale {
+            return pc, err
+        }
+
+        // Make sure a connection that has sat idle still works before
+        // trusting a request to it.  If it doesn't, it has been removed, so
+        // the next try picks another or dials.
+        err = pool.check(ctx, address, pc)
+        if err == nil {
+            return pc, nil
+        }
+        pool.put(address, pc)
+        if ctx.Err() != nil {
+            return nil, ctx.Err()
+        }
+    }
+}
+
+// Same as get(), without checking the connection.  Returns true if the
+// connection is due a health check.
+func (pool *connPool) checkout(ctx context.Context, address string) (*pooledConn, bool, error) {
+    pool.mu.Lock()
+    if pool.closed {
+        pool.mu.Unlock()
+        return nil, false, errPoolClosed
+    }
+    host, ok := pool.hosts[address]
+    if !ok {
+        host = &poolHost{}
+        pool.hosts[address] = host
+    }
+
+    // Prefer the least busy open connection
+    var best *pooledConn
+    for _, pc := range append([]*pooledConn{}, host.conns...) {
+        if pc.isClosed() {
+            pool.remove(address, pc)
+            continue
+        }
+        if best == nil || pc.inflight < best.inflight {
+            best = pc
+        }
+    }
+
+    full := len(host.conns) + host.dialing >= pool.cfg.ConnsPerHost
+    backingOff := time.Now().Before(host.retryAt)
+    if best != nil && (best.inflight == 0 || full || backingOff) {
+        stale := best.inflight == 0 && pool.dueCheck(best, time.Now())
+        best.inflight++
+        pool.mu.Unlock()
+        return best, stale, nil
+    }
+    if backingOff {
+        retryIn := host.retryAt.Sub(time.Now())
+        pool.mu.Unlock()
+        return nil, false, fmt.Errorf("reconnecting to %s in %s", address, retryIn.Round(time.Millisecond))
+    }
+
+    // Dial without holding the lock
+    host.dialing++
+    pool.mu.Unlock()
+    wc, err := pool.dial(ctx, address)
+    pool.mu.Lock()
+    defer pool.mu.Unlock()
+    host.dialing--
+
+    if err != nil {
+        // Don't count our own cancellation against the host
+        if ctx.Err() == nil {
+            host.failures++
+            host.retryAt = time.Now().Add(pool.backoff(host.failures))
+        }
+        return nil, false, err
+    }
+    if pool.closed {
+        wc.close()
+        return nil, false, errPoolClosed
+    }
+
+    host.failures = 0
+    pc := &pooledConn{
+        wireConn: wc,
+        inflight: 1,
+        lastUsed: time.Now(),
+    }
+    host.conns = append(host.conns, pc)
+
+    if !pool.janitorRunning {
+        pool.janitorRunning = true
+        go pool.janitor()
+    }
+
+    return pc, false, nil
+}
+
+// True if <pc> has been idle long enough to need a ping.  Caller must hold
+// pool.mu.
+func (pool *connPool) dueCheck(pc *pooledConn, now time.Time) bool {
+    lastAlive := pc.lastUsed
+    if pc.lastChecked.After(lastAlive) {
+        lastAlive = pc.lastChecked
+    }
+    return now.Sub(lastAlive) >= pool.cfg.HealthCheckInterval
+}
+
+// Ping <pc>, giving up after cfg.HealthCheckTimeout or when <ctx> is done.
+// Connections that don't answer are removed from the pool.
+func (pool *connPool) check(ctx context.Context, address string, pc *pooledConn) error {
+    pool.mu.Lock()
+    pc.checking = true
+    pool.mu.Unlock()
+
+    ctx, cancel := context.WithTimeout(ctx, pool.cfg.HealthCheckTimeout)
+    defer cancel()
+    err := pc.ping(ctx)
+
+    pool.mu.Lock()
+    defer pool.mu.Unlock()
+    pc.checking = false
+    if err != nil {
+        log.Warn("Pigeon: Connection to ", address, " failed health check: ", err)
+        pool.remove(address, pc)
+        return err
+    }
+    pc.lastChecked = time.Now()
+    return nil
+}
+
+// Return a connection checked out with get().  Closed connections are
+// dropped from the pool.
+func (pool *connPool) put(address string, pc *pooledConn) {
+    pool.mu.Lock()
+    defer pool.mu.Unlock()
+
+    pc.inflight--
+    pc.lastUsed = time.Now()
+
+    if pc.isClosed() {
+        pool.remove(address, pc)
+    }
+}
+
+// Drop <pc> from the pool and close it.  Caller must hold pool.mu.
+func (pool *connPool) remove(address string, pc *pooledConn) {
+    host, ok := pool.hosts[address]
+    if !ok {
+        return
+    }
+    for i, other := range host.conns {
+        if other == pc {
+            host.conns = append(host.conns[:i], host.conns[i+1:]...)
+            pc.close()
+            return
+        }
+    }
+}
+
+// Close every connection, and refuse to hand out more.
+func (pool *connPool) close() {
+    pool.mu.Lock()
+    defer pool.mu.Unlock()
+    pool.closed = true
+    for address, host := range pool.hosts {
+        for _, pc := range append([]*pooledConn{}, host.conns...) {
+            pool.remove(address, pc)
+        }
+        delete(pool.hosts, address)
+    }
+}
+
+func (pool *connPool) backoff(failures int) time.Duration {
+    delay := pool.cfg.MinBackoff
+    for i := 1; i < failures && delay < pool.cfg.MaxBackoff; i++ {
+        delay *= 2
+    }
+    if delay > pool.cfg.MaxBackoff {
+        delay = pool.cfg.MaxBackoff
+    }
+    return delay
+}
+
+// Close idle connections, and ping those due a health check.  Exits once
+// the pool is empty; get() restarts it.
+func (pool *connPool) janitor() {
+    interval := pool.cfg.IdleTimeout / 2
+    if pool.cfg.HealthCheckInterval < interval {
+        interval = pool.cfg.HealthCheckInterval
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for range ticker.C {
+        pool.mu.Lock()
+        now := time.Now()
+        for address, host := range pool.hosts {
+            for _, pc := range append([]*pooledConn{}, host.conns...) {
+                if pc.inflight > 0 || pc.checking {
+                    continue
+                }
+                if now.Sub(pc.lastUsed) > pool.cfg.IdleTimeout {
+                    pool.remove(address, pc)
+                } else if pool.dueCheck(pc, now) {
+                    pc.checking = true
+                    go pool.check(context.Background(), address, pc)
+                }
+            }
+            if len(host.conns) == 0 && host.dialing == 0 && now.After(host.retryAt) {
+                delete(pool.hosts, address)
+            }
+        }
+        if len(pool.hosts) == 0 {
+            pool.janitorRunning = false
+            pool.mu.Unlock()
+            return
+        }
+        pool.mu.Unlock()
+    }
+}
@@ -0,0 +1,345 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "context"
+    "fmt"
+    "sync"
+    "time"
+)
+
+// Priority says how urgent a request is.  When a Server's workers are all
+// busy, waiting requests are started in weighted fair order by priority.
+type Priority int
+const (
+    PRIORITY_LOW Priority = iota - 1
+    PRIORITY_NORMAL
+    PRIORITY_HIGH
+)
+
+// Number of priorities, for arrays indexed by Priority.index().
+const NUM_PRIORITIES = 3
+
+var priorityNames = map[Priority]string{
+    PRIORITY_LOW: "low",
+    PRIORITY_NORMAL: "normal",
+    PRIORITY_HIGH: "high",
+}
+
+// LaneConfig controls how a Server shares its workers between priorities.
+type LaneConfig struct {
+    // Number of handler calls that run at once on the Server.  Requests
+    // beyond it wait in a lane for their priority.  0 means no limit, so
+    // nothing waits.
+    MaxWorkers int
+
+    // Share of the workers each priority gets while requests are waiting,
+    // relative to the others.  Defaults to 8 for PRIORITY_HIGH, 4 for
+    // PRIORITY_NORMAL and 1 for PRIORITY_LOW.
+    Weights map[Priority]int
+
+    // Requests that have waited this long start next, whatever their
+    // priority.  Defaults to 5 seconds.
+    StarvationAfter time.Duration
+}
+
+var DefaultLaneConfig = LaneConfig{
+    Weights: map[Priority]int{
+        PRIORITY_LOW: 1,
+        PRIORITY_NORMAL: 4,
+        PRIORITY_HIGH: 8,
+    },
+    StarvationAfter: 5 * time.Second,
+}
+
+// ServerStats is a snapshot of a Server's work, from Server.Stats().
+type ServerStats struct {
+    // Number of handler calls running.
+    Running int
+
+    // Lane for each priority.
+    Lanes map[Priority]LaneStats
+}
+
+// LaneStats describes one priority's lane.
+type LaneStats struct {
+    // Number of requests waiting for a worker.
+    Queued int
+
+    // Number of requests started since the Server was created, or since
+    // SetLanes was last called.
+    Started uint64
+
+    // Number of requests started ahead of their turn because they had
+    // waited longer than LaneConfig.StarvationAfter.
+    Promoted uint64
+
+    // How long the oldest waiting request has been waiting.
+    OldestWait time.Duration
+}
+
+// Request waiting in a lane.
+type laneWaiter struct {
+    enqueued time.Time
+
+    // Closed once the request may start
+    ready chan struct{}
+}
+
+type lane struct {
+    weight int
+    waiting []*laneWaiter
+
+    // Smooth weighted round robin state
+    current int
+
+    started uint64
+    promoted uint64
+}
+
+// Shares a Server's workers between priority lanes.
+type laneScheduler struct {
+    cfg LaneConfig
+
+    mu sync.Mutex
+    running int
+    lanes [NUM_PRIORITIES]*lane
+}
+
+// Get the Priority named <name>, as in HEADER_PRIORITY.  Unknown names are
+// PRIORITY_NORMAL.
+func ParsePriority(name string) Priority {
+    for priority, n := range priorityNames {
+        if n == name {
+            return priority
+        }
+    }
+    return PRIORITY_NORMAL
+}
+
+func (priority Priority) String() string {
+    name, ok := priorityNames[priority]
+    if !ok {
+        return fmt.Sprintf("priority %d", int(priority))
+    }
+    return name
+}
+
+func (priority Priority) index() int {
+    return int(priority - PRIORITY_LOW)
+}
+
+func validatePriority(priority Priority) error {
+    _, ok := priorityNames[priority]
+    if !ok {
+        return fmt.Errorf("Pigeon: Unknown %s", priority)
+    }
+    return nil
+}
+
+// Get a context that gives requests launched with it <priority>.  Overrides
+// Outbox.SetPriority.
+func WithPriority(ctx context.Context, priority Priority) context.Context {
+    return WithHeader(ctx, HEADER_PRIORITY, priority.String())
+}
+
+// Zero values in <cfg> are taken from DefaultLaneConfig, except MaxWorkers.
+func newLaneScheduler(cfg LaneConfig) (*laneScheduler, error) {
+    if cfg.MaxWorkers < 0 {
+        return nil, fmt.Errorf("Pigeon: Invalid MaxWorkers %d", cfg.MaxWorkers)
+    }
+    if cfg.StarvationAfter <= 0 {
+        cfg.StarvationAfter = DefaultLaneConfig.StarvationAfter
+    }
+
+    sched := &laneScheduler{
+        cfg: cfg,
+    }
+    for priority := range priorityNames {
+        weight, ok := cfg.Weights[priority]
+        if !ok {
+            weight = DefaultLaneConfig.Weights[priority]
+        }
+        if weight <= 0 {
+            return nil, fmt.Errorf("Pigeon: Weight for %s priority must be positive", priority)
+        }
+        sched.lanes[priority.index()] = &lane{
+            weight: weight,
+        }
+    }
+    return sched, nil
+}
+
+// Apply <cfg>, as newLaneScheduler would, keeping the running count and the
+// waiting requests.  Resets the lanes' counts of started requests.
+func (sched *laneScheduler) reconfigure(cfg LaneConfig) error {
+    fresh, err := newLaneScheduler(cfg)
+    if err != nil {
+        return err
+    }
+
+    sched.mu.Lock()
+    defer sched.mu.Unlock()
+    sched.cfg = fresh.cfg
+    for i, lane := range sched.lanes {
+        lane.weight = fresh.lanes[i].weight
+        lane.current = 0
+        lane.started = 0
+        lane.promoted = 0
+    }
+    // There may be room for more workers now
+    sched.dispatch()
+    return nil
+}
+
+// Wait for a worker for a request with <priority>, until <ctx> is done.
+// Returns a function to call when the request is finished.
+func (sched *laneScheduler) acquire(ctx context.Context, priority Priority) (func(), error) {
+    lane := sched.lanes[priority.index()]
+
+    sched.mu.Lock()
+    if sched.cfg.MaxWorkers == 0 || (sched.running < sched.cfg.MaxWorkers && !sched.anyWaiting()) {
+        sched.running++
+        lane.started++
+        sched.mu.Unlock()
+        return sched.release, nil
+    }
+    waiter := &laneWaiter{
+        enqueued: time.Now(),
+        ready: make(chan struct{}),
+    }
+    lane.waiting = append(lane.waiting, waiter)
+    sched.mu.Unlock()
+
+    select {
+    case <-waiter.ready:
+        return sched.release, nil
+    case <-ctx.Done():
+    }
+
+    sched.mu.Lock()
+    defer sched.mu.Unlock()
+    for i, other := range lane.waiting {
+        if other == waiter {
+            lane.waiting = append(lane.waiting[:i], lane.waiting[i + 1:]...)
+            return nil, ctx.Err()
+        }
+    }
+
+    // We were given a worker just as we gave up
+    sched.running--
+    sched.dispatch()
+    return nil, ctx.Err()
+}
+
+func (sched *laneScheduler) release() {
+    sched.mu.Lock()
+    defer sched.mu.Unlock()
+    sched.running--
+    sched.dispatch()
+}
+
+// Caller must hold sched.mu.
+func (sched *laneScheduler) anyWaiting() bool {
+    for _, lane := range sched.lanes {
+        if len(lane.waiting) > 0 {
+            return true
+        }
+    }
+    return false
+}
+
+// Start waiting requests while there are free workers.  Caller must hold
+// sched.mu.
+func (sched *laneScheduler) dispatch() {
+    for (sched.cfg.MaxWorkers == 0 || sched.running < sched.cfg.MaxWorkers) && sched.anyWaiting() {
+        lane := sched.starvedLane()
+        if lane != nil {
+            lane.promoted++
+        } else {
+            lane = sched.nextLane()
+        }
+
+        waiter := lane.waiting[0]
+        lane.waiting = lane.waiting[1:]
+        lane.started++
+        sched.running++
+        close(waiter.ready)
+    }
+}
+
+// Get the lane whose first request has waited longest, if it has waited
+// longer than StarvationAfter.  Caller must hold sched.mu.
+func (sched *laneScheduler) starvedLane() *lane {
+    var oldest *lane
+    for _, lane := range sched.lanes {
+        if len(lane.waiting) == 0 {
+            continue
+        }
+        if oldest == nil || lane.waiting[0].enqueued.Before(oldest.waiting[0].enqueued) {
+            oldest = lane
+        }
+    }
+    if oldest == nil || time.Since(oldest.waiting[0].enqueued) < sched.cfg.StarvationAfter {
+        return nil
+    }
+    return oldest
+}
+
+// Choose a lane with waiting requests by smooth weighted round robin: each
+// lane earns its weight per pick, and the richest lane pays the total.
+// Caller must hold sched.mu.
+func (sched *laneScheduler) nextLane() *lane {
+    var best *lane
+    total := 0
+    for i := len(sched.lanes) - 1; i >= 0; i-- {
+        lane := sched.lanes[i]
+        if len(lane.waiting) == 0 {
+            lane.current = 0
+            continue
+        }
+        lane.current += lane.weight
+        total += lane.weight
+        if best == nil || lane.current > best.current {
+            best = lane
+        }
+    }
+    best.current -= total
+    return best
+}
+
+func (sched *laneScheduler) stats() ServerStats {
+    sched.mu.Lock()
+    defer sched.mu.Unlock()
+
+    stats := ServerStats{
+        Running: sched.running,
+        Lanes: map[Priority]LaneStats{},
+    }
+    for priority := range priorityNames {
+        lane := sched.lanes[priority.index()]
+        laneStats := LaneStats{
+            Queued: len(lane.waiting),
+            Started: lane.started,
+            Promoted: lane.promoted,
+        }
+        if len(lane.waiting) > 0 {
+            laneStats.OldestWait = time.Since(lane.waiting[0].enqueued)
+        }
+        stats.Lanes[priority] = laneStats
+    }
+    return stats
+}
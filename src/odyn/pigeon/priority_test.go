@@ -0,0 +1,225 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "context"
+    "sync"
+    "testing"
+    "time"
+)
+
+func newTestLanes(t *testing.T, cfg LaneConfig) *laneScheduler {
+    sched, err := newLaneScheduler(cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return sched
+}
+
+func acquireWorker(t *testing.T, sched *laneScheduler, priority Priority) func() {
+    t.Helper()
+    release, err := sched.acquire(context.Background(), priority)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return release
+}
+
+func queued(sched *laneScheduler) int {
+    total := 0
+    for _, lane := range sched.stats().Lanes {
+        total += lane.Queued
+    }
+    return total
+}
+
+// Records the order in which waiting requests start.  Each releases its
+// worker as soon as it has been recorded, so with one worker they start one
+// at a time.
+type startOrder struct {
+    mu sync.Mutex
+    order []Priority
+    wg sync.WaitGroup
+}
+
+// Queue a request with <priority> on <sched>, waiting until it is queued.
+func (order *startOrder) wait(t *testing.T, sched *laneScheduler, priority Priority) {
+    before := queued(sched)
+    order.wg.Add(1)
+    go func() {
+        defer order.wg.Done()
+        release, err := sched.acquire(context.Background(), priority)
+        if err != nil {
+            t.Error(err)
+            return
+        }
+        order.mu.Lock()
+        order.order = append(order.order, priority)
+        order.mu.Unlock()
+        release()
+    }()
+    eventually(t, "request queued", func() bool {
+        return queued(sched) > before
+    })
+}
+
+func TestLanesWeightedFairOrder(t *testing.T) {
+    sched := newTestLanes(t, LaneConfig{MaxWorkers: 1})
+    release := acquireWorker(t, sched, PRIORITY_NORMAL)
+
+    order := &startOrder{}
+    const perLane = 13
+    for i := 0; i < perLane; i++ {
+        order.wait(t, sched, PRIORITY_LOW)
+        order.wait(t, sched, PRIORITY_NORMAL)
+        order.wait(t, sched, PRIORITY_HIGH)
+    }
+    release()
+    order.wg.Wait()
+
+    // Each round of 13 starts gives each lane its weight: 8, 4 and 1
+    counts := map[Priority]int{}
+    for _, priority := range order.order[:13] {
+        counts[priority]++
+    }
+    if counts[PRIORITY_HIGH] != 8 || counts[PRIORITY_NORMAL] != 4 || counts[PRIORITY_LOW] != 1 {
+        t.Errorf("First round started %v", counts)
+    }
+    if order.order[0] != PRIORITY_HIGH {
+        t.Errorf("Started %s first", order.order[0])
+    }
+
+    stats := sched.stats()
+    if stats.Running != 0 || stats.Lanes[PRIORITY_HIGH].Started != perLane || stats.Lanes[PRIORITY_NORMAL].Started != perLane + 1 {
+        t.Errorf("Stats %+v", stats)
+    }
+}
+
+func TestLanesStarvationPromotion(t *testing.T) {
+    const starvation = 50 * time.Millisecond
+    sched := newTestLanes(t, LaneConfig{MaxWorkers: 1, StarvationAfter: starvation})
+    release := acquireWorker(t, sched, PRIORITY_NORMAL)
+
+    order := &startOrder{}
+    order.wait(t, sched, PRIORITY_LOW)
+    time.Sleep(starvation)
+    for i := 0; i < 3; i++ {
+        order.wait(t, sched, PRIORITY_HIGH)
+    }
+    release()
+    order.wg.Wait()
+
+    if order.order[0] != PRIORITY_LOW {
+        t.Errorf("Started in order %v; the starved request was not first", order.order)
+    }
+    stats := sched.stats()
+    if stats.Lanes[PRIORITY_LOW].Promoted != 1 || stats.Lanes[PRIORITY_HIGH].Promoted != 0 {
+        t.Errorf("Stats %+v", stats)
+    }
+}
+
+func TestLanesStats(t *testing.T) {
+    sched := newTestLanes(t, LaneConfig{MaxWorkers: 2})
+    releases := []func(){
+        acquireWorker(t, sched, PRIORITY_HIGH),
+        acquireWorker(t, sched, PRIORITY_LOW),
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    gaveUp := make(chan error, 1)
+    go func() {
+        _, err := sched.acquire(ctx, PRIORITY_LOW)
+        gaveUp <- err
+    }()
+    eventually(t, "request queued", func() bool {
+        return queued(sched) == 1
+    })
+    time.Sleep(10 * time.Millisecond)
+
+    stats := sched.stats()
+    low := stats.Lanes[PRIORITY_LOW]
+    if stats.Running != 2 || low.Queued != 1 || low.Started != 1 || low.OldestWait < 10 * time.Millisecond {
+        t.Errorf("Stats %+v", stats)
+    }
+    if stats.Lanes[PRIORITY_HIGH].Started != 1 || stats.Lanes[PRIORITY_HIGH].Queued != 0 {
+        t.Errorf("High lane %+v", stats.Lanes[PRIORITY_HIGH])
+    }
+
+    // A request that gives up leaves its lane
+    cancel()
+    if err := <-gaveUp; err != context.Canceled {
+        t.Errorf("Cancelled request returned %v", err)
+    }
+    for _, release := range releases {
+        release()
+    }
+    stats = sched.stats()
+    if stats.Running != 0 || stats.Lanes[PRIORITY_LOW].Queued != 0 || stats.Lanes[PRIORITY_LOW].OldestWait != 0 {
+        t.Errorf("Stats after releasing %+v", stats)
+    }
+}
+
+// Requests running when the lanes change still count against MaxWorkers.
+func TestSetLanesKeepsRunningCount(t *testing.T) {
+    sys, server := newTestServer(t, "local")
+    err := server.SetLanes(LaneConfig{MaxWorkers: 1})
+    if err != nil {
+        t.Fatal(err)
+    }
+    started := make(chan struct{}, 2)
+    release := make(chan struct{})
+    newTestInbox(t, server, "work", func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        started <- struct{}{}
+        <-release
+    })
+
+    outbox := sys.NewOutbox()
+    first := launchOrFail(t, outbox)
+    <-started
+    err = server.SetLanes(LaneConfig{MaxWorkers: 1})
+    if err != nil {
+        t.Fatal(err)
+    }
+    second := launchOrFail(t, outbox)
+    eventually(t, "second request queued", func() bool {
+        return server.Stats().Lanes[PRIORITY_NORMAL].Queued == 1
+    })
+    select {
+    case <-started:
+        t.Fatal("Second request started beyond MaxWorkers")
+    case <-time.After(50 * time.Millisecond):
+    }
+    if running := server.Stats().Running; running != 1 {
+        t.Errorf("%d running", running)
+    }
+
+    // Raising the limit starts waiting requests
+    err = server.SetLanes(LaneConfig{MaxWorkers: 2})
+    if err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case <-started:
+    case <-time.After(5 * time.Second):
+        t.Fatal("Waiting request did not start when MaxWorkers rose")
+    }
+    close(release)
+    waitResponse(t, first)
+    waitResponse(t, second)
+    if running := server.Stats().Running; running != 0 {
+        t.Errorf("%d running after both finished", running)
+    }
+}
@@ -0,0 +1,539 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "odyn/log"
+    "sort"
+    "sync"
+    "time"
+)
+
+// Durable job queue.  Documents are laid out as:
+//
+//      /pigeon/queues/<msgKey>/pending
+//      /pigeon/queues/<msgKey>/dead
+//
+//          { "<jobID>" : true, ... }
+//
+//      /pigeon/jobs/<jobID>
+//
+//          {
+//              "msgKey" : "<msgKey>",
+//              "payload" : { ... },
+//              "created" : "2015-08-03T20:22:08.123456789Z",
+//              "attempts" : 2,
+//              "next_attempt" : "2015-08-03T20:22:10.123456789Z",
+//              "last_error" : "..."
+//          }
+//
+// Pending jobs are also kept in memory.  A job's attempt count is saved
+// before each delivery, so attempts interrupted by a crash still count.
+type pigeonQueue struct {
+    sys *PigeonSystem
+    msgKey string
+    cfg QueueConfig
+    outbox *PigeonOutbox
+
+    // Protects the fields below, and serializes writes to storage.
+    mu sync.Mutex
+    jobs map[string]*JobInfo
+    delivering map[string]bool
+    closed bool
+
+    // Nudges the dispatcher when there may be work to do.
+    wake chan struct{}
+    stop chan struct{}
+    wg sync.WaitGroup
+}
+
+// How long the dispatcher sleeps when no job is scheduled.
+const queueIdleInterval = time.Minute
+
+var DefaultQueueConfig = QueueConfig{
+    MaxAttempts: 5,
+    MinBackoff: time.Second,
+    MaxBackoff: 5 * time.Minute,
+    AckTimeout: 30 * time.Second,
+    MaxInFlight: 16,
+}
+
+// Open the durable job queue for <msgKey>.  Zero values in <cfg> are taken
+// from DefaultQueueConfig.  Jobs left in storage by an earlier Queue are
+// delivered again.
+func (pigeon *PigeonSystem) NewQueue(msgKey string, cfg QueueConfig) (Queue, error) {
+    if cfg.Conn == nil {
+        return nil, errors.New("Pigeon: QueueConfig.Conn is required")
+    }
+    err := validateMsgKey(msgKey)
+    if err != nil {
+        return nil, err
+    }
+    if cfg.MaxAttempts <= 0 {
+        cfg.MaxAttempts = DefaultQueueConfig.MaxAttempts
+    }
+    if cfg.MinBackoff <= 0 {
+        cfg.MinBackoff = DefaultQueueConfig.MinBackoff
+    }
+    if cfg.MaxBackoff <= 0 {
+        cfg.MaxBackoff = DefaultQueueConfig.MaxBackoff
+    }
+    if cfg.MaxBackoff < cfg.MinBackoff {
+        cfg.MaxBackoff = cfg.MinBackoff
+    }
+    if cfg.AckTimeout <= 0 {
+        cfg.AckTimeout = DefaultQueueConfig.AckTimeout
+    }
+    if cfg.MaxInFlight <= 0 {
+        cfg.MaxInFlight = DefaultQueueConfig.MaxInFlight
+    }
+
+    outbox := pigeon.NewOutbox().(*PigeonOutbox)
+    if cfg.Router != nil {
+        outbox.SetRouter(cfg.Router)
+    }
+
+    queue := &pigeonQueue{
+        sys: pigeon,
+        msgKey: msgKey,
+        cfg: cfg,
+        outbox: outbox,
+        jobs: map[string]*JobInfo{},
+        delivering: map[string]bool{},
+        wake: make(chan struct{}, 1),
+        stop: make(chan struct{}),
+    }
+
+    // Pick up where the last Queue left off
+    for jobID := range queue.loadIndex("pending") {
+        job, err := queue.loadJob(jobID)
+        if err != nil {
+            log.Warn("Pigeon: Dropping missing job ", jobID, " from queue ", msgKey, ": ", err)
+            continue
+        }
+        queue.jobs[jobID] = job
+    }
+
+    queue.wg.Add(1)
+    go queue.dispatch()
+
+    return queue, nil
+}
+
+func (queue *pigeonQueue) Enqueue(payload map[string]interface{}) (string, error) {
+    jobID, err := randomID()
+    if err != nil {
+        return "", err
+    }
+
+    // Keep the payload as it will be stored, so that the first delivery
+    // sees the same types as deliveries after a restart
+    var stored map[string]interface{}
+    err = decodePayload(payload, &stored)
+    if err != nil {
+        return "", fmt.Errorf("Pigeon: Cannot save payload for queue %s: %s", queue.msgKey, err.Error())
+    }
+
+    now := time.Now()
+    job := &JobInfo{
+        ID: jobID,
+        MsgKey: queue.msgKey,
+        Payload: stored,
+        Created: now,
+        NextAttempt: now,
+    }
+
+    queue.mu.Lock()
+    defer queue.mu.Unlock()
+    if queue.closed {
+        return "", fmt.Errorf("Pigeon: Queue %s is closed", queue.msgKey)
+    }
+
+    err = queue.saveJob(job)
+    if err != nil {
+        return "", err
+    }
+    queue.jobs[jobID] = job
+    err = queue.savePending()
+    if err != nil {
+        delete(queue.jobs, jobID)
+        queue.cfg.Conn.DeleteDocument(jobPath(jobID))
+        return "", err
+    }
+
+    queue.nudge()
+    return jobID, nil
+}
+
+func (queue *pigeonQueue) Pending() ([]JobInfo, error) {
+    queue.mu.Lock()
+    defer queue.mu.Unlock()
+    jobs := make([]JobInfo, 0, len(queue.jobs))
+    for _, job := range queue.jobs {
+        jobs = append(jobs, *job)
+    }
+    sortJobs(jobs)
+    return jobs, nil
+}
+
+func (queue *pigeonQueue) DeadLetters() ([]JobInfo, error) {
+    queue.mu.Lock()
+    defer queue.mu.Unlock()
+    jobs := []JobInfo{}
+    for jobID := range queue.loadIndex("dead") {
+        job, err := queue.loadJob(jobID)
+        if err != nil {
+            return nil, err
+        }
+        jobs = append(jobs, *job)
+    }
+    sortJobs(jobs)
+    return jobs, nil
+}
+
+func (queue *pigeonQueue) Replay(jobID string) error {
+    queue.mu.Lock()
+    defer queue.mu.Unlock()
+    if queue.closed {
+        return fmt.Errorf("Pigeon: Queue %s is closed", queue.msgKey)
+    }
+
+    dead := queue.loadIndex("dead")
+    if _, ok := dead[jobID]; !ok {
+        return fmt.Errorf("Pigeon: Job %s is not a dead letter in queue %s", jobID, queue.msgKey)
+    }
+    job, err := queue.loadJob(jobID)
+    if err != nil {
+        return err
+    }
+
+    job.Attempts = 0
+    job.NextAttempt = time.Now()
+    err = queue.saveJob(job)
+    if err != nil {
+        return err
+    }
+
+    // Add to pending before removing from dead, so that a failure in
+    // between can't lose the job.
+    queue.jobs[jobID] = job
+    err = queue.savePending()
+    if err != nil {
+        delete(queue.jobs, jobID)
+        return err
+    }
+    delete(dead, jobID)
+    err = queue.saveIndex("dead", dead)
+    if err != nil {
+        return err
+    }
+
+    queue.nudge()
+    return nil
+}
+
+func (queue *pigeonQueue) Discard(jobID string) error {
+    queue.mu.Lock()
+    defer queue.mu.Unlock()
+
+    dead := queue.loadIndex("dead")
+    if _, ok := dead[jobID]; !ok {
+        return fmt.Errorf("Pigeon: Job %s is not a dead letter in queue %s", jobID, queue.msgKey)
+    }
+    delete(dead, jobID)
+    err := queue.saveIndex("dead", dead)
+    if err != nil {
+        return err
+    }
+    return queue.cfg.Conn.DeleteDocument(jobPath(jobID))
+}
+
+func (queue *pigeonQueue) Close() error {
+    queue.mu.Lock()
+    if queue.closed {
+        queue.mu.Unlock()
+        return nil
+    }
+    queue.closed = true
+    close(queue.stop)
+    queue.mu.Unlock()
+
+    queue.wg.Wait()
+    return nil
+}
+
+// Wake the dispatcher.  Never blocks.
+func (queue *pigeonQueue) nudge() {
+    select {
+    case queue.wake <- struct{}{}:
+    default:
+    }
+}
+
+// Deliver jobs as they fall due.  Runs until the queue is closed.
+func (queue *pigeonQueue) dispatch() {
+    defer queue.wg.Done()
+    for {
+        timer := time.NewTimer(queue.deliverDue())
+        select {
+        case <-queue.stop:
+            timer.Stop()
+            return
+        case <-queue.wake:
+        case <-timer.C:
+        }
+        timer.Stop()
+    }
+}
+
+// Start delivering every job that is due, up to cfg.MaxInFlight.  Returns
+// how long until the next job falls due.
+func (queue *pigeonQueue) deliverDue() time.Duration {
+    queue.mu.Lock()
+    defer queue.mu.Unlock()
+
+    ready := []*JobInfo{}
+    for _, job := range queue.jobs {
+        if !queue.delivering[job.ID] {
+            ready = append(ready, job)
+        }
+    }
+    sort.Slice(ready, func(i, j int) bool {
+        return ready[i].NextAttempt.Before(ready[j].NextAttempt)
+    })
+
+    now := time.Now()
+    for _, job := range ready {
+        if job.NextAttempt.After(now) {
+            return job.NextAttempt.Sub(now)
+        }
+        if len(queue.delivering) >= queue.cfg.MaxInFlight {
+            // deliver() nudges us when it finishes
+            return queueIdleInterval
+        }
+
+        job.Attempts++
+        err := queue.saveJob(job)
+        if err != nil {
+            log.Error("Pigeon: Cannot save job ", job.ID, ": ", err)
+            job.Attempts--
+            job.NextAttempt = now.Add(queue.cfg.MinBackoff)
+            continue
+        }
+
+        queue.delivering[job.ID] = true
+        queue.wg.Add(1)
+        go queue.deliver(*job)
+    }
+    return queueIdleInterval
+}
+
+// Send <job> to a handler and record the outcome.
+func (queue *pigeonQueue) deliver(job JobInfo) {
+    defer queue.wg.Done()
+    defer queue.nudge()
+
+    ctx, cancel := context.WithTimeout(context.Background(), queue.cfg.AckTimeout)
+    defer cancel()
+
+    respChan, err := queue.outbox.launch(ctx, &PigeonRequest{
+        ReqJobKey: queue.msgKey,
+        ReqBody: job.Payload,
+        ReqJobID: job.ID,
+        ReqAttempt: job.Attempts,
+    })
+    if err != nil {
+        // Nothing was sent (for example, no server is listening), so this
+        // doesn't count as an attempt.
+        queue.retry(job.ID, err, false)
+        return
+    }
+
+    err = (<-respChan).Err()
+    if err != nil {
+        queue.retry(job.ID, err, true)
+        return
+    }
+    queue.ack(job.ID)
+}
+
+// Remove a job that was handled successfully.
+func (queue *pigeonQueue) ack(jobID string) {
+    queue.mu.Lock()
+    defer queue.mu.Unlock()
+    delete(queue.delivering, jobID)
+    delete(queue.jobs, jobID)
+
+    err := queue.savePending()
+    if err != nil {
+        log.Error("Pigeon: Cannot remove job ", jobID, " from queue ", queue.msgKey, ": ", err)
+    }
+    err = queue.cfg.Conn.DeleteDocument(jobPath(jobID))
+    if err != nil {
+        log.Error("Pigeon: Cannot delete job ", jobID, ": ", err)
+    }
+}
+
+// Schedule a failed job for another attempt, or make it a dead letter if it
+// has failed too often.  <counts> is false if the job was never sent.
+func (queue *pigeonQueue) retry(jobID string, cause error, counts bool) {
+    queue.mu.Lock()
+    defer queue.mu.Unlock()
+    delete(queue.delivering, jobID)
+    job, ok := queue.jobs[jobID]
+    if !ok {
+        return
+    }
+
+    job.LastError = cause.Error()
+    if !counts {
+        job.Attempts--
+    }
+
+    if job.Attempts >= queue.cfg.MaxAttempts {
+        log.Warn("Pigeon: Job ", jobID, " in queue ", queue.msgKey, " failed ", job.Attempts, " times; moving to dead letters: ", cause)
+        err := queue.saveJob(job)
+        if err != nil {
+            log.Error("Pigeon: Cannot save job ", jobID, ": ", err)
+        }
+        dead := queue.loadIndex("dead")
+        dead[jobID] = true
+        err = queue.saveIndex("dead", dead)
+        if err != nil {
+            // Leave it pending rather than lose it
+            log.Error("Pigeon: Cannot add job ", jobID, " to dead letters: ", err)
+            job.NextAttempt = time.Now().Add(queue.cfg.MaxBackoff)
+            return
+        }
+        delete(queue.jobs, jobID)
+        err = queue.savePending()
+        if err != nil {
+            log.Error("Pigeon: Cannot remove job ", jobID, " from queue ", queue.msgKey, ": ", err)
+        }
+        return
+    }
+
+    job.NextAttempt = time.Now().Add(queue.backoff(job.Attempts))
+    log.Warn("Pigeon: Job ", jobID, " in queue ", queue.msgKey, " failed; retrying at ", job.NextAttempt, ": ", cause)
+    err := queue.saveJob(job)
+    if err != nil {
+        log.Error("Pigeon: Cannot save job ", jobID, ": ", err)
+    }
+}
+
+func (queue *pigeonQueue) backoff(failures int) time.Duration {
+    delay := queue.cfg.MinBackoff
+    for i := 1; i < failures && delay < queue.cfg.MaxBackoff; i++ {
+        delay *= 2
+    }
+    if delay > queue.cfg.MaxBackoff {
+        delay = queue.cfg.MaxBackoff
+    }
+    return delay
+}
+
+func (queue *pigeonQueue) indexPath(name string) string {
+    return "/pigeon/queues/" + queue.msgKey + "/" + name
+}
+
+func jobPath(jobID string) string {
+    return "/pigeon/jobs/" + jobID
+}
+
+// Load a set of job IDs, treating a missing document as empty.
+func (queue *pigeonQueue) loadIndex(name string) map[string]bool {
+    index := map[string]bool{}
+    obj, err := queue.cfg.Conn.LoadDocument(queue.indexPath(name))
+    if err != nil {
+        return index
+    }
+    doc, _ := obj.(map[string]interface{})
+    for jobID := range doc {
+        index[jobID] = true
+    }
+    return index
+}
+
+func (queue *pigeonQueue) saveIndex(name string, index map[string]bool) error {
+    doc := map[string]interface{}{}
+    for jobID := range index {
+        doc[jobID] = true
+    }
+    return queue.cfg.Conn.SaveDocument(queue.indexPath(name), doc)
+}
+
+// Save the IDs of the jobs in memory as the pending index.  Caller must hold
+// queue.mu.
+func (queue *pigeonQueue) savePending() error {
+    index := map[string]bool{}
+    for jobID := range queue.jobs {
+        index[jobID] = true
+    }
+    return queue.saveIndex("pending", index)
+}
+
+func (queue *pigeonQueue) loadJob(jobID string) (*JobInfo, error) {
+    obj, err := queue.cfg.Conn.LoadDocument(jobPath(jobID))
+    if err != nil {
+        return nil, err
+    }
+    doc, ok := obj.(map[string]interface{})
+    if !ok {
+        return nil, fmt.Errorf("Pigeon: Job %s is malformed", jobID)
+    }
+
+    job := &JobInfo{ID: jobID}
+    job.MsgKey, _ = doc["msgKey"].(string)
+    job.Payload, _ = doc["payload"].(map[string]interface{})
+    attempts, _ := doc["attempts"].(float64)
+    job.Attempts = int(attempts)
+    created, _ := doc["created"].(string)
+    job.Created, _ = time.Parse(time.RFC3339Nano, created)
+    nextAttempt, _ := doc["next_attempt"].(string)
+    job.NextAttempt, _ = time.Parse(time.RFC3339Nano, nextAttempt)
+    job.LastError, _ = doc["last_error"].(string)
+    return job, nil
+}
+
+func (queue *pigeonQueue) saveJob(job *JobInfo) error {
+    return queue.cfg.Conn.SaveDocument(jobPath(job.ID), map[string]interface{}{
+        "msgKey": job.MsgKey,
+        "payload": job.Payload,
+        "created": job.Created.UTC().Format(time.RFC3339Nano),
+        "attempts": job.Attempts,
+        "next_attempt": job.NextAttempt.UTC().Format(time.RFC3339Nano),
+        "last_error": job.LastError,
+    })
+}
+
+func sortJobs(jobs []JobInfo) {
+    sort.Slice(jobs, func(i, j int) bool {
+        return jobs[i].Created.Before(jobs[j].Created)
+    })
+}
+
+func randomID() (string, error) {
+    var buf [16]byte
+    _, err := rand.Read(buf[:])
+    if err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(buf[:]), nil
+}
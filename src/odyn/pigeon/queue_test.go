@@ -0,0 +1,248 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "errors"
+    "sync"
+    "testing"
+    "time"
+)
+
+func newTestQueue(t *testing.T, sys *PigeonSystem, cfg QueueConfig) Queue {
+    queue, err := sys.NewQueue("work", cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { queue.Close() })
+    return queue
+}
+
+// A "work" handler that fails the first <failures> deliveries of each job.
+// Records each delivery.
+type queueWorker struct {
+    mu sync.Mutex
+    failures int
+    deliveries []queueDelivery
+}
+
+type queueDelivery struct {
+    jobID string
+    attempt int
+    payload map[string]interface{}
+    at time.Time
+}
+
+func newQueueWorker(t *testing.T, server Server, failures int) *queueWorker {
+    worker := &queueWorker{failures: failures}
+    newTestInbox(t, server, "work", func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        worker.mu.Lock()
+        defer worker.mu.Unlock()
+        worker.deliveries = append(worker.deliveries, queueDelivery{
+            jobID: req.JobID(),
+            attempt: req.Attempt(),
+            payload: req.Body(),
+            at: time.Now(),
+        })
+        if req.Attempt() <= worker.failures {
+            resp.SetError(errors.New("not yet"))
+        }
+    })
+    return worker
+}
+
+func (worker *queueWorker) list() []queueDelivery {
+    worker.mu.Lock()
+    defer worker.mu.Unlock()
+    return append([]queueDelivery{}, worker.deliveries...)
+}
+
+func (worker *queueWorker) setFailures(failures int) {
+    worker.mu.Lock()
+    defer worker.mu.Unlock()
+    worker.failures = failures
+}
+
+func pendingCount(t *testing.T, queue Queue) int {
+    jobs, err := queue.Pending()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return len(jobs)
+}
+
+func deadLetters(t *testing.T, queue Queue) []JobInfo {
+    jobs, err := queue.DeadLetters()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return jobs
+}
+
+func TestQueueAck(t *testing.T) {
+    sys, server := newTestServer(t, "local")
+    worker := newQueueWorker(t, server, 0)
+    conn := newMemConn()
+    queue := newTestQueue(t, sys, QueueConfig{Conn: conn})
+
+    jobID, err := queue.Enqueue(map[string]interface{}{"n": 1})
+    if err != nil {
+        t.Fatal(err)
+    }
+    eventually(t, "job acknowledged", func() bool {
+        return pendingCount(t, queue) == 0
+    })
+    deliveries := worker.list()
+    if len(deliveries) != 1 || deliveries[0].jobID != jobID || deliveries[0].attempt != 1 {
+        t.Fatalf("Deliveries %+v", deliveries)
+    }
+    // The payload is delivered as it is stored
+    if deliveries[0].payload["n"] != float64(1) {
+        t.Errorf("Payload delivered as %#v", deliveries[0].payload)
+    }
+    if conn.has(jobPath(jobID)) {
+        t.Error("Acknowledged job was not deleted")
+    }
+}
+
+func TestQueueRetryBackoff(t *testing.T) {
+    sys, server := newTestServer(t, "local")
+    worker := newQueueWorker(t, server, 2)
+    const minBackoff = 50 * time.Millisecond
+    queue := newTestQueue(t, sys, QueueConfig{Conn: newMemConn(), MinBackoff: minBackoff})
+
+    jobID, err := queue.Enqueue(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    eventually(t, "job acknowledged", func() bool {
+        return pendingCount(t, queue) == 0
+    })
+    deliveries := worker.list()
+    if len(deliveries) != 3 {
+        t.Fatalf("Delivered %d times", len(deliveries))
+    }
+    for i, delivery := range deliveries {
+        if delivery.jobID != jobID || delivery.attempt != i + 1 {
+            t.Errorf("Delivery %d was %+v", i, delivery)
+        }
+    }
+    // The wait doubles after each failure
+    if wait := deliveries[1].at.Sub(deliveries[0].at); wait < minBackoff {
+        t.Errorf("Retried after %s", wait)
+    }
+    if wait := deliveries[2].at.Sub(deliveries[1].at); wait < 2 * minBackoff {
+        t.Errorf("Retried again after %s", wait)
+    }
+    if len(deadLetters(t, queue)) != 0 {
+        t.Error("Job that succeeded became a dead letter")
+    }
+}
+
+func TestQueueDeadLetters(t *testing.T) {
+    sys, server := newTestServer(t, "local")
+    worker := newQueueWorker(t, server, 100)
+    conn := newMemConn()
+    queue := newTestQueue(t, sys, QueueConfig{
+        Conn: conn,
+        MaxAttempts: 3,
+        MinBackoff: time.Millisecond,
+        MaxBackoff: time.Millisecond,
+    })
+
+    replayed, err := queue.Enqueue(map[string]interface{}{"n": 1})
+    if err != nil {
+        t.Fatal(err)
+    }
+    discarded, err := queue.Enqueue(map[string]interface{}{"n": 2})
+    if err != nil {
+        t.Fatal(err)
+    }
+    eventually(t, "dead letters", func() bool {
+        return len(deadLetters(t, queue)) == 2
+    })
+    if len(worker.list()) != 6 || pendingCount(t, queue) != 0 {
+        t.Errorf("%d deliveries, %d pending", len(worker.list()), pendingCount(t, queue))
+    }
+    for _, job := range deadLetters(t, queue) {
+        if job.Attempts != 3 || job.LastError == "" {
+            t.Errorf("Dead letter %+v", job)
+        }
+    }
+
+    // Replay starts counting attempts again
+    worker.setFailures(0)
+    err = queue.Replay(replayed)
+    if err != nil {
+        t.Fatal(err)
+    }
+    eventually(t, "replayed job acknowledged", func() bool {
+        return pendingCount(t, queue) == 0
+    })
+    deliveries := worker.list()
+    last := deliveries[len(deliveries) - 1]
+    if len(deliveries) != 7 || last.jobID != replayed || last.attempt != 1 {
+        t.Errorf("Replay delivered %+v", last)
+    }
+    if queue.Replay(replayed) == nil {
+        t.Error("Replayed a job that is not a dead letter")
+    }
+
+    err = queue.Discard(discarded)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(deadLetters(t, queue)) != 0 || conn.has(jobPath(discarded)) {
+        t.Error("Discarded job is still saved")
+    }
+    if queue.Discard(discarded) == nil {
+        t.Error("Discarded a job twice")
+    }
+}
+
+// Jobs left by a Queue that was closed are delivered by the next one.
+func TestNewQueueReloadsPending(t *testing.T) {
+    sys, server := newTestServer(t, "local")
+    conn := newMemConn()
+
+    // Nothing is listening yet, so the job stays pending
+    cfg := QueueConfig{Conn: conn, MinBackoff: 10 * time.Millisecond}
+    queue, err := sys.NewQueue("work", cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    jobID, err := queue.Enqueue(map[string]interface{}{"n": 1})
+    if err != nil {
+        t.Fatal(err)
+    }
+    queue.Close()
+
+    worker := newQueueWorker(t, server, 0)
+    queue = newTestQueue(t, sys, cfg)
+    jobs, err := queue.Pending()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(jobs) != 1 || jobs[0].ID != jobID || jobs[0].Payload["n"] != float64(1) {
+        t.Fatalf("Reloaded %+v", jobs)
+    }
+    eventually(t, "reloaded job acknowledged", func() bool {
+        return pendingCount(t, queue) == 0
+    })
+    deliveries := worker.list()
+    if len(deliveries) != 1 || deliveries[0].jobID != jobID {
+        t.Errorf("Deliveries %+v", deliveries)
+    }
+}
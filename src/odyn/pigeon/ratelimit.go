@@ -0,0 +1,158 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "container/list"
+    "fmt"
+    "sync"
+    "time"
+)
+
+// Number of per-sender buckets a server keeps.  Beyond it, idle senders are
+// forgotten, and then the least recently seen.
+const MAX_SENDER_BUCKETS = 1024
+
+// Token bucket rate limiter.  Holds up to <burst> tokens, refilled at <rate>
+// tokens per second.  Each request takes one token.
+type tokenBucket struct {
+    rate float64
+    burst float64
+
+    mu sync.Mutex
+    tokens float64
+    last time.Time
+}
+
+// Settings for a family of token buckets, such as one per sender.
+type rateLimit struct {
+    perSecond float64
+    burst int
+}
+
+// Per-sender rate limiting: one bucket per sender, all with the same limit.
+type senderLimiter struct {
+    limit rateLimit
+
+    mu sync.Mutex
+    buckets map[string]*list.Element
+
+    // Values are *senderBucket, most recently used first
+    recent *list.List
+}
+
+type senderBucket struct {
+    sender string
+    bucket *tokenBucket
+}
+
+func validateRateLimit(perSecond float64, burst int) error {
+    if perSecond < 0 || burst < 0 {
+        return fmt.Errorf("Pigeon: Invalid rate limit %v/s with burst %d", perSecond, burst)
+    }
+    return nil
+}
+
+// Create a bucket that starts full.  A <burst> below 1 is treated as 1.
+func newTokenBucket(limit rateLimit) *tokenBucket {
+    burst := float64(limit.burst)
+    if burst < 1 {
+        burst = 1
+    }
+    return &tokenBucket{
+        rate: limit.perSecond,
+        burst: burst,
+        tokens: burst,
+        last: time.Now(),
+    }
+}
+
+func (bucket *tokenBucket) refill(now time.Time) {
+    bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+    if bucket.tokens > bucket.burst {
+        bucket.tokens = bucket.burst
+    }
+    bucket.last = now
+}
+
+// Take a token if one is available.
+func (bucket *tokenBucket) allow() bool {
+    bucket.mu.Lock()
+    defer bucket.mu.Unlock()
+    bucket.refill(time.Now())
+    if bucket.tokens < 1 {
+        return false
+    }
+    bucket.tokens--
+    return true
+}
+
+// True if the bucket has refilled completely, so forgetting it changes
+// nothing.
+func (bucket *tokenBucket) full() bool {
+    bucket.mu.Lock()
+    defer bucket.mu.Unlock()
+    bucket.refill(time.Now())
+    return bucket.tokens >= bucket.burst
+}
+
+func newSenderLimiter(limit rateLimit) *senderLimiter {
+    return &senderLimiter{
+        limit: limit,
+        buckets: map[string]*list.Element{},
+        recent: list.New(),
+    }
+}
+
+// Take a token from <sender>'s bucket if one is available.
+func (limiter *senderLimiter) allow(sender string) bool {
+    limiter.mu.Lock()
+    elem := limiter.buckets[sender]
+    if elem != nil {
+        limiter.recent.MoveToFront(elem)
+    } else {
+        if len(limiter.buckets) >= MAX_SENDER_BUCKETS {
+            limiter.forgetIdle()
+        }
+        for len(limiter.buckets) >= MAX_SENDER_BUCKETS {
+            limiter.forget(limiter.recent.Back())
+        }
+        elem = limiter.recent.PushFront(&senderBucket{sender, newTokenBucket(limiter.limit)})
+        limiter.buckets[sender] = elem
+    }
+    bucket := elem.Value.(*senderBucket).bucket
+    limiter.mu.Unlock()
+    return bucket.allow()
+}
+
+// Drop the buckets of senders that have not sent anything for long enough
+// to refill them.  Caller must hold limiter.mu.
+func (limiter *senderLimiter) forgetIdle() {
+    for elem := limiter.recent.Back(); elem != nil; {
+        prev := elem.Prev()
+        if elem.Value.(*senderBucket).bucket.full() {
+            limiter.forget(elem)
+        }
+        elem = prev
+    }
+}
+
+// Drop the bucket in <elem>.  The sender gets a full bucket if it sends
+// again, so this is only done to stay within MAX_SENDER_BUCKETS.  Caller
+// must hold limiter.mu.
+func (limiter *senderLimiter) forget(elem *list.Element) {
+    limiter.recent.Remove(elem)
+    delete(limiter.buckets, elem.Value.(*senderBucket).sender)
+}
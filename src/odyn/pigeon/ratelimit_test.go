@@ -0,0 +1,76 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "fmt"
+    "testing"
+    "time"
+)
+
+func TestTokenBucket(t *testing.T) {
+    bucket := newTokenBucket(rateLimit{perSecond: 0, burst: 3})
+    for i := 0; i < 3; i++ {
+        if !bucket.allow() {
+            t.Fatalf("Request %d was refused", i)
+        }
+    }
+    if bucket.allow() {
+        t.Error("Bucket allowed more than its burst")
+    }
+
+    bucket = newTokenBucket(rateLimit{perSecond: 100, burst: 1})
+    bucket.allow()
+    time.Sleep(20 * time.Millisecond)
+    if !bucket.allow() {
+        t.Error("Bucket did not refill")
+    }
+}
+
+func TestSenderLimiterForgetsIdleSenders(t *testing.T) {
+    limiter := newSenderLimiter(rateLimit{perSecond: 1000000, burst: 1})
+    for i := 0; i < 2 * MAX_SENDER_BUCKETS; i++ {
+        limiter.allow(fmt.Sprintf("sender%d", i))
+    }
+    if len(limiter.buckets) > MAX_SENDER_BUCKETS {
+        t.Errorf("Kept %d buckets", len(limiter.buckets))
+    }
+}
+
+func TestSenderLimiterEvictsLeastRecentlyUsed(t *testing.T) {
+    // Buckets never refill, so none is idle
+    limiter := newSenderLimiter(rateLimit{perSecond: 0, burst: 1})
+    for i := 0; i < MAX_SENDER_BUCKETS; i++ {
+        limiter.allow(fmt.Sprintf("sender%d", i))
+    }
+
+    // sender0 is now the most recently seen, and sender1 the least
+    if limiter.allow("sender0") {
+        t.Error("sender0 was allowed twice")
+    }
+    if !limiter.allow("newcomer") {
+        t.Error("newcomer was refused")
+    }
+
+    if len(limiter.buckets) != MAX_SENDER_BUCKETS || len(limiter.buckets) != limiter.recent.Len() {
+        t.Errorf("Kept %d buckets (%d in the list)", len(limiter.buckets), limiter.recent.Len())
+    }
+    if limiter.buckets["sender1"] != nil {
+        t.Error("Least recently seen sender was kept")
+    }
+    if limiter.allow("sender0") {
+        t.Error("Recently seen sender was forgotten")
+    }
+}
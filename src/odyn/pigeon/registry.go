@@ -0,0 +1,431 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "odyn/storage"
+    "sort"
+    "sync"
+    "time"
+)
+
+// In-memory registry.  Only useful when every server lives in this process.
+type memRegistry struct {
+    mu sync.Mutex
+    workers map[string]*ServerInfo
+
+    // Hostnames by msg key pattern
+    listeners *subjectTrie
+    leases map[string]lease
+}
+
+type lease struct {
+    holder string
+    expires time.Time
+}
+
+// Registry backed by Odyn's storage engine.  Documents are laid out as:
+//
+//      /pigeon/workers
+//
+//          { "<hostname>" : true, ... }
+//
+//      /pigeon/workers/<hostname>
+//
+//          {
+//              "status" : "running",
+//              "heartbeat" : "2015-08-03T20:22:08.123456789Z",
+//              "load" : 3
+//          }
+//
+//      /pigeon/subscriptions/<hostname>
+//
+//          { "<msgKey or pattern>" : true, ... }
+//
+//      /pigeon/leases/<name>
+//
+//          {
+//              "holder" : "<holder>",
+//              "expires" : "2015-08-03T20:22:23.123456789Z"
+//          }
+//
+// Each worker only writes its own documents, so workers in different
+// processes do not overwrite each other's heartbeats or listeners.  The
+// exceptions are MarkUnresponsive, which rewrites the documents of workers
+// that stopped heartbeating (a heartbeat that races with it is restored by
+// the next one), and /pigeon/workers, which lists the hostnames since storage
+// cannot list documents.  A worker adds itself to that list again at every
+// heartbeat, in case a worker registering in another process overwrote it.
+//
+// The storage engine has no transactions, so leases are only exclusive
+// between processes if storage writes are not lost or reordered.
+type storageRegistry struct {
+    mu sync.Mutex
+    conn storage.Connection
+}
+
+const workersPath = "/pigeon/workers"
+
+func workerPath(hostname string) string {
+    return workersPath + "/" + hostname
+}
+
+func subscriptionsPath(hostname string) string {
+    return "/pigeon/subscriptions/" + hostname
+}
+
+var statusEnumNames = map[StatusEnum]string{
+    DOES_NOT_EXIST: "does_not_exist",
+    STOPPED: "stopped",
+    RUNNING: "running",
+    UNRESPONSIVE: "unresponsive",
+}
+
+// Create a Registry that keeps routing info in memory.
+func NewMemRegistry() Registry {
+    return &memRegistry{
+        workers: map[string]*ServerInfo{},
+        listeners: newSubjectTrie(),
+        leases: map[string]lease{},
+    }
+}
+
+// Create a Registry that keeps routing info in Odyn's storage engine, using
+// connection <conn>.
+func NewStorageRegistry(conn storage.Connection) Registry {
+    return &storageRegistry{
+        conn: conn,
+    }
+}
+
+func (status StatusEnum) String() string {
+    return statusEnumNames[status]
+}
+
+func parseStatusEnum(name string) StatusEnum {
+    for status, statusName := range statusEnumNames {
+        if statusName == name {
+            return status
+        }
+    }
+    return DOES_NOT_EXIST
+}
+
+func (reg *memRegistry) RegisterWorker(hostname string) error {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    reg.workers[hostname] = &ServerInfo{
+        Hostname: hostname,
+        Status: RUNNING,
+        LastHeartbeat: time.Now(),
+    }
+    return nil
+}
+
+func (reg *memRegistry) Heartbeat(hostname string, load int) error {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    info, ok := reg.workers[hostname]
+    if !ok {
+        return errNoSuchWorker(hostname)
+    }
+    info.LastHeartbeat = time.Now()
+    info.Load = load
+    if info.Status == UNRESPONSIVE {
+        info.Status = RUNNING
+    }
+    return nil
+}
+
+func (reg *memRegistry) SetWorkerStatus(hostname string, status StatusEnum) error {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    info, ok := reg.workers[hostname]
+    if !ok {
+        return errNoSuchWorker(hostname)
+    }
+    info.Status = status
+    return nil
+}
+
+func (reg *memRegistry) MarkUnresponsive(cutoff time.Time) ([]string, error) {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    marked := []string{}
+    for hostname, info := range reg.workers {
+        if info.Status == RUNNING && info.LastHeartbeat.Before(cutoff) {
+            info.Status = UNRESPONSIVE
+            marked = append(marked, hostname)
+        }
+    }
+    sort.Strings(marked)
+    return marked, nil
+}
+
+func (reg *memRegistry) GetWorker(hostname string) (ServerInfo, error) {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    info, ok := reg.workers[hostname]
+    if !ok {
+        return ServerInfo{Hostname: hostname, Status: DOES_NOT_EXIST}, nil
+    }
+    return *info, nil
+}
+
+func (reg *memRegistry) RegisterListener(hostname, msgKey string) error {
+    err := validatePattern(msgKey)
+    if err != nil {
+        return err
+    }
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    reg.listeners.insert(msgKey, hostname)
+    return nil
+}
+
+func (reg *memRegistry) UnregisterListener(hostname, msgKey string) error {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    reg.listeners.remove(msgKey, hostname)
+    return nil
+}
+
+func (reg *memRegistry) GetListeners(msgKey string) ([]string, error) {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    hosts := map[string]bool{}
+    for hostname := range reg.listeners.match(msgKey) {
+        info, ok := reg.workers[hostname]
+        if ok && info.Status == RUNNING {
+            hosts[hostname] = true
+        }
+    }
+    return sortedKeys(hosts), nil
+}
+
+func (reg *memRegistry) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    now := time.Now()
+    current, ok := reg.leases[name]
+    if ok && current.holder != holder && current.expires.After(now) {
+        return false, nil
+    }
+    reg.leases[name] = lease{holder, now.Add(ttl)}
+    return true, nil
+}
+
+func (reg *storageRegistry) RegisterWorker(hostname string) error {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    err := reg.saveWorker(&ServerInfo{
+        Hostname: hostname,
+        Status: RUNNING,
+        LastHeartbeat: time.Now(),
+    })
+    if err != nil {
+        return err
+    }
+    return reg.addToIndex(hostname)
+}
+
+func (reg *storageRegistry) Heartbeat(hostname string, load int) error {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    info := reg.loadWorker(hostname)
+    if info == nil {
+        return errNoSuchWorker(hostname)
+    }
+    info.LastHeartbeat = time.Now()
+    info.Load = load
+    if info.Status == UNRESPONSIVE {
+        info.Status = RUNNING
+    }
+    err := reg.saveWorker(info)
+    if err != nil {
+        return err
+    }
+    return reg.addToIndex(hostname)
+}
+
+func (reg *storageRegistry) SetWorkerStatus(hostname string, status StatusEnum) error {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    info := reg.loadWorker(hostname)
+    if info == nil {
+        return errNoSuchWorker(hostname)
+    }
+    info.Status = status
+    return reg.saveWorker(info)
+}
+
+func (reg *storageRegistry) MarkUnresponsive(cutoff time.Time) ([]string, error) {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    marked := []string{}
+    for hostname := range reg.loadDocument(workersPath) {
+        info := reg.loadWorker(hostname)
+        if info == nil || info.Status != RUNNING || !info.LastHeartbeat.Before(cutoff) {
+            continue
+        }
+        info.Status = UNRESPONSIVE
+        err := reg.saveWorker(info)
+        if err != nil {
+            return marked, err
+        }
+        marked = append(marked, hostname)
+    }
+    sort.Strings(marked)
+    return marked, nil
+}
+
+func (reg *storageRegistry) GetWorker(hostname string) (ServerInfo, error) {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    info := reg.loadWorker(hostname)
+    if info == nil {
+        return ServerInfo{Hostname: hostname, Status: DOES_NOT_EXIST}, nil
+    }
+    return *info, nil
+}
+
+func (reg *storageRegistry) RegisterListener(hostname, msgKey string) error {
+    err := validatePattern(msgKey)
+    if err != nil {
+        return err
+    }
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    path := subscriptionsPath(hostname)
+    doc := reg.loadDocument(path)
+    if _, ok := doc[msgKey]; ok {
+        return nil
+    }
+    doc[msgKey] = true
+    return reg.conn.SaveDocument(path, doc)
+}
+
+func (reg *storageRegistry) UnregisterListener(hostname, msgKey string) error {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    path := subscriptionsPath(hostname)
+    doc := reg.loadDocument(path)
+    if _, ok := doc[msgKey]; !ok {
+        return nil
+    }
+    delete(doc, msgKey)
+    return reg.conn.SaveDocument(path, doc)
+}
+
+func (reg *storageRegistry) GetListeners(msgKey string) ([]string, error) {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+
+    // Subscriptions of every running worker
+    trie := newSubjectTrie()
+    for hostname := range reg.loadDocument(workersPath) {
+        info := reg.loadWorker(hostname)
+        if info == nil || info.Status != RUNNING {
+            continue
+        }
+        for pattern := range reg.loadDocument(subscriptionsPath(hostname)) {
+            trie.insert(pattern, hostname)
+        }
+    }
+    return sortedKeys(trie.match(msgKey)), nil
+}
+
+func (reg *storageRegistry) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    path := "/pigeon/leases/" + name
+    now := time.Now()
+    doc := reg.loadDocument(path)
+    currentHolder, _ := doc["holder"].(string)
+    expiresStr, _ := doc["expires"].(string)
+    expires, _ := time.Parse(time.RFC3339Nano, expiresStr)
+    if currentHolder != "" && currentHolder != holder && expires.After(now) {
+        return false, nil
+    }
+
+    err := reg.conn.SaveDocument(path, map[string]interface{}{
+        "holder": holder,
+        "expires": now.Add(ttl).UTC().Format(time.RFC3339Nano),
+    })
+    if err != nil {
+        return false, err
+    }
+    return true, nil
+}
+
+// Load a document, treating a missing or malformed document as empty.
+func (reg *storageRegistry) loadDocument(path string) map[string]interface{} {
+    obj, err := reg.conn.LoadDocument(path)
+    if err != nil {
+        return map[string]interface{}{}
+    }
+    doc, ok := obj.(map[string]interface{})
+    if !ok {
+        return map[string]interface{}{}
+    }
+    return doc
+}
+
+// Load the document for worker <hostname>, or nil if it has none.
+func (reg *storageRegistry) loadWorker(hostname string) *ServerInfo {
+    obj, err := reg.conn.LoadDocument(workerPath(hostname))
+    if err != nil {
+        return nil
+    }
+    doc, ok := obj.(map[string]interface{})
+    if !ok {
+        return nil
+    }
+    info := &ServerInfo{Hostname: hostname}
+    status, _ := doc["status"].(string)
+    info.Status = parseStatusEnum(status)
+    heartbeat, _ := doc["heartbeat"].(string)
+    info.LastHeartbeat, _ = time.Parse(time.RFC3339Nano, heartbeat)
+    load, _ := doc["load"].(float64)
+    info.Load = int(load)
+    return info
+}
+
+func (reg *storageRegistry) saveWorker(info *ServerInfo) error {
+    return reg.conn.SaveDocument(workerPath(info.Hostname), map[string]interface{}{
+        "status": info.Status.String(),
+        "heartbeat": info.LastHeartbeat.UTC().Format(time.RFC3339Nano),
+        "load": info.Load,
+    })
+}
+
+// Make sure <hostname> is listed in /pigeon/workers.
+func (reg *storageRegistry) addToIndex(hostname string) error {
+    index := reg.loadDocument(workersPath)
+    if _, ok := index[hostname]; ok {
+        return nil
+    }
+    index[hostname] = true
+    return reg.conn.SaveDocument(workersPath, index)
+}
+
+func sortedKeys(set map[string]bool) []string {
+    out := make([]string, 0, len(set))
+    for key := range set {
+        out = append(out, key)
+    }
+    sort.Strings(out)
+    return out
+}
@@ -0,0 +1,153 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "fmt"
+    "reflect"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestStorageRegistryListeners(t *testing.T) {
+    reg := NewStorageRegistry(newMemConn())
+    for _, hostname := range []string{"a", "b", "c"} {
+        err := reg.RegisterWorker(hostname)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    reg.RegisterListener("a", "device.Leela.status")
+    reg.RegisterListener("b", "device.*.status")
+    reg.RegisterListener("c", "device.>")
+    reg.RegisterListener("c", "other")
+
+    hosts, err := reg.GetListeners("device.Leela.status")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(hosts, []string{"a", "b", "c"}) {
+        t.Errorf("Listeners are %v", hosts)
+    }
+
+    reg.UnregisterListener("c", "device.>")
+    reg.SetWorkerStatus("b", STOPPED)
+    hosts, _ = reg.GetListeners("device.Leela.status")
+    if !reflect.DeepEqual(hosts, []string{"a"}) {
+        t.Errorf("Listeners are %v after changes", hosts)
+    }
+}
+
+func TestStorageRegistryMarkUnresponsive(t *testing.T) {
+    reg := NewStorageRegistry(newMemConn())
+    reg.RegisterWorker("old")
+    cutoff := time.Now()
+    reg.RegisterWorker("new")
+    reg.RegisterListener("old", "job")
+
+    marked, err := reg.MarkUnresponsive(cutoff)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(marked, []string{"old"}) {
+        t.Errorf("Marked %v", marked)
+    }
+    info, _ := reg.GetWorker("old")
+    if info.Status != UNRESPONSIVE {
+        t.Errorf("Status is %s", info.Status)
+    }
+    hosts, _ := reg.GetListeners("job")
+    if len(hosts) != 0 {
+        t.Errorf("Unresponsive worker still listens: %v", hosts)
+    }
+
+    err = reg.Heartbeat("old", 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    info, _ = reg.GetWorker("old")
+    if info.Status != RUNNING || info.Load != 2 {
+        t.Errorf("After a heartbeat: %+v", info)
+    }
+    err = reg.Heartbeat("missing", 0)
+    if err == nil {
+        t.Error("Heartbeat for an unregistered worker succeeded")
+    }
+}
+
+// Workers in separate processes, sharing storage, must not lose each other's
+// heartbeats or listeners.
+func TestStorageRegistryConcurrentWorkers(t *testing.T) {
+    conn := newMemConn()
+    var wg sync.WaitGroup
+    for i := 0; i < 10; i++ {
+        wg.Add(1)
+        go func(hostname string) {
+            defer wg.Done()
+            reg := NewStorageRegistry(conn)
+            reg.RegisterWorker(hostname)
+            reg.RegisterListener(hostname, "job")
+            for j := 0; j < 10; j++ {
+                err := reg.Heartbeat(hostname, j)
+                if err != nil {
+                    t.Error(err)
+                }
+            }
+        }(fmt.Sprintf("worker%d", i))
+    }
+    wg.Wait()
+
+    reg := NewStorageRegistry(conn)
+    for i := 0; i < 10; i++ {
+        hostname := fmt.Sprintf("worker%d", i)
+        info, _ := reg.GetWorker(hostname)
+        if info.Status != RUNNING || info.Load != 9 {
+            t.Errorf("%s is %+v", hostname, info)
+        }
+
+        // Registrations may have raced on the list of workers, which the
+        // next heartbeat fixes
+        reg.Heartbeat(hostname, 0)
+    }
+    hosts, err := reg.GetListeners("job")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(hosts) != 10 {
+        t.Errorf("Listeners are %v", hosts)
+    }
+}
+
+func TestStorageRegistryHeartbeatRestoresIndex(t *testing.T) {
+    conn := newMemConn()
+    reg := NewStorageRegistry(conn)
+    reg.RegisterWorker("a")
+    reg.RegisterWorker("b")
+    reg.RegisterListener("b", "job")
+
+    // As if another process registering "a" overwrote "b"'s entry
+    conn.SaveDocument(workersPath, map[string]interface{}{"a": true})
+    hosts, _ := reg.GetListeners("job")
+    if len(hosts) != 0 {
+        t.Fatalf("Listeners are %v", hosts)
+    }
+
+    reg.Heartbeat("b", 0)
+    hosts, _ = reg.GetListeners("job")
+    if !reflect.DeepEqual(hosts, []string{"b"}) {
+        t.Errorf("Listeners are %v after a heartbeat", hosts)
+    }
+}
@@ -0,0 +1,243 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "fmt"
+    "hash/fnv"
+    "math/rand"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+)
+
+// Router chooses which Server handles a request sent with Outbox.Launch.  A
+// Router may be shared by several outboxes, so implementations must be safe
+// for concurrent use.
+type Router interface {
+    // Choose one of <hosts> to handle a message.  <hosts> is sorted and
+    // never empty.  <registry> is the System's registry, for routers that
+    // need more than the hostnames.
+    Pick(msgKey string, payload map[string]interface{}, hosts []string, registry Registry) (string, error)
+
+    // Called once the request sent to <hostname> (as chosen by Pick) has
+    // finished.
+    Done(hostname string)
+}
+
+// Number of points each server gets on a hash ring.  More points spread keys
+// more evenly.
+const HASH_RING_REPLICAS = 100
+
+// Picks a server at random.
+type randomRouter struct {
+}
+
+// Cycles through servers in order.
+type roundRobinRouter struct {
+    next uint64
+}
+
+// Picks the server with the fewest requests outstanding from this router.
+type leastOutstandingRouter struct {
+    mu sync.Mutex
+    outstanding map[string]int
+}
+
+// Picks two servers at random and uses the one that reported less load in
+// its last heartbeat.
+type powerOfTwoRouter struct {
+}
+
+// Hashes a payload field onto a ring of servers, so that messages with the
+// same value go to the same server while the set of servers is unchanged.
+// When a server joins or leaves, only the values that hashed to it move.
+type hashRouter struct {
+    field string
+
+    mu sync.Mutex
+    ringHosts string
+    ring []ringPoint
+}
+
+type ringPoint struct {
+    hash uint32
+    hostname string
+}
+
+func NewRandomRouter() Router {
+    return &randomRouter{}
+}
+
+func NewRoundRobinRouter() Router {
+    return &roundRobinRouter{}
+}
+
+// Create a Router that only counts requests sent through it.  Share it
+// between outboxes to balance their combined traffic.
+func NewLeastOutstandingRouter() Router {
+    return &leastOutstandingRouter{
+        outstanding: map[string]int{},
+    }
+}
+
+// Create a Router that uses the load Servers report in their heartbeats.
+// The load is at most one heartbeat interval old.
+func NewPowerOfTwoRouter() Router {
+    return &powerOfTwoRouter{}
+}
+
+// Create a Router that sends messages with the same value for payload field
+// <field> to the same Server.  Launching a message without the field fails.
+func NewHashRouter(field string) Router {
+    return &hashRouter{
+        field: field,
+    }
+}
+
+func (router *randomRouter) Pick(msgKey string, payload map[string]interface{}, hosts []string, registry Registry) (string, error) {
+    return hosts[rand.Intn(len(hosts))], nil
+}
+
+func (router *randomRouter) Done(hostname string) {
+}
+
+func (router *roundRobinRouter) Pick(msgKey string, payload map[string]interface{}, hosts []string, registry Registry) (string, error) {
+    n := atomic.AddUint64(&router.next, 1) - 1
+    return hosts[n % uint64(len(hosts))], nil
+}
+
+func (router *roundRobinRouter) Done(hostname string) {
+}
+
+func (router *leastOutstandingRouter) Pick(msgKey string, payload map[string]interface{}, hosts []string, registry Registry) (string, error) {
+    router.mu.Lock()
+    defer router.mu.Unlock()
+
+    // Start at a random offset so that ties are spread out
+    offset := rand.Intn(len(hosts))
+    best := ""
+    for i := range hosts {
+        hostname := hosts[(offset + i) % len(hosts)]
+        if best == "" || router.outstanding[hostname] < router.outstanding[best] {
+            best = hostname
+        }
+    }
+    router.outstanding[best]++
+    return best, nil
+}
+
+func (router *leastOutstandingRouter) Done(hostname string) {
+    router.mu.Lock()
+    defer router.mu.Unlock()
+    router.outstanding[hostname]--
+    if router.outstanding[hostname] <= 0 {
+        delete(router.outstanding, hostname)
+    }
+}
+
+func (router *powerOfTwoRouter) Pick(msgKey string, payload map[string]interface{}, hosts []string, registry Registry) (string, error) {
+    if len(hosts) == 1 {
+        return hosts[0], nil
+    }
+
+    i := rand.Intn(len(hosts))
+    j := rand.Intn(len(hosts) - 1)
+    if j >= i {
+        j++
+    }
+
+    a, err := registry.GetWorker(hosts[i])
+    if err != nil {
+        return "", err
+    }
+    b, err := registry.GetWorker(hosts[j])
+    if err != nil {
+        return "", err
+    }
+
+    if b.Load < a.Load {
+        return b.Hostname, nil
+    }
+    return a.Hostname, nil
+}
+
+func (router *powerOfTwoRouter) Done(hostname string) {
+}
+
+func (router *hashRouter) Pick(msgKey string, payload map[string]interface{}, hosts []string, registry Registry) (string, error) {
+    value, ok := payload[router.field]
+    if !ok {
+        return "", fmt.Errorf("Pigeon: Payload for %s has no field %s to route on", msgKey, router.field)
+    }
+
+    ring := router.ringFor(hosts)
+    hash := hashString(fmt.Sprint(value))
+    i := sort.Search(len(ring), func(i int) bool {
+        return ring[i].hash >= hash
+    })
+    if i == len(ring) {
+        i = 0
+    }
+    return ring[i].hostname, nil
+}
+
+func (router *hashRouter) Done(hostname string) {
+}
+
+// Get the hash ring for <hosts>, rebuilding it if the hosts have changed.
+func (router *hashRouter) ringFor(hosts []string) []ringPoint {
+    key := strings.Join(hosts, "\n")
+
+    router.mu.Lock()
+    defer router.mu.Unlock()
+    if router.ring != nil && router.ringHosts == key {
+        return router.ring
+    }
+
+    ring := make([]ringPoint, 0, len(hosts) * HASH_RING_REPLICAS)
+    for _, hostname := range hosts {
+        for i := 0; i < HASH_RING_REPLICAS; i++ {
+            ring = append(ring, ringPoint{
+                hash: hashString(hostname + "#" + strconv.Itoa(i)),
+                hostname: hostname,
+            })
+        }
+    }
+    sort.Slice(ring, func(i, j int) bool {
+        return ring[i].hash < ring[j].hash
+    })
+
+    router.ringHosts = key
+    router.ring = ring
+    return ring
+}
+
+// FNV alone leaves similar short strings, such as a host's ring points,
+// close together on the ring, so its bits are mixed with the MurmurHash3
+// finalizer.
+func hashString(s string) uint32 {
+    h := fnv.New32a()
+    h.Write([]byte(s))
+    x := h.Sum32()
+    x ^= x >> 16
+    x *= 0x85ebca6b
+    x ^= x >> 13
+    x *= 0xc2b2ae35
+    x ^= x >> 16
+    return x
+}
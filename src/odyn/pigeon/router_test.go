@@ -0,0 +1,148 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "fmt"
+    "reflect"
+    "testing"
+)
+
+var routerHosts = []string{"a", "b", "c"}
+
+func pick(t *testing.T, router Router, payload map[string]interface{}, hosts []string, registry Registry) string {
+    t.Helper()
+    hostname, err := router.Pick("work", payload, hosts, registry)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return hostname
+}
+
+func TestRoundRobinRouter(t *testing.T) {
+    router := NewRoundRobinRouter()
+    picked := []string{}
+    for i := 0; i < 6; i++ {
+        picked = append(picked, pick(t, router, nil, routerHosts, nil))
+    }
+    if !reflect.DeepEqual(picked, []string{"a", "b", "c", "a", "b", "c"}) {
+        t.Errorf("Picked %v", picked)
+    }
+}
+
+func TestLeastOutstandingRouter(t *testing.T) {
+    router := NewLeastOutstandingRouter()
+
+    // Without Done, each host gets one request before any gets two
+    counts := map[string]int{}
+    for i := 0; i < 6; i++ {
+        counts[pick(t, router, nil, routerHosts, nil)]++
+        for _, hostname := range routerHosts {
+            if counts[hostname] < (i + 1) / len(routerHosts) {
+                t.Fatalf("Uneven picks %v", counts)
+            }
+        }
+    }
+
+    // A host that finishes its requests gets the next one
+    router.Done("b")
+    router.Done("b")
+    for i := 0; i < 2; i++ {
+        if hostname := pick(t, router, nil, routerHosts, nil); hostname != "b" {
+            t.Errorf("Picked %s while b had the fewest outstanding", hostname)
+        }
+    }
+}
+
+func TestPowerOfTwoRouter(t *testing.T) {
+    registry := NewMemRegistry()
+    loads := map[string]int{"a": 0, "b": 5, "c": 10}
+    for hostname, load := range loads {
+        registry.RegisterWorker(hostname)
+        registry.Heartbeat(hostname, load)
+    }
+
+    router := NewPowerOfTwoRouter()
+    counts := map[string]int{}
+    for i := 0; i < 300; i++ {
+        counts[pick(t, router, nil, routerHosts, registry)]++
+    }
+    // The busiest host always loses its comparison, and the idlest always
+    // wins, so it gets about two thirds of the picks
+    if counts["c"] != 0 {
+        t.Errorf("Busiest host was picked: %v", counts)
+    }
+    if counts["a"] < 150 {
+        t.Errorf("Idlest host was not preferred: %v", counts)
+    }
+
+    // Two hosts are always compared with each other
+    for i := 0; i < 10; i++ {
+        if hostname := pick(t, router, nil, []string{"b", "c"}, registry); hostname != "b" {
+            t.Errorf("Picked %s over the less loaded b", hostname)
+        }
+    }
+    if hostname := pick(t, router, nil, []string{"c"}, registry); hostname != "c" {
+        t.Errorf("Picked %s from a single host", hostname)
+    }
+}
+
+func TestHashRouter(t *testing.T) {
+    router := NewHashRouter("user")
+    assign := func(hosts []string) map[string]string {
+        assigned := map[string]string{}
+        for i := 0; i < 200; i++ {
+            user := fmt.Sprintf("user-%d", i)
+            assigned[user] = pick(t, router, map[string]interface{}{"user": user}, hosts, nil)
+        }
+        return assigned
+    }
+
+    before := assign(routerHosts)
+    if !reflect.DeepEqual(assign(routerHosts), before) {
+        t.Error("Same values went to different hosts")
+    }
+    counts := map[string]int{}
+    for _, hostname := range before {
+        counts[hostname]++
+    }
+    for _, hostname := range routerHosts {
+        if counts[hostname] < 40 {
+            t.Errorf("Values were not spread over every host: %v", counts)
+            break
+        }
+    }
+
+    // Only the values on a host that leaves move
+    after := assign([]string{"a", "c"})
+    for user, hostname := range before {
+        if hostname != "b" && after[user] != hostname {
+            t.Errorf("%s moved from %s to %s when b left", user, hostname, after[user])
+        }
+    }
+
+    // Only values that move to a host that joins move
+    after = assign([]string{"a", "b", "c", "d"})
+    for user, hostname := range before {
+        if after[user] != hostname && after[user] != "d" {
+            t.Errorf("%s moved from %s to %s when d joined", user, hostname, after[user])
+        }
+    }
+
+    _, err := router.Pick("work", map[string]interface{}{}, routerHosts, nil)
+    if err == nil {
+        t.Error("Picked a host for a payload without the field")
+    }
+}
@@ -0,0 +1,415 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "odyn/log"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Sends delayed and scheduled launches.  Each is saved in its own document:
+//
+//      /pigeon/schedules/<id or name>
+//
+//          {
+//              "msgKey" : "<msgKey>",
+//              "payload" : { ... },
+//              "next_run" : "2015-08-03T03:00:00Z",
+//              "cron" : "0 3 * * *"
+//          }
+//
+//      /pigeon/schedules
+//
+//          { "<id or name>" : true, ... }
+//
+// The second lists the first, since storage cannot list documents.  Only the
+// scheduler holding the lease removes names from the list, once their
+// documents are gone.  In case that races with a System adding a name, the
+// System keeps adding it back at every check until the launch is sent or
+// cancelled.
+//
+// "cron" is empty for one-off launches.  An entry is rescheduled (or, for a
+// one-off launch, removed) only once its launch has succeeded, so a launch
+// that cannot be sent or that fails is tried again at the next check.  A launch is sent
+// again if its entry cannot be saved afterwards, or if the lease changes
+// hands in between, so each run carries an idempotency key (see
+// WithIdempotencyKey) for Servers to recognize the repeat.  A scheduled
+// launch that was missed because no scheduler was running is sent once, as
+// soon as one is, rather than once per missed time.
+type scheduler struct {
+    sys *PigeonSystem
+    outbox *PigeonOutbox
+
+    // Identifies this System when taking the lease
+    holder string
+    leader bool
+
+    // Closed by stop
+    stopChan chan struct{}
+    stopOnce sync.Once
+
+    // Serializes changes to the list of schedules
+    mu sync.Mutex
+
+    // Names this System added that may not be in the list yet
+    added map[string]bool
+
+    // Protects sending
+    sendingMu sync.Mutex
+
+    // Entries whose launch is waiting for a response, so that later checks
+    // don't send them again
+    sending map[string]bool
+}
+
+type scheduleEntry struct {
+    msgKey string
+    payload map[string]interface{}
+    nextRun time.Time
+    cron string
+}
+
+// Name of the Registry lease held by the scheduler that sends launches.
+const SCHEDULER_LEASE = "scheduler"
+
+const schedulesPath = "/pigeon/schedules"
+
+var errNoStorage = errors.New("Pigeon: Scheduling requires SystemConfig.Storage")
+
+func newScheduler(sys *PigeonSystem) *scheduler {
+    hostname, _ := os.Hostname()
+    id, _ := randomID()
+    return &scheduler{
+        sys: sys,
+        outbox: sys.NewOutbox().(*PigeonOutbox),
+        holder: fmt.Sprintf("%s/%d/%s", hostname, os.Getpid(), id),
+        stopChan: make(chan struct{}),
+        added: map[string]bool{},
+        sending: map[string]bool{},
+    }
+}
+
+func schedulePath(id string) string {
+    return schedulesPath + "/" + id
+}
+
+func (outbox *PigeonOutbox) LaunchAt(at time.Time, key string, payload map[string]interface{}) (string, error) {
+    if outbox.sys.scheduler == nil {
+        return "", errNoStorage
+    }
+    err := validateMsgKey(key)
+    if err != nil {
+        return "", err
+    }
+    id, err := randomID()
+    if err != nil {
+        return "", err
+    }
+    err = outbox.sys.scheduler.add(id, &scheduleEntry{
+        msgKey: key,
+        payload: payload,
+        nextRun: at,
+    })
+    if err != nil {
+        return "", err
+    }
+    return id, nil
+}
+
+func (outbox *PigeonOutbox) LaunchAfter(delay time.Duration, key string, payload map[string]interface{}) (string, error) {
+    return outbox.LaunchAt(time.Now().Add(delay), key, payload)
+}
+
+func (outbox *PigeonOutbox) Schedule(name string, spec string, key string, payload map[string]interface{}) error {
+    if outbox.sys.scheduler == nil {
+        return errNoStorage
+    }
+    // Names are document names under schedulesPath
+    if name == "" || strings.Contains(name, "/") {
+        return fmt.Errorf("Pigeon: Invalid schedule name %q", name)
+    }
+    err := validateMsgKey(key)
+    if err != nil {
+        return err
+    }
+    sched, err := parseCron(spec)
+    if err != nil {
+        return err
+    }
+    nextRun := sched.next(time.Now())
+    if nextRun.IsZero() {
+        return fmt.Errorf("Pigeon: Cron spec %q never matches", spec)
+    }
+    return outbox.sys.scheduler.add(name, &scheduleEntry{
+        msgKey: key,
+        payload: payload,
+        nextRun: nextRun,
+        cron: spec,
+    })
+}
+
+func (outbox *PigeonOutbox) CancelScheduled(id string) error {
+    if outbox.sys.scheduler == nil {
+        return errNoStorage
+    }
+    return outbox.sys.scheduler.cancel(id)
+}
+
+func (sched *scheduler) add(id string, entry *scheduleEntry) error {
+    err := sched.saveEntry(id, entry)
+    if err != nil {
+        return err
+    }
+    sched.mu.Lock()
+    defer sched.mu.Unlock()
+    sched.added[id] = true
+    return sched.addToList(id)
+}
+
+func (sched *scheduler) cancel(id string) error {
+    if sched.loadEntry(id) == nil {
+        return fmt.Errorf("Pigeon: Nothing scheduled as %s", id)
+    }
+    // The scheduler removes it from the list
+    return sched.sys.cfg.Storage.DeleteDocument(schedulePath(id))
+}
+
+// Check for due launches until stopped.
+func (sched *scheduler) run() {
+    ticker := time.NewTicker(sched.sys.cfg.SchedulerInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+            sched.tick()
+        case <-sched.stopChan:
+            return
+        }
+    }
+}
+
+// Stop checking for due launches.  Safe to call more than once.
+func (sched *scheduler) stop() {
+    sched.stopOnce.Do(func() {
+        close(sched.stopChan)
+    })
+}
+
+// Send every launch that is due, if we hold the lease.
+func (sched *scheduler) tick() {
+    sched.relist()
+
+    leader, err := sched.sys.registry.AcquireLease(SCHEDULER_LEASE, sched.holder, sched.sys.cfg.SchedulerLease)
+    if err != nil {
+        log.Error("Pigeon: Cannot take scheduler lease: ", err)
+        leader = false
+    }
+    if leader != sched.leader {
+        sched.leader = leader
+        if leader {
+            log.Info("Pigeon: ", sched.holder, " is now sending scheduled launches")
+        } else {
+            log.Info("Pigeon: ", sched.holder, " is no longer sending scheduled launches")
+        }
+    }
+    if !leader {
+        return
+    }
+
+    now := time.Now()
+    for id, entry := range sched.loadDue(now) {
+        if !sched.beginSending(id) {
+            continue
+        }
+        ctx := WithIdempotencyKey(context.Background(), "schedule/" + id + "/" + entry.nextRun.UTC().Format(time.RFC3339Nano))
+        respChan, err := sched.outbox.LaunchContext(ctx, entry.msgKey, entry.payload)
+        if err != nil {
+            sched.endSending(id)
+            log.Error("Pigeon: Scheduled launch ", id, " of ", entry.msgKey, " failed, will retry: ", err)
+            continue
+        }
+        go sched.await(id, entry, now, respChan)
+    }
+}
+
+// Wait for the response to the launch of entry <id>, sent at <now>, and
+// reschedule or remove the entry if it succeeded.
+func (sched *scheduler) await(id string, entry *scheduleEntry, now time.Time, respChan <-chan Response) {
+    defer sched.endSending(id)
+    err := (<-respChan).Err()
+    if err != nil {
+        log.Error("Pigeon: Scheduled launch ", id, " of ", entry.msgKey, " failed, will retry: ", err)
+        return
+    }
+    err = sched.finish(id, entry, now)
+    if err != nil {
+        log.Error("Pigeon: Cannot save schedule ", id, ", it may be sent again: ", err)
+    }
+}
+
+// Mark entry <id> as being sent.  Returns false if it already is.
+func (sched *scheduler) beginSending(id string) bool {
+    sched.sendingMu.Lock()
+    defer sched.sendingMu.Unlock()
+    if sched.sending[id] {
+        return false
+    }
+    sched.sending[id] = true
+    return true
+}
+
+func (sched *scheduler) endSending(id string) {
+    sched.sendingMu.Lock()
+    defer sched.sendingMu.Unlock()
+    delete(sched.sending, id)
+}
+
+// Load the entries due at <now>, removing names whose documents are gone
+// from the list.
+func (sched *scheduler) loadDue(now time.Time) map[string]*scheduleEntry {
+    due := map[string]*scheduleEntry{}
+    gone := []string{}
+    for id := range sched.loadList() {
+        entry := sched.loadEntry(id)
+        if entry == nil {
+            gone = append(gone, id)
+        } else if !entry.nextRun.After(now) {
+            due[id] = entry
+        }
+    }
+    if len(gone) > 0 {
+        sched.removeFromList(gone)
+    }
+    return due
+}
+
+// Reschedule or remove entry <id>, whose launch was sent at <now>.
+func (sched *scheduler) finish(id string, entry *scheduleEntry, now time.Time) error {
+    if entry.cron == "" {
+        return sched.sys.cfg.Storage.DeleteDocument(schedulePath(id))
+    }
+    cron, err := parseCron(entry.cron)
+    var nextRun time.Time
+    if err == nil {
+        nextRun = cron.next(now)
+    }
+    if nextRun.IsZero() {
+        log.Warn("Pigeon: Dropping schedule ", id, ": cannot compute next run of ", entry.cron)
+        return sched.sys.cfg.Storage.DeleteDocument(schedulePath(id))
+    }
+
+    // Unless it was cancelled or replaced meanwhile
+    current := sched.loadEntry(id)
+    if current == nil || current.cron != entry.cron || !current.nextRun.Equal(entry.nextRun) {
+        return nil
+    }
+    return sched.saveEntry(id, &scheduleEntry{entry.msgKey, entry.payload, nextRun, entry.cron})
+}
+
+// Add the names this System added back to the list, in case the scheduler
+// overwrote them, until they are sent or cancelled.
+func (sched *scheduler) relist() {
+    sched.mu.Lock()
+    defer sched.mu.Unlock()
+    if len(sched.added) == 0 {
+        return
+    }
+    list := sched.loadList()
+    changed := false
+    for id := range sched.added {
+        if sched.loadEntry(id) == nil {
+            delete(sched.added, id)
+        } else if !list[id] {
+            list[id] = true
+            changed = true
+        }
+    }
+    if changed {
+        err := sched.sys.cfg.Storage.SaveDocument(schedulesPath, list)
+        if err != nil {
+            log.Error("Pigeon: Cannot save schedules: ", err)
+        }
+    }
+}
+
+// Caller must hold sched.mu.
+func (sched *scheduler) addToList(id string) error {
+    list := sched.loadList()
+    if list[id] {
+        return nil
+    }
+    list[id] = true
+    return sched.sys.cfg.Storage.SaveDocument(schedulesPath, list)
+}
+
+func (sched *scheduler) removeFromList(ids []string) {
+    sched.mu.Lock()
+    defer sched.mu.Unlock()
+    list := sched.loadList()
+    for _, id := range ids {
+        delete(list, id)
+    }
+    err := sched.sys.cfg.Storage.SaveDocument(schedulesPath, list)
+    if err != nil {
+        log.Error("Pigeon: Cannot save schedules: ", err)
+    }
+}
+
+func (sched *scheduler) loadList() map[string]bool {
+    list := map[string]bool{}
+    obj, err := sched.sys.cfg.Storage.LoadDocument(schedulesPath)
+    if err != nil {
+        return list
+    }
+    doc, _ := obj.(map[string]interface{})
+    for id := range doc {
+        list[id] = true
+    }
+    return list
+}
+
+// Load entry <id>, or nil if there is none.
+func (sched *scheduler) loadEntry(id string) *scheduleEntry {
+    obj, err := sched.sys.cfg.Storage.LoadDocument(schedulePath(id))
+    if err != nil {
+        return nil
+    }
+    fields, ok := obj.(map[string]interface{})
+    if !ok {
+        return nil
+    }
+    entry := &scheduleEntry{}
+    entry.msgKey, _ = fields["msgKey"].(string)
+    entry.payload, _ = fields["payload"].(map[string]interface{})
+    nextRun, _ := fields["next_run"].(string)
+    entry.nextRun, _ = time.Parse(time.RFC3339Nano, nextRun)
+    entry.cron, _ = fields["cron"].(string)
+    return entry
+}
+
+func (sched *scheduler) saveEntry(id string, entry *scheduleEntry) error {
+    return sched.sys.cfg.Storage.SaveDocument(schedulePath(id), map[string]interface{}{
+        "msgKey": entry.msgKey,
+        "payload": entry.payload,
+        "next_run": entry.nextRun.UTC().Format(time.RFC3339Nano),
+        "cron": entry.cron,
+    })
+}
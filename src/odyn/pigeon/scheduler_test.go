@@ -0,0 +1,274 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+)
+
+// Start a System that checks for due launches every 10ms, saving them in
+// <conn> and taking the lease in <registry>.
+func newSchedulerSystem(t *testing.T, conn *memConn, registry Registry) *PigeonSystem {
+    sys := NewPigeonSystem(SystemConfig{
+        Registry: registry,
+        Storage: conn,
+        SchedulerInterval: 10 * time.Millisecond,
+        DrainTimeout: time.Second,
+    }).(*PigeonSystem)
+    t.Cleanup(func() {
+        sys.Close()
+    })
+    return sys
+}
+
+// Start a server on <sys> whose "tick" inbox reports the "n" of each request
+// on the returned channel.
+func startTickServer(t *testing.T, sys *PigeonSystem) <-chan string {
+    server, err := sys.StartServer("worker")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        server.Stop()
+    })
+    ticks := make(chan string, 100)
+    newTestInbox(t, server, "tick", func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        n, _ := req.Body()["n"].(string)
+        ticks <- n
+    })
+    return ticks
+}
+
+func expectTick(t *testing.T, ticks <-chan string, expected string) {
+    t.Helper()
+    select {
+    case n := <-ticks:
+        if n != expected {
+            t.Errorf("Got tick %q, expected %q", n, expected)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatalf("No tick %q", expected)
+    }
+}
+
+func expectNoTick(t *testing.T, ticks <-chan string) {
+    t.Helper()
+    select {
+    case n := <-ticks:
+        t.Errorf("Unexpected tick %q", n)
+    case <-time.After(100 * time.Millisecond):
+    }
+}
+
+func TestLaunchAfter(t *testing.T) {
+    conn := newMemConn()
+    sys := newSchedulerSystem(t, conn, NewMemRegistry())
+    ticks := startTickServer(t, sys)
+
+    id, err := sys.NewOutbox().LaunchAfter(20 * time.Millisecond, "tick", map[string]interface{}{"n": "once"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    expectTick(t, ticks, "once")
+    expectNoTick(t, ticks)
+
+    _, err = conn.LoadDocument(schedulePath(id))
+    if err == nil {
+        t.Error("Entry was not removed after it was sent")
+    }
+    if sys.scheduler.loadList()[id] {
+        t.Error("Entry is still listed after it was sent")
+    }
+}
+
+func TestFailedLaunchIsRetried(t *testing.T) {
+    conn := newMemConn()
+    sys := newSchedulerSystem(t, conn, NewMemRegistry())
+
+    // Nothing listens for it yet
+    id, err := sys.NewOutbox().LaunchAfter(0, "tick", map[string]interface{}{"n": "late"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    time.Sleep(50 * time.Millisecond)
+    if sys.scheduler.loadEntry(id) == nil {
+        t.Fatal("Entry was removed although its launch failed")
+    }
+
+    ticks := startTickServer(t, sys)
+    expectTick(t, ticks, "late")
+}
+
+// A launch whose handler fails stays scheduled until a launch succeeds.
+func TestFailedResponseIsRetried(t *testing.T) {
+    conn := newMemConn()
+    sys := newSchedulerSystem(t, conn, NewMemRegistry())
+    server, err := sys.StartServer("worker")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        server.Stop()
+    })
+    attempts := make(chan int, 100)
+    calls := 0
+    newTestInbox(t, server, "tick", func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        calls++
+        attempts <- calls
+        if calls < 3 {
+            resp.SetError(fmt.Errorf("attempt %d failed", calls))
+        }
+    })
+
+    id, err := sys.NewOutbox().LaunchAfter(0, "tick", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for expected := 1; expected <= 3; expected++ {
+        select {
+        case n := <-attempts:
+            if n < 3 && sys.scheduler.loadEntry(id) == nil {
+                t.Fatalf("Entry was removed after attempt %d failed", n)
+            }
+        case <-time.After(5 * time.Second):
+            t.Fatalf("No attempt %d", expected)
+        }
+    }
+    deadline := time.Now().Add(5 * time.Second)
+    for conn.has(schedulePath(id)) && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if conn.has(schedulePath(id)) {
+        t.Error("Entry was not removed after its launch succeeded")
+    }
+    select {
+    case n := <-attempts:
+        t.Errorf("Sent again (attempt %d) after it succeeded", n)
+    case <-time.After(50 * time.Millisecond):
+    }
+}
+
+func TestScheduleNames(t *testing.T) {
+    sys := newSchedulerSystem(t, newMemConn(), NewMemRegistry())
+    outbox := sys.NewOutbox()
+    for _, name := range []string{"", "a/b", "/"} {
+        err := outbox.Schedule(name, "@every 1s", "tick", nil)
+        if err == nil {
+            t.Errorf("Schedule accepted name %q", name)
+        }
+    }
+    err := outbox.Schedule("nightly-report", "@every 1s", "tick", nil)
+    if err != nil {
+        t.Error(err)
+    }
+}
+
+func TestCancelScheduled(t *testing.T) {
+    sys := newSchedulerSystem(t, newMemConn(), NewMemRegistry())
+    ticks := startTickServer(t, sys)
+    outbox := sys.NewOutbox()
+
+    id, err := outbox.LaunchAfter(50 * time.Millisecond, "tick", map[string]interface{}{"n": "cancelled"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = outbox.CancelScheduled(id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    expectNoTick(t, ticks)
+
+    err = outbox.CancelScheduled(id)
+    if err == nil {
+        t.Error("Cancelling twice succeeded")
+    }
+}
+
+func TestScheduleRepeats(t *testing.T) {
+    sys := newSchedulerSystem(t, newMemConn(), NewMemRegistry())
+    ticks := startTickServer(t, sys)
+
+    err := sys.NewOutbox().Schedule("every", "@every 1s", "tick", map[string]interface{}{"n": "again"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    first := sys.scheduler.loadEntry("every").nextRun
+    expectTick(t, ticks, "again")
+    expectTick(t, ticks, "again")
+    if !sys.scheduler.loadEntry("every").nextRun.After(first) {
+        t.Error("Entry was not rescheduled")
+    }
+}
+
+func TestCloseStopsScheduler(t *testing.T) {
+    sys := newSchedulerSystem(t, newMemConn(), NewMemRegistry())
+    ticks := startTickServer(t, sys)
+
+    sys.Close()
+    time.Sleep(20 * time.Millisecond)
+    _, err := sys.NewOutbox().LaunchAfter(0, "tick", map[string]interface{}{"n": "closed"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    expectNoTick(t, ticks)
+}
+
+// Systems sharing storage add schedules at once; none may be lost.  (The
+// Systems stand in for separate processes, since their schedulers do not
+// share memory.)
+func TestConcurrentSchedules(t *testing.T) {
+    conn := newMemConn()
+    registry := NewMemRegistry()
+    leader := newSchedulerSystem(t, conn, registry)
+    ticks := startTickServer(t, leader)
+
+    // Only <leader> can reach the server, so let it take the lease first
+    _, err := leader.NewOutbox().LaunchAfter(0, "tick", map[string]interface{}{"n": "first"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    expectTick(t, ticks, "first")
+
+    var wg sync.WaitGroup
+    for i := 0; i < 4; i++ {
+        sys := newSchedulerSystem(t, conn, registry)
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            for j := 0; j < 5; j++ {
+                n := fmt.Sprintf("%d/%d", i, j)
+                _, err := sys.NewOutbox().LaunchAfter(0, "tick", map[string]interface{}{"n": n})
+                if err != nil {
+                    t.Error(err)
+                }
+            }
+        }(i)
+    }
+    wg.Wait()
+
+    seen := map[string]bool{}
+    deadline := time.After(5 * time.Second)
+    for len(seen) < 20 {
+        select {
+        case n := <-ticks:
+            seen[n] = true
+        case <-deadline:
+            t.Fatalf("Only got %d launches: %v", len(seen), seen)
+        }
+    }
+}
@@ -15,23 +15,70 @@
 package jobqueue
 
 import (
-    "canopy/canolog"
-    "encoding/gob"
+    "context"
     "fmt"
-    "net"
-    "net/rpc"
-    "net/http"
-    "net/url"
     "math/rand"
+    "odyn/log"
     "runtime"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
 )
 
 type PigeonServer struct {
     sys *PigeonSystem
     hostname string
     
-    // mapping from msgKey to list of inboxes
+    // Current *routeTable.  Requests read it without locking.
+    routes atomic.Value
+
+    // Held while replacing <routes> or changing which msg keys the registry
+    // lists for this server
+    routesMu sync.Mutex
+
+    // Concurrency limits by msg key.  Each is a semaphore with one slot
+    // per handler call allowed at once.
+    limitsMu sync.Mutex
+    keyLimits map[string]chan struct{}
+
+    // Rate limits by msg key, and for each sender.  Requests over a limit
+    // are rejected with RESP_BUSY.  senderRates is nil for no limit.
+    keyRates map[string]*tokenBucket
+    senderRates *senderLimiter
+
+    // Shares workers between priorities
+    lanes *laneScheduler
+
+    // Responses to requests with idempotency keys
+    dedup *dedupStore
+
+    // Protects the fields below
+    mu sync.Mutex
+
+    // RUNNING or STOPPED.  Requests are only handled while RUNNING.
+    status StatusEnum
+
+    // True once the Transport is accepting connections for us
+    listening bool
+
+    // Closed to stop the heartbeat goroutine
+    stopHeartbeat chan struct{}
+
+    // Number of requests being handled, and a channel closed when that drops
+    // to zero while Stop() is waiting.
+    inflight int
+    drained chan struct{}
+}
+
+// Snapshot of a server's inboxes.  Never modified once published; changes
+// are made to a copy that then replaces it.
+type routeTable struct {
+    // mapping from msgKey (or pattern) to list of inboxes
     inboxesByMsgKey map[string]([]*PigeonInbox)
+
+    // Keys of inboxesByMsgKey, for finding the patterns that match a msgKey
+    patterns *subjectTrie
 }
 
 type pigeonHandler struct {
@@ -39,8 +86,14 @@ type pigeonHandler struct {
     userCtx map[string]interface{}
 }
 
-// RPC entrypoint
-func (server *PigeonServer) rpcHandleRequest(req *PigeonRequest, resp *PigeonResponse) (outErr error) {
+// RPC entrypoint.  The handler sees <ctx> through req.Context().  Failures are
+// reported in <resp>'s status so that they reach the sender.
+func (server *PigeonServer) rpcHandleRequest(ctx context.Context, req *PigeonRequest, resp *PigeonResponse) {
+    if !server.beginRequest() {
+        resp.setStatus(RESP_REJECTED, "Pigeon Server: Server %s is stopped", server.hostname)
+        return
+    }
+    defer server.endRequest()
 
     // Log crashes in the RPC code
     defer func() {
@@ -48,123 +101,626 @@ func (server *PigeonServer) rpcHandleRequest(req *PigeonRequest, resp *PigeonRes
         if r != nil {
             var buf [4096]byte
             runtime.Stack(buf[:], false)
-            canolog.Error("RPC PANIC ", r, string(buf[:]))
-            canolog.Info("Recovered")
-            outErr = fmt.Errorf("Crash in %s", req.ReqJobKey)
+            log.Error("RPC PANIC ", r, string(buf[:]))
+            log.Info("Recovered")
+            resp.setStatus(RESP_HANDLER_PANIC, "Crash in %s: %v", req.ReqJobKey, r)
         }
     }()
 
-    canolog.Info("RPC Handling", req.ReqJobKey)
+    // Requests the handler launches with req.Context() share the
+    // correlation ID
+    correlationID := req.ReqHeaders[HEADER_CORRELATION_ID]
+    log.Info("RPC Handling ", req.ReqJobKey, " correlation ", correlationID)
+    if correlationID != "" {
+        ctx = WithCorrelationID(ctx, correlationID)
+        resp.SetHeader(HEADER_CORRELATION_ID, correlationID)
+    }
+
+    // Local callers share <req> between servers, so don't modify it
+    reqCopy := *req
+    reqCopy.ctx = ctx
+    req = &reqCopy
+    resp.sendPartial = req.partials
 
     // Lookup the handler for that job type
-    inboxes, ok := server.inboxesByMsgKey[req.ReqJobKey]
-    if !ok {
-        // NOT FOUND (NO INBOX LIST)
-        return fmt.Errorf("Pigeon Server: No inbox for msg key %s on server %s", req.ReqJobKey, server.hostname)
-    }
-    if len(inboxes) < 0 {
-        // NOT FOUND (NO INBOXES IN LIST)
-        return fmt.Errorf("Pigeon Server: No inboxes for msg key %s on server %s", req.ReqJobKey, server.hostname)
+    inboxes := server.inboxesFor(req.ReqJobKey)
+    if len(inboxes) == 0 {
+        // NOT FOUND (NO MATCHING INBOXES)
+        resp.setStatus(RESP_NOT_FOUND, "Pigeon Server: No inbox for msg key %s on server %s", req.ReqJobKey, server.hostname)
+        return
     }
-    // TODO: handle broadcast & idempotent request
-    // For now, send to random inbox
-
-    inbox := inboxes[rand.Intn(len(inboxes))]
 
-    if inbox.handler == nil {
-        return fmt.Errorf("Pigeon Server: Expected handler for inbox %s on inbox %s", req.ReqJobKey, inbox)
+    // Turn away senders that are sending faster than we allow
+    if !server.allowRate(req) {
+        resp.setStatus(RESP_BUSY, "Pigeon Server: Server %s is busy, try another", server.hostname)
+        return
     }
 
-    // Call the handler
-    canolog.Info("Calling Registered handler")
-    canolog.Info(req)
-    canolog.Info(resp)
-    canolog.Info("inbox: ", inbox)
-    inbox.handler.Handle(req.ReqJobKey, inbox.userCtx, req, resp)
-    canolog.Info("All done")
+    // Make sure the payload is what the handler expects
+    payload, err := checkPayload(req.ReqJobKey, req.ReqBody)
+    if err != nil {
+        resp.SetError(err)
+        return
+    }
+    req.payload = payload
 
-    return nil
+    // Answer retries of a request that was already handled with its
+    // response, without calling the handler again.  Partial responses
+    // cannot be replayed, so streams are always handled.
+    idempotencyKey := req.ReqHeaders[HEADER_IDEMPOTENCY_KEY]
+    if idempotencyKey == "" || req.ReqStream {
+        server.handleRequest(ctx, inboxes, req, resp)
+        return
+    }
+    claim, saved, err := server.dedupStore().claim(ctx, req.ReqJobKey, idempotencyKey)
+    if err != nil {
+        resp.setStatus(contextStatus(err), "Pigeon Server: Gave up waiting for the first request with idempotency key %s on server %s", idempotencyKey, server.hostname)
+        return
+    }
+    if saved != nil {
+        log.Info("RPC Replaying response for idempotency key ", idempotencyKey)
+        saved.replay(resp)
+        return
+    }
+    defer claim.release()
+    server.handleRequest(ctx, inboxes, req, resp)
+    claim.save(resp)
 }
 
-func (server *PigeonServer) RPCHandleRequest(req *PigeonRequest, resp *PigeonResponse) error {
-    // defer does not seem to work correctly inside main RPC routine.  So this
-    // is our workaround.
-    err := server.rpcHandleRequest(req, resp) 
-    canolog.Info("Leaving RPCHandleRequest")
-    return err
-}
-
-func (server *PigeonServer) serveRPC() error {
-    // TODO: Use direct TCP instead of HTML
-    gob.Register(map[string]interface{}{})
-    gob.Register(map[string]string{})
-    gob.Register(map[string][]string{})
-    gob.Register(url.Values{})
-    PIGEON_RPC_PORT := ":1888"
-    err := rpc.Register(server)
+// Call a handler in <inboxes> for <req>, once the msg key's concurrency limit
+// and the lanes allow it.
+func (server *PigeonServer) handleRequest(ctx context.Context, inboxes []*PigeonInbox, req *PigeonRequest, resp *PigeonResponse) {
+    // Wait for the msg key's concurrency limit, if any
+    releaseKey, err := server.acquireKeySlot(ctx, req.ReqJobKey)
     if err != nil {
-        return err
+        resp.setStatus(contextStatus(err), "Pigeon Server: Gave up waiting to handle %s on server %s", req.ReqJobKey, server.hostname)
+        return
     }
-    rpc.HandleHTTP()
-    l, err := net.Listen("tcp", PIGEON_RPC_PORT)
+    defer releaseKey()
+
+    // Wait for a worker, in the lane for the request's priority
+    priority := ParsePriority(req.ReqHeaders[HEADER_PRIORITY])
+    releaseWorker, err := server.laneScheduler().acquire(ctx, priority)
     if err != nil {
-        return err
+        resp.setStatus(contextStatus(err), "Pigeon Server: Gave up waiting for a %s priority worker for %s on server %s", priority, req.ReqJobKey, server.hostname)
+        return
+    }
+    defer releaseWorker()
+
+    if req.ReqBroadcast {
+        server.broadcastToInboxes(ctx, inboxes, req, resp)
+        return
+    }
+
+    // Send to the least busy active inbox.  If every inbox is at its
+    // concurrency limit, wait for the least busy one.
+    candidates := inboxesByLoad(inboxes)
+    for _, wait := range []bool{false, true} {
+        for _, inbox := range candidates {
+            handler, userCtx, release, err := inbox.beginHandling(ctx, wait)
+            if err != nil {
+                resp.setStatus(contextStatus(err), "Pigeon Server: Gave up waiting for a free handler for %s on server %s", req.ReqJobKey, server.hostname)
+                return
+            }
+            if release == nil {
+                continue
+            }
+            defer release()
+
+            handler.Handle(req.ReqJobKey, userCtx, req, resp)
+            return
+        }
+    }
+
+    resp.setStatus(RESP_NOT_FOUND, "Pigeon Server: No active inbox with a handler for msg key %s on server %s", req.ReqJobKey, server.hostname)
+}
+
+// Deliver a broadcast request to every active inbox in <inboxes>, waiting
+// for inboxes at their concurrency limit.  Each handler gets its own response
+// object, which is discarded except for the first error.
+func (server *PigeonServer) broadcastToInboxes(ctx context.Context, inboxes []*PigeonInbox, req *PigeonRequest, resp *PigeonResponse) {
+    delivered := 0
+    for _, inbox := range inboxes {
+        handler, userCtx, release, err := inbox.beginHandling(ctx, true)
+        if err != nil {
+            resp.setStatus(contextStatus(err), "Pigeon Server: Gave up waiting for a free handler for %s on server %s", req.ReqJobKey, server.hostname)
+            return
+        }
+        if release == nil {
+            continue
+        }
+        delivered++
+
+        inboxResp := &PigeonResponse{}
+        func() {
+            defer release()
+            handler.Handle(req.ReqJobKey, userCtx, req, inboxResp)
+        }()
+        if inboxResp.RespStatus != RESP_OK && resp.RespStatus == RESP_OK {
+            resp.RespStatus = inboxResp.RespStatus
+            resp.RespError = inboxResp.RespError
+        }
+    }
+
+    if delivered == 0 {
+        resp.setStatus(RESP_NOT_FOUND, "Pigeon Server: No active inbox with a handler for msg key %s on server %s", req.ReqJobKey, server.hostname)
+    }
+}
+
+func (server *PigeonServer) RPCHandleRequest(req *PigeonRequest, resp *PigeonResponse) error {
+    return server.handleRemoteRequest(context.Background(), req, resp)
+}
+
+// Handle <req> from another process.  The handler gives up when <ctx> is
+// done, or at the request's deadline.
+func (server *PigeonServer) handleRemoteRequest(ctx context.Context, req *PigeonRequest, resp *PigeonResponse) error {
+    if !req.ReqDeadline.IsZero() {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithDeadline(ctx, req.ReqDeadline)
+        defer cancel()
     }
-    go http.Serve(l, nil)
+
+    server.rpcHandleRequest(ctx, req, resp)
+    log.Info("Leaving RPCHandleRequest")
+
+    // Errors are reported in resp
     return nil
 }
 
 func (server *PigeonServer) CreateInbox(msgKey string) (Inbox, error) {
+    err := validatePattern(msgKey)
+    if err != nil {
+        return nil, err
+    }
+
     // Create new inbox object
     inbox := &PigeonInbox{
         server: server,
         msgKey: msgKey,
     }
 
-    // Register this inbox (ie "listener") in the DB
-    err := server.sys.dl.RegisterListener(server.hostname, msgKey)
+    // Associate the inbox with the msgKey (locally), then register this
+    // inbox (ie "listener") in the DB
+    server.routesMu.Lock()
+    defer server.routesMu.Unlock()
+    server.addRoute(inbox)
+    err = server.sys.registry.RegisterListener(server.hostname, msgKey)
     if err != nil {
+        server.removeRoute(inbox)
         return nil, err
     }
 
-    // Associate the inbox with the msgKey (locally)
-    _, ok := server.inboxesByMsgKey[msgKey]
-    if ok {
-        // Append new inbox to the list
-        server.inboxesByMsgKey[msgKey] = append(server.inboxesByMsgKey[msgKey], inbox)
-    } else {
-        // This is the first inbox on this server for msgKey.
-        // Create list of inboxes for msgKey.
-        server.inboxesByMsgKey[msgKey] = []*PigeonInbox{inbox}
+    return inbox, nil
+}
+
+// Limit the number of handler calls for msg key <msgKey> running at once on
+// this server, across all inboxes.  Requests over the limit wait for a free
+// slot, or until the sender gives up.  Use 0 for no limit.
+func (server *PigeonServer) SetMaxConcurrency(msgKey string, max int) error {
+    err := validateMsgKey(msgKey)
+    if err != nil {
+        return err
+    }
+
+    server.limitsMu.Lock()
+    defer server.limitsMu.Unlock()
+    if max <= 0 {
+        delete(server.keyLimits, msgKey)
+        return nil
     }
+    // Calls already running release their slot to the old semaphore
+    server.keyLimits[msgKey] = make(chan struct{}, max)
+    return nil
+}
 
-    return inbox, nil
+// Limit messages labelled <msgKey> to <perSecond> per second on this server,
+// allowing bursts of up to <burst>.  Use 0 for no limit.
+func (server *PigeonServer) SetRateLimit(msgKey string, perSecond float64, burst int) error {
+    err := validateMsgKey(msgKey)
+    if err != nil {
+        return err
+    }
+    err = validateRateLimit(perSecond, burst)
+    if err != nil {
+        return err
+    }
 
+    server.limitsMu.Lock()
+    defer server.limitsMu.Unlock()
+    if perSecond == 0 {
+        delete(server.keyRates, msgKey)
+        return nil
+    }
+    server.keyRates[msgKey] = newTokenBucket(rateLimit{perSecond, burst})
+    return nil
 }
 
-func (server *PigeonServer) Start() error {
-    err := server.sys.dl.RegisterWorker(server.hostname)
+// Limit each sender to <perSecond> messages per second on this server,
+// allowing bursts of up to <burst>.  Use 0 for no limit.
+func (server *PigeonServer) SetSenderRateLimit(perSecond float64, burst int) error {
+    err := validateRateLimit(perSecond, burst)
     if err != nil {
         return err
     }
 
-    err = server.serveRPC()
+    server.limitsMu.Lock()
+    defer server.limitsMu.Unlock()
+    if perSecond == 0 {
+        server.senderRates = nil
+        return nil
+    }
+    server.senderRates = newSenderLimiter(rateLimit{perSecond, burst})
+    return nil
+}
+
+// Take a token from the rate limits that apply to <req>.  Returns false if
+// any of them is exhausted.
+func (server *PigeonServer) allowRate(req *PigeonRequest) bool {
+    server.limitsMu.Lock()
+    keyRate := server.keyRates[req.ReqJobKey]
+    senderRates := server.senderRates
+    server.limitsMu.Unlock()
+
+    if senderRates != nil && !senderRates.allow(req.ReqHeaders[HEADER_SENDER]) {
+        return false
+    }
+    return keyRate == nil || keyRate.allow()
+}
+
+// Share this server's workers between priorities according to <cfg>.  Zero
+// values in <cfg> are taken from DefaultLaneConfig, except MaxWorkers.
+// Requests already running still count against MaxWorkers, and requests
+// already waiting keep their place in their lanes.
+func (server *PigeonServer) SetLanes(cfg LaneConfig) error {
+    return server.laneScheduler().reconfigure(cfg)
+}
+
+func (server *PigeonServer) laneScheduler() *laneScheduler {
+    server.limitsMu.Lock()
+    defer server.limitsMu.Unlock()
+    return server.lanes
+}
+
+func (server *PigeonServer) Stats() ServerStats {
+    return server.laneScheduler().stats()
+}
+
+// Remember the responses to requests with idempotency keys according to
+// <cfg>.  Zero values in <cfg> are taken from DefaultDedupConfig, and Conn
+// from the System's Storage.  Responses remembered under the old settings
+// are forgotten, unless they were saved to storage.
+func (server *PigeonServer) SetDeduplication(cfg DedupConfig) error {
+    if cfg.Conn == nil {
+        cfg.Conn = server.sys.cfg.Storage
+    }
+    dedup, err := newDedupStore(server.hostname, cfg)
     if err != nil {
-        // TODO: unregister?
         return err
     }
 
+    server.limitsMu.Lock()
+    defer server.limitsMu.Unlock()
+    server.dedup = dedup
+    return nil
+}
+
+func (server *PigeonServer) dedupStore() *dedupStore {
+    server.limitsMu.Lock()
+    defer server.limitsMu.Unlock()
+    return server.dedup
+}
+
+// Take a slot from <msgKey>'s concurrency limit, waiting until one is free
+// or <ctx> is done.  Returns a function to release the slot.
+func (server *PigeonServer) acquireKeySlot(ctx context.Context, msgKey string) (func(), error) {
+    server.limitsMu.Lock()
+    slots := server.keyLimits[msgKey]
+    server.limitsMu.Unlock()
+    return acquireSlot(ctx, slots, true)
+}
+
+// Take a slot from semaphore <slots>, which may be nil for no limit.  If
+// <wait> is false and no slot is free, returns a nil function.
+func acquireSlot(ctx context.Context, slots chan struct{}, wait bool) (func(), error) {
+    release := func() {
+        if slots != nil {
+            <-slots
+        }
+    }
+    if slots == nil {
+        return release, nil
+    }
+
+    select {
+    case slots <- struct{}{}:
+        return release, nil
+    default:
+    }
+    if !wait {
+        return nil, nil
+    }
+
+    select {
+    case slots <- struct{}{}:
+        return release, nil
+    case <-ctx.Done():
+        return nil, ctx.Err()
+    }
+}
+
+// Admit a request.  Returns false if the server is not running.
+func (server *PigeonServer) beginRequest() bool {
+    server.mu.Lock()
+    defer server.mu.Unlock()
+    if server.status != RUNNING {
+        return false
+    }
+    server.inflight++
+    return true
+}
+
+func (server *PigeonServer) endRequest() {
+    server.mu.Lock()
+    defer server.mu.Unlock()
+    server.inflight--
+    if server.inflight == 0 && server.drained != nil {
+        close(server.drained)
+        server.drained = nil
+    }
+}
+
+// Periodically tell the registry we're alive, and mark servers that have
+// stopped doing the same as UNRESPONSIVE.  Runs until <stop> is closed.
+func (server *PigeonServer) heartbeat(stop <-chan struct{}) {
+    ticker := time.NewTicker(server.sys.cfg.HeartbeatInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-stop:
+            return
+        case <-ticker.C:
+        }
+
+        server.mu.Lock()
+        load := server.inflight
+        server.mu.Unlock()
+
+        err := server.sys.registry.Heartbeat(server.hostname, load)
+        if err != nil {
+            log.Error("Pigeon: Heartbeat failed for ", server.hostname, ": ", err)
+        }
+
+        cutoff := time.Now().Add(-server.sys.cfg.UnresponsiveAfter)
+        marked, err := server.sys.registry.MarkUnresponsive(cutoff)
+        if err != nil {
+            log.Error("Pigeon: Liveness check failed: ", err)
+        }
+        for _, hostname := range marked {
+            log.Warn("Pigeon: Server ", hostname, " is UNRESPONSIVE")
+        }
+    }
+}
+
+func (server *PigeonServer) Start() error {
+    // Lock order is routesMu, then mu
+    server.routesMu.Lock()
+    defer server.routesMu.Unlock()
+    server.mu.Lock()
+    defer server.mu.Unlock()
+
+    if server.status == RUNNING {
+        return nil
+    }
+
+    err := server.sys.registry.RegisterWorker(server.hostname)
+    if err != nil {
+        return err
+    }
+
+    // Re-register our inboxes, which Stop() removed
+    for msgKey := range server.loadRoutes().inboxesByMsgKey {
+        if !server.hasActiveInbox(msgKey) {
+            continue
+        }
+        err = server.sys.registry.RegisterListener(server.hostname, msgKey)
+        if err != nil {
+            server.sys.registry.SetWorkerStatus(server.hostname, STOPPED)
+            return err
+        }
+    }
+
+    server.sys.addLocalServer(server)
+
+    if !server.listening {
+        err = server.sys.transport.Listen(server)
+        if err != nil {
+            server.sys.registry.SetWorkerStatus(server.hostname, STOPPED)
+            return err
+        }
+        server.listening = true
+    }
+
+    server.status = RUNNING
+    server.stopHeartbeat = make(chan struct{})
+    go server.heartbeat(server.stopHeartbeat)
+
     return nil
 }
 
 func (server *PigeonServer) Status() (StatusEnum, error) {
-    return DOES_NOT_EXIST, fmt.Errorf("Not implemented")
+    info, err := server.sys.registry.GetWorker(server.hostname)
+    if err != nil {
+        return DOES_NOT_EXIST, err
+    }
+    return info.Status, nil
 }
 
 func (server *PigeonServer) Stop() error {
-    return fmt.Errorf("Not implemented")
+    server.mu.Lock()
+    if server.status != RUNNING {
+        server.mu.Unlock()
+        return nil
+    }
+    server.status = STOPPED
+    close(server.stopHeartbeat)
+    var drained chan struct{}
+    if server.inflight > 0 {
+        drained = make(chan struct{})
+        server.drained = drained
+    }
+    server.mu.Unlock()
+
+    // Stop routing requests here
+    err := server.sys.registry.SetWorkerStatus(server.hostname, STOPPED)
+    if err != nil {
+        log.Error("Pigeon: Failed to mark ", server.hostname, " STOPPED: ", err)
+    }
+    server.routesMu.Lock()
+    for msgKey := range server.loadRoutes().inboxesByMsgKey {
+        err = server.sys.registry.UnregisterListener(server.hostname, msgKey)
+        if err != nil {
+            log.Error("Pigeon: Failed to unregister ", msgKey, " on ", server.hostname, ": ", err)
+        }
+    }
+    server.routesMu.Unlock()
+
+    // Wait for requests that are being handled
+    if drained != nil {
+        select {
+        case <-drained:
+        case <-time.After(server.sys.cfg.DrainTimeout):
+            return fmt.Errorf("Pigeon: Timed out waiting for requests to finish on %s", server.hostname)
+        }
+    }
+
+    return nil
 }
 
+// Close every inbox for <jobKey> on this server.
 func (server *PigeonServer) StopHandling(jobKey string) error {
-    return fmt.Errorf("Not implemented")
+    var firstErr error
+    for _, inbox := range server.loadRoutes().inboxesByMsgKey[jobKey] {
+        err := inbox.Close()
+        if err != nil && firstErr == nil {
+            firstErr = err
+        }
+    }
+    return firstErr
+}
+
+func (server *PigeonServer) loadRoutes() *routeTable {
+    return server.routes.Load().(*routeTable)
+}
+
+// Publish a copy of the route table with <inbox> added.  Caller must hold
+// server.routesMu.
+func (server *PigeonServer) addRoute(inbox *PigeonInbox) {
+    server.updateRoutes(func(inboxesByMsgKey map[string][]*PigeonInbox) {
+        inboxesByMsgKey[inbox.msgKey] = append(append([]*PigeonInbox{}, inboxesByMsgKey[inbox.msgKey]...), inbox)
+    })
+}
+
+// Publish a copy of the route table without <inbox>.  Caller must hold
+// server.routesMu.
+func (server *PigeonServer) removeRoute(inbox *PigeonInbox) {
+    server.updateRoutes(func(inboxesByMsgKey map[string][]*PigeonInbox) {
+        remaining := []*PigeonInbox{}
+        for _, other := range inboxesByMsgKey[inbox.msgKey] {
+            if other != inbox {
+                remaining = append(remaining, other)
+            }
+        }
+        if len(remaining) == 0 {
+            delete(inboxesByMsgKey, inbox.msgKey)
+        } else {
+            inboxesByMsgKey[inbox.msgKey] = remaining
+        }
+    })
+}
+
+// Copy the route table's map, let <change> modify the copy (without
+// modifying the slices in it), and publish the result.
+func (server *PigeonServer) updateRoutes(change func(inboxesByMsgKey map[string][]*PigeonInbox)) {
+    inboxesByMsgKey := map[string][]*PigeonInbox{}
+    for msgKey, inboxes := range server.loadRoutes().inboxesByMsgKey {
+        inboxesByMsgKey[msgKey] = inboxes
+    }
+    change(inboxesByMsgKey)
+    server.routes.Store(newRouteTable(inboxesByMsgKey))
+}
+
+func newRouteTable(inboxesByMsgKey map[string][]*PigeonInbox) *routeTable {
+    table := &routeTable{
+        inboxesByMsgKey: inboxesByMsgKey,
+        patterns: newSubjectTrie(),
+    }
+    for msgKey := range inboxesByMsgKey {
+        table.patterns.insert(msgKey, msgKey)
+    }
+    return table
+}
+
+// Get the inboxes whose msg key or pattern matches <msgKey>.
+func (server *PigeonServer) inboxesFor(msgKey string) []*PigeonInbox {
+    table := server.loadRoutes()
+    inboxes := []*PigeonInbox{}
+    for pattern := range table.patterns.match(msgKey) {
+        inboxes = append(inboxes, table.inboxesByMsgKey[pattern]...)
+    }
+    return inboxes
+}
+
+// Order <inboxes> by the number of handler calls in progress, breaking ties
+// randomly.
+func inboxesByLoad(inboxes []*PigeonInbox) []*PigeonInbox {
+    sorted := make([]*PigeonInbox, len(inboxes))
+    loads := make(map[*PigeonInbox]int, len(inboxes))
+    for i, j := range rand.Perm(len(inboxes)) {
+        sorted[i] = inboxes[j]
+        loads[inboxes[j]] = inboxes[j].load()
+    }
+    sort.SliceStable(sorted, func(i, j int) bool {
+        return loads[sorted[i]] < loads[sorted[j]]
+    })
+    return sorted
+}
+
+func (server *PigeonServer) hasActiveInbox(msgKey string) bool {
+    for _, inbox := range server.loadRoutes().inboxesByMsgKey[msgKey] {
+        if inbox.isActive() {
+            return true
+        }
+    }
+    return false
+}
+
+// Remove a closed inbox, unregistering its msg key if no active inboxes are
+// left for it.
+func (server *PigeonServer) removeInbox(inbox *PigeonInbox) error {
+    server.routesMu.Lock()
+    defer server.routesMu.Unlock()
+    server.removeRoute(inbox)
+    return server.updateListenerLocked(inbox.msgKey)
+}
+
+// Register or unregister this server as a listener for <msgKey>, depending on
+// whether it has any active inboxes for it.  Stopped servers stay
+// unregistered until Start().
+func (server *PigeonServer) updateListener(msgKey string) error {
+    server.routesMu.Lock()
+    defer server.routesMu.Unlock()
+    return server.updateListenerLocked(msgKey)
+}
+
+// Same as updateListener.  Caller must hold server.routesMu.
+func (server *PigeonServer) updateListenerLocked(msgKey string) error {
+    server.mu.Lock()
+    running := server.status == RUNNING
+    server.mu.Unlock()
+
+    if running && server.hasActiveInbox(msgKey) {
+        return server.sys.registry.RegisterListener(server.hostname, msgKey)
+    }
+    return server.sys.registry.UnregisterListener(server.hostname, msgKey)
 }
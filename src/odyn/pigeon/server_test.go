@@ -0,0 +1,91 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "sync"
+    "testing"
+    "time"
+)
+
+// Run with -race: launches, inboxes coming and going, and inboxes being
+// suspended and resumed, all at once on one server.
+func TestConcurrentInboxChanges(t *testing.T) {
+    sys, server := newTestServer(t, "local")
+    handler := func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        resp.SetBody(map[string]interface{}{"ok": true})
+    }
+    stable := newTestInbox(t, server, "work", handler)
+
+    stop := make(chan struct{})
+    var wg sync.WaitGroup
+    loop := func(fn func()) {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for {
+                select {
+                case <-stop:
+                    return
+                default:
+                }
+                fn()
+            }
+        }()
+    }
+
+    for i := 0; i < 4; i++ {
+        outbox := sys.NewOutbox()
+        outbox.SetTimeoutms(1000)
+        loop(func() {
+            respChan, err := outbox.Launch("work", nil)
+            if err != nil {
+                // Expected while every inbox is suspended
+                return
+            }
+            select {
+            case <-respChan:
+            case <-time.After(5 * time.Second):
+                t.Error("No response")
+            }
+        })
+    }
+    loop(func() {
+        inbox, err := server.CreateInbox("work")
+        if err != nil {
+            t.Error(err)
+            return
+        }
+        inbox.SetHandlerFunc(handler)
+        inbox.Close()
+    })
+    loop(func() {
+        stable.Suspend()
+        stable.Resume()
+    })
+
+    time.Sleep(200 * time.Millisecond)
+    close(stop)
+    wg.Wait()
+
+    respChan, err := sys.NewOutbox().Launch("work", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp := waitResponse(t, respChan)
+    if resp.Err() != nil || resp.Body()["ok"] != true {
+        t.Errorf("Launch after the churn failed: %v", resp.Err())
+    }
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "context"
+    "fmt"
+    "sync"
+)
+
+// Number of responses and input chunks buffered in each direction
+const STREAM_BUFFER = 16
+
+type pigeonStream struct {
+    ctx context.Context
+    msgKey string
+    responses chan Response
+    input chan map[string]interface{}
+
+    // Closed once the final response arrives
+    finished chan struct{}
+
+    // Protects <done>, and sending on <responses>
+    mu sync.Mutex
+    done bool
+
+    // Protects <inputClosed>.  Held for reading while sending on <input>.
+    inputMu sync.RWMutex
+    inputClosed bool
+}
+
+func (outbox *PigeonOutbox) Stream(ctx context.Context, key string, payload map[string]interface{}) (Stream, error) {
+    stream := &pigeonStream{
+        ctx: ctx,
+        msgKey: key,
+        responses: make(chan Response, STREAM_BUFFER),
+        input: make(chan map[string]interface{}, STREAM_BUFFER),
+        finished: make(chan struct{}),
+    }
+
+    respChan, err := outbox.launch(ctx, &PigeonRequest{
+        ReqJobKey: key,
+        ReqBody: payload,
+        ReqStream: true,
+        partials: stream.deliverPartial,
+        input: stream.input,
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    go func() {
+        resp := <-respChan
+        stream.mu.Lock()
+        defer stream.mu.Unlock()
+        stream.done = true
+        close(stream.finished)
+        stream.responses <- resp
+        close(stream.responses)
+    }()
+
+    return stream, nil
+}
+
+// Pass a partial response from the handler to the caller.
+func (stream *pigeonStream) deliverPartial(body map[string]interface{}) error {
+    stream.mu.Lock()
+    defer stream.mu.Unlock()
+    if stream.done {
+        return fmt.Errorf("Pigeon: Stream %s is finished", stream.msgKey)
+    }
+
+    select {
+    case stream.responses <- &PigeonResponse{RespBody: body, partial: true}:
+        return nil
+    case <-stream.ctx.Done():
+        return stream.ctx.Err()
+    }
+}
+
+func (stream *pigeonStream) Responses() <-chan Response {
+    return stream.responses
+}
+
+func (stream *pigeonStream) Send(chunk map[string]interface{}) error {
+    stream.inputMu.RLock()
+    defer stream.inputMu.RUnlock()
+    if stream.inputClosed {
+        return fmt.Errorf("Pigeon: Input to stream %s is closed", stream.msgKey)
+    }
+
+    // Checked first, since the select below picks at random when there is
+    // also room in the buffer
+    select {
+    case <-stream.finished:
+        return fmt.Errorf("Pigeon: Stream %s is finished", stream.msgKey)
+    default:
+    }
+
+    select {
+    case stream.input <- chunk:
+        return nil
+    case <-stream.finished:
+        return fmt.Errorf("Pigeon: Stream %s is finished", stream.msgKey)
+    case <-stream.ctx.Done():
+        return stream.ctx.Err()
+    }
+}
+
+func (stream *pigeonStream) CloseSend() error {
+    stream.inputMu.Lock()
+    defer stream.inputMu.Unlock()
+    if stream.inputClosed {
+        return nil
+    }
+    stream.inputClosed = true
+    close(stream.input)
+    return nil
+}
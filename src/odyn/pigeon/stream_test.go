@@ -0,0 +1,150 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+// Answers each input chunk with a partial response carrying its "n", then
+// with a final response counting the chunks.
+func streamEcho(msgKey string, userCtx interface{}, req Request, resp Response) {
+    count := 0
+    for {
+        chunk, err := req.Recv()
+        if err != nil {
+            break
+        }
+        count++
+        err = resp.Send(map[string]interface{}{"echo": chunk["n"]})
+        if err != nil {
+            resp.SetError(err)
+            return
+        }
+    }
+    resp.SetBody(map[string]interface{}{"count": count, "start": req.Body()["start"]})
+}
+
+// Stream three chunks to "echo" through <outbox>, checking the partial and
+// final responses.
+func checkStream(t *testing.T, outbox Outbox) {
+    ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+    defer cancel()
+    stream, err := outbox.Stream(ctx, "echo", map[string]interface{}{"start": "go"})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for _, n := range []string{"a", "b", "c"} {
+        err = stream.Send(map[string]interface{}{"n": n})
+        if err != nil {
+            t.Fatal(err)
+        }
+        select {
+        case resp := <-stream.Responses():
+            if resp.Final() || resp.Body()["echo"] != n {
+                t.Fatalf("Expected partial %q, got %v (final %v)", n, resp.Body(), resp.Final())
+            }
+        case <-ctx.Done():
+            t.Fatalf("No partial response for %q", n)
+        }
+    }
+
+    err = stream.CloseSend()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if stream.CloseSend() != nil {
+        t.Error("Second CloseSend failed")
+    }
+    if stream.Send(map[string]interface{}{"n": "late"}) == nil {
+        t.Error("Send after CloseSend succeeded")
+    }
+
+    var final Response
+    select {
+    case final = <-stream.Responses():
+    case <-ctx.Done():
+        t.Fatal("No final response")
+    }
+    if final.Err() != nil {
+        t.Fatal(final.Err())
+    }
+    // Numbers are ints with gob, and float64s with JSON
+    count, _ := final.Body()["count"].(int)
+    if !final.Final() || count != 3 || final.Body()["start"] != "go" {
+        t.Errorf("Final response %v (final %v)", final.Body(), final.Final())
+    }
+    if _, ok := <-stream.Responses(); ok {
+        t.Error("Responses were not closed after the final response")
+    }
+}
+
+func TestLocalStream(t *testing.T) {
+    sys, server := newTestServer(t, "local")
+    newTestInbox(t, server, "echo", streamEcho)
+    checkStream(t, sys.NewOutbox())
+}
+
+func TestRemoteStream(t *testing.T) {
+    registry := NewMemRegistry()
+    cfg := DefaultTCPTransportConfig
+    cfg.ListenHost = "127.0.0.1"
+    transport, err := NewTCPTransportWithConfig(cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    serverSys := NewPigeonSystem(SystemConfig{Registry: registry, Transport: transport, DrainTimeout: time.Second})
+    defer serverSys.Close()
+    server, err := serverSys.StartServer(freeHostname(t))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer server.Stop()
+    newTestInbox(t, server, "echo", streamEcho)
+
+    transport, err = NewTCPTransport()
+    if err != nil {
+        t.Fatal(err)
+    }
+    sys := NewPigeonSystem(SystemConfig{Registry: registry, Transport: transport})
+    defer sys.Close()
+    checkStream(t, sys.NewOutbox())
+}
+
+// Send fails once the handler has returned.
+func TestStreamSendAfterFinish(t *testing.T) {
+    sys, server := newTestServer(t, "local")
+    newTestInbox(t, server, "echo", func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        resp.SetBody(map[string]interface{}{"done": true})
+    })
+    stream, err := sys.NewOutbox().Stream(context.Background(), "echo", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case resp := <-stream.Responses():
+        if !resp.Final() || resp.Body()["done"] != true {
+            t.Errorf("Final response %v", resp.Body())
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("No final response")
+    }
+    if stream.Send(map[string]interface{}{"n": "late"}) == nil {
+        t.Error("Send to a finished stream succeeded")
+    }
+}
@@ -0,0 +1,349 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "context"
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "net"
+    "odyn/log"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Port used when a server's hostname does not include one.
+const DEFAULT_PIGEON_PORT = "1888"
+
+var errTransportClosed = errors.New("Pigeon: Transport is closed")
+
+// Transport for systems where every server runs in this process.  The
+// PigeonSystem delivers local requests itself, so this never has anything to
+// do.
+type localTransport struct {
+}
+
+// Transport using Pigeon's framed TCP protocol (see wire.go).
+type tcpTransport struct {
+    cfg TCPTransportConfig
+    codec Codec
+
+    // nil if dialing for every call
+    pool *connPool
+
+    // Listeners, and connections accepted from them, closed by Close()
+    mu sync.Mutex
+    listeners []net.Listener
+    conns map[net.Conn]bool
+    closed bool
+}
+
+// TCPTransportConfig tunes the TCP Transport.
+type TCPTransportConfig struct {
+    // Interface to listen on, such as "10.0.0.5".  Defaults to all
+    // interfaces.  The port is taken from the server's hostname, which may
+    // be of the form "host:port" (default port 1888).  This lets several
+    // servers run in one process.
+    ListenHost string
+
+    // ID of the codec used for outgoing requests.  Defaults to CODEC_GOB.
+    // Servers answer each request with the codec it was sent with.
+    CodecID byte
+
+    // Number of connections kept open to each server.  Use 0 to dial a new
+    // connection for every call.
+    ConnsPerHost int
+
+    // Close connections that have not been used for this long.
+    IdleTimeout time.Duration
+
+    // Ping connections that have been idle this long, and close those that
+    // don't answer within HealthCheckTimeout.  A connection that is due a
+    // check when a call wants it is checked first.
+    HealthCheckInterval time.Duration
+    HealthCheckTimeout time.Duration
+
+    // After a failed dial, wait MinBackoff before dialing the server again.
+    // The wait doubles with each consecutive failure, up to MaxBackoff.
+    MinBackoff time.Duration
+    MaxBackoff time.Duration
+
+    // Mutual TLS configuration, used both to listen and to dial.  See
+    // NewClusterTLSConfig.  nil means plain TCP.
+    TLS *tls.Config
+
+    // Key shared by every member of the cluster.  If set, all frames are
+    // signed with it, and unsigned or mis-signed frames are rejected.
+    ClusterKey []byte
+}
+
+var DefaultTCPTransportConfig = TCPTransportConfig{
+    CodecID: CODEC_GOB,
+    ConnsPerHost: 2,
+    IdleTimeout: 60 * time.Second,
+    HealthCheckInterval: 15 * time.Second,
+    HealthCheckTimeout: 5 * time.Second,
+    MinBackoff: 100 * time.Millisecond,
+    MaxBackoff: 10 * time.Second,
+}
+
+// Create a Transport that cannot reach other processes.
+func NewLocalTransport() Transport {
+    return &localTransport{}
+}
+
+// Create a Transport that uses Pigeon's TCP protocol, with
+// DefaultTCPTransportConfig.
+func NewTCPTransport() (Transport, error) {
+    return NewTCPTransportWithConfig(DefaultTCPTransportConfig)
+}
+
+// Create a Transport that uses Pigeon's TCP protocol.  Zero values in <cfg>
+// are taken from DefaultTCPTransportConfig, except ConnsPerHost.
+func NewTCPTransportWithConfig(cfg TCPTransportConfig) (Transport, error) {
+    if cfg.CodecID == 0 {
+        cfg.CodecID = DefaultTCPTransportConfig.CodecID
+    }
+    if cfg.IdleTimeout <= 0 {
+        cfg.IdleTimeout = DefaultTCPTransportConfig.IdleTimeout
+    }
+    if cfg.HealthCheckInterval <= 0 {
+        cfg.HealthCheckInterval = DefaultTCPTransportConfig.HealthCheckInterval
+    }
+    if cfg.HealthCheckTimeout <= 0 {
+        cfg.HealthCheckTimeout = DefaultTCPTransportConfig.HealthCheckTimeout
+    }
+    if cfg.MinBackoff <= 0 {
+        cfg.MinBackoff = DefaultTCPTransportConfig.MinBackoff
+    }
+    if cfg.MaxBackoff < cfg.MinBackoff {
+        cfg.MaxBackoff = cfg.MinBackoff
+    }
+
+    codec := lookupCodec(cfg.CodecID)
+    if codec == nil {
+        return nil, fmt.Errorf("Pigeon: Codec %d is not registered", cfg.CodecID)
+    }
+
+    transport := &tcpTransport{
+        cfg: cfg,
+        codec: codec,
+        conns: map[net.Conn]bool{},
+    }
+    if cfg.ConnsPerHost > 0 {
+        transport.pool = newConnPool(cfg, transport.dial)
+    }
+    return transport, nil
+}
+
+func (transport *localTransport) Listen(server *PigeonServer) error {
+    return nil
+}
+
+func (transport *localTransport) Call(ctx context.Context, hostname string, req *PigeonRequest, resp *PigeonResponse) error {
+    return fmt.Errorf("Pigeon: Server %s is not running in this process", hostname)
+}
+
+func (transport *localTransport) Close() error {
+    return nil
+}
+
+// Get the "host:port" address for a server <hostname>.
+func pigeonAddress(hostname string) string {
+    _, _, err := net.SplitHostPort(hostname)
+    if err == nil {
+        return hostname
+    }
+    return net.JoinHostPort(strings.Trim(hostname, "[]"), DEFAULT_PIGEON_PORT)
+}
+
+func (transport *tcpTransport) Listen(server *PigeonServer) error {
+    _, port, err := net.SplitHostPort(pigeonAddress(server.hostname))
+    if err != nil {
+        return err
+    }
+
+    l, err := net.Listen("tcp", net.JoinHostPort(transport.cfg.ListenHost, port))
+    if err != nil {
+        return err
+    }
+    if transport.cfg.TLS != nil {
+        l = tls.NewListener(l, transport.cfg.TLS)
+    }
+
+    transport.mu.Lock()
+    if transport.closed {
+        transport.mu.Unlock()
+        l.Close()
+        return errTransportClosed
+    }
+    transport.listeners = append(transport.listeners, l)
+    transport.mu.Unlock()
+
+    go func() {
+        for {
+            conn, err := l.Accept()
+            if err != nil {
+                if !transport.isClosed() {
+                    log.Error("Pigeon: Stopped accepting connections for ", server.hostname, ": ", err)
+                }
+                return
+            }
+            if !transport.track(conn) {
+                conn.Close()
+                return
+            }
+            go transport.serveConn(conn, server)
+        }
+    }()
+    return nil
+}
+
+func (transport *tcpTransport) isClosed() bool {
+    transport.mu.Lock()
+    defer transport.mu.Unlock()
+    return transport.closed
+}
+
+// Remember accepted connection <conn> so Close() can close it.  Returns
+// false if the transport is already closed.
+func (transport *tcpTransport) track(conn net.Conn) bool {
+    transport.mu.Lock()
+    defer transport.mu.Unlock()
+    if transport.closed {
+        return false
+    }
+    transport.conns[conn] = true
+    return true
+}
+
+func (transport *tcpTransport) untrack(conn net.Conn) {
+    transport.mu.Lock()
+    defer transport.mu.Unlock()
+    delete(transport.conns, conn)
+}
+
+// Closing the accepted connections cancels the remote requests being
+// handled on them.
+func (transport *tcpTransport) Close() error {
+    transport.mu.Lock()
+    if transport.closed {
+        transport.mu.Unlock()
+        return nil
+    }
+    transport.closed = true
+    listeners := transport.listeners
+    conns := transport.conns
+    transport.listeners = nil
+    transport.conns = map[net.Conn]bool{}
+    transport.mu.Unlock()
+
+    var firstErr error
+    for _, l := range listeners {
+        err := l.Close()
+        if err != nil && firstErr == nil {
+            firstErr = err
+        }
+    }
+    for conn := range conns {
+        conn.Close()
+    }
+    if transport.pool != nil {
+        transport.pool.close()
+    }
+    return firstErr
+}
+
+func (transport *tcpTransport) serveConn(conn net.Conn, server *PigeonServer) {
+    defer transport.untrack(conn)
+
+    tlsConn, ok := conn.(*tls.Conn)
+    if ok {
+        // Handshake now so that peers without a valid certificate are
+        // logged and turned away before we read anything.
+        tlsConn.SetDeadline(time.Now().Add(wireHandshakeTimeout))
+        err := tlsConn.Handshake()
+        if err != nil {
+            log.Warn("Pigeon: Rejecting connection from ", conn.RemoteAddr(), ": ", err)
+            conn.Close()
+            return
+        }
+        tlsConn.SetDeadline(time.Time{})
+    }
+
+    serveWireConn(conn, server, transport.cfg.ClusterKey)
+}
+
+func (transport *tcpTransport) dial(ctx context.Context, address string) (*wireConn, error) {
+    log.Info("Pigeon Dialing ", address)
+    return dialWire(ctx, address, transport.codec, transport.cfg.TLS, transport.cfg.ClusterKey)
+}
+
+func (transport *tcpTransport) Call(ctx context.Context, hostname string, req *PigeonRequest, resp *PigeonResponse) error {
+    // Let the handler see our deadline
+    deadline, hasDeadline := ctx.Deadline()
+    if hasDeadline {
+        reqCopy := *req
+        reqCopy.ReqDeadline = deadline
+        req = &reqCopy
+    }
+
+    // The reply is decoded into a separate object so that nothing touches
+    // <resp> after we give up.
+    reply := &PigeonResponse{}
+    address := pigeonAddress(hostname)
+    if transport.isClosed() {
+        return errTransportClosed
+    }
+    if transport.pool == nil {
+        wc, err := transport.dial(ctx, address)
+        if err != nil {
+            return fmt.Errorf("Pigeon: (dialing) %s", err.Error())
+        }
+        defer wc.close()
+
+        err = wc.call(ctx, req, reply)
+        if err != nil {
+            return fmt.Errorf("Pigeon: (calling) %s", err.Error())
+        }
+        *resp = *reply
+        return nil
+    }
+
+    for attempt := 0; ; attempt++ {
+        wc, err := transport.pool.get(ctx, address)
+        if err != nil {
+            return fmt.Errorf("Pigeon: (dialing) %s", err.Error())
+        }
+
+        err = wc.call(ctx, req, reply)
+        transport.pool.put(address, wc)
+        if err == nil {
+            *resp = *reply
+            return nil
+        }
+
+        // The connection failed before the request reached the server, so
+        // try once more on a new connection.  Requests that were sent are
+        // never retried, since the handler may already be running.
+        _, notSent := err.(*notSentError)
+        if notSent && attempt == 0 && ctx.Err() == nil {
+            continue
+        }
+        return fmt.Errorf("Pigeon: (calling) %s", err.Error())
+    }
+}
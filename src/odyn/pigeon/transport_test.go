@@ -0,0 +1,341 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "bufio"
+    "context"
+    "net"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// Get a "127.0.0.1:<port>" hostname that nothing is listening on.
+func freeHostname(tb testing.TB) string {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        tb.Fatal(err)
+    }
+    defer l.Close()
+    return l.Addr().String()
+}
+
+// Start a server listening on loopback with a TCP Transport configured by
+// <cfg>.  Returns its hostname.
+func newTCPServer(tb testing.TB, cfg TCPTransportConfig) (string, Server) {
+    cfg.ListenHost = "127.0.0.1"
+    transport, err := NewTCPTransportWithConfig(cfg)
+    if err != nil {
+        tb.Fatal(err)
+    }
+    sys := NewPigeonSystem(SystemConfig{Transport: transport, DrainTimeout: time.Second})
+    hostname := freeHostname(tb)
+    server, err := sys.StartServer(hostname)
+    if err != nil {
+        tb.Fatal(err)
+    }
+    tb.Cleanup(func() {
+        server.Stop()
+        sys.Close()
+    })
+    return hostname, server
+}
+
+// Start a server as newTCPServer does, with an inbox for "echo" that answers
+// with the request's body.
+func startTCPServer(tb testing.TB, cfg TCPTransportConfig) string {
+    hostname, server := newTCPServer(tb, cfg)
+    inbox, err := server.CreateInbox("echo")
+    if err != nil {
+        tb.Fatal(err)
+    }
+    inbox.SetHandlerFunc(func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        resp.SetBody(req.Body())
+    })
+    return hostname
+}
+
+// Pool whose dials are counted.
+type countingPool struct {
+    *connPool
+    mu sync.Mutex
+    dials int
+}
+
+func newCountingPool(cfg TCPTransportConfig) *countingPool {
+    pool := &countingPool{}
+    pool.connPool = newConnPool(cfg, func(ctx context.Context, address string) (*wireConn, error) {
+        pool.mu.Lock()
+        pool.dials++
+        pool.mu.Unlock()
+        return dialWire(ctx, address, lookupCodec(CODEC_GOB), nil, nil)
+    })
+    return pool
+}
+
+func (pool *countingPool) dialCount() int {
+    pool.mu.Lock()
+    defer pool.mu.Unlock()
+    return pool.dials
+}
+
+func poolTestConfig() TCPTransportConfig {
+    cfg := DefaultTCPTransportConfig
+    cfg.ConnsPerHost = 1
+    cfg.HealthCheckInterval = 20 * time.Millisecond
+    cfg.HealthCheckTimeout = 50 * time.Millisecond
+    return cfg
+}
+
+func TestPoolReplacesSilentConnection(t *testing.T) {
+    // Accepts connections, then never answers
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    go func() {
+        for {
+            conn, err := l.Accept()
+            if err != nil {
+                return
+            }
+            defer conn.Close()
+        }
+    }()
+
+    address := l.Addr().String()
+    pool := newCountingPool(poolTestConfig())
+    first, err := pool.get(context.Background(), address)
+    if err != nil {
+        t.Fatal(err)
+    }
+    pool.put(address, first)
+
+    time.Sleep(40 * time.Millisecond)
+    second, err := pool.get(context.Background(), address)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer pool.put(address, second)
+
+    if second == first {
+        t.Error("Pool reused a connection that failed its health check")
+    }
+    if !first.isClosed() {
+        t.Error("Connection that failed its health check is still open")
+    }
+    if pool.dialCount() != 2 {
+        t.Errorf("Dialed %d times, expected 2", pool.dialCount())
+    }
+}
+
+func TestPoolKeepsHealthyConnection(t *testing.T) {
+    hostname := startTCPServer(t, DefaultTCPTransportConfig)
+    pool := newCountingPool(poolTestConfig())
+
+    first, err := pool.get(context.Background(), hostname)
+    if err != nil {
+        t.Fatal(err)
+    }
+    pool.put(hostname, first)
+
+    // Long enough for the janitor to ping it a few times
+    time.Sleep(100 * time.Millisecond)
+    second, err := pool.get(context.Background(), hostname)
+    if err != nil {
+        t.Fatal(err)
+    }
+    pool.put(hostname, second)
+
+    if second != first || pool.dialCount() != 1 {
+        t.Errorf("Healthy connection was replaced (%d dials)", pool.dialCount())
+    }
+}
+
+func TestPing(t *testing.T) {
+    hostname := startTCPServer(t, DefaultTCPTransportConfig)
+    wc, err := dialWire(context.Background(), hostname, lookupCodec(CODEC_GOB), nil, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer wc.close()
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+    err = wc.ping(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestTransportClose(t *testing.T) {
+    cfg := DefaultTCPTransportConfig
+    cfg.ListenHost = "127.0.0.1"
+    cfg.ConnsPerHost = 1
+    transport, err := NewTCPTransportWithConfig(cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    sys := NewPigeonSystem(SystemConfig{Transport: transport, DrainTimeout: time.Second})
+    hostname := freeHostname(t)
+    server, err := sys.StartServer(hostname)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer server.Stop()
+    started := make(chan struct{})
+    cancelled := make(chan struct{})
+    newTestInbox(t, server, "wait", func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        close(started)
+        select {
+        case <-req.Context().Done():
+            close(cancelled)
+        case <-time.After(5 * time.Second):
+        }
+    })
+
+    client, err := NewTCPTransportWithConfig(cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    callErr := make(chan error, 1)
+    go func() {
+        callErr <- client.Call(context.Background(), hostname, &PigeonRequest{ReqJobKey: "wait"}, &PigeonResponse{})
+    }()
+    <-started
+
+    // Closing the server's transport cancels the handler and fails the call
+    err = sys.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case <-cancelled:
+    case <-time.After(2 * time.Second):
+        t.Error("Handler was not cancelled")
+    }
+    select {
+    case err = <-callErr:
+        if err == nil {
+            t.Error("Call succeeded")
+        }
+    case <-time.After(2 * time.Second):
+        t.Error("Call did not fail")
+    }
+
+    conn, err := net.Dial("tcp", hostname)
+    if err == nil {
+        conn.Close()
+        t.Error("Still listening after Close")
+    }
+
+    // A closed client refuses calls
+    client.Close()
+    err = client.Call(context.Background(), hostname, &PigeonRequest{ReqJobKey: "wait"}, &PigeonResponse{})
+    if err != errTransportClosed {
+        t.Errorf("Call on a closed transport returned %v", err)
+    }
+}
+
+func benchmarkCall(b *testing.B, connsPerHost int) {
+    hostname := startTCPServer(b, DefaultTCPTransportConfig)
+    cfg := DefaultTCPTransportConfig
+    cfg.ConnsPerHost = connsPerHost
+    transport, err := NewTCPTransportWithConfig(cfg)
+    if err != nil {
+        b.Fatal(err)
+    }
+
+    req := &PigeonRequest{
+        ReqJobKey: "echo",
+        ReqBody: map[string]interface{}{"n": 1},
+    }
+    b.ResetTimer()
+    b.RunParallel(func(pb *testing.PB) {
+        for pb.Next() {
+            resp := &PigeonResponse{}
+            err := transport.Call(context.Background(), hostname, req, resp)
+            if err == nil {
+                err = resp.Err()
+            }
+            if err != nil {
+                b.Error(err)
+                return
+            }
+        }
+    })
+}
+
+func BenchmarkCallPooled(b *testing.B) {
+    benchmarkCall(b, DefaultTCPTransportConfig.ConnsPerHost)
+}
+
+func BenchmarkCallDialPerCall(b *testing.B) {
+    benchmarkCall(b, 0)
+}
+
+// A request that reached the server is not sent again when the connection
+// closes before the response, since the handler may have run.
+func TestCallDoesNotRetrySentRequest(t *testing.T) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    var requests int32
+    go func() {
+        for {
+            conn, err := l.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                r := bufio.NewReader(conn)
+                for {
+                    f, err := readFrame(r)
+                    if err != nil {
+                        return
+                    }
+                    if f.frameType == FRAME_REQUEST {
+                        atomic.AddInt32(&requests, 1)
+                        return
+                    }
+                }
+            }()
+        }
+    }()
+
+    cfg := DefaultTCPTransportConfig
+    cfg.ConnsPerHost = 1
+    client, err := NewTCPTransportWithConfig(cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+    ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+    defer cancel()
+    err = client.Call(ctx, l.Addr().String(), &PigeonRequest{ReqJobKey: "once"}, &PigeonResponse{})
+    if err == nil {
+        t.Fatal("Call succeeded")
+    }
+    time.Sleep(50 * time.Millisecond)
+    if n := atomic.LoadInt32(&requests); n != 1 {
+        t.Errorf("Server got the request %d times", n)
+    }
+}
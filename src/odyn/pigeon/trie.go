@@ -0,0 +1,165 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "fmt"
+    "strings"
+)
+
+// Msg keys are made of tokens separated by ".", such as
+// "device.Leela.telemetry".  Inboxes may subscribe to patterns, in which
+// "*" matches exactly one token and ">" (only allowed as the last token)
+// matches one or more tokens.  So "device.*.telemetry" matches
+// "device.Leela.telemetry", and "device.Leela.>" matches
+// "device.Leela.telemetry" and "device.Leela.status.online", but not
+// "device.Leela".
+const (
+    MSG_KEY_SEPARATOR = "."
+    MSG_KEY_WILDCARD = "*"
+    MSG_KEY_FULL_WILDCARD = ">"
+)
+
+// Set of strings (such as hostnames) indexed by msg key pattern.  Lookups by
+// msg key take time proportional to the number of tokens in the key, not the
+// number of patterns.
+type subjectTrie struct {
+    root *trieNode
+}
+
+type trieNode struct {
+    // Keyed by token, including "*" and ">"
+    children map[string]*trieNode
+
+    // Values for the pattern ending at this node
+    values map[string]bool
+}
+
+func newSubjectTrie() *subjectTrie {
+    return &subjectTrie{
+        root: newTrieNode(),
+    }
+}
+
+func newTrieNode() *trieNode {
+    return &trieNode{
+        children: map[string]*trieNode{},
+        values: map[string]bool{},
+    }
+}
+
+// Check that <pattern> is a valid msg key pattern.
+func validatePattern(pattern string) error {
+    tokens := strings.Split(pattern, MSG_KEY_SEPARATOR)
+    for i, token := range tokens {
+        if token == "" {
+            return fmt.Errorf("Pigeon: Msg key %q has an empty token", pattern)
+        }
+        if token == MSG_KEY_FULL_WILDCARD && i != len(tokens) - 1 {
+            return fmt.Errorf("Pigeon: Msg key %q has %q before the last token", pattern, MSG_KEY_FULL_WILDCARD)
+        }
+        if token != MSG_KEY_WILDCARD && token != MSG_KEY_FULL_WILDCARD && strings.ContainsAny(token, MSG_KEY_WILDCARD + MSG_KEY_FULL_WILDCARD) {
+            return fmt.Errorf("Pigeon: Msg key %q has a wildcard inside a token", pattern)
+        }
+    }
+    return nil
+}
+
+// Check that <msgKey> is valid and has no wildcards, so it can be sent.
+func validateMsgKey(msgKey string) error {
+    err := validatePattern(msgKey)
+    if err != nil {
+        return err
+    }
+    if isPattern(msgKey) {
+        return fmt.Errorf("Pigeon: Cannot send to wildcard msg key %q", msgKey)
+    }
+    return nil
+}
+
+// Does <pattern> contain wildcards?
+func isPattern(pattern string) bool {
+    for _, token := range strings.Split(pattern, MSG_KEY_SEPARATOR) {
+        if token == MSG_KEY_WILDCARD || token == MSG_KEY_FULL_WILDCARD {
+            return true
+        }
+    }
+    return false
+}
+
+func (trie *subjectTrie) insert(pattern, value string) {
+    node := trie.root
+    for _, token := range strings.Split(pattern, MSG_KEY_SEPARATOR) {
+        child, ok := node.children[token]
+        if !ok {
+            child = newTrieNode()
+            node.children[token] = child
+        }
+        node = child
+    }
+    node.values[value] = true
+}
+
+// Remove <value> from <pattern>, pruning nodes that are no longer needed.
+func (trie *subjectTrie) remove(pattern, value string) {
+    tokens := strings.Split(pattern, MSG_KEY_SEPARATOR)
+    path := []*trieNode{trie.root}
+    node := trie.root
+    for _, token := range tokens {
+        child, ok := node.children[token]
+        if !ok {
+            return
+        }
+        node = child
+        path = append(path, node)
+    }
+    delete(node.values, value)
+
+    for i := len(tokens) - 1; i >= 0; i-- {
+        node := path[i + 1]
+        if len(node.values) > 0 || len(node.children) > 0 {
+            return
+        }
+        delete(path[i].children, tokens[i])
+    }
+}
+
+// Get the values of every pattern matching <msgKey>.
+func (trie *subjectTrie) match(msgKey string) map[string]bool {
+    out := map[string]bool{}
+    trie.root.match(strings.Split(msgKey, MSG_KEY_SEPARATOR), out)
+    return out
+}
+
+func (node *trieNode) match(tokens []string, out map[string]bool) {
+    if len(tokens) == 0 {
+        for value := range node.values {
+            out[value] = true
+        }
+        return
+    }
+
+    if child, ok := node.children[tokens[0]]; ok {
+        child.match(tokens[1:], out)
+    }
+    if child, ok := node.children[MSG_KEY_WILDCARD]; ok {
+        child.match(tokens[1:], out)
+    }
+    if child, ok := node.children[MSG_KEY_FULL_WILDCARD]; ok {
+        for value := range child.values {
+            out[value] = true
+        }
+    }
+}
@@ -0,0 +1,930 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+// Pigeon wire protocol.
+//
+// Every message on a Pigeon TCP connection is a frame:
+//
+//      offset  size  field
+//      0       2     magic "PG"
+//      2       1     protocol version (1)
+//      3       1     frame type (FRAME_REQUEST, FRAME_RESPONSE, ...)
+//      4       1     flags (FLAG_BROADCAST, FLAG_SIGNED, FLAG_STREAM)
+//      5       1     codec ID
+//      6       8     correlation ID
+//      14      2     msg key length (K)
+//      16      4     payload length (P)
+//      20      K     msg key
+//      20+K    P     payload
+//      20+K+P  32    HMAC-SHA256 of all the above (only if FLAG_SIGNED; see
+//                    wireSession for what else it covers)
+//
+// All integers are big-endian.  The payload is a PigeonRequest or
+// PigeonResponse encoded with the codec named in the header.  A response
+// carries the correlation ID of its request, so many calls can be in flight
+// on one connection at once.
+//
+// A request with FLAG_STREAM opens a stream.  The server may answer with any
+// number of FRAME_PARTIAL frames (each a PigeonResponse) before the final
+// FRAME_RESPONSE, and the client may send FRAME_INPUT frames (each an encoded
+// map[string]interface{}) followed by FRAME_INPUT_END.  All of these carry
+// the request's correlation ID.
+//
+// Streams have flow control, so that a slow reader on one stream does not
+// hold up the rest of the connection.  Each side may send wireStreamWindow
+// FRAME_PARTIAL (or FRAME_INPUT) frames for a stream, and no more until the
+// other side returns credit with FRAME_CREDIT, whose payload is the number of
+// further frames allowed (4 bytes).  Each side returns credit as the frames
+// are read.  A side that sends past its credit fails the stream, without
+// affecting the connection's other calls.
+//
+// When the cluster is keyed, the client starts every connection by sending
+// FRAME_HELLO with a random nonce in the payload, and the server answers with
+// FRAME_HELLO carrying its own nonce.  Both are needed to check signatures on
+// the connection's frames.
+//
+// A client that stops waiting for a response sends FRAME_CANCEL with the
+// request's correlation ID, and the server cancels the handler's
+// Request.Context().  Handlers are also cancelled if the connection closes.
+//
+// The client may send FRAME_PING at any time; the server answers with
+// FRAME_PONG carrying the same correlation ID.  Connection pools use this to
+// check idle connections.
+
+import (
+    "bufio"
+    "context"
+    "crypto/tls"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "odyn/log"
+    "sync"
+    "time"
+)
+
+const (
+    WIRE_VERSION byte = 1
+
+    FRAME_REQUEST byte = 1
+    FRAME_RESPONSE byte = 2
+    FRAME_PARTIAL byte = 3
+    FRAME_INPUT byte = 4
+    FRAME_INPUT_END byte = 5
+    FRAME_PING byte = 6
+    FRAME_PONG byte = 7
+    FRAME_HELLO byte = 8
+    FRAME_CREDIT byte = 9
+    FRAME_CANCEL byte = 10
+
+    FLAG_BROADCAST byte = 1 << 0
+    FLAG_SIGNED byte = 1 << 2
+    FLAG_STREAM byte = 1 << 3
+
+    wireHeaderLen = 20
+    wireMaxPayload = 64 * 1024 * 1024
+
+    // Frames each side may send on a stream before it gets credit
+    wireStreamWindow = 16
+)
+
+var wireMagic = [2]byte{'P', 'G'}
+
+var errConnClosed = errors.New("connection closed")
+
+var errStreamOverrun = errors.New("Pigeon: Stream sent more than its window")
+
+// Returned by wireConn.call() when the request never reached the server, so
+// it can be sent again on another connection without running the handler
+// twice.
+type notSentError struct {
+    err error
+}
+
+func (err *notSentError) Error() string {
+    return err.err.Error()
+}
+
+type frame struct {
+    frameType byte
+    flags byte
+    codecID byte
+    correlationID uint64
+    msgKey string
+    payload []byte
+
+    // For signed frames: the encoded frame, and its signature
+    signed []byte
+    mac []byte
+}
+
+// Client side of a Pigeon TCP connection.  Safe for concurrent calls.
+type wireConn struct {
+    conn net.Conn
+    reader *bufio.Reader
+    codec Codec
+
+    // Signs and checks frames, or nil if the cluster has no key
+    session *wireSession
+
+    // Held while writing a frame
+    writeMu sync.Mutex
+
+    mu sync.Mutex
+    pending map[uint64]*pendingCall
+    nextID uint64
+    closed bool
+
+    // Closed along with the connection
+    closedChan chan struct{}
+}
+
+// A call waiting for its response.
+type pendingCall struct {
+    frames chan *frame
+
+    // Closed when the caller stops waiting
+    done chan struct{}
+
+    // For streams, credit for sending input
+    credits wireCredits
+
+    // Closed by the reader if the server sends more frames than there is
+    // room for.  <overrun> is only used by the reader.
+    failed chan struct{}
+    overrun bool
+}
+
+// Server side of a stream (see FLAG_STREAM).
+type wireStream struct {
+    // Input received from the client and not yet taken by the handler.
+    // Closed at FRAME_INPUT_END.  Only the connection's reader sends on it.
+    queued chan map[string]interface{}
+    inputClosed bool
+
+    // Input for the handler, fed from <queued>
+    input chan map[string]interface{}
+
+    // Credit for sending partial responses
+    credits wireCredits
+
+    // Closed if the client sends input beyond its window
+    overrun chan struct{}
+
+    // Closed when the handler returns
+    done chan struct{}
+}
+
+// Permission to send frames on a stream, one per frame.
+type wireCredits chan struct{}
+
+// Credit for a new stream: a full window.
+func newWireCredits() wireCredits {
+    credits := make(wireCredits, wireStreamWindow)
+    credits.grant(wireStreamWindow)
+    return credits
+}
+
+// Add <n> credits.  Credit beyond the window is dropped; a peer following
+// the protocol never grants it.
+func (credits wireCredits) grant(n int) {
+    for i := 0; i < n; i++ {
+        select {
+        case credits <- struct{}{}:
+        default:
+            return
+        }
+    }
+}
+
+// Frame returning <n> credits for the stream with correlation ID <id>.
+func creditFrame(id uint64, msgKey string, n int) *frame {
+    payload := make([]byte, 4)
+    binary.BigEndian.PutUint32(payload, uint32(n))
+    return &frame{
+        frameType: FRAME_CREDIT,
+        correlationID: id,
+        msgKey: msgKey,
+        payload: payload,
+    }
+}
+
+func creditCount(f *frame) int {
+    if len(f.payload) != 4 {
+        return 0
+    }
+    n := binary.BigEndian.Uint32(f.payload)
+    if n > wireStreamWindow {
+        return wireStreamWindow
+    }
+    return int(n)
+}
+
+// Read a frame from <r>.  Signatures are checked by the caller, with
+// wireSession.verify.
+func readFrame(r io.Reader) (*frame, error) {
+    var hdr [wireHeaderLen]byte
+    _, err := io.ReadFull(r, hdr[:])
+    if err != nil {
+        return nil, err
+    }
+    if hdr[0] != wireMagic[0] || hdr[1] != wireMagic[1] {
+        return nil, fmt.Errorf("bad frame magic")
+    }
+    if hdr[2] != WIRE_VERSION {
+        return nil, fmt.Errorf("unsupported protocol version %d", hdr[2])
+    }
+
+    f := &frame{
+        frameType: hdr[3],
+        flags: hdr[4],
+        codecID: hdr[5],
+        correlationID: binary.BigEndian.Uint64(hdr[6:14]),
+    }
+    keyLen := binary.BigEndian.Uint16(hdr[14:16])
+    payloadLen := binary.BigEndian.Uint32(hdr[16:20])
+    if payloadLen > wireMaxPayload {
+        return nil, fmt.Errorf("frame payload too large (%d bytes)", payloadLen)
+    }
+
+    bodyLen := int(keyLen) + int(payloadLen)
+    trailerLen := 0
+    if f.flags & FLAG_SIGNED != 0 {
+        trailerLen = wireMACLen
+    }
+    buf := make([]byte, bodyLen + trailerLen)
+    _, err = io.ReadFull(r, buf)
+    if err != nil {
+        return nil, err
+    }
+    f.msgKey = string(buf[:keyLen])
+    f.payload = buf[keyLen:bodyLen]
+
+    if trailerLen > 0 {
+        f.signed = append(hdr[:], buf[:bodyLen]...)
+        f.mac = buf[bodyLen:]
+    }
+    return f, nil
+}
+
+// Write frame <f> to <w>, signing it if <session> is set.  Writes with the
+// same <session> must not run at once.
+func writeFrame(w io.Writer, f *frame, session *wireSession) error {
+    if len(f.msgKey) > 0xffff {
+        return fmt.Errorf("msg key too long")
+    }
+    if len(f.payload) > wireMaxPayload {
+        return fmt.Errorf("frame payload too large (%d bytes)", len(f.payload))
+    }
+
+    flags := f.flags &^ FLAG_SIGNED
+    if session != nil {
+        flags |= FLAG_SIGNED
+    }
+
+    buf := make([]byte, wireHeaderLen + len(f.msgKey) + len(f.payload), wireHeaderLen + len(f.msgKey) + len(f.payload) + wireMACLen)
+    buf[0] = wireMagic[0]
+    buf[1] = wireMagic[1]
+    buf[2] = WIRE_VERSION
+    buf[3] = f.frameType
+    buf[4] = flags
+    buf[5] = f.codecID
+    binary.BigEndian.PutUint64(buf[6:14], f.correlationID)
+    binary.BigEndian.PutUint16(buf[14:16], uint16(len(f.msgKey)))
+    binary.BigEndian.PutUint32(buf[16:20], uint32(len(f.payload)))
+    copy(buf[wireHeaderLen:], f.msgKey)
+    copy(buf[wireHeaderLen + len(f.msgKey):], f.payload)
+    if session != nil {
+        buf = append(buf, session.sign(buf)...)
+    }
+
+    _, err := w.Write(buf)
+    return err
+}
+
+// Flags describing <req> for the frame header.
+func requestFlags(req *PigeonRequest) byte {
+    var flags byte
+    if req.ReqBroadcast {
+        flags |= FLAG_BROADCAST
+    }
+    if req.ReqStream {
+        flags |= FLAG_STREAM
+    }
+    return flags
+}
+
+// Connect to the Pigeon server at <address>, giving up when <ctx> is done.
+// Uses TLS if <tlsConfig> is set, and signs frames if <key> is set.
+func dialWire(ctx context.Context, address string, codec Codec, tlsConfig *tls.Config, key []byte) (*wireConn, error) {
+    var conn net.Conn
+    var err error
+    if tlsConfig != nil {
+        dialer := &tls.Dialer{Config: tlsConfig}
+        conn, err = dialer.DialContext(ctx, "tcp", address)
+    } else {
+        var dialer net.Dialer
+        conn, err = dialer.DialContext(ctx, "tcp", address)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    reader := bufio.NewReader(conn)
+    var session *wireSession
+    if key != nil {
+        session, err = clientHandshake(ctx, conn, reader, key)
+        if err != nil {
+            conn.Close()
+            return nil, err
+        }
+    }
+    return newWireConn(conn, reader, codec, session), nil
+}
+
+func newWireConn(conn net.Conn, reader *bufio.Reader, codec Codec, session *wireSession) *wireConn {
+    wc := &wireConn{
+        conn: conn,
+        reader: reader,
+        codec: codec,
+        session: session,
+        pending: map[uint64]*pendingCall{},
+        closedChan: make(chan struct{}),
+    }
+    go wc.readLoop()
+    return wc
+}
+
+// Send <req> and wait for the response, giving up when <ctx> is done.  For
+// streams, partial responses are passed to the request's partials hook, and
+// chunks from its input are sent to the server, as they arrive.
+func (wc *wireConn) call(ctx context.Context, req *PigeonRequest, resp *PigeonResponse) error {
+    payload, err := wc.codec.Marshal(req)
+    if err != nil {
+        return err
+    }
+
+    // The final response follows the partial ones
+    buffer := 1
+    if req.ReqStream {
+        buffer = wireStreamWindow + 1
+    }
+    id, pc, err := wc.beginCall(buffer)
+    if err != nil {
+        return &notSentError{err}
+    }
+    defer wc.endCall(id, pc)
+
+    f := &frame{
+        frameType: FRAME_REQUEST,
+        flags: requestFlags(req),
+        codecID: wc.codec.ID(),
+        correlationID: id,
+        msgKey: req.ReqJobKey,
+        payload: payload,
+    }
+    err = wc.writeFrame(ctx, f)
+    if err != nil {
+        // The frame is written in one go, and the server drops partial
+        // frames
+        return &notSentError{err}
+    }
+
+    if req.ReqStream && req.input != nil {
+        go wc.forwardInput(ctx, id, req.ReqJobKey, req.input, pc)
+    }
+
+    // Partial responses read since credit was last returned
+    consumed := 0
+
+    // Returns true once <f> is the final response
+    handle := func(f *frame) (bool, error) {
+        codec := lookupCodec(f.codecID)
+        if codec == nil {
+            return true, fmt.Errorf("response uses unknown codec %d", f.codecID)
+        }
+        if f.frameType == FRAME_RESPONSE {
+            return true, codec.Unmarshal(f.payload, resp)
+        }
+
+        partial := &PigeonResponse{}
+        err := codec.Unmarshal(f.payload, partial)
+        if err != nil {
+            return true, err
+        }
+        if req.partials != nil {
+            req.partials(partial.RespBody)
+        }
+        consumed++
+        if consumed >= wireStreamWindow / 2 {
+            // On failure the connection closes, which ends the call
+            wc.writeFrame(ctx, creditFrame(id, req.ReqJobKey, consumed))
+            consumed = 0
+        }
+        return false, nil
+    }
+
+    for {
+        select {
+        case f := <-pc.frames:
+            final, err := handle(f)
+            if final {
+                return err
+            }
+        case <-pc.failed:
+            wc.cancelCall(id, req.ReqJobKey)
+            return errStreamOverrun
+        case <-wc.closedChan:
+            // Frames that arrived before the connection closed still count
+            for {
+                select {
+                case f := <-pc.frames:
+                    final, err := handle(f)
+                    if final {
+                        return err
+                    }
+                    continue
+                default:
+                }
+                return errConnClosed
+            }
+        case <-ctx.Done():
+            wc.cancelCall(id, req.ReqJobKey)
+            return ctx.Err()
+        }
+    }
+}
+
+// How long we try to tell a server that a call was abandoned
+const wireCancelTimeout = 5 * time.Second
+
+// Tell the server to stop working on call <id>, without waiting.
+func (wc *wireConn) cancelCall(id uint64, msgKey string) {
+    go func() {
+        ctx, cancel := context.WithTimeout(context.Background(), wireCancelTimeout)
+        defer cancel()
+        wc.writeFrame(ctx, &frame{
+            frameType: FRAME_CANCEL,
+            correlationID: id,
+            msgKey: msgKey,
+        })
+    }()
+}
+
+// Check that the server is still answering, giving up when <ctx> is done.
+func (wc *wireConn) ping(ctx context.Context) error {
+    id, pc, err := wc.beginCall(1)
+    if err != nil {
+        return err
+    }
+    defer wc.endCall(id, pc)
+
+    err = wc.writeFrame(ctx, &frame{
+        frameType: FRAME_PING,
+        correlationID: id,
+    })
+    if err != nil {
+        return err
+    }
+
+    select {
+    case <-pc.frames:
+        return nil
+    case <-wc.closedChan:
+        return errConnClosed
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// Register a call, with room for <buffer> frames from the server; the call
+// fails if the server sends more.  Returns the call's correlation ID.  Must be
+// followed by a call to endCall().
+func (wc *wireConn) beginCall(buffer int) (uint64, *pendingCall, error) {
+    pc := &pendingCall{
+        frames: make(chan *frame, buffer),
+        done: make(chan struct{}),
+        credits: newWireCredits(),
+        failed: make(chan struct{}),
+    }
+    wc.mu.Lock()
+    defer wc.mu.Unlock()
+    if wc.closed {
+        return 0, nil, errConnClosed
+    }
+    wc.nextID++
+    wc.pending[wc.nextID] = pc
+    return wc.nextID, pc, nil
+}
+
+// Stop waiting for frames for call <id>.
+func (wc *wireConn) endCall(id uint64, pc *pendingCall) {
+    wc.mu.Lock()
+    delete(wc.pending, id)
+    wc.mu.Unlock()
+    close(pc.done)
+}
+
+// Write <f>, giving up at <ctx>'s deadline.
+func (wc *wireConn) writeFrame(ctx context.Context, f *frame) error {
+    wc.writeMu.Lock()
+    defer wc.writeMu.Unlock()
+    deadline, _ := ctx.Deadline()
+    wc.conn.SetWriteDeadline(deadline)
+    err := writeFrame(wc.conn, f, wc.session)
+    if err != nil {
+        // A partial frame leaves the stream unusable
+        wc.close()
+    }
+    return err
+}
+
+// Send chunks from <input> to the server as FRAME_INPUT frames, as credit
+// allows, then FRAME_INPUT_END once <input> is closed.  Stops early when
+// call <pc> ends.
+func (wc *wireConn) forwardInput(ctx context.Context, id uint64, msgKey string, input <-chan map[string]interface{}, pc *pendingCall) {
+    for {
+        select {
+        case chunk, ok := <-input:
+            if ok {
+                select {
+                case <-pc.credits:
+                case <-pc.done:
+                    return
+                }
+            }
+            f := &frame{
+                frameType: FRAME_INPUT_END,
+                codecID: wc.codec.ID(),
+                correlationID: id,
+                msgKey: msgKey,
+            }
+            if ok {
+                payload, err := wc.codec.Marshal(chunk)
+                if err != nil {
+                    log.Error("Pigeon: Cannot encode stream input for ", msgKey, ": ", err)
+                    continue
+                }
+                f.frameType = FRAME_INPUT
+                f.payload = payload
+            }
+            if wc.writeFrame(ctx, f) != nil || !ok {
+                return
+            }
+        case <-pc.done:
+            return
+        }
+    }
+}
+
+// Dispatch responses to waiting callers until the connection fails.
+func (wc *wireConn) readLoop() {
+    for {
+        f, err := readFrame(wc.reader)
+        if err != nil {
+            wc.close()
+            return
+        }
+        if wc.session != nil && !wc.session.verify(f) {
+            log.Warn("Pigeon: Unauthenticated response from ", peerName(wc.conn), ", dropping connection")
+            wc.close()
+            return
+        }
+        switch f.frameType {
+        case FRAME_RESPONSE, FRAME_PARTIAL, FRAME_PONG, FRAME_CREDIT:
+        default:
+            continue
+        }
+
+        wc.mu.Lock()
+        pc, ok := wc.pending[f.correlationID]
+        wc.mu.Unlock()
+
+        // Responses to abandoned calls are dropped
+        if !ok || pc.overrun {
+            continue
+        }
+        if f.frameType == FRAME_CREDIT {
+            pc.credits.grant(creditCount(f))
+            continue
+        }
+        select {
+        case pc.frames <- f:
+        default:
+            log.Warn("Pigeon: ", peerName(wc.conn), " sent ", f.msgKey, " more partial responses than its window")
+            pc.overrun = true
+            close(pc.failed)
+        }
+    }
+}
+
+// Close the connection and fail all calls waiting on it.
+func (wc *wireConn) close() {
+    wc.mu.Lock()
+    defer wc.mu.Unlock()
+    if wc.closed {
+        return
+    }
+    wc.closed = true
+    wc.conn.Close()
+    close(wc.closedChan)
+}
+
+func (wc *wireConn) isClosed() bool {
+    wc.mu.Lock()
+    defer wc.mu.Unlock()
+    return wc.closed
+}
+
+// Serve requests arriving on <conn> for <server>.  Each request is handled in
+// its own goroutine; responses are written back as they complete.  If <key> is
+// set, the connection is dropped at the first frame that is not signed with
+// it for this connection, or if the client does not start with FRAME_HELLO.
+func serveWireConn(conn net.Conn, server *PigeonServer, key []byte) {
+    defer conn.Close()
+
+    var session *wireSession
+    if key != nil {
+        session = newWireSession(key, wireServerSide)
+    }
+
+    var writeMu sync.Mutex
+    send := func(f *frame) error {
+        writeMu.Lock()
+        defer writeMu.Unlock()
+        conn.SetWriteDeadline(time.Now().Add(wireWriteTimeout))
+        err := writeFrame(conn, f, session)
+        if err != nil {
+            log.Warn("Pigeon: Failed to send response to ", conn.RemoteAddr(), ": ", err)
+            conn.Close()
+        }
+        return err
+    }
+
+    // Requests being handled, and open streams, by correlation ID
+    var callsMu sync.Mutex
+    cancels := map[uint64]context.CancelFunc{}
+    streams := map[uint64]*wireStream{}
+
+    // Handlers still running are cancelled, and see the end of their input
+    defer func() {
+        callsMu.Lock()
+        defer callsMu.Unlock()
+        for _, cancel := range cancels {
+            cancel()
+        }
+        for _, stream := range streams {
+            if !stream.inputClosed {
+                stream.inputClosed = true
+                close(stream.queued)
+            }
+        }
+    }()
+
+    reader := bufio.NewReader(conn)
+    for first := true; ; first = false {
+        f, err := readFrame(reader)
+        if err != nil {
+            if err != io.EOF {
+                log.Warn("Pigeon: Dropping connection from ", peerName(conn), ": ", err)
+            }
+            return
+        }
+
+        hello := first && f.frameType == FRAME_HELLO
+        if session != nil && (!session.verify(f) || (session.nonces == nil && !hello)) {
+            log.Warn("Pigeon: Rejecting unauthenticated request ", f.msgKey, " from ", peerName(conn))
+            resp := &PigeonResponse{}
+            resp.setStatus(RESP_REJECTED, "Pigeon Server: Request is not signed with the cluster key")
+            send(encodeWireResponse(lookupCodec(CODEC_GOB), f, resp))
+            return
+        }
+
+        if hello {
+            nonce, err := serverHello(session, f)
+            if err != nil {
+                log.Warn("Pigeon: Dropping connection from ", peerName(conn), ": ", err)
+                return
+            }
+            send(&frame{
+                frameType: FRAME_HELLO,
+                payload: nonce,
+            })
+            continue
+        }
+
+        switch f.frameType {
+        case FRAME_PING:
+            go send(&frame{
+                frameType: FRAME_PONG,
+                correlationID: f.correlationID,
+            })
+
+        case FRAME_REQUEST:
+            ctx, cancel := context.WithCancel(context.Background())
+            var stream *wireStream
+            if f.flags & FLAG_STREAM != 0 {
+                stream = &wireStream{
+                    queued: make(chan map[string]interface{}, wireStreamWindow),
+                    input: make(chan map[string]interface{}),
+                    credits: newWireCredits(),
+                    overrun: make(chan struct{}),
+                    done: make(chan struct{}),
+                }
+                go stream.pump(f, send)
+            }
+            callsMu.Lock()
+            cancels[f.correlationID] = cancel
+            if stream != nil {
+                streams[f.correlationID] = stream
+            }
+            callsMu.Unlock()
+
+            go func(f *frame) {
+                respFrame := handleWireRequest(ctx, server, f, stream, send)
+                callsMu.Lock()
+                delete(cancels, f.correlationID)
+                delete(streams, f.correlationID)
+                callsMu.Unlock()
+                cancel()
+
+                if stream != nil {
+                    close(stream.done)
+
+                    select {
+                    case <-stream.overrun:
+                        resp := &PigeonResponse{}
+                        resp.setStatus(RESP_REJECTED, "Pigeon Server: Stream input exceeded its window")
+                        respFrame = encodeWireResponse(lookupCodec(CODEC_GOB), f, resp)
+                    default:
+                    }
+                }
+                send(respFrame)
+            }(f)
+
+        case FRAME_CANCEL:
+            callsMu.Lock()
+            cancel := cancels[f.correlationID]
+            callsMu.Unlock()
+            if cancel != nil {
+                cancel()
+            }
+
+        case FRAME_CREDIT:
+            callsMu.Lock()
+            stream := streams[f.correlationID]
+            callsMu.Unlock()
+            if stream != nil {
+                stream.credits.grant(creditCount(f))
+            }
+
+        case FRAME_INPUT, FRAME_INPUT_END:
+            callsMu.Lock()
+            stream := streams[f.correlationID]
+            callsMu.Unlock()
+            if stream == nil || stream.inputClosed {
+                // The handler already finished
+                continue
+            }
+
+            if f.frameType == FRAME_INPUT_END {
+                stream.inputClosed = true
+                close(stream.queued)
+                continue
+            }
+            codec := lookupCodec(f.codecID)
+            if codec == nil {
+                log.Warn("Pigeon: Dropping stream input in unknown codec ", f.codecID, " from ", peerName(conn))
+                continue
+            }
+            chunk := map[string]interface{}{}
+            err := codec.Unmarshal(f.payload, &chunk)
+            if err != nil {
+                log.Warn("Pigeon: Dropping malformed stream input from ", peerName(conn), ": ", err)
+                continue
+            }
+            select {
+            case stream.queued <- chunk:
+            default:
+                log.Warn("Pigeon: ", peerName(conn), " sent ", f.msgKey, " more stream input than its window")
+                close(stream.overrun)
+                stream.inputClosed = true
+                close(stream.queued)
+            }
+        }
+    }
+}
+
+// Pass input for request <f> to the handler as it reads it, returning credit
+// to the client with <send>.
+func (stream *wireStream) pump(f *frame, send func(*frame) error) {
+    defer close(stream.input)
+    consumed := 0
+    for {
+        select {
+        case chunk, ok := <-stream.queued:
+            if !ok {
+                return
+            }
+            select {
+            case stream.input <- chunk:
+            case <-stream.done:
+                return
+            }
+            consumed++
+            if consumed >= wireStreamWindow / 2 {
+                send(creditFrame(f.correlationID, f.msgKey, consumed))
+                consumed = 0
+            }
+        case <-stream.done:
+            return
+        }
+    }
+}
+
+// How long a server waits for a client to accept a response
+const wireWriteTimeout = 30 * time.Second
+
+// Decode and handle the request in <f>, returning the response frame.  The
+// handler gives up when <ctx> is done.  If <stream> is set, partial responses
+// are written with <send> as the handler produces them, and the handler reads
+// input from the stream.
+func handleWireRequest(ctx context.Context, server *PigeonServer, f *frame, stream *wireStream, send func(*frame) error) *frame {
+    resp := &PigeonResponse{}
+
+    // Reply with the client's codec if we can, or else gob
+    codec := lookupCodec(f.codecID)
+    if codec == nil {
+        codec = lookupCodec(CODEC_GOB)
+        resp.setStatus(RESP_REJECTED, "Pigeon Server: Unknown codec %d", f.codecID)
+    } else {
+        req := &PigeonRequest{}
+        err := codec.Unmarshal(f.payload, req)
+        if err != nil {
+            resp.setStatus(RESP_REJECTED, "Pigeon Server: Malformed request: %s", err.Error())
+        } else {
+            // The header is authoritative
+            req.ReqJobKey = f.msgKey
+            req.ReqBroadcast = f.flags & FLAG_BROADCAST != 0
+            req.ReqStream = stream != nil
+            if stream != nil {
+                req.input = stream.input
+                req.partials = func(body map[string]interface{}) error {
+                    select {
+                    case <-stream.credits:
+                    case <-ctx.Done():
+                        return ctx.Err()
+                    }
+                    payload, err := codec.Marshal(&PigeonResponse{RespBody: body})
+                    if err != nil {
+                        return err
+                    }
+                    return send(&frame{
+                        frameType: FRAME_PARTIAL,
+                        codecID: codec.ID(),
+                        correlationID: f.correlationID,
+                        msgKey: f.msgKey,
+                        payload: payload,
+                    })
+                }
+            }
+            server.handleRemoteRequest(ctx, req, resp)
+        }
+    }
+
+    return encodeWireResponse(codec, f, resp)
+}
+
+// Build the response frame to request frame <f>.
+func encodeWireResponse(codec Codec, f *frame, resp *PigeonResponse) *frame {
+    payload, err := codec.Marshal(resp)
+    if err != nil {
+        // Probably a payload value the codec can't handle
+        resp = &PigeonResponse{}
+        resp.setStatus(RESP_HANDLER_ERROR, "Pigeon Server: Cannot encode response: %s", err.Error())
+        payload, _ = codec.Marshal(resp)
+    }
+
+    return &frame{
+        frameType: FRAME_RESPONSE,
+        codecID: codec.ID(),
+        correlationID: f.correlationID,
+        msgKey: f.msgKey,
+        payload: payload,
+    }
+}
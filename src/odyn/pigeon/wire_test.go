@@ -0,0 +1,303 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobqueue
+
+import (
+    "bufio"
+    "context"
+    "io"
+    "net"
+    "testing"
+    "time"
+)
+
+func dialTestWire(t *testing.T, hostname string) *wireConn {
+    wc, err := dialWire(context.Background(), hostname, lookupCodec(CODEC_GOB), nil, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(wc.close)
+    return wc
+}
+
+// Many more frames than the window each way
+const streamTestFrames = 10 * wireStreamWindow
+
+func TestStreamBeyondWindow(t *testing.T) {
+    hostname, server := newTCPServer(t, DefaultTCPTransportConfig)
+    newTestInbox(t, server, "count", func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        received := 0
+        for {
+            _, err := req.Recv()
+            if err != nil {
+                break
+            }
+            received++
+        }
+        for i := 0; i < streamTestFrames; i++ {
+            err := resp.Send(map[string]interface{}{"i": i})
+            if err != nil {
+                resp.SetError(err)
+                return
+            }
+        }
+        resp.SetBody(map[string]interface{}{"received": received})
+    })
+
+    input := make(chan map[string]interface{})
+    go func() {
+        defer close(input)
+        for i := 0; i < streamTestFrames; i++ {
+            input <- map[string]interface{}{"i": i}
+        }
+    }()
+    partials := 0
+    req := &PigeonRequest{
+        ReqJobKey: "count",
+        ReqStream: true,
+        input: input,
+        partials: func(body map[string]interface{}) error {
+            partials++
+            return nil
+        },
+    }
+    resp := &PigeonResponse{}
+    ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+    defer cancel()
+    err := dialTestWire(t, hostname).call(ctx, req, resp)
+    if err == nil {
+        err = resp.Err()
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+    if partials != streamTestFrames || resp.RespBody["received"] != streamTestFrames {
+        t.Errorf("Got %d partial responses, server received %v chunks", partials, resp.RespBody["received"])
+    }
+}
+
+func TestSlowStreamDoesNotBlockConnection(t *testing.T) {
+    hostname, server := newTCPServer(t, DefaultTCPTransportConfig)
+    newTestInbox(t, server, "flood", func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        for i := 0; i < streamTestFrames; i++ {
+            err := resp.Send(map[string]interface{}{"i": i})
+            if err != nil {
+                resp.SetError(err)
+                return
+            }
+        }
+    })
+    newTestInbox(t, server, "echo", func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        resp.SetBody(req.Body())
+    })
+    wc := dialTestWire(t, hostname)
+
+    // A caller that does not read its stream
+    release := make(chan struct{})
+    streamDone := make(chan error, 1)
+    go func() {
+        req := &PigeonRequest{
+            ReqJobKey: "flood",
+            ReqStream: true,
+            partials: func(body map[string]interface{}) error {
+                <-release
+                return nil
+            },
+        }
+        resp := &PigeonResponse{}
+        err := wc.call(context.Background(), req, resp)
+        if err == nil {
+            err = resp.Err()
+        }
+        streamDone <- err
+    }()
+    time.Sleep(50 * time.Millisecond)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 2 * time.Second)
+    defer cancel()
+    resp := &PigeonResponse{}
+    err := wc.call(ctx, &PigeonRequest{ReqJobKey: "echo", ReqBody: map[string]interface{}{"n": 1}}, resp)
+    if err != nil {
+        t.Fatalf("Call behind a stalled stream failed: %s", err)
+    }
+
+    close(release)
+    select {
+    case err := <-streamDone:
+        if err != nil {
+            t.Error(err)
+        }
+    case <-time.After(5 * time.Second):
+        t.Error("Stream did not finish")
+    }
+}
+
+func TestServerOverrunFailsCall(t *testing.T) {
+    // Answers the first request with more partial responses than the window
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    go func() {
+        conn, err := l.Accept()
+        if err != nil {
+            return
+        }
+        defer conn.Close()
+        f, err := readFrame(bufio.NewReader(conn))
+        if err != nil {
+            return
+        }
+        payload, _ := lookupCodec(CODEC_GOB).Marshal(&PigeonResponse{})
+        for i := 0; i < 2 * wireStreamWindow; i++ {
+            writeFrame(conn, &frame{
+                frameType: FRAME_PARTIAL,
+                codecID: CODEC_GOB,
+                correlationID: f.correlationID,
+                msgKey: f.msgKey,
+                payload: payload,
+            }, nil)
+        }
+        io.Copy(io.Discard, conn)
+    }()
+
+    wc := dialTestWire(t, l.Addr().String())
+    release := make(chan struct{})
+    time.AfterFunc(50 * time.Millisecond, func() {
+        close(release)
+    })
+    ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+    defer cancel()
+    req := &PigeonRequest{
+        ReqJobKey: "flood",
+        ReqStream: true,
+        partials: func(body map[string]interface{}) error {
+            <-release
+            return nil
+        },
+    }
+    err = wc.call(ctx, req, &PigeonResponse{})
+    if err != errStreamOverrun {
+        t.Errorf("Call returned %v", err)
+    }
+    if wc.isClosed() {
+        t.Error("Overrun closed the connection")
+    }
+}
+
+func TestClientOverrunFailsStream(t *testing.T) {
+    hostname, server := newTCPServer(t, DefaultTCPTransportConfig)
+    release := make(chan struct{})
+    newTestInbox(t, server, "sink", func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        <-release
+    })
+
+    conn, err := net.Dial("tcp", hostname)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    codec := lookupCodec(CODEC_GOB)
+    payload, _ := codec.Marshal(&PigeonRequest{ReqJobKey: "sink"})
+    writeFrame(conn, &frame{
+        frameType: FRAME_REQUEST,
+        flags: FLAG_STREAM,
+        codecID: codec.ID(),
+        correlationID: 1,
+        msgKey: "sink",
+        payload: payload,
+    }, nil)
+    chunk, _ := codec.Marshal(map[string]interface{}{"n": 1})
+    for i := 0; i < wireStreamWindow + 2; i++ {
+        writeFrame(conn, &frame{
+            frameType: FRAME_INPUT,
+            codecID: codec.ID(),
+            correlationID: 1,
+            msgKey: "sink",
+            payload: chunk,
+        }, nil)
+    }
+    time.Sleep(50 * time.Millisecond)
+    close(release)
+
+    reader := bufio.NewReader(conn)
+    f, err := readFrame(reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp := &PigeonResponse{}
+    codec.Unmarshal(f.payload, resp)
+    if f.frameType != FRAME_RESPONSE || resp.RespStatus != RESP_REJECTED {
+        t.Errorf("Got frame %d with %+v", f.frameType, resp)
+    }
+
+    // The connection still works
+    writeFrame(conn, &frame{frameType: FRAME_PING, correlationID: 2}, nil)
+    f, err = readFrame(reader)
+    if err != nil || f.frameType != FRAME_PONG {
+        t.Errorf("Ping failed after an overrun: %v", err)
+    }
+}
+
+func TestCancelReachesRemoteHandler(t *testing.T) {
+    hostname, server := newTCPServer(t, DefaultTCPTransportConfig)
+    cancelled := make(chan struct{})
+    newTestInbox(t, server, "wait", func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        select {
+        case <-req.Context().Done():
+            close(cancelled)
+        case <-time.After(5 * time.Second):
+        }
+    })
+
+    // No deadline, so only FRAME_CANCEL can tell the server
+    ctx, cancel := context.WithCancel(context.Background())
+    time.AfterFunc(50 * time.Millisecond, cancel)
+    err := dialTestWire(t, hostname).call(ctx, &PigeonRequest{ReqJobKey: "wait"}, &PigeonResponse{})
+    if err != context.Canceled {
+        t.Errorf("Call returned %v", err)
+    }
+    select {
+    case <-cancelled:
+    case <-time.After(2 * time.Second):
+        t.Error("Handler was not cancelled")
+    }
+}
+
+func TestClosedConnectionCancelsHandler(t *testing.T) {
+    hostname, server := newTCPServer(t, DefaultTCPTransportConfig)
+    started := make(chan struct{})
+    cancelled := make(chan struct{})
+    newTestInbox(t, server, "wait", func(msgKey string, userCtx interface{}, req Request, resp Response) {
+        close(started)
+        select {
+        case <-req.Context().Done():
+            close(cancelled)
+        case <-time.After(5 * time.Second):
+        }
+    })
+
+    wc := dialTestWire(t, hostname)
+    go wc.call(context.Background(), &PigeonRequest{ReqJobKey: "wait"}, &PigeonResponse{})
+    <-started
+    wc.close()
+    select {
+    case <-cancelled:
+    case <-time.After(2 * time.Second):
+        t.Error("Handler was not cancelled")
+    }
+}
@@ -74,7 +74,7 @@ package policy
 //  User can control which devices & which scopes to grant 
 //
 
-type Actor struct
+type Actor struct {
     ActorPath string
     AppPath string
 }
@@ -97,5 +97,5 @@ type PropertyUserPermissions struct {
 }
 
 type PropertyACL interface {
-    UserPermsissionList()[]
+    UserPermsissionList() []PropertyUserPermissions
 }
@@ -0,0 +1,510 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+// Share grants.
+//
+// A share grant gives time-limited access to some of a resource's properties
+// to whoever holds the grant's token (for example, the doorman who needs to
+// get into the building for one afternoon).  Minting a grant writes an ACL
+// entry for the pseudo-actor "share/<GRANT_ID>" on each shared property:
+//
+//  // For device/Leela/FrontDoor:
+//
+//  {
+//      "lock" : {
+//          ":datatype" : "bool",
+//          ":acl" : {
+//              "user/Leela" : "*",
+//              "share/8c1f2e0a9b7d4c3e5f6a7b8c9d0e1f2a" : "20150803120000-20150803180000:gs"
+//          },
+//          "value" : true
+//      }
+//  }
+//
+// The token handed out to the guest is signed with the server's share key, so
+// it cannot be forged or altered.  Revoking a grant deletes its ACL entries,
+// which invalidates the token even before it expires.  Expired ACL entries
+// (including hand-written ones like "user/doorman") are garbage-collected
+// whenever a grant is minted or revoked for the resource, when an expired
+// token is presented to Verify, or by calling CollectExpired.  Entries that
+// are not permission strings are left alone.
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "odyn/storage"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Layout of ACL timestamps, such as "20150803202208".
+const aclTimestampLayout = "20060102150405"
+
+// Valid access right characters.  See the overview in policy.go.
+const aclRights = "*gsmcdG"
+
+// ShareGrant describes delegated access to a set of properties.
+type ShareGrant struct {
+    // Random identifier for this grant.
+    ID string `json:"id"`
+
+    // Actor that minted the grant, such as "user/Leela".
+    Granter string `json:"granter"`
+
+    // Resource being shared, such as "device/Leela/FrontDoor".
+    ResourcePath string `json:"resource"`
+
+    // Properties of the resource that are shared.
+    Properties []string `json:"properties"`
+
+    // Access rights given to the token holder, such as "gs".
+    Rights string `json:"rights"`
+
+    // Validity window.
+    NotBefore time.Time `json:"not_before"`
+    NotAfter time.Time `json:"not_after"`
+}
+
+// ShareManager mints, verifies and revokes share grants.
+type ShareManager struct {
+    conn storage.Connection
+    key []byte
+
+    // Serializes changes to resource documents
+    mu sync.Mutex
+}
+
+// A single permission in an ACL entry, such as
+// "20150803202208-20150804235959:smcd".
+type aclPermission struct {
+    notBefore time.Time
+    notAfter time.Time
+    rights string
+}
+
+// Create a new ShareManager that stores ACL changes using <conn> and signs
+// tokens with <key>, which must not be empty.
+func NewShareManager(conn storage.Connection, key []byte) (*ShareManager, error) {
+    if len(key) == 0 {
+        return nil, fmt.Errorf("Policy: Share tokens need a signing key")
+    }
+    return &ShareManager{
+        conn: conn,
+        key: key,
+    }, nil
+}
+
+// Get the pseudo-actor path used in ACL entries for this grant.
+func (grant *ShareGrant) ActorPath() string {
+    return "share/" + grant.ID
+}
+
+// Mint a new share grant giving <rights> on <properties> of <resourcePath>,
+// valid from <notBefore> until <notAfter>.  A zero <notBefore> means "now".
+// The ACL entries are written immediately.  Returns the grant and the token
+// that should be handed to the guest.
+//
+// The caller is responsible for checking that <granter> is allowed to
+// delegate <rights>.
+func (mgr *ShareManager) Mint(granter Actor, resourcePath string,
+        properties []string, rights string,
+        notBefore, notAfter time.Time) (*ShareGrant, string, error) {
+
+    if len(properties) == 0 {
+        return nil, "", fmt.Errorf("Policy: Share grant must include at least one property")
+    }
+    err := validateRights(rights)
+    if err != nil {
+        return nil, "", err
+    }
+
+    now := time.Now().UTC()
+    if notBefore.IsZero() {
+        notBefore = now
+    }
+    // ACL timestamps have one second resolution
+    notBefore = notBefore.UTC().Truncate(time.Second)
+    notAfter = notAfter.UTC().Truncate(time.Second)
+    if !notAfter.After(notBefore) {
+        return nil, "", fmt.Errorf("Policy: Share grant must end after it begins")
+    }
+    if !notAfter.After(now) {
+        return nil, "", fmt.Errorf("Policy: Share grant has already expired")
+    }
+
+    id, err := newGrantID()
+    if err != nil {
+        return nil, "", err
+    }
+
+    grant := &ShareGrant{
+        ID: id,
+        Granter: granter.ActorPath,
+        ResourcePath: resourcePath,
+        Properties: properties,
+        Rights: rights,
+        NotBefore: notBefore,
+        NotAfter: notAfter,
+    }
+
+    mgr.mu.Lock()
+    defer mgr.mu.Unlock()
+
+    doc, err := mgr.loadResource(resourcePath)
+    if err != nil {
+        return nil, "", err
+    }
+
+    perm := aclPermission{
+        notBefore: notBefore,
+        notAfter: notAfter,
+        rights: rights,
+    }
+    for _, propName := range properties {
+        acl, err := propertyACL(doc, resourcePath, propName, true)
+        if err != nil {
+            return nil, "", err
+        }
+        acl[grant.ActorPath()] = perm.String()
+    }
+
+    collectExpired(doc, now)
+
+    err = mgr.conn.SaveDocument(resourcePath, doc)
+    if err != nil {
+        return nil, "", err
+    }
+
+    token, err := mgr.sign(grant)
+    if err != nil {
+        return nil, "", err
+    }
+
+    return grant, token, nil
+}
+
+// Verify a share token.  Returns an error if the token is forged, has been
+// revoked, or is not valid at time <now>.
+func (mgr *ShareManager) Verify(token string, now time.Time) (*ShareGrant, error) {
+    grant, err := mgr.parse(token)
+    if err != nil {
+        return nil, err
+    }
+
+    if now.Before(grant.NotBefore) {
+        return nil, fmt.Errorf("Policy: Share grant %s is not valid yet", grant.ID)
+    }
+    if now.After(grant.NotAfter) {
+        // Clean up after it while we're here
+        mgr.CollectExpired(grant.ResourcePath, now)
+        return nil, fmt.Errorf("Policy: Share grant %s has expired", grant.ID)
+    }
+
+    // A revoked grant no longer has ACL entries
+    doc, err := mgr.loadResource(grant.ResourcePath)
+    if err != nil {
+        return nil, err
+    }
+    for _, propName := range grant.Properties {
+        acl, err := propertyACL(doc, grant.ResourcePath, propName, false)
+        if err != nil {
+            return nil, err
+        }
+        _, ok := acl[grant.ActorPath()]
+        if !ok {
+            return nil, fmt.Errorf("Policy: Share grant %s has been revoked", grant.ID)
+        }
+    }
+
+    return grant, nil
+}
+
+// Revoke a share grant by deleting its ACL entries.  Revoking a grant that has
+// already expired or been revoked is not an error.
+func (mgr *ShareManager) Revoke(token string) error {
+    grant, err := mgr.parse(token)
+    if err != nil {
+        return err
+    }
+
+    mgr.mu.Lock()
+    defer mgr.mu.Unlock()
+
+    doc, err := mgr.loadResource(grant.ResourcePath)
+    if err != nil {
+        return err
+    }
+
+    changed := false
+    for _, propName := range grant.Properties {
+        acl, err := propertyACL(doc, grant.ResourcePath, propName, false)
+        if err != nil {
+            continue
+        }
+        _, ok := acl[grant.ActorPath()]
+        if ok {
+            delete(acl, grant.ActorPath())
+            changed = true
+        }
+    }
+
+    _, collected := collectExpired(doc, time.Now().UTC())
+    if !changed && !collected {
+        return nil
+    }
+    return mgr.conn.SaveDocument(grant.ResourcePath, doc)
+}
+
+// Remove ACL entries that expired before <now> from every property of
+// <resourcePath>.  Returns the number of entries removed.
+func (mgr *ShareManager) CollectExpired(resourcePath string, now time.Time) (int, error) {
+    mgr.mu.Lock()
+    defer mgr.mu.Unlock()
+
+    doc, err := mgr.loadResource(resourcePath)
+    if err != nil {
+        return 0, err
+    }
+
+    count, changed := collectExpired(doc, now.UTC())
+    if !changed {
+        return 0, nil
+    }
+
+    err = mgr.conn.SaveDocument(resourcePath, doc)
+    if err != nil {
+        return 0, err
+    }
+    return count, nil
+}
+
+func (mgr *ShareManager) loadResource(resourcePath string) (map[string]interface{}, error) {
+    obj, err := mgr.conn.LoadDocument(resourcePath)
+    if err != nil {
+        return nil, err
+    }
+    doc, ok := obj.(map[string]interface{})
+    if !ok {
+        return nil, fmt.Errorf("Policy: Resource '%s' is not a JSON object", resourcePath)
+    }
+    return doc, nil
+}
+
+// Token format is base64(grant JSON) + "." + base64(HMAC-SHA256 signature)
+func (mgr *ShareManager) sign(grant *ShareGrant) (string, error) {
+    payload, err := json.Marshal(grant)
+    if err != nil {
+        return "", err
+    }
+
+    mac := hmac.New(sha256.New, mgr.key)
+    mac.Write(payload)
+
+    return base64.RawURLEncoding.EncodeToString(payload) + "." +
+            base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (mgr *ShareManager) parse(token string) (*ShareGrant, error) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 2 {
+        return nil, fmt.Errorf("Policy: Malformed share token")
+    }
+    payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+    if err != nil {
+        return nil, fmt.Errorf("Policy: Malformed share token")
+    }
+    sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+    if err != nil {
+        return nil, fmt.Errorf("Policy: Malformed share token")
+    }
+
+    mac := hmac.New(sha256.New, mgr.key)
+    mac.Write(payload)
+    if !hmac.Equal(sig, mac.Sum(nil)) {
+        return nil, fmt.Errorf("Policy: Invalid share token signature")
+    }
+
+    grant := &ShareGrant{}
+    err = json.Unmarshal(payload, grant)
+    if err != nil {
+        return nil, fmt.Errorf("Policy: Malformed share token")
+    }
+    return grant, nil
+}
+
+func newGrantID() (string, error) {
+    var buf [16]byte
+    _, err := rand.Read(buf[:])
+    if err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(buf[:]), nil
+}
+
+func validateRights(rights string) error {
+    if rights == "" {
+        return fmt.Errorf("Policy: Share grant must include at least one right")
+    }
+    for _, r := range rights {
+        if !strings.ContainsRune(aclRights, r) {
+            return fmt.Errorf("Policy: Invalid access right '%c'", r)
+        }
+    }
+    return nil
+}
+
+// Lookup the ":acl" attribute of property <propName> in resource document
+// <doc>.  If <create> is true, an empty ACL is added when none exists.
+func propertyACL(doc map[string]interface{}, resourcePath, propName string,
+        create bool) (map[string]interface{}, error) {
+
+    prop, ok := doc[propName].(map[string]interface{})
+    if !ok {
+        return nil, fmt.Errorf("Policy: Resource '%s' property '%s' not found",
+                resourcePath, propName)
+    }
+
+    acl, ok := prop[":acl"].(map[string]interface{})
+    if !ok {
+        if !create {
+            return nil, fmt.Errorf("Policy: Resource '%s' property '%s' has no ACL",
+                    resourcePath, propName)
+        }
+        acl = map[string]interface{}{}
+        prop[":acl"] = acl
+    }
+    return acl, nil
+}
+
+// Remove expired permissions from the ACLs of every property in resource
+// document <doc>.  Returns the number of ACL entries removed entirely, and
+// whether <doc> was changed at all.
+func collectExpired(doc map[string]interface{}, now time.Time) (int, bool) {
+    count := 0
+    changed := false
+    for _, propObj := range doc {
+        prop, ok := propObj.(map[string]interface{})
+        if !ok {
+            continue
+        }
+        acl, ok := prop[":acl"].(map[string]interface{})
+        if !ok {
+            continue
+        }
+        for actor, entry := range acl {
+            remaining, expired := unexpiredPermissions(entry, now)
+            if expired == 0 {
+                continue
+            }
+            changed = true
+            switch len(remaining) {
+            case 0:
+                delete(acl, actor)
+                count++
+            case 1:
+                acl[actor] = remaining[0]
+            default:
+                acl[actor] = remaining
+            }
+        }
+    }
+    return count, changed
+}
+
+// Split ACL entry <entry>, which is either a single permission string or a
+// list of them, into the items that have not expired at <now> and the number
+// that have.  Items we don't understand are kept.
+func unexpiredPermissions(entry interface{}, now time.Time) ([]interface{}, int) {
+    var items []interface{}
+    switch val := entry.(type) {
+    case []interface{}:
+        items = val
+    case []string:
+        for _, item := range val {
+            items = append(items, item)
+        }
+    default:
+        items = []interface{}{entry}
+    }
+
+    remaining := []interface{}{}
+    expired := 0
+    for _, item := range items {
+        permString, ok := item.(string)
+        if ok {
+            perm, err := parseACLPermission(permString)
+            if err == nil && perm.expired(now) {
+                expired++
+                continue
+            }
+        }
+        remaining = append(remaining, item)
+    }
+    return remaining, expired
+}
+
+// Parse a permission string such as "gs", "20150803202208:gs" or
+// "20150803202208-20150804235959:smcd".
+func parseACLPermission(s string) (aclPermission, error) {
+    perm := aclPermission{}
+
+    idx := strings.LastIndex(s, ":")
+    if idx == -1 {
+        perm.rights = s
+        return perm, validateRights(s)
+    }
+
+    perm.rights = s[idx+1:]
+    err := validateRights(perm.rights)
+    if err != nil {
+        return perm, err
+    }
+
+    window := strings.Split(s[:idx], "-")
+    switch len(window) {
+    case 1:
+        perm.notAfter, err = time.Parse(aclTimestampLayout, window[0])
+    case 2:
+        perm.notBefore, err = time.Parse(aclTimestampLayout, window[0])
+        if err == nil {
+            perm.notAfter, err = time.Parse(aclTimestampLayout, window[1])
+        }
+    default:
+        err = fmt.Errorf("Policy: Malformed ACL timestamp '%s'", s[:idx])
+    }
+    return perm, err
+}
+
+func (perm aclPermission) expired(now time.Time) bool {
+    return !perm.notAfter.IsZero() && now.After(perm.notAfter)
+}
+
+func (perm aclPermission) String() string {
+    switch {
+    case perm.notAfter.IsZero():
+        return perm.rights
+    case perm.notBefore.IsZero():
+        return perm.notAfter.Format(aclTimestampLayout) + ":" + perm.rights
+    }
+    return perm.notBefore.Format(aclTimestampLayout) + "-" +
+            perm.notAfter.Format(aclTimestampLayout) + ":" + perm.rights
+}
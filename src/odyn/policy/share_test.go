@@ -0,0 +1,337 @@
+// Copyright 2015 Odyn Authors (see AUTHORS file for project)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+    "encoding/json"
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+)
+
+// In-memory storage.Connection.  Documents are stored as JSON, as a real
+// backend would.
+type memConn struct {
+    mu sync.Mutex
+    docs map[string][]byte
+    saves int
+}
+
+func newMemConn() *memConn {
+    return &memConn{docs: map[string][]byte{}}
+}
+
+func (conn *memConn) Close() {}
+
+func (conn *memConn) DeleteDocument(path string) error {
+    conn.mu.Lock()
+    defer conn.mu.Unlock()
+    delete(conn.docs, path)
+    return nil
+}
+
+func (conn *memConn) LoadDocument(path string) (interface{}, error) {
+    conn.mu.Lock()
+    defer conn.mu.Unlock()
+    data, ok := conn.docs[path]
+    if !ok {
+        return nil, fmt.Errorf("no document %s", path)
+    }
+    var doc map[string]interface{}
+    err := json.Unmarshal(data, &doc)
+    return doc, err
+}
+
+func (conn *memConn) SaveDocument(path string, doc interface{}) error {
+    conn.mu.Lock()
+    defer conn.mu.Unlock()
+    data, err := json.Marshal(doc)
+    if err != nil {
+        return err
+    }
+    conn.docs[path] = data
+    conn.saves++
+    return nil
+}
+
+const frontDoor = "device/Leela/FrontDoor"
+
+func newTestShares(t *testing.T, acl map[string]interface{}) (*ShareManager, *memConn) {
+    conn := newMemConn()
+    err := conn.SaveDocument(frontDoor, map[string]interface{}{
+        "lock": map[string]interface{}{
+            ":datatype": "bool",
+            ":acl": acl,
+            "value": true,
+        },
+        "name": "Front door",
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    conn.saves = 0
+    mgr, err := NewShareManager(conn, []byte("secret"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return mgr, conn
+}
+
+func lockACL(t *testing.T, conn *memConn) map[string]interface{} {
+    obj, err := conn.LoadDocument(frontDoor)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return obj.(map[string]interface{})["lock"].(map[string]interface{})[":acl"].(map[string]interface{})
+}
+
+func TestMintWritesACLEntry(t *testing.T) {
+    mgr, conn := newTestShares(t, map[string]interface{}{"user/Leela": "*"})
+    notBefore := time.Date(2030, 8, 3, 12, 0, 0, 0, time.UTC)
+    notAfter := notBefore.Add(6 * time.Hour)
+
+    grant, token, err := mgr.Mint(Actor{ActorPath: "user/Leela"}, frontDoor, []string{"lock"}, "gs", notBefore, notAfter)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    entry := lockACL(t, conn)[grant.ActorPath()]
+    if entry != "20300803120000-20300803180000:gs" {
+        t.Errorf("ACL entry is %v", entry)
+    }
+
+    verified, err := mgr.Verify(token, notBefore.Add(time.Hour))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if verified.ID != grant.ID || verified.Rights != "gs" {
+        t.Errorf("Verify returned %+v", verified)
+    }
+    _, err = mgr.Verify(token, notBefore.Add(-time.Hour))
+    if err == nil {
+        t.Error("Verify accepted a grant before it starts")
+    }
+}
+
+func TestMintRejectsBadGrants(t *testing.T) {
+    mgr, _ := newTestShares(t, map[string]interface{}{})
+    now := time.Now()
+    granter := Actor{ActorPath: "user/Leela"}
+
+    cases := []struct {
+        name string
+        properties []string
+        rights string
+        notBefore, notAfter time.Time
+    }{
+        {"no properties", nil, "g", now, now.Add(time.Hour)},
+        {"no rights", []string{"lock"}, "", now, now.Add(time.Hour)},
+        {"bad right", []string{"lock"}, "gx", now, now.Add(time.Hour)},
+        {"ends before it begins", []string{"lock"}, "g", now.Add(time.Hour), now},
+        {"already expired", []string{"lock"}, "g", now.Add(-2 * time.Hour), now.Add(-time.Hour)},
+        {"missing property", []string{"color"}, "g", now, now.Add(time.Hour)},
+    }
+    for _, c := range cases {
+        _, _, err := mgr.Mint(granter, frontDoor, c.properties, c.rights, c.notBefore, c.notAfter)
+        if err == nil {
+            t.Errorf("%s: Mint succeeded", c.name)
+        }
+    }
+}
+
+func TestVerifyRejectsTamperedToken(t *testing.T) {
+    mgr, _ := newTestShares(t, map[string]interface{}{})
+    _, token, err := mgr.Mint(Actor{ActorPath: "user/Leela"}, frontDoor, []string{"lock"}, "g", time.Time{}, time.Now().Add(time.Hour))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    other, err := NewShareManager(newMemConn(), []byte("other secret"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = other.Verify(token, time.Now())
+    if err == nil {
+        t.Error("Verify accepted a token signed with another key")
+    }
+    _, err = mgr.Verify(token + "x", time.Now())
+    if err == nil {
+        t.Error("Verify accepted a tampered token")
+    }
+}
+
+func TestNewShareManagerRequiresKey(t *testing.T) {
+    for _, key := range [][]byte{nil, []byte{}} {
+        _, err := NewShareManager(newMemConn(), key)
+        if err == nil {
+            t.Errorf("Accepted signing key %q", key)
+        }
+    }
+}
+
+func TestRevoke(t *testing.T) {
+    mgr, conn := newTestShares(t, map[string]interface{}{})
+    grant, token, err := mgr.Mint(Actor{ActorPath: "user/Leela"}, frontDoor, []string{"lock"}, "g", time.Time{}, time.Now().Add(time.Hour))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = mgr.Revoke(token)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, ok := lockACL(t, conn)[grant.ActorPath()]
+    if ok {
+        t.Error("Revoke left the ACL entry")
+    }
+    _, err = mgr.Verify(token, time.Now())
+    if err == nil {
+        t.Error("Verify accepted a revoked grant")
+    }
+
+    saves := conn.saves
+    err = mgr.Revoke(token)
+    if err != nil {
+        t.Errorf("Revoking twice failed: %s", err)
+    }
+    if conn.saves != saves {
+        t.Error("Revoking twice saved the document")
+    }
+}
+
+func TestCollectExpired(t *testing.T) {
+    mgr, conn := newTestShares(t, map[string]interface{}{
+        "user/Leela": "*",
+        "user/doorman": "20150803202208:gs",
+        "user/doorman2": []interface{}{"g", "20150803202208-20150804235959:smcd"},
+        "user/doorman3": []interface{}{"20150803202208:g", "20150804202208:s"},
+        "user/future": "20300803202208:g",
+        "user/odd": []interface{}{float64(7), "20150803202208:g"},
+        "user/garbled": "not a permission!",
+    })
+    now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+    count, err := mgr.CollectExpired(frontDoor, now)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if count != 2 {
+        t.Errorf("Removed %d entries, expected 2", count)
+    }
+
+    acl := lockACL(t, conn)
+    expected := map[string]interface{}{
+        "user/Leela": "*",
+        "user/doorman2": "g",
+        "user/future": "20300803202208:g",
+        "user/odd": float64(7),
+        "user/garbled": "not a permission!",
+    }
+    if len(acl) != len(expected) {
+        t.Errorf("ACL is %v", acl)
+    }
+    for actor, entry := range expected {
+        if acl[actor] != entry {
+            t.Errorf("%s is %v, expected %v", actor, acl[actor], entry)
+        }
+    }
+}
+
+func TestCollectExpiredOnlySavesChanges(t *testing.T) {
+    mgr, conn := newTestShares(t, map[string]interface{}{
+        "user/Leela": "*",
+        "user/future": []interface{}{"g", "20300803202208:s"},
+    })
+
+    count, err := mgr.CollectExpired(frontDoor, time.Now())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if count != 0 || conn.saves != 0 {
+        t.Errorf("Removed %d entries and saved %d times, expected nothing", count, conn.saves)
+    }
+
+    // Shortening a list is a change, even though no entry is removed
+    count, err = mgr.CollectExpired(frontDoor, time.Date(2031, 1, 1, 0, 0, 0, 0, time.UTC))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if count != 0 || conn.saves != 1 {
+        t.Errorf("Removed %d entries and saved %d times, expected 0 and 1", count, conn.saves)
+    }
+    if lockACL(t, conn)["user/future"] != "g" {
+        t.Errorf("user/future is %v", lockACL(t, conn)["user/future"])
+    }
+}
+
+func TestExpiredGrantsAreCollected(t *testing.T) {
+    mgr, conn := newTestShares(t, map[string]interface{}{
+        "user/doorman": "20150803202208:gs",
+    })
+
+    // Minting collects the hand-written entry
+    notAfter := time.Now().Add(2 * time.Second)
+    grant, token, err := mgr.Mint(Actor{ActorPath: "user/Leela"}, frontDoor, []string{"lock"}, "g", time.Time{}, notAfter)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, ok := lockACL(t, conn)["user/doorman"]
+    if ok {
+        t.Error("Mint left an expired entry")
+    }
+
+    // Presenting the token after it expires collects the grant's entry
+    _, err = mgr.Verify(token, notAfter.Add(2 * time.Second))
+    if err == nil {
+        t.Fatal("Verify accepted an expired grant")
+    }
+    _, ok = lockACL(t, conn)[grant.ActorPath()]
+    if ok {
+        t.Error("Verify left the expired grant's entry")
+    }
+}
+
+func TestConcurrentMints(t *testing.T) {
+    mgr, conn := newTestShares(t, map[string]interface{}{})
+    granter := Actor{ActorPath: "user/Leela"}
+
+    var wg sync.WaitGroup
+    grants := make([]*ShareGrant, 10)
+    for i := range grants {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            grant, _, err := mgr.Mint(granter, frontDoor, []string{"lock"}, "g", time.Time{}, time.Now().Add(time.Hour))
+            if err != nil {
+                t.Error(err)
+                return
+            }
+            grants[i] = grant
+        }(i)
+    }
+    wg.Wait()
+
+    acl := lockACL(t, conn)
+    for _, grant := range grants {
+        if grant == nil {
+            continue
+        }
+        _, ok := acl[grant.ActorPath()]
+        if !ok {
+            t.Errorf("Grant %s was lost", grant.ID)
+        }
+    }
+}
@@ -221,6 +221,10 @@ func (conn *FsConnection)SaveDocument(path string, doc interface{}) (error) {
     }
 
     // Save to document file
+    err = os.MkdirAll(conn.dataDir + "/res/" + id, 0755)
+    if err != nil {
+        return err
+    }
     filename := conn.dataDir + "/res/" + id + "/__doc"
     err = ioutil.WriteFile(filename, jsonBytes, 0644)
     if err != nil {